@@ -51,6 +51,10 @@ func WriteSetCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error
 	return writeDataCmdCommon(w, OpcodeSet, key, flags, exptime, dataSize)
 }
 
+func WriteSetQCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error {
+	return writeDataCmdCommon(w, OpcodeSetQ, key, flags, exptime, dataSize)
+}
+
 func WriteAddCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error {
 	//fmt.Printf("Add: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
@@ -92,9 +96,10 @@ func WritePrependCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) e
 }
 
 // Key commands send the header and key only
-func writeKeyCmd(w io.Writer, opcode uint8, key []byte) error {
+func writeKeyCmd(w io.Writer, opcode uint8, key []byte, opaque uint32) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	header := makeRequestHeader(opcode, len(key), 0, len(key))
+	header.OpaqueToken = opaque
 	writeRequestHeader(w, header)
 
 	n, err := w.Write(key)
@@ -107,36 +112,44 @@ func writeKeyCmd(w io.Writer, opcode uint8, key []byte) error {
 
 func WriteGetCmd(w io.Writer, key []byte) error {
 	//fmt.Printf("Get: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGet, key)
+	return writeKeyCmd(w, OpcodeGet, key, 0)
 }
 
 func WriteGetQCmd(w io.Writer, key []byte) error {
 	//fmt.Printf("GetQ: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGetQ, key)
+	return writeKeyCmd(w, OpcodeGetQ, key, 0)
+}
+
+// WriteGetQOpaqueCmd writes a quiet get whose response carries the given
+// opaque, so a batch of them can be matched up with their responses even
+// though misses don't send one.
+func WriteGetQOpaqueCmd(w io.Writer, key []byte, opaque uint32) error {
+	return writeKeyCmd(w, OpcodeGetQ, key, opaque)
 }
 
 func WriteGetECmd(w io.Writer, key []byte) error {
 	//fmt.Printf("GetE: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGetE, key)
+	return writeKeyCmd(w, OpcodeGetE, key, 0)
 }
 
 func WriteGetEQCmd(w io.Writer, key []byte) error {
 	//fmt.Printf("GetEQ: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGetEQ, key)
+	return writeKeyCmd(w, OpcodeGetEQ, key, 0)
 }
 
 func WriteDeleteCmd(w io.Writer, key []byte) error {
 	//fmt.Printf("Delete: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeDelete, key)
+	return writeKeyCmd(w, OpcodeDelete, key, 0)
 }
 
 // Key Exptime commands send the header, key, and an exptime
-func writeKeyExptimeCmd(w io.Writer, opcode uint8, key []byte, exptime uint32) error {
+func writeKeyExptimeCmd(w io.Writer, opcode uint8, key []byte, exptime, opaque uint32) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	// key + extras + body
 	extrasLen := 4
 	totalBodyLength := len(key) + extrasLen
 	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength)
+	header.OpaqueToken = opaque
 
 	writeRequestHeader(w, header)
 
@@ -155,19 +168,24 @@ func writeKeyExptimeCmd(w io.Writer, opcode uint8, key []byte, exptime uint32) e
 func WriteTouchCmd(w io.Writer, key []byte, exptime uint32) error {
 	//fmt.Printf("Touch: key: %v | exptime: %v | totalBodyLength: %v\n", string(key),
 	//exptime, totalBodyLength)
-	return writeKeyExptimeCmd(w, OpcodeTouch, key, exptime)
+	return writeKeyExptimeCmd(w, OpcodeTouch, key, exptime, 0)
 }
 
 func WriteGATCmd(w io.Writer, key []byte, exptime uint32) error {
 	//fmt.Printf("GAT: key: %v | exptime: %v | totalBodyLength: %v\n", string(key),
 	//exptime, len(key))
-	return writeKeyExptimeCmd(w, OpcodeGat, key, exptime)
+	return writeKeyExptimeCmd(w, OpcodeGat, key, exptime, 0)
 }
 
 func WriteGATQCmd(w io.Writer, key []byte, exptime uint32) error {
 	//fmt.Printf("GATQ: key: %v | exptime: %v | totalBodyLength: %v\n", string(key),
 	//exptime, len(key))
-	return writeKeyExptimeCmd(w, OpcodeGatQ, key, exptime)
+	return writeKeyExptimeCmd(w, OpcodeGatQ, key, exptime, 0)
+}
+
+// WriteGATQOpaqueCmd is the GATQ version of WriteGetQOpaqueCmd
+func WriteGATQOpaqueCmd(w io.Writer, key []byte, exptime, opaque uint32) error {
+	return writeKeyExptimeCmd(w, OpcodeGatQ, key, exptime, opaque)
 }
 
 // And the noop command is just a header
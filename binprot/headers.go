@@ -26,10 +26,12 @@ import (
 const ReqHeaderLen = 24
 
 var (
-	MetricBinaryRequestHeadersParsed    = metrics.AddCounter("binary_request_headers_parsed")
-	MetricBinaryRequestHeadersBadMagic  = metrics.AddCounter("binary_request_headers_bad_magic")
-	MetricBinaryResponseHeadersParsed   = metrics.AddCounter("binary_response_headers_parsed")
-	MetricBinaryResponseHeadersBadMagic = metrics.AddCounter("binary_response_headers_bad_magic")
+	MetricBinaryRequestHeadersParsed    = metrics.AddCounter("binary_request_headers_parsed", nil)
+	MetricBinaryRequestHeadersBadMagic  = metrics.AddCounter("binary_request_headers_bad_magic", nil)
+	MetricBinaryResponseHeadersParsed   = metrics.AddCounter("binary_response_headers_parsed", nil)
+	MetricBinaryResponseHeadersBadMagic = metrics.AddCounter("binary_response_headers_bad_magic", nil)
+	MetricBinaryResponseHeadersBad      = metrics.AddCounter("binary_response_headers_bad", nil)
+	MetricBinaryResponsesUnexpected     = metrics.AddCounter("binary_responses_unexpected", nil)
 )
 
 type RequestHeader struct {
@@ -198,9 +200,28 @@ func ReadResponseHeader(r io.Reader) (ResponseHeader, error) {
 	bufPool.Put(buf)
 	metrics.IncCounter(MetricBinaryResponseHeadersParsed)
 
+	if uint32(rh.KeyLength)+uint32(rh.ExtraLength) > rh.TotalBodyLength {
+		resHeadPool.Put(rh)
+		metrics.IncCounter(MetricBinaryResponseHeadersBad)
+		return emptyResHeader, ErrBadResponse
+	}
+
 	return rh, nil
 }
 
+// CheckOpcode returns ErrUnexpectedResponse if the response isn't for one of
+// the given opcodes, which means the reader is out of step with the requests
+// sent.
+func CheckOpcode(rh ResponseHeader, opcodes ...uint8) error {
+	for _, o := range opcodes {
+		if rh.Opcode == o {
+			return nil
+		}
+	}
+	metrics.IncCounter(MetricBinaryResponsesUnexpected)
+	return ErrUnexpectedResponse
+}
+
 func writeResponseHeader(w io.Writer, rh ResponseHeader) error {
 	buf := bufPool.Get().([]byte)
 
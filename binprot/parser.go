@@ -18,7 +18,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"io"
-	"log"
+	"strings"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
@@ -104,6 +104,10 @@ import (
 
 type BinaryParser struct {
 	reader *bufio.Reader
+
+	// Log is used for all log lines about the requests being parsed. It may be
+	// nil.
+	Log *common.RequestLog
 }
 
 func NewBinaryParser(reader *bufio.Reader) BinaryParser {
@@ -125,6 +129,8 @@ func NewBinaryParser(reader *bufio.Reader) BinaryParser {
 // spymemcached's implementation ^^^
 
 func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
+	b.Log.Next()
+
 	// read in the full header before any variable length fields
 	reqHeader, err := readRequestHeader(b.reader)
 	defer reqHeadPool.Put(reqHeader)
@@ -135,34 +141,34 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 
 	switch reqHeader.Opcode {
 	case OpcodeSet:
-		return setRequest(b.reader, reqHeader, common.RequestSet, false)
+		return b.setRequest(b.reader, reqHeader, common.RequestSet, false)
 	case OpcodeSetQ:
-		return setRequest(b.reader, reqHeader, common.RequestSet, true)
+		return b.setRequest(b.reader, reqHeader, common.RequestSet, true)
 
 	case OpcodeAdd:
-		return setRequest(b.reader, reqHeader, common.RequestAdd, false)
+		return b.setRequest(b.reader, reqHeader, common.RequestAdd, false)
 	case OpcodeAddQ:
-		return setRequest(b.reader, reqHeader, common.RequestAdd, true)
+		return b.setRequest(b.reader, reqHeader, common.RequestAdd, true)
 
 	case OpcodeReplace:
-		return setRequest(b.reader, reqHeader, common.RequestReplace, false)
+		return b.setRequest(b.reader, reqHeader, common.RequestReplace, false)
 	case OpcodeReplaceQ:
-		return setRequest(b.reader, reqHeader, common.RequestReplace, true)
+		return b.setRequest(b.reader, reqHeader, common.RequestReplace, true)
 
 	case OpcodeAppend:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestAppend, false)
+		return b.appendPrependRequest(b.reader, reqHeader, common.RequestAppend, false)
 	case OpcodeAppendQ:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestAppend, true)
+		return b.appendPrependRequest(b.reader, reqHeader, common.RequestAppend, true)
 
 	case OpcodePrepend:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, false)
+		return b.appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, false)
 	case OpcodePrependQ:
-		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, true)
+		return b.appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, true)
 
 	case OpcodeGetQ:
-		req, err := readBatchGet(b.reader, reqHeader)
+		req, err := b.readBatchGet(b.reader, reqHeader)
 		if err != nil {
-			log.Println("Error reading batch get")
+			b.Log.Println("Error reading batch get")
 			return nil, common.RequestGet, err
 		}
 
@@ -172,7 +178,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 		// key
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
-			log.Println("Error reading key")
+			b.Log.Println("Error reading key")
 			return nil, common.RequestGet, err
 		}
 
@@ -185,9 +191,9 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 
 	// Expected only in applications behind Rend that reuse this parsing code
 	case OpcodeGetEQ:
-		req, err := readBatchGetE(b.reader, reqHeader)
+		req, err := b.readBatchGetE(b.reader, reqHeader)
 		if err != nil {
-			log.Println("Error reading batch get")
+			b.Log.Println("Error reading batch get")
 			return nil, common.RequestGetE, err
 		}
 
@@ -198,7 +204,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 		// key
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
-			log.Println("Error reading key")
+			b.Log.Println("Error reading key")
 			return nil, common.RequestGetE, err
 		}
 
@@ -210,17 +216,9 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 		}, common.RequestGetE, nil
 
 	case OpcodeGat:
-		// exptime, key
-		exptime, err := readUInt32(b.reader)
-		if err != nil {
-			log.Println("Error reading exptime")
-			return nil, common.RequestGat, err
-		}
-
-		key, err := readString(b.reader, reqHeader.KeyLength)
+		exptime, key, err := b.touchRequest(reqHeader)
 		if err != nil {
-			log.Println("Error reading key")
-			return nil, common.RequestGat, err
+			return common.GATRequest{Opaque: reqHeader.OpaqueToken}, common.RequestGat, err
 		}
 
 		return common.GATRequest{
@@ -233,7 +231,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 		// key
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
-			log.Println("Error reading key")
+			b.Log.Println("Error reading key")
 			return nil, common.RequestDelete, err
 		}
 
@@ -243,17 +241,9 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 		}, common.RequestDelete, nil
 
 	case OpcodeTouch:
-		// exptime, key
-		exptime, err := readUInt32(b.reader)
+		exptime, key, err := b.touchRequest(reqHeader)
 		if err != nil {
-			log.Println("Error reading exptime")
-			return nil, common.RequestTouch, err
-		}
-
-		key, err := readString(b.reader, reqHeader.KeyLength)
-		if err != nil {
-			log.Println("Error reading key")
-			return nil, common.RequestTouch, err
+			return common.TouchRequest{Opaque: reqHeader.OpaqueToken}, common.RequestTouch, err
 		}
 
 		return common.TouchRequest{
@@ -282,14 +272,36 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, error) {
 		return common.VersionRequest{
 			Opaque: reqHeader.OpaqueToken,
 		}, common.RequestVersion, nil
+
+	case OpcodeStat:
+		// key, which names a specific group of stats followed by any
+		// arguments, separated by spaces.
+		key, err := readString(b.reader, reqHeader.KeyLength)
+		if err != nil {
+			b.Log.Println("Error reading key")
+			return nil, common.RequestStats, err
+		}
+
+		var group string
+		var args []string
+		if fields := strings.Fields(string(key)); len(fields) > 0 {
+			group = fields[0]
+			args = fields[1:]
+		}
+
+		return common.StatsRequest{
+			Group:  group,
+			Args:   args,
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestStats, nil
 	}
 
-	log.Printf("Error processing request: unknown command. Command: %X\nWhole request:%#v", reqHeader.Opcode, reqHeader)
+	b.Log.Printf("Error processing request: unknown command. Command: %X\nWhole request:%#v", reqHeader.Opcode, reqHeader)
 
 	return nil, common.RequestUnknown, common.ErrUnknownCmd
 }
 
-func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error) {
+func (b BinaryParser) readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error) {
 	var keys [][]byte
 	var opaques []uint32
 	var quiet []bool
@@ -352,7 +364,7 @@ func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error)
 	}, nil
 }
 
-func readBatchGetE(r io.Reader, header RequestHeader) (common.GetRequest, error) {
+func (b BinaryParser) readBatchGetE(r io.Reader, header RequestHeader) (common.GetRequest, error) {
 	var keys [][]byte
 	var opaques []uint32
 	var quiet []bool
@@ -415,23 +427,55 @@ func readBatchGetE(r io.Reader, header RequestHeader) (common.GetRequest, error)
 	}, nil
 }
 
-func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool) (common.SetRequest, common.RequestType, error) {
+// Reads the exptime and key of a touch or GAT, which have the exptime as their
+// only extras and no value. A request with any other layout is skipped and
+// gets ErrBadRequest, so the connection stays in step with the client.
+func (b BinaryParser) touchRequest(reqHeader RequestHeader) (uint32, []byte, error) {
+	if reqHeader.ExtraLength != 4 || reqHeader.KeyLength == 0 ||
+		reqHeader.TotalBodyLength != 4+uint32(reqHeader.KeyLength) {
+		b.Log.Printf("Bad touch request layout: %d bytes of extras, %d of key, %d of body",
+			reqHeader.ExtraLength, reqHeader.KeyLength, reqHeader.TotalBodyLength)
+
+		n, err := b.reader.Discard(int(reqHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, common.ErrBadRequest
+	}
+
+	exptime, err := readUInt32(b.reader)
+	if err != nil {
+		b.Log.Println("Error reading exptime")
+		return 0, nil, err
+	}
+
+	key, err := readString(b.reader, reqHeader.KeyLength)
+	if err != nil {
+		b.Log.Println("Error reading key")
+		return 0, nil, err
+	}
+
+	return exptime, key, nil
+}
+
+func (b BinaryParser) setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool) (common.SetRequest, common.RequestType, error) {
 	// flags, exptime, key, value
 	flags, err := readUInt32(r)
 	if err != nil {
-		log.Println("Error reading flags")
+		b.Log.Println("Error reading flags")
 		return common.SetRequest{}, reqType, err
 	}
 
 	exptime, err := readUInt32(r)
 	if err != nil {
-		log.Println("Error reading exptime")
+		b.Log.Println("Error reading exptime")
 		return common.SetRequest{}, reqType, err
 	}
 
 	key, err := readString(r, reqHeader.KeyLength)
 	if err != nil {
-		log.Println("Error reading key")
+		b.Log.Println("Error reading key")
 		return common.SetRequest{}, reqType, err
 	}
 
@@ -440,7 +484,7 @@ func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType
 		uint32(reqHeader.KeyLength)
 
 	// Read in the body of the set request
-	dataBuf := make([]byte, realLength)
+	dataBuf := common.GetBuf(int(realLength))
 	n, err := io.ReadAtLeast(r, dataBuf, int(realLength))
 	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
 	if err != nil {
@@ -457,18 +501,18 @@ func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType
 	}, reqType, nil
 }
 
-func appendPrependRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool) (common.SetRequest, common.RequestType, error) {
+func (b BinaryParser) appendPrependRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool) (common.SetRequest, common.RequestType, error) {
 	// key, value
 	key, err := readString(r, reqHeader.KeyLength)
 	if err != nil {
-		log.Println("Error reading key")
+		b.Log.Println("Error reading key")
 		return common.SetRequest{}, reqType, err
 	}
 
 	realLength := reqHeader.TotalBodyLength - uint32(reqHeader.KeyLength)
 
 	// Read in the body of the set request
-	dataBuf := make([]byte, realLength)
+	dataBuf := common.GetBuf(int(realLength))
 	n, err := io.ReadAtLeast(r, dataBuf, int(realLength))
 	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
 	if err != nil {
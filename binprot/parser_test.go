@@ -48,3 +48,81 @@ func TestUnknownCommand(t *testing.T) {
 		t.Fatal("Expected error to be Unknown Command")
 	}
 }
+
+func TestResponseHeaderChecks(t *testing.T) {
+	header := func(opcode, extras uint8, bodyLen uint8) []byte {
+		return []byte{
+			0x81,       // Magic
+			opcode,     // Opcode
+			0x00, 0x00, // key length
+			extras,     // Extra length
+			0x00,       // Data type
+			0x00, 0x00, // Status
+			0x00, 0x00, 0x00, bodyLen, // total body length
+			0x00, 0x00, 0x00, 0x00, // opaque token
+			0x00, 0x00, 0x00, 0x00, // CAS
+			0x00, 0x00, 0x00, 0x00, // CAS
+		}
+	}
+
+	rh, err := binprot.ReadResponseHeader(bytes.NewReader(header(binprot.OpcodeGet, 4, 9)))
+	if err != nil {
+		t.Fatalf("Error reading a good header: %s", err.Error())
+	}
+	if err := binprot.CheckOpcode(rh, binprot.OpcodeGet); err != nil {
+		t.Fatalf("Expected the opcode to match, got %v", err)
+	}
+	if err := binprot.CheckOpcode(rh, binprot.OpcodeSet, binprot.OpcodeNoop); err != binprot.ErrUnexpectedResponse {
+		t.Fatalf("Expected an unexpected response, got %v", err)
+	}
+
+	_, err = binprot.ReadResponseHeader(bytes.NewReader(header(binprot.OpcodeGet, 4, 3)))
+	if err != binprot.ErrBadResponse || !binprot.IsDesync(err) {
+		t.Fatalf("Expected extras longer than the body to be a bad response, got %v", err)
+	}
+}
+
+func TestTouchExtras(t *testing.T) {
+	header := func(opcode, extras uint8, keyLen, bodyLen uint8) []byte {
+		return []byte{
+			0x80,         // Magic
+			opcode,       // Opcode
+			0x00, keyLen, // key length
+			extras,     // Extra length
+			0x00,       // Data type
+			0x00, 0x00, // VBucket
+			0x00, 0x00, 0x00, bodyLen, // total body length
+			0x00, 0x00, 0x00, 0xA5, // opaque token
+			0x00, 0x00, 0x00, 0x00, // CAS
+			0x00, 0x00, 0x00, 0x00, // CAS
+		}
+	}
+
+	var buf bytes.Buffer
+	// A touch without its exptime
+	buf.Write(header(binprot.OpcodeTouch, 0, 3, 3))
+	buf.WriteString("key")
+	// A good GAT after it
+	buf.Write(header(binprot.OpcodeGat, 4, 3, 7))
+	buf.Write([]byte{0x00, 0x00, 0x0e, 0x10})
+	buf.WriteString("key")
+
+	p := binprot.NewBinaryParser(bufio.NewReader(&buf))
+
+	req, reqType, err := p.Parse()
+	if err != common.ErrBadRequest || reqType != common.RequestTouch {
+		t.Fatalf("Expected a bad touch request, got %v, %v", reqType, err)
+	}
+	if req.GetOpaque() != 0xA5 {
+		t.Fatalf("Expected the bad request to keep its opaque, got %X", req.GetOpaque())
+	}
+
+	req, reqType, err = p.Parse()
+	if err != nil || reqType != common.RequestGat {
+		t.Fatalf("Expected the next request to be a GAT, got %v, %v", reqType, err)
+	}
+	gat := req.(common.GATRequest)
+	if string(gat.Key) != "key" || gat.Exptime != 3600 || gat.Opaque != 0xA5 {
+		t.Fatalf("Expected a GAT of key for an hour, got %+v", gat)
+	}
+}
@@ -161,15 +161,17 @@ func (b BinaryResponder) Prepend(opaque uint32, quiet bool) error {
 	return nil
 }
 
+// The responses to the keys of a batch of gets are buffered and sent all at
+// once by GetEnd.
 func (b BinaryResponder) Get(response common.GetResponse) error {
 	if response.Miss {
 		if !response.Quiet {
-			return b.Error(response.Opaque, common.RequestGet, common.ErrKeyNotFound, false)
+			return writeErrorResponseHeader(b.writer, OpcodeGet, StatusKeyEnoent, response.Opaque, false)
 		}
 		return nil
 	}
 
-	return getCommon(b.writer, response, OpcodeGet)
+	return getCommon(b.writer, response, OpcodeGet, false)
 }
 
 func (b BinaryResponder) GetEnd(opaque uint32, noopEnd bool) error {
@@ -179,7 +181,7 @@ func (b BinaryResponder) GetEnd(opaque uint32, noopEnd bool) error {
 		return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, true)
 	}
 
-	return nil
+	return b.writer.Flush()
 }
 
 func (b BinaryResponder) GAT(response common.GetResponse) error {
@@ -190,13 +192,13 @@ func (b BinaryResponder) GAT(response common.GetResponse) error {
 		return nil
 	}
 
-	return getCommon(b.writer, response, OpcodeGat)
+	return getCommon(b.writer, response, OpcodeGat, true)
 }
 
 func (b BinaryResponder) GetE(response common.GetEResponse) error {
 	if response.Miss {
 		if !response.Quiet {
-			return b.Error(response.Opaque, common.RequestGetE, common.ErrKeyNotFound, false)
+			return writeErrorResponseHeader(b.writer, OpcodeGetE, StatusKeyEnoent, response.Opaque, false)
 		}
 		return nil
 	}
@@ -206,11 +208,10 @@ func (b BinaryResponder) GetE(response common.GetEResponse) error {
 	writeSuccessResponseHeader(b.writer, OpcodeGetE, 0, 8, totalBodyLength, response.Opaque, false)
 	binary.Write(b.writer, binary.BigEndian, response.Flags)
 	binary.Write(b.writer, binary.BigEndian, response.Exptime)
-	b.writer.Write(response.Data)
-
-	if err := b.writer.Flush(); err != nil {
+	if _, err := b.writer.Write(response.Data); err != nil {
 		return err
 	}
+
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
 	return nil
 }
@@ -243,9 +244,35 @@ func (b BinaryResponder) Version(opaque uint32) error {
 	return b.writer.Flush()
 }
 
+// Each stat is sent as its own response with the name as the key and the value
+// as the body. The end of the stats is signaled with an empty response.
+func (b BinaryResponder) Stats(opaque uint32, stats []common.Stat) error {
+	for _, stat := range stats {
+		totalBodyLength := len(stat.Name) + len(stat.Value)
+		if err := writeSuccessResponseHeader(b.writer, OpcodeStat, len(stat.Name), 0, totalBodyLength, opaque, false); err != nil {
+			return err
+		}
+		b.writer.WriteString(stat.Name)
+		b.writer.WriteString(stat.Value)
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
+	}
+
+	return writeSuccessResponseHeader(b.writer, OpcodeStat, 0, 0, 0, opaque, true)
+}
+
+// A stats reset is answered with only the end of the stats, like memcached
+// does.
+func (b BinaryResponder) StatsReset(opaque uint32) error {
+	return writeSuccessResponseHeader(b.writer, OpcodeStat, 0, 0, 0, opaque, true)
+}
+
+func (b BinaryResponder) Line(line []byte, last bool) error {
+	panic("lru_crawler command in binary protocol")
+}
+
 func (b BinaryResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
 	// TODO: proper opcode
-	return writeErrorResponseHeader(b.writer, reqTypeToOpcode(reqType, quiet), errorToCode(err), opaque)
+	return writeErrorResponseHeader(b.writer, reqTypeToOpcode(reqType, quiet), errorToCode(err), opaque, true)
 }
 
 // Mae sure this includes all possibilities in the github.com/netflix/rend/common.RequestType enum
@@ -285,22 +312,28 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 		return OpcodeDelete
 	case rt == common.RequestTouch:
 		return OpcodeTouch
+	case rt == common.RequestStats:
+		return OpcodeStat
 	default:
 		return OpcodeInvalid
 	}
 }
 
-func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8) error {
+func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8, flush bool) error {
 	// total body length = extras (flags, 4 bytes) + data length
 	totalBodyLength := len(response.Data) + 4
 	writeSuccessResponseHeader(w, opcode, 0, 4, totalBodyLength, response.Opaque, false)
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, response.Flags)
 	w.Write(buf)
-	w.Write(response.Data)
-	if err := w.Flush(); err != nil {
+	if _, err := w.Write(response.Data); err != nil {
 		return err
 	}
+	if flush {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
 	return nil
 }
@@ -338,7 +371,7 @@ func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraL
 	return nil
 }
 
-func writeErrorResponseHeader(w *bufio.Writer, opcode uint8, status uint16, opaque uint32) error {
+func writeErrorResponseHeader(w *bufio.Writer, opcode uint8, status uint16, opaque uint32, flush bool) error {
 	header := resHeadPool.Get().(ResponseHeader)
 
 	header.Magic = MagicResponse
@@ -356,9 +389,11 @@ func writeErrorResponseHeader(w *bufio.Writer, opcode uint8, status uint16, opaq
 		return err
 	}
 
-	if err := w.Flush(); err != nil {
-		resHeadPool.Put(header)
-		return err
+	if flush {
+		if err := w.Flush(); err != nil {
+			resHeadPool.Put(header)
+			return err
+		}
 	}
 
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, resHeaderLen)
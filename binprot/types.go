@@ -22,6 +22,24 @@ import (
 
 var ErrBadMagic = errors.New("Bad magic value")
 
+var (
+	// ErrBadResponse means a response header doesn't add up, like a key and
+	// extras longer than the whole body.
+	ErrBadResponse = errors.New("Malformed response header")
+	// ErrUnexpectedResponse means a response is for a different command than
+	// the one sent.
+	ErrUnexpectedResponse = errors.New("Response doesn't match the request")
+)
+
+// IsDesync is true for errors that mean the responses read from a backend
+// connection no longer line up with the requests sent on it, so nothing more
+// can be read from it.
+func IsDesync(err error) bool {
+	return err == ErrBadMagic ||
+		err == ErrBadResponse ||
+		err == ErrUnexpectedResponse
+}
+
 const (
 	MagicRequest  = uint8(0x80)
 	MagicResponse = uint8(0x81)
@@ -123,7 +141,7 @@ func errorToCode(err error) uint16 {
 		return StatusKeyExists
 	case common.ErrValueTooBig:
 		return StatusE2big
-	case common.ErrInvalidArgs:
+	case common.ErrInvalidArgs, common.ErrTooManyKeys, common.ErrBadRequest:
 		return StatusEinval
 	case common.ErrItemNotStored:
 		return StatusNotStored
@@ -141,7 +159,7 @@ func errorToCode(err error) uint16 {
 		return StatusInternalError
 	case common.ErrBusy:
 		return StatusBusy
-	case common.ErrTempFailure:
+	case common.ErrTempFailure, common.ErrUnavailable, common.ErrBudgetExceeded:
 		return StatusTempFailure
 	}
 	return StatusInvalid
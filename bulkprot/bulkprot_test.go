@@ -0,0 +1,125 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkprot_test
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/bulkprot"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers/memcached"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/server"
+)
+
+// Starts a bulk listener in front of a fakemem and connects to it
+func connect(t *testing.T) net.Conn {
+	dir := t.TempDir()
+	l1Sock := filepath.Join(dir, "l1.sock")
+	sock := filepath.Join(dir, "bulk.sock")
+
+	l, err := net.Listen("unix", l1Sock)
+	if err != nil {
+		t.Fatalf("Error listening for fakemem: %s", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+	go fakemem.New(false).Serve(l)
+
+	go server.Serve(server.Config{
+		ListenArgs: server.ListenArgs{Type: server.ListenUnix, Path: sock, Protocol: &server.BulkProtocol},
+		Orca:       orcas.L1Only,
+		L1:         memcached.Regular(l1Sock),
+	})
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+	}
+	t.Fatalf("Bulk listener didn't start on %s", sock)
+	return nil
+}
+
+func roundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, id uint32, ops []bulkprot.Op) []bulkprot.Result {
+	if err := bulkprot.WriteRequest(conn, id, ops); err != nil {
+		t.Fatalf("Error writing frame: %s", err.Error())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	gotID, results, err := bulkprot.ReadResponse(r)
+	if err != nil {
+		t.Fatalf("Error reading frame: %s", err.Error())
+	}
+	if gotID != id || len(results) != len(ops) {
+		t.Fatalf("Expected frame %d with %d results, got frame %d with %d", id, len(ops), gotID, len(results))
+	}
+	return results
+}
+
+func TestBulk(t *testing.T) {
+	conn := connect(t)
+	r := bufio.NewReader(conn)
+
+	results := roundTrip(t, conn, r, 7, []bulkprot.Op{
+		{Opcode: bulkprot.OpSet, Key: []byte("a"), Data: []byte("apple"), Flags: 3},
+		{Opcode: bulkprot.OpSet, Key: []byte("b"), Data: []byte("banana")},
+		{Opcode: bulkprot.OpGet, Key: []byte("a")},
+		{Opcode: bulkprot.OpGet, Key: []byte("missing")},
+		{Opcode: bulkprot.OpGet, Key: []byte("b")},
+		{Opcode: bulkprot.OpAdd, Key: []byte("a"), Data: []byte("again")},
+		{Opcode: bulkprot.OpDelete, Key: []byte("missing")},
+		{Opcode: bulkprot.OpTouch, Key: []byte("b"), Exptime: 100},
+		{Opcode: bulkprot.OpGet, Key: []byte("b")},
+	})
+
+	expected := []bulkprot.Result{
+		{Status: bulkprot.StatusOK},
+		{Status: bulkprot.StatusOK},
+		{Status: bulkprot.StatusOK, Flags: 3, Data: []byte("apple")},
+		{Status: bulkprot.StatusNotFound},
+		{Status: bulkprot.StatusOK, Data: []byte("banana")},
+		{Status: bulkprot.StatusNotStored},
+		{Status: bulkprot.StatusNotFound},
+		{Status: bulkprot.StatusOK},
+		{Status: bulkprot.StatusOK, Data: []byte("banana")},
+	}
+	for i, res := range results {
+		if res.Status != expected[i].Status || res.Flags != expected[i].Flags || string(res.Data) != string(expected[i].Data) {
+			t.Errorf("Op %d: expected %+v, got %+v", i, expected[i], res)
+		}
+	}
+
+	// The connection keeps going with the next frame
+	results = roundTrip(t, conn, r, 8, []bulkprot.Op{{Opcode: bulkprot.OpDelete, Key: []byte("a")}})
+	if results[0].Status != bulkprot.StatusOK {
+		t.Fatalf("Expected the delete to succeed, got %+v", results[0])
+	}
+}
+
+func TestBulkBadFrame(t *testing.T) {
+	conn := connect(t)
+
+	conn.Write([]byte{bulkprot.MagicRequest, 0, 0, 0, 0, 0, 0, 0})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := bulkprot.ReadResponse(conn); err == nil {
+		t.Fatalf("Expected the connection to be closed after an empty frame")
+	}
+}
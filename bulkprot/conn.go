@@ -0,0 +1,369 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkprot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricFrames = metrics.AddCounter("bulk_frames", nil)
+	MetricOps    = metrics.AddCounter("bulk_ops", nil)
+)
+
+// Conn is both the request parser and the responder for a bulk protocol
+// connection, since the responses to a frame are collected into one response
+// frame. Ops are parsed one at a time as the server asks for them, so a frame
+// is never held in memory whole, and the opaque of each request is the index
+// of its op in the frame. The response frame is sent once every op has a
+// result.
+type Conn struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	// Log is used for all log lines about the requests being parsed. It may be
+	// nil.
+	Log *common.RequestLog
+
+	// The frame being run
+	id        uint32
+	unparsed  int
+	next      uint32
+	results   []Result
+	filled    []bool
+	remaining int
+
+	// The ops in the last get, which share its errors
+	getOps []uint32
+}
+
+func NewConn(reader *bufio.Reader, writer *bufio.Writer) *Conn {
+	return &Conn{
+		reader: reader,
+		writer: writer,
+	}
+}
+
+func (c *Conn) read(buf []byte) error {
+	n, err := io.ReadFull(c.reader, buf)
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	return err
+}
+
+func (c *Conn) readFrameHeader() error {
+	var h [frameHeaderLen]byte
+	if err := c.read(h[:]); err != nil {
+		if err == io.EOF {
+			c.Log.Println("Connection closed")
+		} else {
+			c.Log.Printf("Error while reading bulk frame header: %s\n", err.Error())
+		}
+		return err
+	}
+
+	count := int(binary.BigEndian.Uint16(h[2:4]))
+	if h[0] != MagicRequest || count == 0 {
+		c.Log.Printf("Bad bulk frame header: %X\n", h)
+		return ErrBadFrame
+	}
+
+	metrics.IncCounter(MetricFrames)
+	metrics.IncCounterBy(MetricOps, uint64(count))
+
+	c.id = binary.BigEndian.Uint32(h[4:8])
+	c.unparsed = count
+	c.next = 0
+	c.remaining = count
+	c.results = make([]Result, count)
+	c.filled = make([]bool, count)
+	return nil
+}
+
+// Reads the next op in the frame. The data of sets comes from the buffer pool
+// and is given back by the server once the set is done.
+func (c *Conn) readOp() (Op, uint32, error) {
+	var h [opHeaderLen]byte
+	if err := c.read(h[:]); err != nil {
+		c.Log.Println("Error reading bulk op")
+		return Op{}, 0, err
+	}
+
+	op := Op{
+		Opcode:  Opcode(h[0]),
+		Flags:   binary.BigEndian.Uint32(h[4:8]),
+		Exptime: binary.BigEndian.Uint32(h[8:12]),
+	}
+	keyLen := binary.BigEndian.Uint16(h[2:4])
+	dataLen := binary.BigEndian.Uint32(h[12:16])
+
+	if op.Opcode > OpTouch || keyLen == 0 || (dataLen > 0 && !hasData(op.Opcode)) {
+		c.Log.Printf("Bad bulk op header: %X\n", h)
+		return Op{}, 0, ErrBadFrame
+	}
+
+	op.Key = make([]byte, keyLen)
+	if err := c.read(op.Key); err != nil {
+		c.Log.Println("Error reading key")
+		return Op{}, 0, err
+	}
+
+	if hasData(op.Opcode) {
+		op.Data = common.GetBuf(int(dataLen))
+		if err := c.read(op.Data); err != nil {
+			c.Log.Println("Error reading data")
+			common.PutBuf(op.Data)
+			return Op{}, 0, err
+		}
+	}
+
+	c.unparsed--
+	c.next++
+	return op, c.next - 1, nil
+}
+
+// Parse returns the next op in the frame as a request, reading the next frame
+// header first if the last frame is all parsed. Consecutive gets are returned
+// as one multiget.
+func (c *Conn) Parse() (common.Request, common.RequestType, error) {
+	c.Log.Next()
+
+	if c.unparsed == 0 {
+		if err := c.readFrameHeader(); err != nil {
+			return nil, common.RequestUnknown, err
+		}
+	}
+
+	op, opaque, err := c.readOp()
+	if err != nil {
+		return nil, common.RequestUnknown, err
+	}
+
+	switch op.Opcode {
+	case OpGet:
+		req := common.GetRequest{}
+		c.getOps = c.getOps[:0]
+		for {
+			req.Keys = append(req.Keys, op.Key)
+			req.Opaques = append(req.Opaques, opaque)
+			req.Quiet = append(req.Quiet, false)
+			c.getOps = append(c.getOps, opaque)
+
+			// The rest of the frame is already on its way, so looking at the
+			// next op doesn't wait on the client
+			if c.unparsed == 0 {
+				break
+			}
+			next, err := c.reader.Peek(1)
+			if err != nil {
+				return nil, common.RequestUnknown, err
+			}
+			if Opcode(next[0]) != OpGet {
+				break
+			}
+
+			if op, opaque, err = c.readOp(); err != nil {
+				return nil, common.RequestUnknown, err
+			}
+		}
+		return req, common.RequestGet, nil
+
+	case OpSet, OpAdd, OpReplace:
+		reqType := common.RequestSet
+		if op.Opcode == OpAdd {
+			reqType = common.RequestAdd
+		} else if op.Opcode == OpReplace {
+			reqType = common.RequestReplace
+		}
+
+		return common.SetRequest{
+			Key:     op.Key,
+			Data:    op.Data,
+			Flags:   op.Flags,
+			Exptime: op.Exptime,
+			Opaque:  opaque,
+		}, reqType, nil
+
+	case OpDelete:
+		return common.DeleteRequest{
+			Key:    op.Key,
+			Opaque: opaque,
+		}, common.RequestDelete, nil
+
+	default:
+		return common.TouchRequest{
+			Key:     op.Key,
+			Exptime: op.Exptime,
+			Opaque:  opaque,
+		}, common.RequestTouch, nil
+	}
+}
+
+// Records the result of an op and sends the response frame once all the ops
+// in the frame have one.
+func (c *Conn) result(opaque uint32, r Result) error {
+	if int(opaque) >= len(c.filled) || c.filled[opaque] {
+		return nil
+	}
+	c.results[opaque] = r
+	c.filled[opaque] = true
+	c.remaining--
+
+	if c.remaining > 0 {
+		return nil
+	}
+	return c.writeFrame()
+}
+
+func (c *Conn) writeFrame() error {
+	var h [frameHeaderLen]byte
+	h[0] = MagicResponse
+	binary.BigEndian.PutUint16(h[2:4], uint16(len(c.results)))
+	binary.BigEndian.PutUint32(h[4:8], c.id)
+	if err := c.write(h[:]); err != nil {
+		return err
+	}
+
+	for _, r := range c.results {
+		var rh [resultHeaderLen]byte
+		rh[0] = byte(r.Status)
+		binary.BigEndian.PutUint32(rh[4:8], r.Flags)
+		binary.BigEndian.PutUint32(rh[8:12], uint32(len(r.Data)))
+		if err := c.write(rh[:]); err != nil {
+			return err
+		}
+		if err := c.write(r.Data); err != nil {
+			return err
+		}
+	}
+
+	c.results = nil
+	c.filled = nil
+	return c.writer.Flush()
+}
+
+func (c *Conn) write(b []byte) error {
+	n, err := c.writer.Write(b)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return err
+}
+
+func (c *Conn) Set(opaque uint32, quiet bool) error {
+	return c.result(opaque, Result{Status: StatusOK})
+}
+
+func (c *Conn) Add(opaque uint32, quiet bool) error {
+	return c.result(opaque, Result{Status: StatusOK})
+}
+
+func (c *Conn) Replace(opaque uint32, quiet bool) error {
+	return c.result(opaque, Result{Status: StatusOK})
+}
+
+func (c *Conn) Append(opaque uint32, quiet bool) error {
+	panic("Append command in bulk protocol")
+}
+
+func (c *Conn) Prepend(opaque uint32, quiet bool) error {
+	panic("Prepend command in bulk protocol")
+}
+
+func (c *Conn) Get(response common.GetResponse) error {
+	if response.Miss {
+		return c.result(response.Opaque, Result{Status: StatusNotFound})
+	}
+
+	// The value may be reused once this returns, and the frame isn't sent
+	// until every op is done
+	data := make([]byte, len(response.Data))
+	copy(data, response.Data)
+	return c.result(response.Opaque, Result{Status: StatusOK, Flags: response.Flags, Data: data})
+}
+
+func (c *Conn) GetEnd(opaque uint32, noopEnd bool) error {
+	return nil
+}
+
+func (c *Conn) GetE(response common.GetEResponse) error {
+	panic("GetE command in bulk protocol")
+}
+
+func (c *Conn) GAT(response common.GetResponse) error {
+	panic("GAT command in bulk protocol")
+}
+
+func (c *Conn) Delete(opaque uint32) error {
+	return c.result(opaque, Result{Status: StatusOK})
+}
+
+func (c *Conn) Touch(opaque uint32) error {
+	return c.result(opaque, Result{Status: StatusOK})
+}
+
+func (c *Conn) Noop(opaque uint32) error {
+	panic("Noop command in bulk protocol")
+}
+
+func (c *Conn) Quit(opaque uint32, quiet bool) error {
+	panic("Quit command in bulk protocol")
+}
+
+func (c *Conn) Version(opaque uint32) error {
+	panic("Version command in bulk protocol")
+}
+
+func (c *Conn) Stats(opaque uint32, stats []common.Stat) error {
+	panic("Stats command in bulk protocol")
+}
+
+func (c *Conn) StatsReset(opaque uint32) error {
+	panic("Stats command in bulk protocol")
+}
+
+func (c *Conn) Line(line []byte, last bool) error {
+	panic("lru_crawler command in bulk protocol")
+}
+
+func (c *Conn) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	var r Result
+	switch err {
+	case common.ErrKeyNotFound:
+		r.Status = StatusNotFound
+	case common.ErrKeyExists, common.ErrItemNotStored:
+		r.Status = StatusNotStored
+	default:
+		r.Status = StatusError
+		r.Data = []byte(err.Error())
+		if c.Log != nil {
+			r.Data = []byte(err.Error() + " (request " + c.Log.ID() + ")")
+		}
+	}
+
+	// A get has no opaque of its own, so an error for it goes to each of its
+	// ops that doesn't have a result yet
+	if reqType != common.RequestGet {
+		return c.result(opaque, r)
+	}
+	for _, o := range c.getOps {
+		if err := c.result(o, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
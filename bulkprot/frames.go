@@ -0,0 +1,181 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bulkprot is a simple protocol for bulk producers like batch jobs.
+// Each request frame holds many operations and gets back a single response
+// frame with a result for each, in the same order, so a whole batch costs one
+// write and one read instead of one of each per operation. Consecutive gets in
+// a frame are sent to the backends as one multiget.
+//
+// All numbers are big endian.
+package bulkprot
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Request frame
+// Field        (offset) (value)
+//     Magic        (0)    : 0xB0
+//     Reserved     (1)    : 0x00
+//     Op count     (2,3)  : at least 1
+//     Frame ID     (4-7)  : returned in the response frame
+//     Ops                 : op count of them
+//
+// Op
+//     Opcode       (0)    : OpGet, OpSet, ...
+//     Reserved     (1)    : 0x00
+//     Key length   (2,3)  : at least 1
+//     Flags        (4-7)  : for sets, add, and replace
+//     Exptime      (8-11) : for sets, add, replace, and touch
+//     Data length  (12-15): 0 for anything but sets, add, and replace
+//     Key
+//     Data
+//
+// Response frame
+//     Magic        (0)    : 0xB1
+//     Reserved     (1)    : 0x00
+//     Result count (2,3)  : the op count of the request
+//     Frame ID     (4-7)  : from the request
+//     Results             : result count of them
+//
+// Result
+//     Status       (0)    : StatusOK, StatusNotFound, ...
+//     Reserved     (1-3)  : 0x000000
+//     Flags        (4-7)  : for get hits
+//     Data length  (8-11)
+//     Data                : the value for get hits, the message for errors
+
+const (
+	MagicRequest  = 0xB0
+	MagicResponse = 0xB1
+
+	frameHeaderLen  = 8
+	opHeaderLen     = 16
+	resultHeaderLen = 12
+
+	// The most ops in a frame
+	MaxOps = 0xFFFF
+)
+
+type Opcode uint8
+
+const (
+	OpGet Opcode = iota
+	OpSet
+	OpAdd
+	OpReplace
+	OpDelete
+	OpTouch
+)
+
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	// A get miss, or a delete or touch of a key that isn't there
+	StatusNotFound
+	// An add of a key that's there, or a replace of one that isn't
+	StatusNotStored
+	// Any other error. The data is the error message.
+	StatusError
+)
+
+// ErrBadFrame means a frame couldn't be parsed. The connection can't find the
+// start of the next frame, so it's closed.
+var ErrBadFrame = errors.New("Malformed bulk protocol frame")
+
+// Op is one operation in a request frame.
+type Op struct {
+	Opcode  Opcode
+	Key     []byte
+	Data    []byte
+	Flags   uint32
+	Exptime uint32
+}
+
+// Result is the result of one op in a response frame.
+type Result struct {
+	Status Status
+	Flags  uint32
+	Data   []byte
+}
+
+func hasData(op Opcode) bool {
+	return op == OpSet || op == OpAdd || op == OpReplace
+}
+
+// WriteRequest writes a request frame with the given ops.
+func WriteRequest(w io.Writer, id uint32, ops []Op) error {
+	if len(ops) == 0 || len(ops) > MaxOps {
+		return ErrBadFrame
+	}
+
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+len(ops)*opHeaderLen)
+	buf[0] = MagicRequest
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(ops)))
+	binary.BigEndian.PutUint32(buf[4:8], id)
+
+	for _, op := range ops {
+		if len(op.Key) == 0 || len(op.Key) > 0xFFFF || (len(op.Data) > 0 && !hasData(op.Opcode)) {
+			return ErrBadFrame
+		}
+
+		var h [opHeaderLen]byte
+		h[0] = byte(op.Opcode)
+		binary.BigEndian.PutUint16(h[2:4], uint16(len(op.Key)))
+		binary.BigEndian.PutUint32(h[4:8], op.Flags)
+		binary.BigEndian.PutUint32(h[8:12], op.Exptime)
+		binary.BigEndian.PutUint32(h[12:16], uint32(len(op.Data)))
+
+		buf = append(buf, h[:]...)
+		buf = append(buf, op.Key...)
+		buf = append(buf, op.Data...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadResponse reads a response frame.
+func ReadResponse(r io.Reader) (uint32, []Result, error) {
+	var h [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	if h[0] != MagicResponse {
+		return 0, nil, ErrBadFrame
+	}
+
+	id := binary.BigEndian.Uint32(h[4:8])
+	results := make([]Result, binary.BigEndian.Uint16(h[2:4]))
+
+	for i := range results {
+		var rh [resultHeaderLen]byte
+		if _, err := io.ReadFull(r, rh[:]); err != nil {
+			return 0, nil, err
+		}
+
+		results[i].Status = Status(rh[0])
+		results[i].Flags = binary.BigEndian.Uint32(rh[4:8])
+		results[i].Data = make([]byte, binary.BigEndian.Uint32(rh[8:12]))
+		if _, err := io.ReadFull(r, results[i].Data); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return id, results, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture records the bytes clients send, along with when they were
+// sent, so the same traffic can be replayed later against another server.
+// Bytes are recorded as they are read, before they are parsed, so both
+// protocols and even malformed requests are captured as they were.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// Every capture starts with this, so other files aren't replayed by mistake
+const magic = "RENDCAP1"
+
+// Each record is the connection ID, the time since the capture started in
+// nanoseconds, and the length of the data, followed by the data.
+const recordHeaderLen = 20
+
+// Records waiting to be written. Records are dropped when it's full so a slow
+// disk never slows down requests.
+const queueSize = 10000
+
+var (
+	MetricCaptureRecords = metrics.AddCounter("capture_records", nil)
+	MetricCaptureBytes   = metrics.AddCounter("capture_bytes", nil)
+	MetricCaptureDropped = metrics.AddCounter("capture_dropped", nil)
+)
+
+var ErrNotCapture = errors.New("Not a capture file")
+
+// Record is one read from a client connection.
+type Record struct {
+	// Connections are numbered from 1 in the order they were accepted
+	Conn uint64
+	// The time since the capture started
+	Time time.Duration
+	// The bytes read. Empty when the connection was closed.
+	Data []byte
+}
+
+// Recorder writes what's read from client connections to a capture.
+type Recorder struct {
+	queue chan Record
+	start time.Time
+	conns uint64
+}
+
+// Creates a recorder that writes to the file at the given path, replacing it if
+// it exists. Recording stops once the capture is limit bytes long. No limit if
+// 0.
+func NewFileRecorder(path string, limit int64) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f, limit), nil
+}
+
+// Creates a recorder that writes to w. Recording stops once limit bytes have
+// been written. No limit if 0.
+func NewRecorder(w io.Writer, limit int64) *Recorder {
+	r := &Recorder{
+		queue: make(chan Record, queueSize),
+		start: time.Now(),
+	}
+	go r.write(w, limit)
+	return r
+}
+
+func (r *Recorder) write(w io.Writer, limit int64) {
+	bw := bufio.NewWriter(w)
+	written, err := bw.WriteString(magic)
+	size := int64(written)
+	header := make([]byte, recordHeaderLen)
+	full := false
+
+	for rec := range r.queue {
+		// Once one record doesn't fit none are written, so the capture never
+		// has gaps in the middle of a connection
+		full = full || (limit > 0 && size+recordHeaderLen+int64(len(rec.Data)) > limit)
+
+		if err == nil && !full {
+			binary.BigEndian.PutUint64(header[0:8], rec.Conn)
+			binary.BigEndian.PutUint64(header[8:16], uint64(rec.Time))
+			binary.BigEndian.PutUint32(header[16:20], uint32(len(rec.Data)))
+			bw.Write(header)
+			bw.Write(rec.Data)
+			size += recordHeaderLen + int64(len(rec.Data))
+
+			metrics.IncCounter(MetricCaptureRecords)
+			metrics.IncCounterBy(MetricCaptureBytes, uint64(len(rec.Data)))
+		} else {
+			metrics.IncCounter(MetricCaptureDropped)
+		}
+
+		// Write out whenever the queue is drained so the capture is usable
+		// without the proxy having to stop cleanly
+		if err == nil && len(r.queue) == 0 {
+			if err = bw.Flush(); err != nil {
+				log.Println("Error writing capture, stopping:", err.Error())
+			}
+		}
+	}
+}
+
+// Conn returns a connection that records everything read from c. If a record
+// has to be dropped, the rest of the connection isn't recorded either, so a
+// replay never sends a request with a piece missing.
+func (r *Recorder) Conn(c net.Conn) net.Conn {
+	return &recordedConn{
+		Conn: c,
+		r:    r,
+		id:   atomic.AddUint64(&r.conns, 1),
+	}
+}
+
+func (r *Recorder) record(id uint64, data []byte) bool {
+	rec := Record{
+		Conn: id,
+		Time: time.Since(r.start),
+		Data: data,
+	}
+	select {
+	case r.queue <- rec:
+		return true
+	default:
+		metrics.IncCounter(MetricCaptureDropped)
+		return false
+	}
+}
+
+type recordedConn struct {
+	net.Conn
+	r       *Recorder
+	id      uint64
+	dropped bool
+	once    sync.Once
+}
+
+func (c *recordedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.dropped {
+		data := make([]byte, n)
+		copy(data, p)
+		c.dropped = !c.r.record(c.id, data)
+	}
+	return n, err
+}
+
+func (c *recordedConn) Close() error {
+	c.once.Do(func() { c.r.record(c.id, nil) })
+	return c.Conn.Close()
+}
+
+// Reader reads the records of a capture in the order they were recorded.
+type Reader struct {
+	r      *bufio.Reader
+	header []byte
+}
+
+// Creates a reader for the capture in r. Returns ErrNotCapture if r doesn't
+// start like a capture does.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != magic {
+		return nil, ErrNotCapture
+	}
+	return &Reader{r: br, header: make([]byte, recordHeaderLen)}, nil
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (r *Reader) Next() (Record, error) {
+	if _, err := io.ReadFull(r.r, r.header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// The proxy stopped in the middle of writing a record
+			err = io.EOF
+		}
+		return Record{}, err
+	}
+
+	rec := Record{
+		Conn: binary.BigEndian.Uint64(r.header[0:8]),
+		Time: time.Duration(binary.BigEndian.Uint64(r.header[8:16])),
+		Data: make([]byte, binary.BigEndian.Uint32(r.header[16:20])),
+	}
+	if _, err := io.ReadFull(r.r, rec.Data); err != nil {
+		return Record{}, io.EOF
+	}
+	return rec, nil
+}
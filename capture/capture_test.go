@@ -0,0 +1,148 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/capture"
+	"github.com/netflix/rend/fakemem"
+)
+
+// The recorder writes from its own goroutine
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	b.Lock()
+	defer b.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// Sends the data through a recorded connection and closes it
+func record(t *testing.T, rec *capture.Recorder, data string) {
+	client, server := net.Pipe()
+	conn := rec.Conn(server)
+
+	go func() {
+		client.Write([]byte(data))
+		client.Close()
+	}()
+
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("Error reading: %s", err.Error())
+	}
+	conn.Close()
+}
+
+// Reads the capture once it has n records
+func records(t *testing.T, buf *lockedBuffer, n int) []capture.Record {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		r, err := capture.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			continue
+		}
+
+		var recs []capture.Record
+		for {
+			rec, err := r.Next()
+			if err != nil {
+				break
+			}
+			recs = append(recs, rec)
+		}
+		if len(recs) >= n {
+			return recs
+		}
+	}
+	t.Fatalf("Capture never had %d records", n)
+	return nil
+}
+
+func TestCaptureReplay(t *testing.T) {
+	buf := &lockedBuffer{}
+	rec := capture.NewRecorder(buf, 0)
+
+	// Each connection is replayed independently, so nothing on the second
+	// depends on the first
+	const first = "set k 0 0 5\r\nhello\r\nget k\r\n"
+	const second = "delete missing\r\n"
+	record(t, rec, first)
+	record(t, rec, second)
+
+	recs := records(t, buf, 4)
+	if len(recs) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(recs))
+	}
+	if recs[0].Conn != 1 || string(recs[0].Data) != first || recs[1].Conn != 1 || len(recs[1].Data) != 0 {
+		t.Fatalf("Unexpected records for the first connection: %+v %+v", recs[0], recs[1])
+	}
+	if recs[2].Conn != 2 || string(recs[2].Data) != second || recs[2].Time < recs[1].Time {
+		t.Fatalf("Unexpected record for the second connection: %+v", recs[2])
+	}
+
+	sock := filepath.Join(t.TempDir(), "fakemem.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer l.Close()
+	go fakemem.New(false).Serve(l)
+
+	r, err := capture.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Error reading capture: %s", err.Error())
+	}
+	res, err := capture.Replay(r, func() (net.Conn, error) { return net.Dial("unix", sock) }, 0)
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err.Error())
+	}
+
+	received := int64(len("STORED\r\nVALUE k 0 5\r\nhello\r\nEND\r\n") + len("NOT_FOUND\r\n"))
+	want := capture.Result{Conns: 2, Records: 4, Sent: int64(len(first) + len(second)), Received: received}
+	if res != want {
+		t.Fatalf("Expected %+v, got %+v", want, res)
+	}
+}
+
+func TestCaptureLimit(t *testing.T) {
+	buf := &lockedBuffer{}
+	rec := capture.NewRecorder(buf, 40)
+
+	// Only the first record fits in the limit along with the header
+	record(t, rec, "get a\r\n")
+	record(t, rec, "get b\r\n")
+
+	// Give the recorder time to write anything that's over the limit
+	time.Sleep(50 * time.Millisecond)
+	recs := records(t, buf, 1)
+	if len(recs) != 1 || string(recs[0].Data) != "get a\r\n" {
+		t.Fatalf("Expected only the first record, got %+v", recs)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long to wait for the rest of the responses on a connection once the
+// capture has nothing more to send on it
+const drainTimeout = 5 * time.Second
+
+// Result is the totals of a replay.
+type Result struct {
+	Conns    int
+	Records  int
+	Sent     int64
+	Received int64
+	// Connections that couldn't be opened or failed partway through. The rest
+	// of their records are skipped.
+	Errors int
+}
+
+// Replay sends the records of a capture to the server dial connects to, with
+// a connection for each connection that was captured. Records are sent as far
+// apart as they were captured divided by speed, so 2 replays twice as fast.
+// If speed is 0 they are sent as fast as possible. Responses are read and
+// discarded. Returns once every connection has been closed.
+func Replay(r *Reader, dial func() (net.Conn, error), speed float64) (Result, error) {
+	var res Result
+	var received int64
+	var wg sync.WaitGroup
+
+	// Connections that failed have a nil entry, so their records are skipped
+	conns := make(map[uint64]net.Conn)
+	start := time.Now()
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		res.Records++
+
+		if speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(rec.Time) / speed))))
+		}
+
+		conn, ok := conns[rec.Conn]
+		if !ok {
+			conn, err = dial()
+			if err != nil {
+				res.Errors++
+				conns[rec.Conn] = nil
+				continue
+			}
+			res.Conns++
+			conns[rec.Conn] = conn
+
+			wg.Add(1)
+			go func(conn net.Conn) {
+				defer wg.Done()
+				n, _ := io.Copy(ioutil.Discard, conn)
+				atomic.AddInt64(&received, n)
+				conn.Close()
+			}(conn)
+		}
+		if conn == nil {
+			continue
+		}
+
+		if len(rec.Data) == 0 {
+			finish(conn)
+			delete(conns, rec.Conn)
+			continue
+		}
+
+		n, err := conn.Write(rec.Data)
+		res.Sent += int64(n)
+		if err != nil {
+			res.Errors++
+			conn.Close()
+			conns[rec.Conn] = nil
+		}
+	}
+
+	// Connections still open at the end of the capture
+	for _, conn := range conns {
+		if conn != nil {
+			finish(conn)
+		}
+	}
+
+	wg.Wait()
+	res.Received = atomic.LoadInt64(&received)
+	return res, nil
+}
+
+// finish closes the sending side of the connection, so the server sees the
+// client close it after responding to everything sent before.
+func finish(conn net.Conn) {
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(drainTimeout))
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,266 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/client/binprot"
+	"github.com/netflix/rend/client/common"
+	"github.com/netflix/rend/client/f"
+	_ "github.com/netflix/rend/client/sigs"
+	"github.com/netflix/rend/client/stats"
+	"github.com/netflix/rend/client/textprot"
+)
+
+var benchOps = []common.Op{common.Set, common.Get, common.Delete}
+
+type sample struct {
+	d    time.Duration
+	op   common.Op
+	miss bool
+}
+
+func main() {
+	weights, err := parseMix(f.Mix)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	var pipe common.Pipeliner
+	protString := "text"
+	if f.Binary {
+		pipe = binprot.BinProt{}
+		protString = "binary"
+	} else {
+		pipe = textprot.TextProt{}
+	}
+
+	fmt.Printf("Performing %v operations total with:\n"+
+		"\t%v connections\n"+
+		"\t%v requests in flight per connection\n"+
+		"\t%v keys\n"+
+		"\t%v values from %v to %v bytes\n"+
+		"\tset:get:delete mix of %v\n"+
+		"\tover the %v protocol\n\n",
+		f.NumOps, f.NumWorkers, f.Pipeline, f.KeyCount, f.ValueDist, f.ValueMin, f.ValueMax, f.Mix, protString)
+
+	conns := make([]net.Conn, 0, f.NumWorkers)
+	for i := 0; i < f.NumWorkers; i++ {
+		conn, err := common.Connect(f.Host, f.Port)
+		if err != nil {
+			fmt.Println("Error connecting:", err.Error())
+			os.Exit(1)
+		}
+		conns = append(conns, conn)
+	}
+
+	results := make(chan []sample, f.NumWorkers)
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+
+	for i, conn := range conns {
+		n := f.NumOps / f.NumWorkers
+		if i < f.NumOps%f.NumWorkers {
+			n++
+		}
+
+		wg.Add(1)
+		go bench(pipe, conn, n, weights, results, wg)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(results)
+
+	report(results, elapsed)
+}
+
+// Parses the set:get:delete weights into cumulative weights
+func parseMix(mix string) ([]int, error) {
+	parts := strings.Split(mix, ":")
+	if len(parts) != len(benchOps) {
+		return nil, fmt.Errorf("--mix must be set:get:delete weights, got %q", mix)
+	}
+
+	weights := make([]int, len(parts))
+	total := 0
+	for i, p := range parts {
+		w, err := strconv.Atoi(p)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("--mix weights must be whole numbers, got %q", mix)
+		}
+		total += w
+		weights[i] = total
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("--mix needs at least one weight above 0, got %q", mix)
+	}
+
+	return weights, nil
+}
+
+func nextOp(r *rand.Rand, weights []int) common.Op {
+	n := r.Intn(weights[len(weights)-1])
+	for i, w := range weights {
+		if n < w {
+			return benchOps[i]
+		}
+	}
+	return benchOps[len(benchOps)-1]
+}
+
+func nextKey(r *rand.Rand) []byte {
+	return []byte("bench:" + strconv.Itoa(r.Intn(f.KeyCount)))
+}
+
+func nextValue(r *rand.Rand) []byte {
+	spread := f.ValueMax - f.ValueMin
+
+	var n int
+	switch f.ValueDist {
+	case "exp":
+		// Mostly small values with a long tail up to the max
+		n = f.ValueMin + int(r.ExpFloat64()*float64(spread)/4)
+		if n > f.ValueMax {
+			n = f.ValueMax
+		}
+	default:
+		n = f.ValueMin + r.Intn(spread+1)
+	}
+
+	return common.RandData(r, n, true)
+}
+
+// Sends n requests in batches the size of the pipeline depth. The latency of
+// each request is from when its batch started being sent to when its response
+// was read.
+func bench(pipe common.Pipeliner, conn net.Conn, n int, weights []int, results chan<- []sample, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer conn.Close()
+
+	r := rand.New(rand.NewSource(common.RandSeed()))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	samples := make([]sample, 0, n)
+	ops := make([]common.Op, f.Pipeline)
+
+	defer func() { results <- samples }()
+
+	for done := 0; done < n; {
+		batch := f.Pipeline
+		if n-done < batch {
+			batch = n - done
+		}
+
+		start := time.Now()
+
+		for i := 0; i < batch; i++ {
+			op := nextOp(r, weights)
+			ops[i] = op
+
+			var err error
+			switch op {
+			case common.Set:
+				err = pipe.SendSet(rw.Writer, nextKey(r), nextValue(r))
+			case common.Get:
+				err = pipe.SendGet(rw.Writer, nextKey(r))
+			case common.Delete:
+				err = pipe.SendDelete(rw.Writer, nextKey(r))
+			}
+
+			if err != nil {
+				fmt.Println("Error sending request:", err.Error())
+				return
+			}
+		}
+
+		if err := rw.Flush(); err != nil {
+			fmt.Println("Error sending requests:", err.Error())
+			return
+		}
+
+		for i := 0; i < batch; i++ {
+			err := pipe.Recv(rw.Reader, ops[i])
+			miss := isMiss(err)
+			if err != nil && !miss {
+				fmt.Printf("Error performing operation %s: %s\n", ops[i], err.Error())
+				return
+			}
+
+			samples = append(samples, sample{
+				d:    time.Since(start),
+				op:   ops[i],
+				miss: miss,
+			})
+		}
+
+		done += batch
+	}
+}
+
+func isMiss(err error) bool {
+	return err == common.ErrKeyNotFound || err == common.ErrItemNotStored
+}
+
+func report(results <-chan []sample, elapsed time.Duration) {
+	times := make(map[common.Op][]int)
+	misses := make(map[common.Op]int)
+	total := 0
+
+	for samples := range results {
+		for _, s := range samples {
+			times[s.op] = append(times[s.op], int(s.d.Nanoseconds()))
+			if s.miss {
+				misses[s.op]++
+			}
+		}
+		total += len(samples)
+	}
+
+	fmt.Printf("\nCompleted %d operations in %v\n", total, elapsed)
+	fmt.Printf("Throughput: %.0f ops/sec\n", float64(total)/elapsed.Seconds())
+
+	for _, op := range benchOps {
+		t := times[op]
+		if len(t) == 0 {
+			continue
+		}
+
+		sort.Ints(t)
+		s := stats.Get(t)
+
+		fmt.Println()
+		fmt.Printf("%s (n = %d, misses = %d)\n", op.String(), len(t), misses[op])
+		fmt.Printf("Min: %fms\n", s.Min)
+		fmt.Printf("Max: %fms\n", s.Max)
+		fmt.Printf("Avg: %fms\n", s.Avg)
+		fmt.Printf("p50: %fms\n", s.P50)
+		fmt.Printf("p75: %fms\n", s.P75)
+		fmt.Printf("p90: %fms\n", s.P90)
+		fmt.Printf("p95: %fms\n", s.P95)
+		fmt.Printf("p99: %fms\n", s.P99)
+	}
+}
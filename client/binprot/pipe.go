@@ -0,0 +1,52 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binprot
+
+import (
+	"bufio"
+	"encoding/binary"
+
+	"github.com/netflix/rend/client/common"
+)
+
+// Pipelined sets never expire so the keys stay around for later gets
+func (b BinProt) SendSet(w *bufio.Writer, key, value []byte) error {
+	bodylen := 8 + len(key) + len(value)
+	writeReq(w, Set, len(key), 8, bodylen, 0)
+	// Extras
+	binary.Write(w, binary.BigEndian, uint32(0))
+	binary.Write(w, binary.BigEndian, uint32(0))
+	// Body / data
+	w.Write(key)
+	_, err := w.Write(value)
+	return err
+}
+
+func (b BinProt) SendGet(w *bufio.Writer, key []byte) error {
+	writeReq(w, Get, len(key), 0, len(key), 0)
+	_, err := w.Write(key)
+	return err
+}
+
+func (b BinProt) SendDelete(w *bufio.Writer, key []byte) error {
+	writeReq(w, Delete, len(key), 0, len(key), 0)
+	_, err := w.Write(key)
+	return err
+}
+
+func (b BinProt) Recv(r *bufio.Reader, op common.Op) error {
+	_, err := consumeResponse(r)
+	return err
+}
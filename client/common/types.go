@@ -35,6 +35,18 @@ type Prot interface {
 	Touch(rw *bufio.ReadWriter, key []byte) error
 }
 
+// Pipeliner sends requests without waiting for their responses, so many can be
+// in flight on one connection. The responses are read back in the order the
+// requests were sent.
+type Pipeliner interface {
+	SendSet(w *bufio.Writer, key []byte, value []byte) error
+	SendGet(w *bufio.Writer, key []byte) error
+	SendDelete(w *bufio.Writer, key []byte) error
+	// Reads the response to one request of the given type. Misses return
+	// ErrKeyNotFound.
+	Recv(r *bufio.Reader, op Op) error
+}
+
 var (
 	ErrKeyNotFound   = errors.New("Key not found")
 	ErrKeyExists     = errors.New("Key exists")
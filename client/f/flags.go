@@ -31,6 +31,14 @@ var Port int
 var Pprof string
 var Host string
 
+// Used by bench.go
+var KeyCount int
+var ValueMin int
+var ValueMax int
+var ValueDist string
+var Mix string
+var Pipeline int
+
 // Flags
 func init() {
 	flag.BoolVar(&Binary, "binary", false, "Use the binary protocol. Cannot be combined with --text or -t.")
@@ -56,9 +64,18 @@ func init() {
 	flag.StringVar(&Host, "h", "localhost", "Hostname / IP to connect to.")
 	flag.StringVar(&Host, "host", "localhost", "Hostname / IP to connect to. (shorthand)")
 
+	flag.IntVar(&KeyCount, "key-count", 100000, "Number of distinct keys to use. Only used by bench.go.")
+	flag.IntVar(&ValueMin, "value-min", 1024, "Smallest value size in bytes. Only used by bench.go.")
+	flag.IntVar(&ValueMax, "value-max", 10240, "Largest value size in bytes. Only used by bench.go.")
+	flag.StringVar(&ValueDist, "value-dist", "uniform", "Distribution of value sizes between --value-min and --value-max, either uniform or exp. Only used by bench.go.")
+	flag.StringVar(&Mix, "mix", "10:85:5", "Relative weights of sets, gets, and deletes as set:get:delete. Only used by bench.go.")
+	flag.IntVar(&Pipeline, "pipeline", 1, "Number of requests each connection sends before reading the responses. Only used by bench.go.")
+
 	flag.Parse()
 
-	if (Binary && Text) || KeyLength <= 0 || NumOps <= 0 {
+	if (Binary && Text) || KeyLength <= 0 || NumOps <= 0 || KeyCount <= 0 ||
+		ValueMin < 0 || ValueMax < ValueMin || Pipeline <= 0 ||
+		(ValueDist != "uniform" && ValueDist != "exp") {
 		flag.Usage()
 		os.Exit(1)
 	}
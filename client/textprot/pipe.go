@@ -0,0 +1,97 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/netflix/rend/client/common"
+)
+
+func (t TextProt) SendSet(w *bufio.Writer, key, value []byte) error {
+	if _, err := fmt.Fprintf(w, "set %s 0 0 %v\r\n", key, len(value)); err != nil {
+		return err
+	}
+	w.Write(value)
+	_, err := w.WriteString("\r\n")
+	return err
+}
+
+func (t TextProt) SendGet(w *bufio.Writer, key []byte) error {
+	_, err := fmt.Fprintf(w, "get %s\r\n", key)
+	return err
+}
+
+func (t TextProt) SendDelete(w *bufio.Writer, key []byte) error {
+	_, err := fmt.Fprintf(w, "delete %s\r\n", key)
+	return err
+}
+
+func (t TextProt) Recv(r *bufio.Reader, op common.Op) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSpace(line)
+
+	switch op {
+	case common.Set:
+		switch line {
+		case "STORED":
+			return nil
+		case "NOT_STORED":
+			return common.ErrItemNotStored
+		}
+
+	case common.Delete:
+		switch line {
+		case "DELETED":
+			return nil
+		case "NOT_FOUND":
+			return common.ErrKeyNotFound
+		}
+
+	case common.Get:
+		if line == "END" {
+			return common.ErrKeyNotFound
+		}
+
+		// VALUE <key> <flags> <bytes>
+		parts := strings.Split(line, " ")
+		if len(parts) != 4 || parts[0] != "VALUE" {
+			break
+		}
+		n, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return err
+		}
+
+		// Skip the data and its \r\n, then read the END
+		if _, err := r.Discard(n + 2); err != nil {
+			return err
+		}
+		if line, err = r.ReadString('\n'); err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == "END" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unexpected response: %q", line)
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// conformance checks a running Rend, or any memcached, against the memcached
+// protocols. See the conformance package.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/conformance"
+)
+
+var (
+	addr     string
+	protocol string
+	timeout  time.Duration
+)
+
+func init() {
+	flag.StringVar(&addr, "addr", "localhost:11211", "The server to check, as a host:port or a unix socket path.")
+	flag.StringVar(&protocol, "protocol", "all", "The protocol to check. One of text, binary, or all.")
+	flag.DurationVar(&timeout, "timeout", time.Second, "How long to wait for each response.")
+}
+
+func main() {
+	flag.Parse()
+
+	var cases []conformance.Case
+	switch protocol {
+	case "text":
+		cases = conformance.TextCases
+	case "binary":
+		cases = conformance.BinaryCases
+	case "all":
+		cases = append(append(cases, conformance.TextCases...), conformance.BinaryCases...)
+	default:
+		log.Fatalf("Unknown protocol %s. Must be one of text, binary, or all.\n", protocol)
+	}
+
+	network := "unix"
+	if strings.Contains(addr, ":") {
+		network = "tcp"
+	}
+	dial := func() (net.Conn, error) { return net.Dial(network, addr) }
+
+	devs := conformance.Run(dial, cases, timeout)
+
+	var unknown int
+	for _, d := range devs {
+		fmt.Println(d)
+		if d.Case.Known == "" {
+			unknown++
+		}
+	}
+	fmt.Printf("%d of %d cases deviate from memcached, %d of them not known\n", len(devs), len(cases), unknown)
+
+	// Known deviations are expected of Rend, so only the rest are a failure
+	if unknown > 0 {
+		os.Exit(1)
+	}
+}
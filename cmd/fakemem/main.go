@@ -0,0 +1,60 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// fakemem runs a minimal in-memory memcached server for local development and
+// benchmarks. See the fakemem package.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/netflix/rend/fakemem"
+)
+
+var (
+	port     int
+	sockPath string
+	discard  bool
+)
+
+func init() {
+	flag.IntVar(&port, "p", 11211, "TCP port to listen on. Ignored if --sock-path is set.")
+	flag.StringVar(&sockPath, "sock-path", "", "Unix domain socket path to listen on instead of a TCP port.")
+	flag.BoolVar(&discard, "discard", false, "Keep nothing. Every store succeeds and every read misses.")
+}
+
+func main() {
+	flag.Parse()
+
+	var l net.Listener
+	var err error
+
+	if sockPath != "" {
+		if err := os.Remove(sockPath); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Error removing previous unix socket file at %s: %s\n", sockPath, err.Error())
+		}
+		l, err = net.Listen("unix", sockPath)
+	} else {
+		l, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+	if err != nil {
+		log.Fatalln("Error listening:", err.Error())
+	}
+
+	log.Fatalln(fakemem.New(discard).Serve(l))
+}
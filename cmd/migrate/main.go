@@ -0,0 +1,123 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// migrate converts a list of keys in one memcached between plain values and
+// the chunked layout Rend uses with --chunked, to move a dataset into or out
+// of the proxy. See the warmer package, which does the copying.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/warmer"
+)
+
+var (
+	addr        string
+	to          string
+	keyFile     string
+	rate        int
+	batch       int
+	exptime     uint
+	preserveTTL bool
+	keepSource  bool
+)
+
+func init() {
+	flag.StringVar(&addr, "addr", "", "The memcached to convert keys in, as a host:port or a unix socket path.")
+	flag.StringVar(&to, "to", "chunked", "The layout to convert keys to: chunked to read plain values and write them in chunks, or plain for the reverse.")
+	flag.StringVar(&keyFile, "keys", "-", "The file of keys to convert, one per line. Standard input if -.")
+	flag.IntVar(&rate, "rate", 1000, "The most keys read per second. No limit if 0.")
+	flag.IntVar(&batch, "batch", 10, "The number of keys read in each get.")
+	flag.UintVar(&exptime, "exptime", 0, "The expiration time given to every value written. Ignored if --preserve-ttl is set.")
+	flag.BoolVar(&preserveTTL, "preserve-ttl", false, "Read plain values with the GetE extension and keep the expiration time memcached reports. Only with --to chunked.")
+	flag.BoolVar(&keepSource, "keep-source", false, "Leave each key in its old layout after writing the new one instead of deleting it.")
+}
+
+func main() {
+	flag.Parse()
+
+	if addr == "" {
+		log.Fatalln("--addr must be set")
+	}
+	if to != "chunked" && to != "plain" {
+		log.Fatalf("Unknown layout %q for --to, expected chunked or plain\n", to)
+	}
+	if preserveTTL && to == "plain" {
+		log.Fatalln("--preserve-ttl can't be used with --to plain, since chunked values can't be read with GetE")
+	}
+	if rate < 0 || batch < 1 {
+		log.Fatalln("--rate must be at least 0 and --batch at least 1")
+	}
+
+	var r io.Reader = os.Stdin
+	if keyFile != "-" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			log.Fatalf("Error opening key file %s: %s\n", keyFile, err.Error())
+		}
+		defer f.Close()
+		r = f
+	}
+
+	// The plain and chunked layouts use different keys, so both sides can be
+	// the same memcached
+	src := connect(addr, to == "plain")
+	defer src.Close()
+	dst := connect(addr, to == "chunked")
+	defer dst.Close()
+
+	start := time.Now()
+
+	res, err := warmer.Warm(r, src, dst, warmer.Config{
+		Rate:        rate,
+		Batch:       batch,
+		Exptime:     uint32(exptime),
+		PreserveTTL: preserveTTL,
+		Move:        !keepSource,
+	})
+
+	log.Printf("Converted %d of %d keys to %s in %s: %d hits, %d misses, %d skipped, %d deleted, %d errors\n",
+		res.Written, res.Keys, to, time.Since(start), res.Hits, res.Misses, res.Skipped, res.Deleted, res.Errors)
+
+	if err != nil {
+		log.Fatalln("Error converting keys:", err.Error())
+	}
+}
+
+func connect(addr string, isChunked bool) handlers.Handler {
+	network := "unix"
+	if strings.Contains(addr, ":") {
+		network = "tcp"
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		log.Fatalf("Error connecting to %s: %s\n", addr, err.Error())
+	}
+
+	if isChunked {
+		return chunked.NewHandler(conn)
+	}
+	return std.NewHandler(conn)
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// replay sends traffic captured by Rend with --capture-file to a proxy or
+// memcached. See the capture package.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/capture"
+)
+
+var (
+	file   string
+	target string
+	speed  float64
+)
+
+func init() {
+	flag.StringVar(&file, "file", "", "The capture to replay.")
+	flag.StringVar(&target, "target", "localhost:11211", "The server to replay to, as a host:port or a unix socket path.")
+	flag.Float64Var(&speed, "speed", 1, "How many times faster than it was captured to replay the traffic. As fast as possible if 0.")
+}
+
+func main() {
+	flag.Parse()
+
+	if file == "" {
+		log.Fatalln("--file must be set")
+	}
+	if speed < 0 {
+		log.Fatalln("--speed must be at least 0")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Error opening capture %s: %s\n", file, err.Error())
+	}
+	defer f.Close()
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		log.Fatalf("Error reading capture %s: %s\n", file, err.Error())
+	}
+
+	network := "unix"
+	if strings.Contains(target, ":") {
+		network = "tcp"
+	}
+	dial := func() (net.Conn, error) { return net.Dial(network, target) }
+
+	start := time.Now()
+
+	res, err := capture.Replay(r, dial, speed)
+
+	log.Printf("Replayed %d records on %d connections in %s: %d bytes sent, %d received, %d errors\n",
+		res.Records, res.Conns, time.Since(start), res.Sent, res.Received, res.Errors)
+
+	if err != nil {
+		log.Fatalln("Error replaying capture:", err.Error())
+	}
+}
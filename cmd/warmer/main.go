@@ -0,0 +1,115 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// warmer copies a list of keys from one memcached pool to another before a
+// cutover. See the warmer package.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/warmer"
+)
+
+var (
+	src         string
+	dst         string
+	srcChunked  bool
+	dstChunked  bool
+	keyFile     string
+	rate        int
+	batch       int
+	exptime     uint
+	preserveTTL bool
+)
+
+func init() {
+	flag.StringVar(&src, "src", "", "The memcached to read keys from, as a host:port or a unix socket path.")
+	flag.StringVar(&dst, "dst", "", "The memcached to write keys to, as a host:port or a unix socket path.")
+	flag.BoolVar(&srcChunked, "src-chunked", false, "Read items the source stored in chunks by Rend.")
+	flag.BoolVar(&dstChunked, "dst-chunked", false, "Write items to the destination in chunks, like Rend run with --chunked.")
+	flag.StringVar(&keyFile, "keys", "-", "The file of keys to copy, one per line. Standard input if -.")
+	flag.IntVar(&rate, "rate", 1000, "The most keys read per second. No limit if 0.")
+	flag.IntVar(&batch, "batch", 10, "The number of keys read from the source in each get.")
+	flag.UintVar(&exptime, "exptime", 0, "The expiration time given to every item written. Ignored if --preserve-ttl is set.")
+	flag.BoolVar(&preserveTTL, "preserve-ttl", false, "Read keys with the GetE extension and keep the expiration time the source reports.")
+}
+
+func main() {
+	flag.Parse()
+
+	if src == "" || dst == "" {
+		log.Fatalln("Both --src and --dst must be set")
+	}
+	if rate < 0 || batch < 1 {
+		log.Fatalln("--rate must be at least 0 and --batch at least 1")
+	}
+
+	var r io.Reader = os.Stdin
+	if keyFile != "-" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			log.Fatalf("Error opening key file %s: %s\n", keyFile, err.Error())
+		}
+		defer f.Close()
+		r = f
+	}
+
+	srcHandler := connect(src, srcChunked)
+	defer srcHandler.Close()
+	dstHandler := connect(dst, dstChunked)
+	defer dstHandler.Close()
+
+	start := time.Now()
+
+	res, err := warmer.Warm(r, srcHandler, dstHandler, warmer.Config{
+		Rate:        rate,
+		Batch:       batch,
+		Exptime:     uint32(exptime),
+		PreserveTTL: preserveTTL,
+	})
+
+	log.Printf("Copied %d of %d keys in %s: %d hits, %d misses, %d skipped, %d errors\n",
+		res.Written, res.Keys, time.Since(start), res.Hits, res.Misses, res.Skipped, res.Errors)
+
+	if err != nil {
+		log.Fatalln("Error copying keys:", err.Error())
+	}
+}
+
+func connect(addr string, isChunked bool) handlers.Handler {
+	network := "unix"
+	if strings.Contains(addr, ":") {
+		network = "tcp"
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		log.Fatalf("Error connecting to %s: %s\n", addr, err.Error())
+	}
+
+	if isChunked {
+		return chunked.NewHandler(conn)
+	}
+	return std.NewHandler(conn)
+}
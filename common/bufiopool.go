@@ -0,0 +1,89 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// DefaultBufioSize is the size of the buffered readers and writers for client
+// and backend connections unless it's changed with SetBufioSizes. It's the same
+// as the bufio package default.
+const DefaultBufioSize = 4096
+
+// BufioPool reuses the buffered readers and writers of closed connections for
+// new ones. Every reader and writer from a pool has the same buffer size.
+type BufioPool struct {
+	size    int
+	readers sync.Pool
+	writers sync.Pool
+}
+
+func NewBufioPool(size int) *BufioPool {
+	return &BufioPool{size: size}
+}
+
+// Size returns the buffer size of the pool's readers and writers.
+func (p *BufioPool) Size() int {
+	return p.size
+}
+
+// GetReader returns a buffered reader that reads from r.
+func (p *BufioPool) GetReader(r io.Reader) *bufio.Reader {
+	if br, ok := p.readers.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, p.size)
+}
+
+// PutReader gives a reader back once its connection is closed. Anything still
+// buffered is dropped.
+func (p *BufioPool) PutReader(br *bufio.Reader) {
+	br.Reset(nil)
+	p.readers.Put(br)
+}
+
+// GetWriter returns a buffered writer that writes to w.
+func (p *BufioPool) GetWriter(w io.Writer) *bufio.Writer {
+	if bw, ok := p.writers.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, p.size)
+}
+
+// PutWriter gives a writer back once its connection is closed. Anything still
+// buffered is dropped.
+func (p *BufioPool) PutWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	p.writers.Put(bw)
+}
+
+// The pools for the connections from clients and the connections to the
+// backends.
+var (
+	ClientBufio  = NewBufioPool(DefaultBufioSize)
+	BackendBufio = NewBufioPool(DefaultBufioSize)
+)
+
+// SetBufioSizes sets the buffer sizes for client and backend connections. It
+// has to be called before any connections are made.
+func SetBufioSizes(client, backend int) {
+	ClientBufio = NewBufioPool(client)
+	BackendBufio = NewBufioPool(backend)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sync"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// Buffers are pooled in power of two size classes from 64 bytes to 2 MB, which
+// covers the largest values memcached accepts by default. Larger buffers are
+// allocated normally and dropped when put back.
+const (
+	minBufClass = 6
+	maxBufClass = 21
+)
+
+var bufPools [maxBufClass + 1]sync.Pool
+
+var (
+	MetricBufPoolHits     = metrics.AddCounter("buf_pool_hits", nil)
+	MetricBufPoolMisses   = metrics.AddCounter("buf_pool_misses", nil)
+	MetricBufPoolOversize = metrics.AddCounter("buf_pool_oversize", nil)
+)
+
+func init() {
+	metrics.Describe("buf_pool_hits", metrics.UnitCount, "Buffers reused from the value and chunk buffer pools")
+	metrics.Describe("buf_pool_misses", metrics.UnitCount, "Buffers allocated because the pool for their size was empty")
+	metrics.Describe("buf_pool_oversize", metrics.UnitCount, "Buffers allocated because they were too big to pool")
+}
+
+// Returns the size class that holds buffers of length n
+func bufClass(n int) uint {
+	c := uint(minBufClass)
+	for 1<<c < n {
+		c++
+	}
+	return c
+}
+
+// GetBuf returns a buffer of length n from the pool for its size class. Its
+// contents are undefined. Buffers should be given back with PutBuf once
+// nothing refers to them any more.
+func GetBuf(n int) []byte {
+	c := bufClass(n)
+	if c > maxBufClass {
+		metrics.IncCounter(MetricBufPoolOversize)
+		return make([]byte, n)
+	}
+
+	if b := bufPools[c].Get(); b != nil {
+		metrics.IncCounter(MetricBufPoolHits)
+		return b.([]byte)[:n]
+	}
+
+	metrics.IncCounter(MetricBufPoolMisses)
+	return make([]byte, n, 1<<c)
+}
+
+// PutBuf gives a buffer from GetBuf back to its pool. Buffers whose capacity
+// isn't one of the size classes are ignored.
+func PutBuf(b []byte) {
+	c := bufClass(cap(b))
+	if c > maxBufClass || cap(b) != 1<<c {
+		return
+	}
+	bufPools[c].Put(b[:0])
+}
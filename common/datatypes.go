@@ -22,28 +22,47 @@ package common
 
 import (
 	"errors"
+	"time"
 
 	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/tracing"
 )
 
-const VersionString = "Rend 0.1"
+// Build information. GitSHA and BuildDate are meant to be filled in at link time, e.g.:
+//
+//	go build -ldflags "-X github.com/netflix/rend/common.GitSHA=$(git rev-parse --short HEAD)
+//	    -X github.com/netflix/rend/common.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// These are variables instead of constants because the linker can only set string variables.
+var (
+	Version   = "0.1"
+	GitSHA    = "unknown"
+	BuildDate = "unknown"
+)
+
+// VersionString is the full version sent in response to a version command.
+var VersionString = "Rend " + Version + " (" + GitSHA + " " + BuildDate + ")"
 
 // Common metrics used across packages
 var (
-	MetricBytesReadRemote     = metrics.AddCounter("bytes_read_remote")
-	MetricBytesReadLocal      = metrics.AddCounter("bytes_read_local")
-	MetricBytesReadLocalL1    = metrics.AddCounter("bytes_read_local_l1")
-	MetricBytesReadLocalL2    = metrics.AddCounter("bytes_read_local_l2")
-	MetricBytesWrittenRemote  = metrics.AddCounter("bytes_written_remote")
-	MetricBytesWrittenLocal   = metrics.AddCounter("bytes_written_local")
-	MetricBytesWrittenLocalL1 = metrics.AddCounter("bytes_written_local_l1")
-	MetricBytesWrittenLocalL2 = metrics.AddCounter("bytes_written_local_l2")
+	MetricBytesReadRemote     = metrics.AddCounter("bytes_read_remote", nil)
+	MetricBytesReadLocal      = metrics.AddCounter("bytes_read_local", nil)
+	MetricBytesReadLocalL1    = metrics.AddCounter("bytes_read_local_l1", nil)
+	MetricBytesReadLocalL2    = metrics.AddCounter("bytes_read_local_l2", nil)
+	MetricBytesWrittenRemote  = metrics.AddCounter("bytes_written_remote", nil)
+	MetricBytesWrittenLocal   = metrics.AddCounter("bytes_written_local", nil)
+	MetricBytesWrittenLocalL1 = metrics.AddCounter("bytes_written_local_l1", nil)
+	MetricBytesWrittenLocalL2 = metrics.AddCounter("bytes_written_local_l2", nil)
 
 	// Errors used across the application
 	ErrBadRequest = errors.New("CLIENT_ERROR bad request")
 	ErrBadLength  = errors.New("CLIENT_ERROR length is not a valid integer")
 	ErrBadFlags   = errors.New("CLIENT_ERROR flags is not a valid integer")
 	ErrBadExptime = errors.New("CLIENT_ERROR exptime is not a valid integer")
+	// The data block of a command wasn't the length the command line said
+	ErrBadDataChunk = errors.New("CLIENT_ERROR bad data chunk")
+	// A get had more keys than the proxy allows
+	ErrTooManyKeys = errors.New("CLIENT_ERROR too many keys")
 
 	ErrNoError        = errors.New("Success")
 	ErrKeyNotFound    = errors.New("ERROR Key not found")
@@ -59,6 +78,12 @@ var (
 	ErrInternal       = errors.New("ERROR Internal error")
 	ErrBusy           = errors.New("ERROR Busy")
 	ErrTempFailure    = errors.New("ERROR Temporary error")
+	// A backend couldn't be reached. Only returned when listeners are set to
+	// keep client connections open while backends are down.
+	ErrUnavailable = errors.New("SERVER_ERROR backend unavailable")
+	// A request ran past its deadline and the work left for it was abandoned.
+	// Only returned when listeners have a latency budget.
+	ErrBudgetExceeded = errors.New("SERVER_ERROR latency budget exceeded")
 )
 
 // IsAppError differentiates between protocol-defined errors that are relatively benign and other
@@ -78,7 +103,9 @@ func IsAppError(err error) bool {
 		err == ErrNotSupported ||
 		err == ErrInternal ||
 		err == ErrBusy ||
-		err == ErrTempFailure
+		err == ErrTempFailure ||
+		err == ErrUnavailable ||
+		err == ErrBudgetExceeded
 }
 
 // RequestType is the protocol-agnostic identifier for the command
@@ -131,8 +158,40 @@ const (
 
 	// RequestVersion replies with a string designating the current software version
 	RequestVersion
+
+	// RequestStats replies with a set of name / value pairs describing the running proxy
+	RequestStats
+
+	// RequestLeaseGet is a single key get that hands out a lease to fill the key on a miss. Only
+	// one client holds a lease for a key at a time, and the others get a hot miss until it's
+	// filled. Uses a GetRequest.
+	RequestLeaseGet
+
+	// RequestLeaseSet is a set that is only stored if the lease token it carries is still valid.
+	// Uses a SetRequest.
+	RequestLeaseSet
+
+	// RequestLruCrawler is memcached's lru_crawler command, passed through to L1 so tools that
+	// list the keys in the cache keep working behind the proxy. Text protocol only.
+	RequestLruCrawler
 )
 
+// IsIdempotent returns whether running a request of the type more than once has the same effect
+// as running it once, so it's safe to retry, hedge, or send to another backend after a failure
+// that leaves it unknown whether the first attempt was applied. Gets change nothing, and a touch
+// or GAT sets the same expiration time each time. Every other write has side effects: a set run
+// again can undo a newer write that landed between the attempts, and an add, append, or delete
+// depends on what the first attempt left behind. Lease gets hand out a new lease each time.
+// Commands that never reach a backend are treated as not idempotent, since nothing should retry
+// them.
+func IsIdempotent(reqType RequestType) bool {
+	switch reqType {
+	case RequestGet, RequestGetE, RequestGat, RequestTouch:
+		return true
+	}
+	return false
+}
+
 // RequestParser represents an interface to parse incoming requests. Each protocol provides its own
 // implementation. The return value is an interface{}, but not all hope is lost. The return result
 // is guaranteed by implementations to be castable to the type that matches the RequestType returned.
@@ -159,14 +218,34 @@ type Responder interface {
 	Noop(opaque uint32) error
 	Quit(opaque uint32, quiet bool) error
 	Version(opaque uint32) error
+	Stats(opaque uint32, stats []Stat) error
+	// StatsReset acknowledges a stats reset.
+	StatsReset(opaque uint32) error
+	// Line sends on a line of a response read from a backend, like the keys listed by
+	// lru_crawler, without its line ending. The lines are only sure to be sent once the last one
+	// is.
+	Line(line []byte, last bool) error
 	Error(opaque uint32, reqType RequestType, err error, quiet bool) error
 }
 
+// LeaseResponder is implemented by the responders for protocols that support
+// leases. On a lease get miss, the client is either given a lease token to fill
+// the key with or told that another client is already filling it.
+type LeaseResponder interface {
+	Lease(key []byte, token uint64) error
+	HotMiss(key []byte) error
+}
+
 type Request interface {
 	GetOpaque() uint32
 	IsQuiet() bool
 }
 
+// ExptimeExpired is the exptime negative exptimes from clients are turned into.
+// Like in memcached, it's a unix time long past, so values stored or touched
+// with it expire right away.
+const ExptimeExpired = 60*60*24*30 + 1
+
 // SetRequest corresponds to common.RequestSet. It contains all the information required to fulfill
 // a set request.
 type SetRequest struct {
@@ -176,6 +255,14 @@ type SetRequest struct {
 	Exptime uint32
 	Opaque  uint32
 	Quiet   bool
+	// The lease token given out by a lease get, only for lease sets
+	LeaseToken uint64
+	// Span traces the request to the backends. It is nil if the request is
+	// not traced.
+	Span *tracing.Span
+	// Deadline is when the proxy gives up on the request and abandons the
+	// work left for it at the backends. It is zero if there's no budget.
+	Deadline time.Time
 }
 
 func (r SetRequest) GetOpaque() uint32 {
@@ -195,13 +282,21 @@ type GetRequest struct {
 	Quiet      []bool
 	NoopOpaque uint32
 	NoopEnd    bool
+	// Span traces the request to the backends. It is nil if the request is
+	// not traced.
+	Span *tracing.Span
+	// Deadline is when the proxy gives up on the request and abandons the
+	// work left for it at the backends. It is zero if there's no budget.
+	Deadline time.Time
 }
 
+// GetOpaque returns the opaque of whatever ends the batch, either the noop or
+// the last get, so an error for the whole batch ends it for the client.
 func (r GetRequest) GetOpaque() uint32 {
-	// TODO: better implementation?
-	// It's nonsensical but the best way to react in this case since it's a bad situation already.
-	// Typically if this method was needed we're already in a fatal error sitation.
-	return 0
+	if r.NoopEnd || len(r.Opaques) == 0 {
+		return r.NoopOpaque
+	}
+	return r.Opaques[len(r.Opaques)-1]
 }
 
 func (r GetRequest) IsQuiet() bool {
@@ -214,6 +309,12 @@ type DeleteRequest struct {
 	Key    []byte
 	Opaque uint32
 	Quiet  bool
+	// Span traces the request to the backends. It is nil if the request is
+	// not traced.
+	Span *tracing.Span
+	// Deadline is when the proxy gives up on the request and abandons the
+	// work left for it at the backends. It is zero if there's no budget.
+	Deadline time.Time
 }
 
 func (r DeleteRequest) GetOpaque() uint32 {
@@ -231,6 +332,12 @@ type TouchRequest struct {
 	Exptime uint32
 	Opaque  uint32
 	Quiet   bool
+	// Span traces the request to the backends. It is nil if the request is
+	// not traced.
+	Span *tracing.Span
+	// Deadline is when the proxy gives up on the request and abandons the
+	// work left for it at the backends. It is zero if there's no budget.
+	Deadline time.Time
 }
 
 func (r TouchRequest) GetOpaque() uint32 {
@@ -248,6 +355,12 @@ type GATRequest struct {
 	Exptime uint32
 	Opaque  uint32
 	Quiet   bool
+	// Span traces the request to the backends. It is nil if the request is
+	// not traced.
+	Span *tracing.Span
+	// Deadline is when the proxy gives up on the request and abandons the
+	// work left for it at the backends. It is zero if there's no budget.
+	Deadline time.Time
 }
 
 func (r GATRequest) GetOpaque() uint32 {
@@ -301,6 +414,47 @@ func (r VersionRequest) IsQuiet() bool {
 	return false
 }
 
+// StatsRequest corresponds to common.RequestStats. It contains all the information required to
+// fulfill a stats request.
+type StatsRequest struct {
+	// Group names the set of stats to return, e.g. "hotkeys". Empty is the
+	// general stats.
+	Group string
+	// Args are any words after the group, for groups that take arguments
+	Args   []string
+	Opaque uint32
+}
+
+func (r StatsRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r StatsRequest) IsQuiet() bool {
+	return false
+}
+
+// LruCrawlerRequest corresponds to common.RequestLruCrawler.
+type LruCrawlerRequest struct {
+	// Args are the words after lru_crawler, e.g. "metadump all"
+	Args   []string
+	Opaque uint32
+}
+
+func (r LruCrawlerRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r LruCrawlerRequest) IsQuiet() bool {
+	return false
+}
+
+// Stat is a single name / value pair sent in response to a stats request. Values are strings
+// because that is how they are sent over the wire in both protocols.
+type Stat struct {
+	Name  string
+	Value string
+}
+
 // GetResponse is used in both RequestGet and RequestGat handling. Both respond in the same manner
 // but with different opcodes. It is binary-protocol specific, but is still a part of the interface
 // of responder to make the handling code more protocol-agnostic.
@@ -0,0 +1,152 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The number of bits the chunk format version takes up
+const FlagVersionBits = 4
+
+// FlagBits says which bits of the 32 bit flags stored with each value the proxy
+// reserves for its own features. Bits are numbered from 0, the lowest. Every
+// other bit belongs to clients and is passed through untouched, and clients
+// can't store values with a reserved bit set, so a value the proxy changed can
+// always be told apart from one it didn't. Nothing is reserved unless a
+// deployment opts in, since clients that already use the bits would otherwise
+// have their stores refused.
+type FlagBits struct {
+	// Reserves nothing when false, for clients that use every bit
+	Enabled bool
+	// Set on values the proxy compressed
+	Compressed uint
+	// Set on values the proxy encrypted
+	Encrypted uint
+	// The lowest of the FlagVersionBits bits holding the format version of a
+	// chunked value, set on the flags of its metadata in the backend
+	Version uint
+}
+
+// DefaultFlagBits are the bits reserved once a deployment opts in, for the
+// features it doesn't name a bit for. They're the top 6 bits, which memcached
+// clients rarely use: 31 for compressed, 30 for encrypted, and 26 to 29 for
+// the chunk format version.
+var DefaultFlagBits = FlagBits{
+	Enabled:    true,
+	Compressed: 31,
+	Encrypted:  30,
+	Version:    26,
+}
+
+// Nothing is reserved by default
+var flagBits FlagBits
+
+// ParseFlagBits parses the reserved bits as a comma separated list of
+// name=bit for compressed, encrypted, and version, e.g.
+// "compressed=7,encrypted=6,version=2". Bits that aren't named are taken from
+// DefaultFlagBits, and "default" reserves those. "none" reserves nothing.
+func ParseFlagBits(s string) (FlagBits, error) {
+	switch s {
+	case "none":
+		return FlagBits{}, nil
+	case "default":
+		return DefaultFlagBits, nil
+	}
+
+	b := DefaultFlagBits
+	for _, field := range strings.Split(s, ",") {
+		parts := strings.Split(field, "=")
+		if len(parts) != 2 {
+			return FlagBits{}, fmt.Errorf("expected name=bit, got %q", field)
+		}
+
+		bit, err := strconv.ParseUint(parts[1], 10, 8)
+		if err != nil || bit > 31 {
+			return FlagBits{}, fmt.Errorf("bad bit %q, expected 0 to 31", parts[1])
+		}
+
+		switch parts[0] {
+		case "compressed":
+			b.Compressed = uint(bit)
+		case "encrypted":
+			b.Encrypted = uint(bit)
+		case "version":
+			if bit+FlagVersionBits > 32 {
+				return FlagBits{}, fmt.Errorf("version bits start at %d, so they don't fit in 32 bits", bit)
+			}
+			b.Version = uint(bit)
+		default:
+			return FlagBits{}, fmt.Errorf("unknown reserved bit %q, expected compressed, encrypted, or version", parts[0])
+		}
+	}
+
+	if b.Compressed == b.Encrypted ||
+		b.versionMask()&(1<<b.Compressed) != 0 ||
+		b.versionMask()&(1<<b.Encrypted) != 0 {
+		return FlagBits{}, fmt.Errorf("reserved bits overlap")
+	}
+
+	return b, nil
+}
+
+// SetFlagBits sets the bits the proxy reserves. It must be called before any
+// connections are accepted.
+func SetFlagBits(b FlagBits) {
+	flagBits = b
+}
+
+// GetFlagBits returns the bits the proxy reserves.
+func GetFlagBits() FlagBits {
+	return flagBits
+}
+
+func (b FlagBits) versionMask() uint32 {
+	return (1<<FlagVersionBits - 1) << b.Version
+}
+
+// Mask has every reserved bit set.
+func (b FlagBits) Mask() uint32 {
+	if !b.Enabled {
+		return 0
+	}
+	return 1<<b.Compressed | 1<<b.Encrypted | b.versionMask()
+}
+
+// ReservedFlags is true if the flags have any reserved bit set.
+func ReservedFlags(flags uint32) bool {
+	return flags&flagBits.Mask() != 0
+}
+
+// WithFlagVersion returns the flags with the chunk format version set in its
+// reserved bits. The flags are returned as is if nothing is reserved.
+func WithFlagVersion(flags, version uint32) uint32 {
+	if !flagBits.Enabled {
+		return flags
+	}
+	mask := flagBits.versionMask()
+	return flags&^mask | version<<flagBits.Version&mask
+}
+
+// FlagVersion returns the chunk format version in the flags, which is 0 if
+// nothing is reserved.
+func FlagVersion(flags uint32) uint32 {
+	if !flagBits.Enabled {
+		return 0
+	}
+	return flags & flagBits.versionMask() >> flagBits.Version
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
+// KeyRedaction is how keys are hidden wherever they leave the proxy other than
+// in responses, e.g. hot key stats, for deployments where keys hold user
+// identifiers.
+type KeyRedaction int
+
+const (
+	// Keys are shown as they are.
+	RedactNone KeyRedaction = iota
+	// Keys are shown as the hex FNV-1a hash of the key, the same hash the
+	// miss stream uses, so the two can be matched up.
+	RedactHash
+	// Keys are cut to their first RedactedKeyLength bytes, which usually
+	// keeps a namespace prefix but not an identifier after it.
+	RedactTruncate
+)
+
+// The bytes of a key kept by RedactTruncate
+const RedactedKeyLength = 8
+
+var keyRedaction = RedactNone
+
+// ParseKeyRedaction returns the redaction named "none", "hash", or "truncate".
+func ParseKeyRedaction(s string) (KeyRedaction, error) {
+	switch s {
+	case "none":
+		return RedactNone, nil
+	case "hash":
+		return RedactHash, nil
+	case "truncate":
+		return RedactTruncate, nil
+	}
+	return RedactNone, fmt.Errorf("unknown key redaction %q, expected none, hash, or truncate", s)
+}
+
+// SetKeyRedaction sets how keys are redacted. It must be called before any
+// connections are accepted.
+func SetKeyRedaction(r KeyRedaction) {
+	keyRedaction = r
+}
+
+// RedactKey returns the key as it may be shown outside the proxy. The key is
+// returned as is if keys aren't redacted.
+func RedactKey(key []byte) []byte {
+	switch keyRedaction {
+	case RedactHash:
+		h := fnv.New64a()
+		h.Write(key)
+		return strconv.AppendUint(make([]byte, 0, 16), h.Sum64(), 16)
+	case RedactTruncate:
+		if len(key) > RedactedKeyLength {
+			return key[:RedactedKeyLength]
+		}
+	}
+	return key
+}
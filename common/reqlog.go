@@ -0,0 +1,74 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"log"
+	"strconv"
+	"sync/atomic"
+)
+
+var lastConnID uint64
+
+// RequestLog writes log lines prefixed with the ID of the request being handled
+// on a connection, so the lines from many concurrent connections can be told
+// apart. The ID is the number of the connection and the number of the request
+// on that connection, e.g. "12.345". There is one RequestLog per connection and
+// it is only used by the goroutine handling that connection.
+//
+// A nil RequestLog logs lines without an ID.
+type RequestLog struct {
+	conn uint64
+	seq  uint64
+}
+
+// NewRequestLog returns a RequestLog for a new connection.
+func NewRequestLog() *RequestLog {
+	return &RequestLog{
+		conn: atomic.AddUint64(&lastConnID, 1),
+	}
+}
+
+// Next moves on to the next request on the connection. Parsers call it as they
+// start reading each request.
+func (r *RequestLog) Next() {
+	if r != nil {
+		r.seq++
+	}
+}
+
+// ID returns the ID of the current request.
+func (r *RequestLog) ID() string {
+	if r == nil {
+		return ""
+	}
+	return strconv.FormatUint(r.conn, 10) + "." + strconv.FormatUint(r.seq, 10)
+}
+
+func (r *RequestLog) Println(v ...interface{}) {
+	if r == nil {
+		log.Println(v...)
+		return
+	}
+	log.Println(append([]interface{}{"[" + r.ID() + "]"}, v...)...)
+}
+
+func (r *RequestLog) Printf(format string, v ...interface{}) {
+	if r == nil {
+		log.Printf(format, v...)
+		return
+	}
+	log.Printf("["+r.ID()+"] "+format, v...)
+}
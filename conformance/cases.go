@@ -0,0 +1,433 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/netflix/rend/binprot"
+)
+
+// The longest key memcached accepts
+const maxKeyLength = 250
+
+// The number of quiet requests sent in a row by the storm cases
+const stormSize = 100
+
+func maxKey(key string) string {
+	return key + strings.Repeat("k", maxKeyLength-len(key))
+}
+
+// TextCases covers the memcached text protocol.
+var TextCases = []Case{
+	{
+		Name: "text set and get",
+		Build: func(k string) ([]byte, []byte) {
+			return text("set "+k+" 5 0 5", "hello", "get "+k),
+				text("STORED", "VALUE "+k+" 5 5", "hello", "END")
+		},
+	},
+	{
+		Name: "text zero length value",
+		Build: func(k string) ([]byte, []byte) {
+			return text("set "+k+" 0 0 0", "", "get "+k),
+				text("STORED", "VALUE "+k+" 0 0", "", "END")
+		},
+	},
+	{
+		Name: "text max length key",
+		Build: func(k string) ([]byte, []byte) {
+			k = maxKey(k)
+			return text("set "+k+" 0 0 1", "x", "get "+k),
+				text("STORED", "VALUE "+k+" 0 1", "x", "END")
+		},
+	},
+	{
+		Name:   "text key too long",
+		Known:  "Rend doesn't limit the length of keys",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			return text("get " + maxKey(k) + "k"),
+				text("CLIENT_ERROR")
+		},
+	},
+	{
+		Name: "text multiget with misses",
+		Build: func(k string) ([]byte, []byte) {
+			return text("set "+k+"a 0 0 1", "a", "set "+k+"c 0 0 1", "c", "get "+k+"a "+k+"b "+k+"c"),
+				text("STORED", "STORED", "VALUE "+k+"a 0 1", "a", "VALUE "+k+"c 0 1", "c", "END")
+		},
+	},
+	{
+		Name:   "text bad exptime",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			// The length is never parsed, so the data is read as a command
+			return text("set "+k+" 0 abc 1", "x"),
+				text("CLIENT_ERROR", "ERROR")
+		},
+	},
+	{
+		Name:   "text bad length",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			return text("set " + k + " 0 0 -1"),
+				text("CLIENT_ERROR")
+		},
+	},
+	{
+		Name: "text negative exptime",
+		Build: func(k string) ([]byte, []byte) {
+			// Negative times expire the item immediately
+			return text("set "+k+" 0 -1 1", "x", "get "+k),
+				text("STORED", "END")
+		},
+	},
+	{
+		Name:   "text data longer than length",
+		Known:  "Rend doesn't check the data ends with \\r\\n",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			// memcached reads "xy\r" as the data and the rest as an empty command
+			return text("set "+k+" 0 0 1", "xy"),
+				text("CLIENT_ERROR", "ERROR")
+		},
+	},
+	{
+		Name:  "text noreply storm",
+		Known: "Rend doesn't support noreply",
+		Build: func(k string) ([]byte, []byte) {
+			var lines []string
+			for i := 0; i < stormSize; i++ {
+				lines = append(lines, fmt.Sprintf("set %s%d 0 0 1 noreply", k, i), "x")
+			}
+			lines = append(lines, fmt.Sprintf("delete %s0 noreply", k), fmt.Sprintf("get %s0 %s%d", k, k, stormSize-1))
+			return text(lines...),
+				text(fmt.Sprintf("VALUE %s%d 0 1", k, stormSize-1), "x", "END")
+		},
+	},
+	{
+		Name: "text add existing",
+		Build: func(k string) ([]byte, []byte) {
+			return text("set "+k+" 0 0 1", "a", "add "+k+" 0 0 1", "b", "get "+k),
+				text("STORED", "NOT_STORED", "VALUE "+k+" 0 1", "a", "END")
+		},
+	},
+	{
+		Name:  "text replace missing",
+		Known: "Rend responds NOT_FOUND to a replace of a missing key",
+		Build: func(k string) ([]byte, []byte) {
+			return text("replace "+k+" 0 0 1", "a"),
+				text("NOT_STORED")
+		},
+	},
+	{
+		Name: "text append and prepend",
+		Build: func(k string) ([]byte, []byte) {
+			return text("set "+k+" 3 0 1", "b", "append "+k+" 0 0 1", "c", "prepend "+k+" 0 0 1", "a", "get "+k),
+				text("STORED", "STORED", "STORED", "VALUE "+k+" 3 3", "abc", "END")
+		},
+	},
+	{
+		Name: "text append missing",
+		Build: func(k string) ([]byte, []byte) {
+			return text("append "+k+" 0 0 1", "a"),
+				text("NOT_STORED")
+		},
+	},
+	{
+		Name: "text delete",
+		Build: func(k string) ([]byte, []byte) {
+			return text("set "+k+" 0 0 1", "a", "delete "+k, "delete "+k, "get "+k),
+				text("STORED", "DELETED", "NOT_FOUND", "END")
+		},
+	},
+	{
+		Name: "text touch",
+		Build: func(k string) ([]byte, []byte) {
+			return text("touch "+k+" 0", "set "+k+" 0 0 1", "a", "touch "+k+" 100"),
+				text("NOT_FOUND", "STORED", "TOUCHED")
+		},
+	},
+	{
+		Name:   "text touch bad exptime",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			return text("touch " + k + " abc"),
+				text("CLIENT_ERROR")
+		},
+	},
+	{
+		Name:   "text gets",
+		Known:  "Rend doesn't support CAS",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			// The CAS unique at the end of the VALUE line is up to the server
+			return text("set "+k+" 0 0 1", "a", "gets "+k),
+				text("STORED", "VALUE "+k+" 0 1 ", "a", "END")
+		},
+	},
+	{
+		Name:  "text gat",
+		Known: "Rend only supports gat in the binary protocol",
+		Build: func(k string) ([]byte, []byte) {
+			return text("set "+k+" 0 0 1", "a", "gat 100 "+k),
+				text("STORED", "VALUE "+k+" 0 1", "a", "END")
+		},
+	},
+	{
+		Name:   "text version",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			return text("version"),
+				text("VERSION ")
+		},
+	},
+	{
+		Name:   "text unknown command",
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			return text("bogus " + k),
+				text("ERROR")
+		},
+	},
+	{
+		Name: "meta set and get",
+		Build: func(k string) ([]byte, []byte) {
+			return text("ms "+k+" 5 F3 T0", "hello", "mg "+k+" v f", "mg "+k+" s"),
+				text("HD", "VA 5 f3", "hello", "HD s5")
+		},
+	},
+	{
+		Name: "meta opaque and key",
+		Build: func(k string) ([]byte, []byte) {
+			return text("ms "+k+" 1 Oa1", "x", "mg "+k+" v k Oa2", "md "+k+" Oa3 k"),
+				text("HD Oa1", "VA 1 k"+k+" Oa2", "x", "HD Oa3 k"+k)
+		},
+	},
+	{
+		Name: "meta quiet pipeline",
+		Build: func(k string) ([]byte, []byte) {
+			return text("mg "+k+" v q", "ms "+k+" 1 q", "x", "mg "+k+" v q", "md "+k+" q", "md "+k+" q", "mn"),
+				text("VA 1", "x", "MN")
+		},
+	},
+	{
+		Name: "meta misses",
+		Build: func(k string) ([]byte, []byte) {
+			return text("mg "+k+" v", "md "+k, "ms "+k+" 1 MR", "x"),
+				text("EN", "NF", "NS")
+		},
+	},
+}
+
+// BinaryCases covers the memcached binary protocol.
+var BinaryCases = []Case{
+	{
+		Name:   "binary set and get",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			key := []byte(k)
+			return cat(
+					req(binprot.OpcodeSet, 1, uint32s(5, 0), key, []byte("hello")),
+					req(binprot.OpcodeGet, 2, nil, key, nil),
+				), cat(
+					res(binprot.OpcodeSet, binprot.StatusSuccess, 1, nil, nil, nil),
+					res(binprot.OpcodeGet, binprot.StatusSuccess, 2, uint32s(5), nil, []byte("hello")),
+				)
+		},
+	},
+	{
+		Name:   "binary zero length value",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			key := []byte(k)
+			return cat(
+					req(binprot.OpcodeSet, 1, uint32s(0, 0), key, nil),
+					req(binprot.OpcodeGet, 2, nil, key, nil),
+				), cat(
+					res(binprot.OpcodeSet, binprot.StatusSuccess, 1, nil, nil, nil),
+					res(binprot.OpcodeGet, binprot.StatusSuccess, 2, uint32s(0), nil, nil),
+				)
+		},
+	},
+	{
+		Name:   "binary max length key",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			key := []byte(maxKey(k))
+			return cat(
+					req(binprot.OpcodeSet, 1, uint32s(0, 0), key, []byte("x")),
+					req(binprot.OpcodeGet, 2, nil, key, nil),
+				), cat(
+					res(binprot.OpcodeSet, binprot.StatusSuccess, 1, nil, nil, nil),
+					res(binprot.OpcodeGet, binprot.StatusSuccess, 2, uint32s(0), nil, []byte("x")),
+				)
+		},
+	},
+	{
+		Name:   "binary key too long",
+		Known:  "Rend doesn't limit the length of keys",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(binprot.OpcodeGet, 1, nil, []byte(maxKey(k)+"k"), nil),
+				res(binprot.OpcodeGet, binprot.StatusEinval, 1, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary get miss",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(binprot.OpcodeGet, 1, nil, []byte(k), nil),
+				res(binprot.OpcodeGet, binprot.StatusKeyEnoent, 1, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary quiet get storm",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			var send [][]byte
+			for i := 0; i < stormSize; i++ {
+				send = append(send, req(binprot.OpcodeGetQ, uint32(i), nil, []byte(fmt.Sprintf("%s%d", k, i)), nil))
+			}
+			send = append(send, req(binprot.OpcodeNoop, stormSize, nil, nil, nil))
+			return cat(send...),
+				res(binprot.OpcodeNoop, binprot.StatusSuccess, stormSize, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary quiet set storm",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			var send [][]byte
+			for i := 0; i < stormSize; i++ {
+				send = append(send, req(binprot.OpcodeSetQ, uint32(i), uint32s(0, 0), []byte(fmt.Sprintf("%s%d", k, i)), []byte("x")))
+			}
+			last := []byte(fmt.Sprintf("%s%d", k, stormSize-1))
+			send = append(send, req(binprot.OpcodeGet, stormSize, nil, last, nil))
+			return cat(send...),
+				res(binprot.OpcodeGet, binprot.StatusSuccess, stormSize, uint32s(0), nil, []byte("x"))
+		},
+	},
+	{
+		Name:   "binary quiet get hit",
+		Known:  "Rend responds to quiet gets with the opcode of a get",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			key := []byte(k)
+			return cat(
+					req(binprot.OpcodeSet, 1, uint32s(0, 0), key, []byte("a")),
+					req(binprot.OpcodeGetQ, 2, nil, key, nil),
+					req(binprot.OpcodeNoop, 3, nil, nil, nil),
+				), cat(
+					res(binprot.OpcodeSet, binprot.StatusSuccess, 1, nil, nil, nil),
+					res(binprot.OpcodeGetQ, binprot.StatusSuccess, 2, uint32s(0), nil, []byte("a")),
+					res(binprot.OpcodeNoop, binprot.StatusSuccess, 3, nil, nil, nil),
+				)
+		},
+	},
+	{
+		Name:   "binary add existing",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			key := []byte(k)
+			return cat(
+					req(binprot.OpcodeSet, 1, uint32s(0, 0), key, []byte("a")),
+					req(binprot.OpcodeAdd, 2, uint32s(0, 0), key, []byte("b")),
+				), cat(
+					res(binprot.OpcodeSet, binprot.StatusSuccess, 1, nil, nil, nil),
+					res(binprot.OpcodeAdd, binprot.StatusKeyExists, 2, nil, nil, nil),
+				)
+		},
+	},
+	{
+		Name:   "binary replace missing",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(binprot.OpcodeReplace, 1, uint32s(0, 0), []byte(k), []byte("a")),
+				res(binprot.OpcodeReplace, binprot.StatusKeyEnoent, 1, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary append missing",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(binprot.OpcodeAppend, 1, nil, []byte(k), []byte("a")),
+				res(binprot.OpcodeAppend, binprot.StatusNotStored, 1, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary delete missing",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(binprot.OpcodeDelete, 1, nil, []byte(k), nil),
+				res(binprot.OpcodeDelete, binprot.StatusKeyEnoent, 1, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary touch and gat",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			key := []byte(k)
+			return cat(
+					req(binprot.OpcodeTouch, 1, uint32s(100), key, nil),
+					req(binprot.OpcodeSet, 2, uint32s(9, 0), key, []byte("a")),
+					req(binprot.OpcodeTouch, 3, uint32s(100), key, nil),
+					req(binprot.OpcodeGat, 4, uint32s(100), key, nil),
+				), cat(
+					res(binprot.OpcodeTouch, binprot.StatusKeyEnoent, 1, nil, nil, nil),
+					res(binprot.OpcodeSet, binprot.StatusSuccess, 2, nil, nil, nil),
+					res(binprot.OpcodeTouch, binprot.StatusSuccess, 3, nil, nil, nil),
+					res(binprot.OpcodeGat, binprot.StatusSuccess, 4, uint32s(9), nil, []byte("a")),
+				)
+		},
+	},
+	{
+		Name:   "binary set without extras",
+		Known:  "Rend reads the extras a command should have, whatever their length in the header",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(binprot.OpcodeSet, 1, nil, []byte(k), []byte("a")),
+				res(binprot.OpcodeSet, binprot.StatusEinval, 1, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary version",
+		Binary: true,
+		Prefix: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(binprot.OpcodeVersion, 1, nil, nil, nil),
+				res(binprot.OpcodeVersion, binprot.StatusSuccess, 1, nil, nil, nil)
+		},
+	},
+	{
+		Name:   "binary unknown command",
+		Known:  "Rend closes the connection after an unknown command",
+		Binary: true,
+		Build: func(k string) ([]byte, []byte) {
+			return req(0x30, 1, nil, []byte(k), nil),
+				res(0x30, binprot.StatusUnknownCommand, 1, nil, nil, nil)
+		},
+	},
+}
+
+func cat(bufs ...[]byte) []byte {
+	var buf []byte
+	for _, b := range bufs {
+		buf = append(buf, b...)
+	}
+	return buf
+}
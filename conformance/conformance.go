@@ -0,0 +1,277 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conformance checks a running server against the memcached text and
+// binary protocols. Each case sends a request on its own connection and
+// compares the response to what memcached sends for the same request.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/binprot"
+)
+
+// Case is a request and the response memcached gives to it.
+type Case struct {
+	Name   string
+	Binary bool
+	// Build returns the bytes to send and the response expected for them. The
+	// key is unique to each run of the case, so earlier runs don't interfere.
+	Build func(key string) (send, expect []byte)
+	// If set, each expected text line only needs to be the start of the line
+	// received, and an expected binary value only the start of the value. Used
+	// where memcached leaves the text up to the server, like error messages.
+	Prefix bool
+	// Why Rend is known to differ from memcached for this case, if it does
+	Known string
+}
+
+// Deviation is a case where the server didn't respond as memcached does.
+type Deviation struct {
+	Case     Case
+	Expected []byte
+	Got      []byte
+	// The error reading the response, if any. Usually a timeout when the
+	// server sends less than expected.
+	Err error
+}
+
+func (d Deviation) String() string {
+	s := fmt.Sprintf("%s: expected %q, got %q", d.Case.Name, d.Expected, d.Got)
+	if d.Err != nil {
+		s += " (" + d.Err.Error() + ")"
+	}
+	if d.Case.Known != "" {
+		s += " [known: " + d.Case.Known + "]"
+	}
+	return s
+}
+
+// Dialer opens a new connection to the server under test.
+type Dialer func() (net.Conn, error)
+
+var runs uint64
+
+// Run runs each case on a new connection and returns the ones the server
+// failed. Timeout is how long to wait for each response. Any bytes that arrive
+// after the expected response, within a short wait, are a deviation as well.
+func Run(dial Dialer, cases []Case, timeout time.Duration) []Deviation {
+	run := atomic.AddUint64(&runs, 1)
+	prefix := fmt.Sprintf("conformance:%x:%d", time.Now().UnixNano(), run)
+
+	var devs []Deviation
+	for i, c := range cases {
+		send, expect := c.Build(fmt.Sprintf("%s:%d", prefix, i))
+		got, err := exchange(dial, c.Binary, send, expect, timeout)
+		if err != nil || !match(c, expect, got) {
+			devs = append(devs, Deviation{Case: c, Expected: expect, Got: got, Err: err})
+		}
+	}
+	return devs
+}
+
+// How long to wait for bytes after the expected response
+const trailingWait = 50 * time.Millisecond
+
+func exchange(dial Dialer, isBinary bool, send, expect []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(send); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	var got []byte
+	for range frames(isBinary, expect) {
+		f, err := readFrame(r, isBinary)
+		got = append(got, f...)
+		if err != nil {
+			return got, err
+		}
+	}
+
+	// Whatever is left over or arrives soon after is more than memcached sends
+	if r.Buffered() == 0 {
+		conn.SetReadDeadline(time.Now().Add(trailingWait))
+		r.Peek(1)
+	}
+	if n := r.Buffered(); n > 0 {
+		extra, _ := r.Peek(n)
+		got = append(got, extra...)
+	}
+
+	return got, nil
+}
+
+// frames splits a response into its lines, for text, or packets, for binary.
+func frames(isBinary bool, buf []byte) [][]byte {
+	var fs [][]byte
+	r := bufio.NewReader(bytes.NewReader(buf))
+	for {
+		f, err := readFrame(r, isBinary)
+		if len(f) > 0 {
+			fs = append(fs, f)
+		}
+		if err != nil {
+			return fs
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader, isBinary bool) ([]byte, error) {
+	if !isBinary {
+		return r.ReadBytes('\n')
+	}
+
+	header := make([]byte, binprot.ReqHeaderLen)
+	if n, err := io.ReadFull(r, header); err != nil {
+		return header[:n], err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	n, err := io.ReadFull(r, body)
+	return append(header, body[:n]...), err
+}
+
+func match(c Case, expect, got []byte) bool {
+	ef := frames(c.Binary, expect)
+	gf := frames(c.Binary, got)
+	if len(ef) != len(gf) {
+		return false
+	}
+
+	for i := range ef {
+		var ok bool
+		if c.Binary {
+			ok = matchPacket(ef[i], gf[i], c.Prefix)
+		} else if c.Prefix {
+			ok = bytes.HasPrefix(gf[i], bytes.TrimSuffix(ef[i], crlf)) && bytes.HasSuffix(gf[i], crlf)
+		} else {
+			ok = bytes.Equal(ef[i], gf[i])
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPacket compares binary responses field by field. The CAS is ignored,
+// since it's up to the server, as is the message in the body of errors.
+func matchPacket(expect, got []byte, prefix bool) bool {
+	e, eok := parsePacket(expect)
+	g, gok := parsePacket(got)
+	if !eok || !gok {
+		return false
+	}
+
+	if e.magic != g.magic || e.opcode != g.opcode || e.status != g.status || e.opaque != g.opaque ||
+		!bytes.Equal(e.extras, g.extras) || !bytes.Equal(e.key, g.key) {
+		return false
+	}
+	if e.status != binprot.StatusSuccess {
+		return true
+	}
+	if prefix {
+		return bytes.HasPrefix(g.value, e.value)
+	}
+	return bytes.Equal(e.value, g.value)
+}
+
+type packet struct {
+	magic  uint8
+	opcode uint8
+	status uint16
+	opaque uint32
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func parsePacket(buf []byte) (packet, bool) {
+	if len(buf) < binprot.ReqHeaderLen {
+		return packet{}, false
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(buf[2:4]))
+	extrasLen := int(buf[4])
+	body := buf[binprot.ReqHeaderLen:]
+	if len(body) != int(binary.BigEndian.Uint32(buf[8:12])) || keyLen+extrasLen > len(body) {
+		return packet{}, false
+	}
+
+	return packet{
+		magic:  buf[0],
+		opcode: buf[1],
+		status: binary.BigEndian.Uint16(buf[6:8]),
+		opaque: binary.BigEndian.Uint32(buf[12:16]),
+		extras: body[:extrasLen],
+		key:    body[extrasLen : extrasLen+keyLen],
+		value:  body[extrasLen+keyLen:],
+	}, true
+}
+
+var crlf = []byte("\r\n")
+
+// text joins lines into a text protocol request or response.
+func text(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// pack builds a binary request or response. The status is the vbucket for
+// requests, which is always 0.
+func pack(magic, opcode uint8, status uint16, opaque uint32, extras, key, value []byte) []byte {
+	buf := make([]byte, binprot.ReqHeaderLen, binprot.ReqHeaderLen+len(extras)+len(key)+len(value))
+	buf[0] = magic
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(buf[6:8], status)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+
+	buf = append(buf, extras...)
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+func req(opcode uint8, opaque uint32, extras, key, value []byte) []byte {
+	return pack(binprot.MagicRequest, opcode, 0, opaque, extras, key, value)
+}
+
+func res(opcode uint8, status uint16, opaque uint32, extras, key, value []byte) []byte {
+	return pack(binprot.MagicResponse, opcode, status, opaque, extras, key, value)
+}
+
+// uint32s encodes the numbers as big endian extras.
+func uint32s(ns ...uint32) []byte {
+	buf := make([]byte, 4*len(ns))
+	for i, n := range ns {
+		binary.BigEndian.PutUint32(buf[4*i:], n)
+	}
+	return buf
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance_test
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/conformance"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers/memcached"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/server"
+)
+
+// Starts Rend in front of a fakemem and returns a dialer for it
+func proxy(t *testing.T, multiplex int) conformance.Dialer {
+	dir := t.TempDir()
+	l1Sock := filepath.Join(dir, "l1.sock")
+	sock := filepath.Join(dir, "rend.sock")
+
+	l, err := net.Listen("unix", l1Sock)
+	if err != nil {
+		t.Fatalf("Error listening for fakemem: %s", err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+	go fakemem.New(false).Serve(l)
+
+	go func() {
+		err := server.Serve(server.Config{
+			ListenArgs: server.ListenArgs{Type: server.ListenUnix, Path: sock, Multiplex: multiplex},
+			Orca:       orcas.L1Only,
+			L1:         memcached.Regular(l1Sock),
+		})
+		if err != nil {
+			t.Errorf("Error serving: %s", err.Error())
+		}
+	}()
+
+	dial := func() (net.Conn, error) { return net.Dial("unix", sock) }
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if conn, err := dial(); err == nil {
+			conn.Close()
+			return dial
+		}
+	}
+	t.Fatalf("Rend didn't start listening on %s", sock)
+	return nil
+}
+
+func TestConformance(t *testing.T) {
+	testConformance(t, proxy(t, 1))
+}
+
+// Requests answered out of order give the same responses when they're sent
+// one at a time
+func TestConformanceMultiplexed(t *testing.T) {
+	testConformance(t, proxy(t, 4))
+}
+
+func testConformance(t *testing.T, dial conformance.Dialer) {
+	for _, cases := range [][]conformance.Case{conformance.TextCases, conformance.BinaryCases} {
+		for _, d := range conformance.Run(dial, cases, 500*time.Millisecond) {
+			if d.Case.Known != "" {
+				t.Logf("Known deviation: %s", d)
+				continue
+			}
+			t.Errorf("Deviation: %s", d)
+		}
+	}
+}
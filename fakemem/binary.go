@@ -0,0 +1,234 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakemem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/netflix/rend/binprot"
+)
+
+const headerLen = 24
+
+type header struct {
+	opcode   uint8
+	keyLen   uint16
+	extraLen uint8
+	bodyLen  uint32
+	opaque   uint32
+}
+
+func (s *Server) serveBinary(rw *bufio.ReadWriter) {
+	hbuf := make([]byte, headerLen)
+	var body []byte
+
+	for {
+		// Responses are only sent once the client stops sending, so a batch of
+		// quiet commands and its noop get one write.
+		if rw.Reader.Buffered() == 0 {
+			if err := rw.Flush(); err != nil {
+				return
+			}
+		}
+
+		if _, err := io.ReadFull(rw, hbuf); err != nil {
+			return
+		}
+		if hbuf[0] != binprot.MagicRequest {
+			return
+		}
+
+		h := header{
+			opcode:   hbuf[1],
+			keyLen:   binary.BigEndian.Uint16(hbuf[2:4]),
+			extraLen: hbuf[4],
+			bodyLen:  binary.BigEndian.Uint32(hbuf[8:12]),
+			opaque:   binary.BigEndian.Uint32(hbuf[12:16]),
+		}
+
+		if cap(body) < int(h.bodyLen) {
+			body = make([]byte, h.bodyLen)
+		}
+		body = body[:h.bodyLen]
+		if _, err := io.ReadFull(rw, body); err != nil {
+			return
+		}
+
+		keyEnd := int(h.extraLen) + int(h.keyLen)
+		if keyEnd > len(body) {
+			writeResponse(rw.Writer, h, binprot.StatusEinval, nil, nil, nil)
+			continue
+		}
+
+		extras := body[:h.extraLen]
+		key := body[h.extraLen:keyEnd]
+		value := body[keyEnd:]
+
+		if !s.binaryCommand(rw.Writer, h, extras, key, value) {
+			rw.Flush()
+			return
+		}
+	}
+}
+
+// Runs one command and writes its response. Returns false if the client quit.
+func (s *Server) binaryCommand(w *bufio.Writer, h header, extras, key, value []byte) bool {
+	switch h.opcode {
+	case binprot.OpcodeGet, binprot.OpcodeGetQ, binprot.OpcodeGetK, binprot.OpcodeGetKQ:
+		quiet := h.opcode == binprot.OpcodeGetQ || h.opcode == binprot.OpcodeGetKQ
+		withKey := h.opcode == binprot.OpcodeGetK || h.opcode == binprot.OpcodeGetKQ
+		i, ok := s.get(key)
+		getResponse(w, h, i, ok, quiet, withKey, key, false)
+
+	case binprot.OpcodeGetE, binprot.OpcodeGetEQ:
+		i, ok := s.get(key)
+		getResponse(w, h, i, ok, h.opcode == binprot.OpcodeGetEQ, false, key, true)
+
+	case binprot.OpcodeGat, binprot.OpcodeGatQ, binprot.OpcodeGatK, binprot.OpcodeGatKQ:
+		if len(extras) != 4 {
+			writeResponse(w, h, binprot.StatusEinval, nil, nil, nil)
+			break
+		}
+		quiet := h.opcode == binprot.OpcodeGatQ || h.opcode == binprot.OpcodeGatKQ
+		withKey := h.opcode == binprot.OpcodeGatK || h.opcode == binprot.OpcodeGatKQ
+		i, ok := s.touch(key, binary.BigEndian.Uint32(extras))
+		getResponse(w, h, i, ok, quiet, withKey, key, false)
+
+	case binprot.OpcodeTouch:
+		if len(extras) != 4 {
+			writeResponse(w, h, binprot.StatusEinval, nil, nil, nil)
+			break
+		}
+		if _, ok := s.touch(key, binary.BigEndian.Uint32(extras)); !ok {
+			writeResponse(w, h, binprot.StatusKeyEnoent, nil, nil, nil)
+			break
+		}
+		writeResponse(w, h, binprot.StatusSuccess, nil, nil, nil)
+
+	case binprot.OpcodeSet, binprot.OpcodeSetQ:
+		s.binaryStore(w, h, storeSet, h.opcode == binprot.OpcodeSetQ, extras, key, value)
+	case binprot.OpcodeAdd, binprot.OpcodeAddQ:
+		s.binaryStore(w, h, storeAdd, h.opcode == binprot.OpcodeAddQ, extras, key, value)
+	case binprot.OpcodeReplace, binprot.OpcodeReplaceQ:
+		s.binaryStore(w, h, storeReplace, h.opcode == binprot.OpcodeReplaceQ, extras, key, value)
+	case binprot.OpcodeAppend, binprot.OpcodeAppendQ:
+		s.binaryStore(w, h, storeAppend, h.opcode == binprot.OpcodeAppendQ, extras, key, value)
+	case binprot.OpcodePrepend, binprot.OpcodePrependQ:
+		s.binaryStore(w, h, storePrepend, h.opcode == binprot.OpcodePrependQ, extras, key, value)
+
+	case binprot.OpcodeDelete, binprot.OpcodeDeleteQ:
+		if !s.delete(key) {
+			writeResponse(w, h, binprot.StatusKeyEnoent, nil, nil, nil)
+			break
+		}
+		if h.opcode == binprot.OpcodeDelete {
+			writeResponse(w, h, binprot.StatusSuccess, nil, nil, nil)
+		}
+
+	case binprot.OpcodeFlush, binprot.OpcodeFlushQ:
+		s.flush()
+		if h.opcode == binprot.OpcodeFlush {
+			writeResponse(w, h, binprot.StatusSuccess, nil, nil, nil)
+		}
+
+	case binprot.OpcodeNoop:
+		writeResponse(w, h, binprot.StatusSuccess, nil, nil, nil)
+
+	case binprot.OpcodeVersion:
+		writeResponse(w, h, binprot.StatusSuccess, nil, nil, []byte(version))
+
+	case binprot.OpcodeQuit:
+		writeResponse(w, h, binprot.StatusSuccess, nil, nil, nil)
+		return false
+	case binprot.OpcodeQuitQ:
+		return false
+
+	default:
+		writeResponse(w, h, binprot.StatusUnknownCommand, nil, nil, nil)
+	}
+
+	return true
+}
+
+// Quiet gets only respond to hits. GetE responses also carry the expiration
+// time in their extras.
+func getResponse(w *bufio.Writer, h header, i item, hit, quiet, withKey bool, key []byte, withExptime bool) {
+	if !withKey {
+		key = nil
+	}
+
+	if !hit {
+		if !quiet {
+			writeResponse(w, h, binprot.StatusKeyEnoent, nil, key, nil)
+		}
+		return
+	}
+
+	extras := make([]byte, 4, 8)
+	binary.BigEndian.PutUint32(extras, i.flags)
+	if withExptime {
+		extras = extras[:8]
+		binary.BigEndian.PutUint32(extras[4:], i.exptime)
+	}
+
+	writeResponse(w, h, binprot.StatusSuccess, extras, key, i.data)
+}
+
+// Quiet stores only respond to failures
+func (s *Server) binaryStore(w *bufio.Writer, h header, mode storeMode, quiet bool, extras, key, value []byte) {
+	var flags, exptime uint32
+	if mode == storeSet || mode == storeAdd || mode == storeReplace {
+		if len(extras) != 8 {
+			writeResponse(w, h, binprot.StatusEinval, nil, nil, nil)
+			return
+		}
+		flags = binary.BigEndian.Uint32(extras[:4])
+		exptime = binary.BigEndian.Uint32(extras[4:])
+	}
+
+	if !s.store(mode, key, flags, exptime, value) {
+		switch mode {
+		case storeAdd:
+			writeResponse(w, h, binprot.StatusKeyExists, nil, nil, nil)
+		case storeReplace:
+			writeResponse(w, h, binprot.StatusKeyEnoent, nil, nil, nil)
+		default:
+			writeResponse(w, h, binprot.StatusNotStored, nil, nil, nil)
+		}
+		return
+	}
+
+	if !quiet {
+		writeResponse(w, h, binprot.StatusSuccess, nil, nil, nil)
+	}
+}
+
+func writeResponse(w *bufio.Writer, h header, status uint16, extras, key, value []byte) {
+	var buf [headerLen]byte
+	buf[0] = binprot.MagicResponse
+	buf[1] = h.opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(buf[6:8], status)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], h.opaque)
+
+	w.Write(buf[:])
+	w.Write(extras)
+	w.Write(key)
+	w.Write(value)
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakemem is a minimal in-memory memcached server speaking the text
+// and binary protocols. It stands in for memcached in tests and benchmarks so
+// they don't need a memcached install. It only implements the commands Rend
+// and its clients use, and it has no memory limit or eviction.
+//
+// A server can also discard everything it's sent, which measures the cost of
+// the proxy alone: stores always succeed and reads always miss.
+package fakemem
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/binprot"
+)
+
+const version = "1.6.0-fakemem"
+
+// Relative expiration times are at most 30 days, like memcached. Larger
+// values are absolute Unix times.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+type item struct {
+	flags   uint32
+	exptime uint32
+	expires time.Time
+	data    []byte
+}
+
+func (i item) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+type Server struct {
+	discard bool
+
+	mu    sync.Mutex
+	items map[string]item
+}
+
+// New returns an empty server. If discard is true, the server keeps nothing.
+func New(discard bool) *Server {
+	return &Server{
+		discard: discard,
+		items:   make(map[string]item),
+	}
+}
+
+// Serve accepts connections on the listener and serves each on its own
+// goroutine until the listener is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves one connection until the client quits or disconnects. The
+// protocol is picked from the first byte like memcached does.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	first, err := rw.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if first[0] == binprot.MagicRequest {
+		s.serveBinary(rw)
+	} else {
+		s.serveText(rw)
+	}
+}
+
+func expiresAt(exptime uint32, now time.Time) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime <= maxRelativeExptime:
+		return now.Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(int64(exptime), 0)
+	}
+}
+
+// Returns the live item for the key, removing it if it expired. The lock must
+// be held.
+func (s *Server) lookup(key string, now time.Time) (item, bool) {
+	i, ok := s.items[key]
+	if ok && i.expired(now) {
+		delete(s.items, key)
+		return item{}, false
+	}
+	return i, ok
+}
+
+func (s *Server) get(key []byte) (item, bool) {
+	if s.discard {
+		return item{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(string(key), time.Now())
+}
+
+// Gets the item and changes its expiration time
+func (s *Server) touch(key []byte, exptime uint32) (item, bool) {
+	if s.discard {
+		return item{}, false
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.lookup(string(key), now)
+	if !ok {
+		return item{}, false
+	}
+
+	i.exptime = exptime
+	i.expires = expiresAt(exptime, now)
+	s.items[string(key)] = i
+	return i, true
+}
+
+type storeMode int
+
+const (
+	storeSet storeMode = iota
+	storeAdd
+	storeReplace
+	storeAppend
+	storePrepend
+)
+
+// Stores the data according to the mode and reports whether it was stored.
+// Appends and prepends keep the flags and expiration of the existing item.
+// The data is copied.
+func (s *Server) store(mode storeMode, key []byte, flags, exptime uint32, data []byte) bool {
+	if s.discard {
+		return true
+	}
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, exists := s.lookup(string(key), now)
+
+	switch mode {
+	case storeAdd:
+		if exists {
+			return false
+		}
+	case storeReplace, storeAppend, storePrepend:
+		if !exists {
+			return false
+		}
+	}
+
+	var i item
+	switch mode {
+	case storeAppend:
+		i = old
+		i.data = append(append(make([]byte, 0, len(old.data)+len(data)), old.data...), data...)
+	case storePrepend:
+		i = old
+		i.data = append(append(make([]byte, 0, len(old.data)+len(data)), data...), old.data...)
+	default:
+		i = item{
+			flags:   flags,
+			exptime: exptime,
+			expires: expiresAt(exptime, now),
+			data:    append([]byte(nil), data...),
+		}
+	}
+
+	s.items[string(key)] = i
+	return true
+}
+
+func (s *Server) delete(key []byte) bool {
+	if s.discard {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.lookup(string(key), time.Now()); !ok {
+		return false
+	}
+	delete(s.items, string(key))
+	return true
+}
+
+func (s *Server) flush() {
+	s.mu.Lock()
+	s.items = make(map[string]item)
+	s.mu.Unlock()
+}
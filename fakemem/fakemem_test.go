@@ -0,0 +1,174 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakemem_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/netflix/rend/binprot"
+	"github.com/netflix/rend/fakemem"
+)
+
+// Returns a client connection to a new server
+func connect(t *testing.T, discard bool) *bufio.ReadWriter {
+	client, server := net.Pipe()
+	go fakemem.New(discard).ServeConn(server)
+	t.Cleanup(func() { client.Close() })
+	return bufio.NewReadWriter(bufio.NewReader(client), bufio.NewWriter(client))
+}
+
+func send(t *testing.T, rw *bufio.ReadWriter, s string) {
+	if _, err := rw.WriteString(s); err != nil {
+		t.Fatalf("Error writing: %s", err.Error())
+	}
+	if err := rw.Flush(); err != nil {
+		t.Fatalf("Error writing: %s", err.Error())
+	}
+}
+
+func expect(t *testing.T, rw *bufio.ReadWriter, lines ...string) {
+	for _, expected := range lines {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %s", err.Error())
+		}
+		if line != expected+"\r\n" {
+			t.Fatalf("Expected %q, got %q", expected, line)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	rw := connect(t, false)
+
+	send(t, rw, "set foo 5 0 3\r\nbar\r\n")
+	expect(t, rw, "STORED")
+
+	send(t, rw, "add foo 0 0 1\r\nx\r\nappend foo 0 0 1\r\n!\r\n")
+	expect(t, rw, "NOT_STORED", "STORED")
+
+	send(t, rw, "get foo missing\r\n")
+	expect(t, rw, "VALUE foo 5 4", "bar!", "END")
+
+	send(t, rw, "delete foo\r\ndelete foo\r\nget foo\r\n")
+	expect(t, rw, "DELETED", "NOT_FOUND", "END")
+
+	send(t, rw, "set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n")
+	expect(t, rw, "VALUE quiet 0 1", "q", "END")
+}
+
+func TestTextDiscard(t *testing.T) {
+	rw := connect(t, true)
+
+	send(t, rw, "set foo 0 0 3\r\nbar\r\nget foo\r\n")
+	expect(t, rw, "STORED", "END")
+}
+
+func request(opcode uint8, opaque uint32, extras, key, value []byte) []byte {
+	buf := make([]byte, 24)
+	buf[0] = binprot.MagicRequest
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+
+	buf = append(buf, extras...)
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+type response struct {
+	opcode uint8
+	status uint16
+	opaque uint32
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func readResponse(t *testing.T, r io.Reader) response {
+	head := make([]byte, 24)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatalf("Error reading: %s", err.Error())
+	}
+	body := make([]byte, binary.BigEndian.Uint32(head[8:12]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("Error reading: %s", err.Error())
+	}
+
+	extraLen := int(head[4])
+	keyLen := int(binary.BigEndian.Uint16(head[2:4]))
+	return response{
+		opcode: head[1],
+		status: binary.BigEndian.Uint16(head[6:8]),
+		opaque: binary.BigEndian.Uint32(head[12:16]),
+		extras: body[:extraLen],
+		key:    body[extraLen : extraLen+keyLen],
+		value:  body[extraLen+keyLen:],
+	}
+}
+
+func TestBinaryQuietBatch(t *testing.T) {
+	rw := connect(t, false)
+
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras, 7)
+
+	var buf bytes.Buffer
+	buf.Write(request(binprot.OpcodeSetQ, 1, extras, []byte("a"), []byte("1")))
+	buf.Write(request(binprot.OpcodeSetQ, 2, extras, []byte("b"), []byte("22")))
+	buf.Write(request(binprot.OpcodeGetKQ, 3, nil, []byte("missing"), nil))
+	buf.Write(request(binprot.OpcodeGetKQ, 4, nil, []byte("b"), nil))
+	buf.Write(request(binprot.OpcodeNoop, 5, nil, nil, nil))
+	send(t, rw, buf.String())
+
+	// Only the hit and the noop respond
+	res := readResponse(t, rw)
+	if res.opaque != 4 || res.status != binprot.StatusSuccess || string(res.key) != "b" || string(res.value) != "22" ||
+		binary.BigEndian.Uint32(res.extras) != 7 {
+		t.Fatalf("Unexpected get response %+v", res)
+	}
+
+	res = readResponse(t, rw)
+	if res.opcode != binprot.OpcodeNoop || res.opaque != 5 {
+		t.Fatalf("Expected the noop response, got %+v", res)
+	}
+}
+
+func TestBinaryErrors(t *testing.T) {
+	rw := connect(t, false)
+
+	extras := make([]byte, 8)
+	send(t, rw, string(request(binprot.OpcodeGet, 1, nil, []byte("missing"), nil)))
+	if res := readResponse(t, rw); res.status != binprot.StatusKeyEnoent {
+		t.Fatalf("Expected a miss, got %+v", res)
+	}
+
+	send(t, rw, string(request(binprot.OpcodeReplaceQ, 2, extras, []byte("missing"), []byte("x"))))
+	if res := readResponse(t, rw); res.status != binprot.StatusKeyEnoent || res.opaque != 2 {
+		t.Fatalf("Expected quiet replace to report the miss, got %+v", res)
+	}
+
+	send(t, rw, string(request(0x33, 3, nil, nil, nil)))
+	if res := readResponse(t, rw); res.status != binprot.StatusUnknownCommand {
+		t.Fatalf("Expected unknown command, got %+v", res)
+	}
+}
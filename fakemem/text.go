@@ -0,0 +1,216 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakemem
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Server) serveText(rw *bufio.ReadWriter) {
+	for {
+		if rw.Reader.Buffered() == 0 {
+			if err := rw.Flush(); err != nil {
+				return
+			}
+		}
+
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			rw.WriteString("ERROR\r\n")
+			continue
+		}
+
+		if !s.textCommand(rw, fields) {
+			rw.Flush()
+			return
+		}
+	}
+}
+
+// Runs one command and writes its response. Returns false if the client quit
+// or the connection can't be used any more.
+func (s *Server) textCommand(rw *bufio.ReadWriter, fields []string) bool {
+	w := rw.Writer
+
+	switch fields[0] {
+	case "get", "gets":
+		for _, key := range fields[1:] {
+			if i, ok := s.get([]byte(key)); ok {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, i.flags, len(i.data))
+				w.Write(i.data)
+				w.WriteString("\r\n")
+			}
+		}
+		w.WriteString("END\r\n")
+
+	case "set", "add", "replace", "append", "prepend":
+		return s.textStore(rw, fields)
+
+	case "delete":
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		if s.delete([]byte(fields[1])) {
+			reply(w, fields, 2, "DELETED")
+		} else {
+			reply(w, fields, 2, "NOT_FOUND")
+		}
+
+	case "touch":
+		if len(fields) < 3 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		exptime, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			break
+		}
+		if _, ok := s.touch([]byte(fields[1]), uint32(exptime)); ok {
+			reply(w, fields, 3, "TOUCHED")
+		} else {
+			reply(w, fields, 3, "NOT_FOUND")
+		}
+
+	case "flush_all":
+		s.flush()
+		reply(w, fields, len(fields)-1, "OK")
+
+	case "lru_crawler":
+		if len(fields) < 2 {
+			w.WriteString("ERROR\r\n")
+			break
+		}
+		if fields[1] == "metadump" {
+			s.metadump(w)
+			break
+		}
+		w.WriteString("OK\r\n")
+
+	case "stats":
+		if len(fields) > 1 && fields[1] == "reset" {
+			w.WriteString("RESET\r\n")
+			break
+		}
+		w.WriteString("END\r\n")
+
+	case "version":
+		w.WriteString("VERSION " + version + "\r\n")
+
+	case "quit":
+		return false
+
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return true
+}
+
+// <command> <key> <flags> <exptime> <bytes> [noreply]\r\n<data>\r\n
+func (s *Server) textStore(rw *bufio.ReadWriter, fields []string) bool {
+	if len(fields) < 5 {
+		rw.WriteString("ERROR\r\n")
+		return true
+	}
+
+	flags, err1 := strconv.ParseUint(fields[2], 10, 32)
+	exptime, err2 := strconv.ParseUint(fields[3], 10, 32)
+	length, err3 := strconv.ParseUint(fields[4], 10, 32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(rw, data); err != nil {
+		return false
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		rw.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+
+	var mode storeMode
+	switch fields[0] {
+	case "set":
+		mode = storeSet
+	case "add":
+		mode = storeAdd
+	case "replace":
+		mode = storeReplace
+	case "append":
+		mode = storeAppend
+	case "prepend":
+		mode = storePrepend
+	}
+
+	if s.store(mode, []byte(fields[1]), uint32(flags), uint32(exptime), data[:length]) {
+		reply(rw.Writer, fields, 5, "STORED")
+	} else {
+		reply(rw.Writer, fields, 5, "NOT_STORED")
+	}
+
+	return true
+}
+
+// Writes the reply unless the command asked for none with noreply at the given
+// field.
+func reply(w *bufio.Writer, fields []string, noreplyAt int, s string) {
+	if len(fields) > noreplyAt && fields[noreplyAt] == "noreply" {
+		return
+	}
+	w.WriteString(s + "\r\n")
+}
+
+// Writes a line for each live item in key order, in the format memcached uses
+// for lru_crawler metadump, followed by END.
+func (s *Server) metadump(w *bufio.Writer) {
+	s.mu.Lock()
+	now := time.Now()
+	keys := make([]string, 0, len(s.items))
+	for key, i := range s.items {
+		if !i.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		i := s.items[key]
+		exp := int64(-1)
+		if !i.expires.IsZero() {
+			exp = i.expires.Unix()
+		}
+		fmt.Fprintf(w, "key=%s exp=%d la=0 cas=0 fetch=no cls=1 size=%d\r\n", url.PathEscape(key), exp, len(i.data))
+	}
+	s.mu.Unlock()
+
+	w.WriteString("END\r\n")
+}
@@ -0,0 +1,300 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// Budgeted wraps the handlers made by the given constructor so a request is
+// given up on once its deadline passes. The memcached handlers stop waiting on
+// their backend connection at the request's deadline, which ends any work left
+// for it, like the rest of the chunks of a large value. The connection is then
+// in an unknown state, so it's closed and a new one is made for the next
+// request. A request that arrives after its deadline isn't sent to the backend
+// at all. Either way, with miss set, gets and GATs miss, and everything else
+// fails with common.ErrBudgetExceeded. Requests with no deadline are passed
+// through as is.
+func Budgeted(hc HandlerConst, miss bool) HandlerConst {
+	return func() (Handler, error) {
+		wrapped, err := hc()
+		if wrapped == nil || err != nil {
+			return wrapped, err
+		}
+		return &budgetHandler{hc: hc, miss: miss, wrapped: wrapped}, nil
+	}
+}
+
+type budgetHandler struct {
+	hc   HandlerConst
+	miss bool
+
+	// nil after a request ran past its deadline, until the next request
+	wrapped Handler
+}
+
+// Returns the handler to use for a request, making a new one if the last one
+// was thrown away at a deadline.
+func (h *budgetHandler) handler() (Handler, error) {
+	if h.wrapped != nil {
+		return h.wrapped, nil
+	}
+
+	wrapped, err := h.hc()
+	if err != nil {
+		if wrapped != nil {
+			wrapped.Close()
+		}
+		return nil, err
+	}
+	h.wrapped = wrapped
+	return wrapped, nil
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Checks the error of a request, throwing away the connection if the request
+// was cut off at its deadline. A request that failed on its own, like with a
+// miss, keeps its error.
+func (h *budgetHandler) exceeded(deadline time.Time, err error) bool {
+	if err == nil || common.IsAppError(err) || !expired(deadline) {
+		return false
+	}
+
+	h.wrapped.Close()
+	h.wrapped = nil
+	return true
+}
+
+func (h *budgetHandler) do(deadline time.Time, f func(Handler) error) error {
+	if expired(deadline) {
+		return common.ErrBudgetExceeded
+	}
+
+	wrapped, err := h.handler()
+	if err != nil {
+		return err
+	}
+
+	err = f(wrapped)
+	if h.exceeded(deadline, err) {
+		return common.ErrBudgetExceeded
+	}
+	return err
+}
+
+func (h *budgetHandler) Set(cmd common.SetRequest) error {
+	return h.do(cmd.Deadline, func(w Handler) error { return w.Set(cmd) })
+}
+
+func (h *budgetHandler) Add(cmd common.SetRequest) error {
+	return h.do(cmd.Deadline, func(w Handler) error { return w.Add(cmd) })
+}
+
+func (h *budgetHandler) Replace(cmd common.SetRequest) error {
+	return h.do(cmd.Deadline, func(w Handler) error { return w.Replace(cmd) })
+}
+
+func (h *budgetHandler) Append(cmd common.SetRequest) error {
+	return h.do(cmd.Deadline, func(w Handler) error { return w.Append(cmd) })
+}
+
+func (h *budgetHandler) Prepend(cmd common.SetRequest) error {
+	return h.do(cmd.Deadline, func(w Handler) error { return w.Prepend(cmd) })
+}
+
+func (h *budgetHandler) Delete(cmd common.DeleteRequest) error {
+	return h.do(cmd.Deadline, func(w Handler) error { return w.Delete(cmd) })
+}
+
+func (h *budgetHandler) Touch(cmd common.TouchRequest) error {
+	return h.do(cmd.Deadline, func(w Handler) error { return w.Touch(cmd) })
+}
+
+func (h *budgetHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.do(cmd.Deadline, func(w Handler) error {
+		var err error
+		res, err = w.GAT(cmd)
+		return err
+	})
+	if err == common.ErrBudgetExceeded && h.miss {
+		return common.GetResponse{
+			Key:    cmd.Key,
+			Opaque: cmd.Opaque,
+			Quiet:  cmd.Quiet,
+			Miss:   true,
+		}, nil
+	}
+	return res, err
+}
+
+func (h *budgetHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resOut := make(chan common.GetResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	// The keys with no response yet miss
+	exceeded := func(responded int) {
+		if !h.miss {
+			errOut <- common.ErrBudgetExceeded
+			return
+		}
+		for i := responded; i < len(cmd.Keys); i++ {
+			resOut <- common.GetResponse{
+				Key:    cmd.Keys[i],
+				Opaque: cmd.Opaques[i],
+				Quiet:  cmd.Quiet[i],
+				Miss:   true,
+			}
+		}
+	}
+
+	if expired(cmd.Deadline) {
+		exceeded(0)
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	wrapped, err := h.handler()
+	if err != nil {
+		errOut <- err
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+	if cmd.Deadline.IsZero() {
+		return wrapped.Get(cmd)
+	}
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var responded int
+		var failure error
+
+		resIn, errIn := wrapped.Get(cmd)
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				responded++
+				resOut <- res
+			case e, ok := <-errIn:
+				if !ok {
+					errIn = nil
+					continue
+				}
+				failure = e
+			}
+		}
+
+		if h.exceeded(cmd.Deadline, failure) {
+			exceeded(responded)
+		} else if failure != nil {
+			errOut <- failure
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *budgetHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	exceeded := func(responded int) {
+		if !h.miss {
+			errOut <- common.ErrBudgetExceeded
+			return
+		}
+		for i := responded; i < len(cmd.Keys); i++ {
+			resOut <- common.GetEResponse{
+				Key:    cmd.Keys[i],
+				Opaque: cmd.Opaques[i],
+				Quiet:  cmd.Quiet[i],
+				Miss:   true,
+			}
+		}
+	}
+
+	if expired(cmd.Deadline) {
+		exceeded(0)
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	wrapped, err := h.handler()
+	if err != nil {
+		errOut <- err
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+	if cmd.Deadline.IsZero() {
+		return wrapped.GetE(cmd)
+	}
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var responded int
+		var failure error
+
+		resIn, errIn := wrapped.GetE(cmd)
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				responded++
+				resOut <- res
+			case e, ok := <-errIn:
+				if !ok {
+					errIn = nil
+					continue
+				}
+				failure = e
+			}
+		}
+
+		if h.exceeded(cmd.Deadline, failure) {
+			exceeded(responded)
+		} else if failure != nil {
+			errOut <- failure
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *budgetHandler) Close() error {
+	if h.wrapped == nil {
+		return nil
+	}
+	return h.wrapped.Close()
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+// Returns a constructor whose first connection never answers, and whose later
+// ones go to a fakemem
+func stalling() (handlers.HandlerConst, *int) {
+	fm := fakemem.New(false)
+	conns := new(int)
+	return func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		*conns++
+		if *conns == 1 {
+			go io.Copy(io.Discard, server)
+		} else {
+			go fm.ServeConn(server)
+		}
+		return std.NewHandler(client), nil
+	}, conns
+}
+
+func TestBudgetedAbort(t *testing.T) {
+	hc, conns := stalling()
+	h, _ := handlers.Budgeted(hc, false)()
+	defer h.Close()
+
+	start := time.Now()
+	err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v"), Deadline: start.Add(20 * time.Millisecond)})
+	if err != common.ErrBudgetExceeded {
+		t.Fatalf("Expected the set to run past its budget, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected the set to be given up on at its deadline, took %s", time.Since(start))
+	}
+
+	// The stuck connection is replaced for the next request
+	err = h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v"), Deadline: time.Now().Add(time.Second)})
+	if err != nil {
+		t.Fatalf("Expected the next set to reach the backend, got %v", err)
+	}
+	if *conns != 2 {
+		t.Fatalf("Expected a new connection after the deadline, got %d connections", *conns)
+	}
+	if res, err := get(h, "k"); err != nil || res.Miss || string(res.Data) != "v" {
+		t.Fatalf("Expected to get the value back, got %+v, %v", res, err)
+	}
+}
+
+func TestBudgetedMiss(t *testing.T) {
+	hc, conns := stalling()
+	h, _ := handlers.Budgeted(hc, true)()
+	defer h.Close()
+
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:     [][]byte{[]byte("a"), []byte("b")},
+		Opaques:  []uint32{1, 2},
+		Quiet:    []bool{false, false},
+		Deadline: time.Now().Add(20 * time.Millisecond),
+	})
+	var misses int
+	for res := range resChan {
+		if !res.Miss {
+			t.Fatalf("Expected a miss, got %+v", res)
+		}
+		misses++
+	}
+	if err := <-errChan; err != nil || misses != 2 {
+		t.Fatalf("Expected every key to miss, got %d misses, %v", misses, err)
+	}
+
+	res, err := h.GAT(common.GATRequest{Key: []byte("a"), Deadline: time.Now().Add(-time.Millisecond)})
+	if err != nil || !res.Miss {
+		t.Fatalf("Expected a GAT past its deadline to miss, got %+v, %v", res, err)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: []byte("a"), Deadline: time.Now().Add(-time.Millisecond)}); err != common.ErrBudgetExceeded {
+		t.Fatalf("Expected a delete past its deadline to fail, got %v", err)
+	}
+
+	// Requests past their deadline don't reach the backend
+	if *conns != 1 {
+		t.Fatalf("Expected no new connection, got %d connections", *conns)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/netflix/rend/common"
+)
+
+// Canary wraps the handlers made by the primary constructor so the given
+// percentage of keys go to the handlers made by the canary constructor
+// instead, to try out a new memcached version or a new handler with a slice of
+// real traffic. Keys are picked by their hash, so a key always goes to the same
+// side and a value set on one is read back from the same one. The keys of a
+// multiget are split between the two and fetched at once, and the responses
+// come back in the order of the keys. If a canary connection can't be made,
+// the error is returned like the primary's would be, since sending its keys to
+// the primary would leave them on both backends once other connections write
+// them to the canary. Instrument each constructor under its own backend name,
+// rather than wrapping the canary handler, to see the canary's metrics apart
+// from the primary's.
+func Canary(primary, canary HandlerConst, percent float64) HandlerConst {
+	// In hundredths of a percent
+	cutoff := uint32(percent * 100)
+
+	return func() (Handler, error) {
+		p, err := primary()
+		if p == nil || err != nil {
+			return p, err
+		}
+
+		c, err := canary()
+		if err != nil {
+			log.Println("Error opening canary connection:", err.Error())
+			if c != nil {
+				c.Close()
+			}
+			p.Close()
+			return nil, err
+		}
+
+		return &canaryHandler{primary: p, canary: c, cutoff: cutoff}, nil
+	}
+}
+
+type canaryHandler struct {
+	primary Handler
+	canary  Handler
+	cutoff  uint32
+}
+
+func (h *canaryHandler) isCanary(key []byte) bool {
+	hash := fnv.New32a()
+	hash.Write(key)
+	return hash.Sum32()%10000 < h.cutoff
+}
+
+func (h *canaryHandler) handler(key []byte) Handler {
+	if h.isCanary(key) {
+		return h.canary
+	}
+	return h.primary
+}
+
+func (h *canaryHandler) Set(cmd common.SetRequest) error {
+	return h.handler(cmd.Key).Set(cmd)
+}
+
+func (h *canaryHandler) Add(cmd common.SetRequest) error {
+	return h.handler(cmd.Key).Add(cmd)
+}
+
+func (h *canaryHandler) Replace(cmd common.SetRequest) error {
+	return h.handler(cmd.Key).Replace(cmd)
+}
+
+func (h *canaryHandler) Append(cmd common.SetRequest) error {
+	return h.handler(cmd.Key).Append(cmd)
+}
+
+func (h *canaryHandler) Prepend(cmd common.SetRequest) error {
+	return h.handler(cmd.Key).Prepend(cmd)
+}
+
+func (h *canaryHandler) Delete(cmd common.DeleteRequest) error {
+	return h.handler(cmd.Key).Delete(cmd)
+}
+
+func (h *canaryHandler) Touch(cmd common.TouchRequest) error {
+	return h.handler(cmd.Key).Touch(cmd)
+}
+
+func (h *canaryHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return h.handler(cmd.Key).GAT(cmd)
+}
+
+// Splits the keys of a get between the primary and the canary. The returned
+// slice says which side each key went to. Either request is empty if it has no
+// keys.
+func (h *canaryHandler) split(cmd common.GetRequest) (primary, canary common.GetRequest, toCanary []bool) {
+	primary = cmd
+	primary.Keys, primary.Opaques, primary.Quiet = nil, nil, nil
+	canary = primary
+
+	toCanary = make([]bool, len(cmd.Keys))
+	for i, key := range cmd.Keys {
+		req := &primary
+		if h.isCanary(key) {
+			toCanary[i] = true
+			req = &canary
+		}
+		req.Keys = append(req.Keys, key)
+		req.Opaques = append(req.Opaques, cmd.Opaques[i])
+		req.Quiet = append(req.Quiet, cmd.Quiet[i])
+	}
+	return primary, canary, toCanary
+}
+
+func (h *canaryHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	preq, creq, toCanary := h.split(cmd)
+	if len(creq.Keys) == 0 {
+		return h.primary.Get(cmd)
+	}
+	if len(preq.Keys) == 0 {
+		return h.canary.Get(cmd)
+	}
+
+	fetch := func(handler Handler, req common.GetRequest) getGroup {
+		g := getGroup{
+			res: make(chan common.GetResponse, len(req.Keys)),
+			err: make(chan error, 1),
+		}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		resIn, errIn := handler.Get(req)
+		go collectGet(resIn, errIn, g, wg)
+		go closeWhenDone(wg, g)
+		return g
+	}
+	pg := fetch(h.primary, preq)
+	cg := fetch(h.canary, creq)
+
+	resOut := make(chan common.GetResponse)
+	errOut := make(chan error)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		// Each side responds to its keys in order, so the next response for
+		// a key is the next one from its side. Nothing is sent after the
+		// first error, like any other handler, but both sides are read to the
+		// end so their connections are ready for the next request.
+		var failed error
+		for _, c := range toCanary {
+			g := pg
+			if c {
+				g = cg
+			}
+			res, ok := <-g.res
+			if !ok {
+				failed, _ = <-g.err
+				break
+			}
+			resOut <- res
+		}
+		for _, g := range []getGroup{pg, cg} {
+			for range g.res {
+			}
+			if err, ok := <-g.err; ok && failed == nil {
+				failed = err
+			}
+		}
+		if failed != nil {
+			errOut <- failed
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *canaryHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	preq, creq, toCanary := h.split(cmd)
+	if len(creq.Keys) == 0 {
+		return h.primary.GetE(cmd)
+	}
+	if len(preq.Keys) == 0 {
+		return h.canary.GetE(cmd)
+	}
+
+	fetch := func(handler Handler, req common.GetRequest) getEGroup {
+		g := getEGroup{
+			res: make(chan common.GetEResponse, len(req.Keys)),
+			err: make(chan error, 1),
+		}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		resIn, errIn := handler.GetE(req)
+		go collectGetE(resIn, errIn, g, wg)
+		go closeEWhenDone(wg, g)
+		return g
+	}
+	pg := fetch(h.primary, preq)
+	cg := fetch(h.canary, creq)
+
+	resOut := make(chan common.GetEResponse)
+	errOut := make(chan error)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var failed error
+		for _, c := range toCanary {
+			g := pg
+			if c {
+				g = cg
+			}
+			res, ok := <-g.res
+			if !ok {
+				failed, _ = <-g.err
+				break
+			}
+			resOut <- res
+		}
+		for _, g := range []getEGroup{pg, cg} {
+			for range g.res {
+			}
+			if err, ok := <-g.err; ok && failed == nil {
+				failed = err
+			}
+		}
+		if failed != nil {
+			errOut <- failed
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *canaryHandler) Close() error {
+	err := h.primary.Close()
+	if cerr := h.canary.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+func fakememConst(fm *fakemem.Server) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go fm.ServeConn(server)
+		return std.NewHandler(client), nil
+	}
+}
+
+// Returns whether the key is in the fakemem
+func hasKey(t *testing.T, fm *fakemem.Server, key string) bool {
+	h, _ := fakememConst(fm)()
+	defer h.Close()
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	res := <-resChan
+	if err, ok := <-errChan; ok {
+		t.Fatalf("Error checking for %q: %s", key, err.Error())
+	}
+	return !res.Miss
+}
+
+func TestCanarySplitsKeys(t *testing.T) {
+	primary := fakemem.New(false)
+	canary := fakemem.New(false)
+	h, err := handlers.Canary(fakememConst(primary), fakememConst(canary), 50)()
+	if err != nil {
+		t.Fatalf("Error making handler: %s", err.Error())
+	}
+	defer h.Close()
+
+	keys := setupKeys(t, h, 30)
+
+	var inPrimary, inCanary int
+	for i, k := range keys {
+		p, c := hasKey(t, primary, k), hasKey(t, canary, k)
+		if i%3 == 0 {
+			continue
+		}
+		if p == c {
+			t.Fatalf("Expected %q in exactly one backend, in primary: %v, in canary: %v", k, p, c)
+		}
+		if p {
+			inPrimary++
+		} else {
+			inCanary++
+		}
+	}
+	if inPrimary == 0 || inCanary == 0 {
+		t.Fatalf("Expected keys on both sides, got %d in primary and %d in canary", inPrimary, inCanary)
+	}
+
+	// Responses from both sides come back in the order of the keys
+	got := multiget(t, h, keys)
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatalf("Expected responses in request order %v, got %v", keys, got)
+	}
+}
+
+func TestCanaryUnreachable(t *testing.T) {
+	primary := fakemem.New(false)
+	closed := false
+	primaryConst := func() (handlers.Handler, error) {
+		h, err := fakememConst(primary)()
+		return closeRecorder{h, &closed}, err
+	}
+	canary := func() (handlers.Handler, error) {
+		return nil, errors.New("no canary")
+	}
+
+	// Canary keys aren't sent to the primary instead
+	h, err := handlers.Canary(primaryConst, canary, 100)()
+	if err == nil || h != nil {
+		t.Fatalf("Expected the canary's error, got %v", err)
+	}
+	if !closed {
+		t.Fatalf("Expected the primary connection to be closed")
+	}
+}
+
+type closeRecorder struct {
+	handlers.Handler
+	closed *bool
+}
+
+func (c closeRecorder) Close() error {
+	*c.closed = true
+	return c.Handler.Close()
+}
+
+func TestCanaryInstrumentedApart(t *testing.T) {
+	start := func(backend string) uint64 { return backendCounter("backend_requests", "set", backend) }
+	primaryStart, canaryStart := start("canary_test_primary"), start("canary_test_canary")
+
+	h, err := handlers.Canary(
+		handlers.Instrumented(fakememConst(fakemem.New(false)), "canary_test_primary"),
+		handlers.Instrumented(fakememConst(fakemem.New(false)), "canary_test_canary"),
+		50)()
+	if err != nil {
+		t.Fatalf("Error making handler: %s", err.Error())
+	}
+	defer h.Close()
+
+	const n = 30
+	for i := 0; i < n; i++ {
+		if err := h.Set(common.SetRequest{Key: []byte(fmt.Sprint("key", i)), Data: []byte("v")}); err != nil {
+			t.Fatalf("Error setting: %s", err.Error())
+		}
+	}
+
+	// Each set is counted once, by the side it went to
+	primary, canary := start("canary_test_primary")-primaryStart, start("canary_test_canary")-canaryStart
+	if primary == 0 || canary == 0 || primary+canary != n {
+		t.Fatalf("Expected %d sets counted once each on both sides, got %d primary and %d canary", n, primary, canary)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"log"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricGetFanOuts = metrics.AddCounter("get_fanouts", nil)
+
+// FanOut wraps the handlers made by the given constructor so the keys of a
+// multiget are fetched over up to width backend connections at once instead of
+// one after another over a single connection. The keys are split into
+// contiguous groups, one per connection. Every other request uses the first
+// connection, which is made with the handler. The others are made the first
+// time a get needs them, and a get that can't make one uses fewer.
+//
+// If ordered is true, responses come back in the order of the keys in the
+// request, buffering the responses of later groups until the earlier ones are
+// done. Otherwise each response is passed on as soon as it arrives, which the
+// memcached protocols allow, since clients match up responses by key or
+// opaque.
+func FanOut(hc HandlerConst, width int, ordered bool) HandlerConst {
+	return func() (Handler, error) {
+		first, err := hc()
+		if first == nil || err != nil {
+			return first, err
+		}
+		return &fanOutHandler{
+			Handler:  first,
+			hc:       hc,
+			width:    width,
+			ordered:  ordered,
+			handlers: []Handler{first},
+		}, nil
+	}
+}
+
+// The embedded handler is the first connection, used for everything but gets.
+type fanOutHandler struct {
+	Handler
+	hc       HandlerConst
+	width    int
+	ordered  bool
+	handlers []Handler
+}
+
+// Splits the keys of a get into a request for each connection to use, making
+// connections as needed.
+func (h *fanOutHandler) split(cmd common.GetRequest) []common.GetRequest {
+	groups := h.width
+	if len(cmd.Keys) < groups {
+		groups = len(cmd.Keys)
+	}
+
+	for len(h.handlers) < groups {
+		handler, err := h.hc()
+		if err != nil {
+			if handler != nil {
+				handler.Close()
+			}
+			log.Println("Error opening another backend connection for a get:", err.Error())
+			groups = len(h.handlers)
+			break
+		}
+		h.handlers = append(h.handlers, handler)
+	}
+
+	if groups <= 1 {
+		return []common.GetRequest{cmd}
+	}
+
+	reqs := make([]common.GetRequest, 0, groups)
+	size := (len(cmd.Keys) + groups - 1) / groups
+	for start := 0; start < len(cmd.Keys); start += size {
+		end := start + size
+		if end > len(cmd.Keys) {
+			end = len(cmd.Keys)
+		}
+		reqs = append(reqs, common.GetRequest{
+			Keys:       cmd.Keys[start:end],
+			Opaques:    cmd.Opaques[start:end],
+			Quiet:      cmd.Quiet[start:end],
+			NoopOpaque: cmd.NoopOpaque,
+			NoopEnd:    cmd.NoopEnd,
+			Span:       cmd.Span,
+			Deadline:   cmd.Deadline,
+		})
+	}
+	return reqs
+}
+
+// The responses of one or more groups, buffered so each backend connection is
+// read as fast as the backend responds no matter how far along the client is.
+// Both are closed once the groups are done.
+type getGroup struct {
+	res chan common.GetResponse
+	err chan error
+}
+
+type getEGroup struct {
+	res chan common.GetEResponse
+	err chan error
+}
+
+func (h *fanOutHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	reqs := h.split(cmd)
+	if len(reqs) == 1 {
+		return h.Handler.Get(cmd)
+	}
+	metrics.IncCounter(MetricGetFanOuts)
+
+	// In order, each group has its own buffers, read one after another.
+	// Otherwise they all share one.
+	var groups []getGroup
+	shared := getGroup{
+		res: make(chan common.GetResponse, len(cmd.Keys)),
+		err: make(chan error, len(reqs)),
+	}
+	wg := &sync.WaitGroup{}
+	for i, req := range reqs {
+		g := shared
+		if h.ordered {
+			g = getGroup{
+				res: make(chan common.GetResponse, len(req.Keys)),
+				err: make(chan error, 1),
+			}
+			wg = &sync.WaitGroup{}
+		}
+
+		resIn, errIn := h.handlers[i].Get(req)
+		wg.Add(1)
+		go collectGet(resIn, errIn, g, wg)
+
+		if h.ordered {
+			groups = append(groups, g)
+			go closeWhenDone(wg, g)
+		}
+	}
+	if !h.ordered {
+		groups = append(groups, shared)
+		go closeWhenDone(wg, shared)
+	}
+
+	resOut := make(chan common.GetResponse)
+	errOut := make(chan error)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		// Nothing is sent after the first error, like any other handler
+		for _, g := range groups {
+			for res := range g.res {
+				resOut <- res
+			}
+			if err, ok := <-g.err; ok {
+				errOut <- err
+				return
+			}
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *fanOutHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	reqs := h.split(cmd)
+	if len(reqs) == 1 {
+		return h.Handler.GetE(cmd)
+	}
+	metrics.IncCounter(MetricGetFanOuts)
+
+	// In order, each group has its own buffers, read one after another.
+	// Otherwise they all share one.
+	var groups []getEGroup
+	shared := getEGroup{
+		res: make(chan common.GetEResponse, len(cmd.Keys)),
+		err: make(chan error, len(reqs)),
+	}
+	wg := &sync.WaitGroup{}
+	for i, req := range reqs {
+		g := shared
+		if h.ordered {
+			g = getEGroup{
+				res: make(chan common.GetEResponse, len(req.Keys)),
+				err: make(chan error, 1),
+			}
+			wg = &sync.WaitGroup{}
+		}
+
+		resIn, errIn := h.handlers[i].GetE(req)
+		wg.Add(1)
+		go collectGetE(resIn, errIn, g, wg)
+
+		if h.ordered {
+			groups = append(groups, g)
+			go closeEWhenDone(wg, g)
+		}
+	}
+	if !h.ordered {
+		groups = append(groups, shared)
+		go closeEWhenDone(wg, shared)
+	}
+
+	resOut := make(chan common.GetEResponse)
+	errOut := make(chan error)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		for _, g := range groups {
+			for res := range g.res {
+				resOut <- res
+			}
+			if err, ok := <-g.err; ok {
+				errOut <- err
+				return
+			}
+		}
+	}()
+
+	return resOut, errOut
+}
+
+// Passes on the responses of one group's get until the handler is done with it
+func collectGet(resIn <-chan common.GetResponse, errIn <-chan error, g getGroup, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for resIn != nil || errIn != nil {
+		select {
+		case res, ok := <-resIn:
+			if !ok {
+				resIn = nil
+				continue
+			}
+			g.res <- res
+		case err, ok := <-errIn:
+			if !ok {
+				errIn = nil
+				continue
+			}
+			g.err <- err
+			return
+		}
+	}
+}
+
+func collectGetE(resIn <-chan common.GetEResponse, errIn <-chan error, g getEGroup, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for resIn != nil || errIn != nil {
+		select {
+		case res, ok := <-resIn:
+			if !ok {
+				resIn = nil
+				continue
+			}
+			g.res <- res
+		case err, ok := <-errIn:
+			if !ok {
+				errIn = nil
+				continue
+			}
+			g.err <- err
+			return
+		}
+	}
+}
+
+func closeWhenDone(wg *sync.WaitGroup, g getGroup) {
+	wg.Wait()
+	close(g.res)
+	close(g.err)
+}
+
+func closeEWhenDone(wg *sync.WaitGroup, g getEGroup) {
+	wg.Wait()
+	close(g.res)
+	close(g.err)
+}
+
+func (h *fanOutHandler) Close() error {
+	var err error
+	for _, handler := range h.handlers {
+		if e := handler.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
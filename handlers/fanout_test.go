@@ -0,0 +1,140 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+// Returns a fan out constructor over a fakemem, and how many connections it
+// has made so far
+func fanOut(ordered bool) (handlers.HandlerConst, *int) {
+	fm := fakemem.New(false)
+	conns := new(int)
+	return handlers.FanOut(func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go fm.ServeConn(server)
+		*conns++
+		return std.NewHandler(client), nil
+	}, 4, ordered), conns
+}
+
+// Gets the keys, with the hits set to their key and the rest missing, and
+// returns the keys of the responses in the order they came back
+func multiget(t *testing.T, h handlers.Handler, keys []string) []string {
+	req := common.GetRequest{}
+	for i, k := range keys {
+		req.Keys = append(req.Keys, []byte(k))
+		req.Opaques = append(req.Opaques, uint32(i))
+		req.Quiet = append(req.Quiet, false)
+	}
+
+	var got []string
+	resChan, errChan := h.Get(req)
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			if res.Opaque >= uint32(len(keys)) || string(res.Key) != keys[res.Opaque] {
+				t.Fatalf("Response for key %q has the opaque of %d", res.Key, res.Opaque)
+			}
+			if !res.Miss && string(res.Data) != string(res.Key) {
+				t.Fatalf("Expected %q to have itself as its value, got %q", res.Key, res.Data)
+			}
+			got = append(got, string(res.Key))
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			t.Fatalf("Error getting: %s", err.Error())
+		}
+	}
+	return got
+}
+
+func setupKeys(t *testing.T, h handlers.Handler, n int) []string {
+	var keys []string
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("key%d", i)
+		keys = append(keys, k)
+		// Every third key misses
+		if i%3 == 0 {
+			continue
+		}
+		if err := h.Set(common.SetRequest{Key: []byte(k), Data: []byte(k)}); err != nil {
+			t.Fatalf("Error setting: %s", err.Error())
+		}
+	}
+	return keys
+}
+
+func TestFanOutOrdered(t *testing.T) {
+	hc, conns := fanOut(true)
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Error making handler: %s", err.Error())
+	}
+	defer h.Close()
+
+	keys := setupKeys(t, h, 10)
+	if *conns != 1 {
+		t.Fatalf("Expected only one connection before a get, got %d", *conns)
+	}
+
+	got := multiget(t, h, keys)
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatalf("Expected responses in request order %v, got %v", keys, got)
+	}
+	if *conns != 4 {
+		t.Fatalf("Expected the get to use 4 connections, got %d", *conns)
+	}
+
+	// Fewer keys than connections still works
+	got = multiget(t, h, keys[:2])
+	if fmt.Sprint(got) != fmt.Sprint(keys[:2]) {
+		t.Fatalf("Expected responses %v, got %v", keys[:2], got)
+	}
+}
+
+func TestFanOutAnyOrder(t *testing.T) {
+	hc, _ := fanOut(false)
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Error making handler: %s", err.Error())
+	}
+	defer h.Close()
+
+	keys := setupKeys(t, h, 10)
+
+	got := multiget(t, h, keys)
+	sort.Strings(got)
+	expected := append([]string(nil), keys...)
+	sort.Strings(expected)
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Expected a response for each of %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	ErrFaultDropped = errors.New("Backend response dropped by fault injection")
+	ErrFaultReset   = errors.New("Backend connection reset by fault injection")
+)
+
+// Faults are the problems Faulty injects into backend requests, each with the
+// probability from 0 to 1 that it happens to a request.
+type Faults struct {
+	// Added before the request is sent
+	Latency     time.Duration
+	LatencyProb float64
+	// The request is sent but its response is lost, so it fails with
+	// ErrFaultDropped
+	DropProb float64
+	// Hits come back with only the first half of their value
+	TruncateProb float64
+	// The connection is closed, so the request and every one after it on the
+	// connection fail with ErrFaultReset
+	ResetProb float64
+	// Seeds the faults, so the same requests on the same connections get the
+	// same faults every run
+	Seed int64
+}
+
+// Enabled is true if any fault can happen.
+func (f Faults) Enabled() bool {
+	return f.LatencyProb > 0 || f.DropProb > 0 || f.TruncateProb > 0 || f.ResetProb > 0
+}
+
+type faultMetrics struct {
+	latency  uint32
+	drop     uint32
+	truncate uint32
+	reset    uint32
+}
+
+// Faulty wraps the handlers made by the given constructor to inject faults into
+// their requests, for testing how the rest of the proxy copes with a backend
+// misbehaving. Each connection gets its faults from its own random numbers,
+// seeded in the order the connections are made. The injected faults are
+// counted, tagged with the fault and the given backend name.
+func Faulty(hc HandlerConst, backend string, f Faults) HandlerConst {
+	m := faultMetrics{
+		latency:  metrics.AddCounter("backend_faults", metrics.Tags{"fault": "latency", "backend": backend}),
+		drop:     metrics.AddCounter("backend_faults", metrics.Tags{"fault": "drop", "backend": backend}),
+		truncate: metrics.AddCounter("backend_faults", metrics.Tags{"fault": "truncate", "backend": backend}),
+		reset:    metrics.AddCounter("backend_faults", metrics.Tags{"fault": "reset", "backend": backend}),
+	}
+
+	var lock sync.Mutex
+	seeds := rand.New(rand.NewSource(f.Seed))
+
+	return func() (Handler, error) {
+		h, err := hc()
+		if h == nil || err != nil {
+			return h, err
+		}
+
+		lock.Lock()
+		seed := seeds.Int63()
+		lock.Unlock()
+
+		return &faultyHandler{
+			wrapped: h,
+			faults:  f,
+			metrics: m,
+			rand:    rand.New(rand.NewSource(seed)),
+		}, nil
+	}
+}
+
+type faultyHandler struct {
+	wrapped Handler
+	faults  Faults
+	metrics faultMetrics
+	rand    *rand.Rand
+	reset   bool
+	close   sync.Once
+}
+
+// The faults that happen to one request
+type fault struct {
+	drop     bool
+	truncate bool
+}
+
+// Decides the faults for the next request and waits out any latency. A number
+// is drawn for every fault whether or not it's enabled, so turning one fault on
+// doesn't change when the others happen.
+func (h *faultyHandler) next() (fault, error) {
+	if h.reset {
+		return fault{}, ErrFaultReset
+	}
+
+	reset := h.rand.Float64() < h.faults.ResetProb
+	latency := h.rand.Float64() < h.faults.LatencyProb
+	f := fault{
+		drop:     h.rand.Float64() < h.faults.DropProb,
+		truncate: h.rand.Float64() < h.faults.TruncateProb,
+	}
+
+	if reset {
+		metrics.IncCounter(h.metrics.reset)
+		h.reset = true
+		h.Close()
+		return fault{}, ErrFaultReset
+	}
+	if latency {
+		metrics.IncCounter(h.metrics.latency)
+		time.Sleep(h.faults.Latency)
+	}
+	if f.drop {
+		metrics.IncCounter(h.metrics.drop)
+	}
+	return f, nil
+}
+
+func (h *faultyHandler) done(f fault, err error) error {
+	if f.drop {
+		return ErrFaultDropped
+	}
+	return err
+}
+
+func (h *faultyHandler) truncate(f fault, miss bool, data []byte) []byte {
+	if !f.truncate || miss {
+		return data
+	}
+	metrics.IncCounter(h.metrics.truncate)
+	return data[:len(data)/2]
+}
+
+func (h *faultyHandler) Set(cmd common.SetRequest) error {
+	f, err := h.next()
+	if err != nil {
+		return err
+	}
+	return h.done(f, h.wrapped.Set(cmd))
+}
+
+func (h *faultyHandler) Add(cmd common.SetRequest) error {
+	f, err := h.next()
+	if err != nil {
+		return err
+	}
+	return h.done(f, h.wrapped.Add(cmd))
+}
+
+func (h *faultyHandler) Replace(cmd common.SetRequest) error {
+	f, err := h.next()
+	if err != nil {
+		return err
+	}
+	return h.done(f, h.wrapped.Replace(cmd))
+}
+
+func (h *faultyHandler) Append(cmd common.SetRequest) error {
+	f, err := h.next()
+	if err != nil {
+		return err
+	}
+	return h.done(f, h.wrapped.Append(cmd))
+}
+
+func (h *faultyHandler) Prepend(cmd common.SetRequest) error {
+	f, err := h.next()
+	if err != nil {
+		return err
+	}
+	return h.done(f, h.wrapped.Prepend(cmd))
+}
+
+// Get and GetE pass the responses through, truncating the hits or dropping
+// them all and failing once the wrapped handler is done.
+func (h *faultyHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resOut := make(chan common.GetResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	f, err := h.next()
+	if err != nil {
+		errOut <- err
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	resIn, errIn := h.wrapped.Get(cmd)
+	if !f.drop && !f.truncate {
+		return resIn, errIn
+	}
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+				} else if !f.drop {
+					res.Data = h.truncate(f, res.Miss, res.Data)
+					resOut <- res
+				}
+			case e, ok := <-errIn:
+				if !ok {
+					errIn = nil
+				} else if !f.drop {
+					errOut <- e
+				}
+			}
+		}
+
+		if f.drop {
+			errOut <- ErrFaultDropped
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *faultyHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	f, err := h.next()
+	if err != nil {
+		errOut <- err
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	resIn, errIn := h.wrapped.GetE(cmd)
+	if !f.drop && !f.truncate {
+		return resIn, errIn
+	}
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+				} else if !f.drop {
+					res.Data = h.truncate(f, res.Miss, res.Data)
+					resOut <- res
+				}
+			case e, ok := <-errIn:
+				if !ok {
+					errIn = nil
+				} else if !f.drop {
+					errOut <- e
+				}
+			}
+		}
+
+		if f.drop {
+			errOut <- ErrFaultDropped
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *faultyHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	f, err := h.next()
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+
+	res, err := h.wrapped.GAT(cmd)
+	if f.drop {
+		return common.GetResponse{}, ErrFaultDropped
+	}
+	res.Data = h.truncate(f, res.Miss, res.Data)
+	return res, err
+}
+
+func (h *faultyHandler) Delete(cmd common.DeleteRequest) error {
+	f, err := h.next()
+	if err != nil {
+		return err
+	}
+	return h.done(f, h.wrapped.Delete(cmd))
+}
+
+func (h *faultyHandler) Touch(cmd common.TouchRequest) error {
+	f, err := h.next()
+	if err != nil {
+		return err
+	}
+	return h.done(f, h.wrapped.Touch(cmd))
+}
+
+// Close closes the wrapped handler once, whether it's called by the proxy or
+// by an injected reset.
+func (h *faultyHandler) Close() error {
+	var err error
+	h.close.Do(func() { err = h.wrapped.Close() })
+	return err
+}
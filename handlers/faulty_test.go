@@ -0,0 +1,133 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+func faulty(t *testing.T, f handlers.Faults) handlers.Handler {
+	hc := handlers.Faulty(func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go fakemem.New(false).ServeConn(server)
+		return std.NewHandler(client), nil
+	}, "test", f)
+
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Error making handler: %s", err.Error())
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func get(h handlers.Handler, key string) (common.GetResponse, error) {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				res = r
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+	return res, err
+}
+
+// Returns the errors of sets through a handler with the given faults
+func sets(t *testing.T, f handlers.Faults, n int) []error {
+	h := faulty(t, f)
+	var errs []error
+	for i := 0; i < n; i++ {
+		errs = append(errs, h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}))
+	}
+	return errs
+}
+
+func TestFaultyDeterministic(t *testing.T) {
+	f := handlers.Faults{DropProb: 0.5, Seed: 7}
+
+	first := sets(t, f, 50)
+	second := sets(t, f, 50)
+
+	var dropped int
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Set %d failed with %v the first time and %v the second", i, first[i], second[i])
+		}
+		if first[i] == handlers.ErrFaultDropped {
+			dropped++
+		}
+	}
+	if dropped == 0 || dropped == len(first) {
+		t.Fatalf("Expected some of the sets to be dropped, got %d of %d", dropped, len(first))
+	}
+
+	// Turning on another fault doesn't change which requests are dropped
+	f.LatencyProb = 0.5
+	for i, err := range sets(t, f, 50) {
+		if err != first[i] {
+			t.Fatalf("Set %d failed with %v without latency and %v with it", i, first[i], err)
+		}
+	}
+}
+
+func TestFaultyTruncate(t *testing.T) {
+	h := faulty(t, handlers.Faults{TruncateProb: 1})
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	res, err := get(h, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %s", err.Error())
+	}
+	if string(res.Data) != "va" {
+		t.Fatalf("Expected a truncated value, got %q", res.Data)
+	}
+}
+
+func TestFaultyReset(t *testing.T) {
+	h := faulty(t, handlers.Faults{ResetProb: 1})
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}); err != handlers.ErrFaultReset {
+		t.Fatalf("Expected the set to be reset, got %v", err)
+	}
+	if _, err := get(h, "k"); err != handlers.ErrFaultReset {
+		t.Fatalf("Expected the get after a reset to fail, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import "github.com/netflix/rend/common"
+
+// A getHook is run on each response and error of a get as it is forwarded, and
+// once more with the last error after the wrapped handler closes its channels.
+// Any of the functions may be nil.
+type getHook struct {
+	res  func(*common.GetResponse)
+	err  func(error)
+	done func(error)
+}
+
+type getEHook struct {
+	res  func(*common.GetEResponse)
+	err  func(error)
+	done func(error)
+}
+
+// hookedHandler is implemented by the wrappers that only look at or rewrite get
+// responses as they pass through. Each adds its hook and hands the get down,
+// so a stack of them forwards it through one goroutine instead of one each.
+// The hooks are given outermost first.
+type hookedHandler interface {
+	getHooked(cmd common.GetRequest, hooks []getHook) (<-chan common.GetResponse, <-chan error)
+	getEHooked(cmd common.GetRequest, hooks []getEHook) (<-chan common.GetEResponse, <-chan error)
+}
+
+// forwardGet sends the get to h with the hooks run on its responses. The
+// innermost hook is run first, so every wrapper sees what the ones inside it
+// returned. With no hooks the channels from h are returned as they are.
+func forwardGet(h Handler, cmd common.GetRequest, hooks []getHook) (<-chan common.GetResponse, <-chan error) {
+	if hh, ok := h.(hookedHandler); ok {
+		return hh.getHooked(cmd, hooks)
+	}
+
+	resIn, errIn := h.Get(cmd)
+	if len(hooks) == 0 {
+		return resIn, errIn
+	}
+
+	resOut := make(chan common.GetResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var last error
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				for i := len(hooks) - 1; i >= 0; i-- {
+					if hooks[i].res != nil {
+						hooks[i].res(&res)
+					}
+				}
+				resOut <- res
+			case err, ok := <-errIn:
+				if !ok {
+					errIn = nil
+					continue
+				}
+				for i := len(hooks) - 1; i >= 0; i-- {
+					if hooks[i].err != nil {
+						hooks[i].err(err)
+					}
+				}
+				last = err
+				errOut <- err
+			}
+		}
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if hooks[i].done != nil {
+				hooks[i].done(last)
+			}
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func forwardGetE(h Handler, cmd common.GetRequest, hooks []getEHook) (<-chan common.GetEResponse, <-chan error) {
+	if hh, ok := h.(hookedHandler); ok {
+		return hh.getEHooked(cmd, hooks)
+	}
+
+	resIn, errIn := h.GetE(cmd)
+	if len(hooks) == 0 {
+		return resIn, errIn
+	}
+
+	resOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var last error
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				for i := len(hooks) - 1; i >= 0; i-- {
+					if hooks[i].res != nil {
+						hooks[i].res(&res)
+					}
+				}
+				resOut <- res
+			case err, ok := <-errIn:
+				if !ok {
+					errIn = nil
+					continue
+				}
+				for i := len(hooks) - 1; i >= 0; i-- {
+					if hooks[i].err != nil {
+						hooks[i].err(err)
+					}
+				}
+				last = err
+				errOut <- err
+			}
+		}
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if hooks[i].done != nil {
+				hooks[i].done(last)
+			}
+		}
+	}()
+
+	return resOut, errOut
+}
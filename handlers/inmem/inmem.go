@@ -56,7 +56,7 @@ func (h *Handler) Set(cmd common.SetRequest) error {
 	}
 
 	h.data[string(cmd.Key)] = entry{
-		data:    cmd.Data,
+		data:    copyData(cmd.Data),
 		exptime: exptime,
 		flags:   cmd.Flags,
 	}
@@ -82,7 +82,7 @@ func (h *Handler) Add(cmd common.SetRequest) error {
 	}
 
 	h.data[string(cmd.Key)] = entry{
-		data:    cmd.Data,
+		data:    copyData(cmd.Data),
 		exptime: exptime,
 		flags:   cmd.Flags,
 	}
@@ -108,7 +108,7 @@ func (h *Handler) Replace(cmd common.SetRequest) error {
 	}
 
 	h.data[string(cmd.Key)] = entry{
-		data:    cmd.Data,
+		data:    copyData(cmd.Data),
 		exptime: exptime,
 		flags:   cmd.Flags,
 	}
@@ -150,7 +150,7 @@ func (h *Handler) Prepend(cmd common.SetRequest) error {
 	}
 
 	h.data[string(cmd.Key)] = entry{
-		data:    append(cmd.Data, e.data...),
+		data:    append(copyData(cmd.Data), e.data...),
 		exptime: e.exptime,
 		flags:   e.flags,
 	}
@@ -302,3 +302,9 @@ func (h *Handler) Touch(cmd common.TouchRequest) error {
 func (h *Handler) Close() error {
 	return nil
 }
+
+// Request values are in pooled buffers that are reused once the request is
+// done, so they have to be copied to be kept.
+func copyData(data []byte) []byte {
+	return append([]byte(nil), data...)
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// The counters for one command on one backend, tagged with both.
+type cmdMetrics struct {
+	requests uint32
+	hits     uint32
+	misses   uint32
+	errors   uint32
+	bytesIn  uint32
+	bytesOut uint32
+}
+
+func newCmdMetrics(cmd, backend string) cmdMetrics {
+	tgs := metrics.Tags{"cmd": cmd, "backend": backend}
+	return cmdMetrics{
+		requests: metrics.AddCounter("backend_requests", tgs),
+		hits:     metrics.AddCounter("backend_hits", tgs),
+		misses:   metrics.AddCounter("backend_misses", tgs),
+		errors:   metrics.AddCounter("backend_errors", tgs),
+		bytesIn:  metrics.AddCounter("backend_bytes_in", tgs),
+		bytesOut: metrics.AddCounter("backend_bytes_out", tgs),
+	}
+}
+
+// Counts the outcome of a request that has no value in the response. A request
+// that finds its key is a hit; set and add have no key to find so they only
+// count requests and errors.
+func (m cmdMetrics) done(err error, findsKey bool) error {
+	metrics.IncCounter(m.requests)
+	switch {
+	case err == nil:
+		if findsKey {
+			metrics.IncCounter(m.hits)
+		}
+	case err == common.ErrKeyNotFound:
+		metrics.IncCounter(m.misses)
+	default:
+		metrics.IncCounter(m.errors)
+	}
+	return err
+}
+
+// Counts one key in the response to a get.
+func (m cmdMetrics) response(miss bool, data []byte) {
+	if miss {
+		metrics.IncCounter(m.misses)
+	} else {
+		metrics.IncCounter(m.hits)
+		metrics.IncCounterBy(m.bytesIn, uint64(len(data)))
+	}
+}
+
+type instrumentedHandler struct {
+	wrapped Handler
+
+	set, add, replace, append, prepend cmdMetrics
+	get, gete, gat, delete, touch      cmdMetrics
+}
+
+// Instrumented wraps the handlers made by the given constructor to count the
+// requests, hits, misses, errors, and value bytes in and out of the backend for
+// each command. The counters are tagged with the command and the given backend
+// name, e.g. "l1".
+func Instrumented(hc HandlerConst, backend string) HandlerConst {
+	ih := instrumentedHandler{
+		set:     newCmdMetrics("set", backend),
+		add:     newCmdMetrics("add", backend),
+		replace: newCmdMetrics("replace", backend),
+		append:  newCmdMetrics("append", backend),
+		prepend: newCmdMetrics("prepend", backend),
+		get:     newCmdMetrics("get", backend),
+		gete:    newCmdMetrics("gete", backend),
+		gat:     newCmdMetrics("gat", backend),
+		delete:  newCmdMetrics("delete", backend),
+		touch:   newCmdMetrics("touch", backend),
+	}
+
+	return func() (Handler, error) {
+		h, err := hc()
+		if h == nil || err != nil {
+			return h, err
+		}
+
+		ret := ih
+		ret.wrapped = h
+		return &ret, nil
+	}
+}
+
+func (h *instrumentedHandler) Set(cmd common.SetRequest) error {
+	metrics.IncCounterBy(h.set.bytesOut, uint64(len(cmd.Data)))
+	return h.set.done(h.wrapped.Set(cmd), false)
+}
+
+func (h *instrumentedHandler) Add(cmd common.SetRequest) error {
+	metrics.IncCounterBy(h.add.bytesOut, uint64(len(cmd.Data)))
+	return h.add.done(h.wrapped.Add(cmd), false)
+}
+
+func (h *instrumentedHandler) Replace(cmd common.SetRequest) error {
+	metrics.IncCounterBy(h.replace.bytesOut, uint64(len(cmd.Data)))
+	return h.replace.done(h.wrapped.Replace(cmd), true)
+}
+
+func (h *instrumentedHandler) Append(cmd common.SetRequest) error {
+	metrics.IncCounterBy(h.append.bytesOut, uint64(len(cmd.Data)))
+	return h.append.done(h.wrapped.Append(cmd), true)
+}
+
+func (h *instrumentedHandler) Prepend(cmd common.SetRequest) error {
+	metrics.IncCounterBy(h.prepend.bytesOut, uint64(len(cmd.Data)))
+	return h.prepend.done(h.wrapped.Prepend(cmd), true)
+}
+
+// Get and GetE responses are counted per key as they are passed through, by a
+// hook on the goroutine that forwards them rather than one of its own.
+func (h *instrumentedHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return h.getHooked(cmd, nil)
+}
+
+func (h *instrumentedHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return h.getEHooked(cmd, nil)
+}
+
+func (h *instrumentedHandler) getHooked(cmd common.GetRequest, hooks []getHook) (<-chan common.GetResponse, <-chan error) {
+	metrics.IncCounter(h.get.requests)
+	return forwardGet(h.wrapped, cmd, append(hooks, getHook{
+		res: func(res *common.GetResponse) {
+			h.get.response(res.Miss, res.Data)
+		},
+		err: func(error) {
+			metrics.IncCounter(h.get.errors)
+		},
+	}))
+}
+
+func (h *instrumentedHandler) getEHooked(cmd common.GetRequest, hooks []getEHook) (<-chan common.GetEResponse, <-chan error) {
+	metrics.IncCounter(h.gete.requests)
+	return forwardGetE(h.wrapped, cmd, append(hooks, getEHook{
+		res: func(res *common.GetEResponse) {
+			h.gete.response(res.Miss, res.Data)
+		},
+		err: func(error) {
+			metrics.IncCounter(h.gete.errors)
+		},
+	}))
+}
+
+func (h *instrumentedHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.wrapped.GAT(cmd)
+	metrics.IncCounter(h.gat.requests)
+
+	switch {
+	case err != nil:
+		metrics.IncCounter(h.gat.errors)
+	case res.Miss:
+		metrics.IncCounter(h.gat.misses)
+	default:
+		metrics.IncCounter(h.gat.hits)
+		metrics.IncCounterBy(h.gat.bytesIn, uint64(len(res.Data)))
+	}
+
+	return res, err
+}
+
+func (h *instrumentedHandler) Delete(cmd common.DeleteRequest) error {
+	return h.delete.done(h.wrapped.Delete(cmd), true)
+}
+
+func (h *instrumentedHandler) Touch(cmd common.TouchRequest) error {
+	return h.touch.done(h.wrapped.Touch(cmd), true)
+}
+
+func (h *instrumentedHandler) Close() error {
+	return h.wrapped.Close()
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+func backendCounter(name, cmd, backend string) uint64 {
+	for _, c := range metrics.GetCounters() {
+		if c.Name == name && c.Tags["cmd"] == cmd && c.Tags["backend"] == backend {
+			return c.Value
+		}
+	}
+	return 0
+}
+
+func TestInstrumentedGet(t *testing.T) {
+	h, raw := wrapped(t, func(hc handlers.HandlerConst) handlers.HandlerConst {
+		return handlers.Instrumented(handlers.Verified(hc), "instrumented_get")
+	})
+
+	for _, key := range []string{"k", "corrupt"} {
+		if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte("value")}); err != nil {
+			t.Fatalf("Error setting: %s", err.Error())
+		}
+	}
+	stored, _ := get(raw, "corrupt")
+	stored.Data[len(stored.Data)/2] ^= 1
+	if err := raw.Set(common.SetRequest{Key: []byte("corrupt"), Data: stored.Data}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	counters := []string{"backend_requests", "backend_hits", "backend_misses", "backend_bytes_in"}
+	start := make(map[string]uint64)
+	for _, name := range counters {
+		start[name] = backendCounter(name, "get", "instrumented_get")
+	}
+
+	for _, key := range []string{"k", "corrupt", "missing"} {
+		if _, err := get(h, key); err != nil {
+			t.Fatalf("Error getting %s: %s", key, err.Error())
+		}
+	}
+
+	// The count is taken after the value is checked, so the corrupt value is a
+	// miss like the missing one
+	expected := []uint64{3, 1, 2, uint64(len("value"))}
+	for i, name := range counters {
+		if n := backendCounter(name, "get", "instrumented_get") - start[name]; n != expected[i] {
+			t.Fatalf("Expected %s to go up by %d, got %d", name, expected[i], n)
+		}
+	}
+}
+
+// A backend whose gets never answer
+type silentGets struct {
+	handlers.Handler
+}
+
+func (silentGets) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return make(chan common.GetResponse), make(chan error)
+}
+
+func TestStackedWrappersShareGoroutine(t *testing.T) {
+	var hc handlers.HandlerConst = func() (handlers.Handler, error) {
+		return silentGets{}, nil
+	}
+	hc = handlers.Verified(hc)
+	hc = handlers.Instrumented(hc, "stacked")
+	hc = handlers.Traced(hc, "stacked")
+	h, _ := hc()
+
+	before := runtime.NumGoroutine()
+	h.Get(common.GetRequest{Keys: [][]byte{[]byte("k")}})
+	if n := runtime.NumGoroutine() - before; n != 1 {
+		t.Fatalf("Expected the wrappers to forward the get on 1 goroutine, got %d", n)
+	}
+}
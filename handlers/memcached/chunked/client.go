@@ -0,0 +1,83 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"io"
+
+	"github.com/netflix/rend/common"
+)
+
+// Client reads and writes values in the chunked format directly in memcached,
+// without going through Rend, for tools like migration scripts and for
+// debugging. It shares its code with the Handler the proxy uses, so values
+// written by either can be read by the other. Like a Handler, a Client can
+// only be used by one goroutine at a time.
+type Client struct {
+	h Handler
+}
+
+// NewClient returns a client that talks to memcached over the connection. The
+// connection is closed when the client is.
+func NewClient(conn io.ReadWriteCloser) Client {
+	return Client{h: NewHandler(conn)}
+}
+
+func (c Client) Close() error {
+	return c.h.Close()
+}
+
+// The key with no spare capacity, so building the metadata and chunk keys
+// from it can't write into the caller's array
+func fullKey(key []byte) []byte {
+	return key[:len(key):len(key)]
+}
+
+// Get returns the value and flags stored for the key. It returns
+// common.ErrKeyNotFound if the key is missing or any of its chunks are
+// missing or from a different write.
+func (c Client) Get(key []byte) ([]byte, uint32, error) {
+	flags, data, err := getOne(c.h.rw, fullKey(key), nil)
+	return data, flags, err
+}
+
+// Set stores the value for the key, replacing any value already there.
+func (c Client) Set(key, data []byte, flags, exptime uint32) error {
+	return c.h.Set(common.SetRequest{
+		Key:     fullKey(key),
+		Data:    data,
+		Flags:   flags,
+		Exptime: exptime,
+	})
+}
+
+// Delete removes the key. It returns common.ErrKeyNotFound if it is missing.
+func (c Client) Delete(key []byte) error {
+	return c.h.Delete(common.DeleteRequest{Key: fullKey(key)})
+}
+
+// Touch sets a new expiration time for the key. It returns
+// common.ErrKeyNotFound if it is missing.
+func (c Client) Touch(key []byte, exptime uint32) error {
+	return c.h.Touch(common.TouchRequest{Key: fullKey(key), Exptime: exptime})
+}
+
+// Metadata returns the metadata stored for the key without reading its chunks,
+// e.g. to see how a value was split. It returns common.ErrKeyNotFound if the
+// key is missing.
+func (c Client) Metadata(key []byte) (Metadata, error) {
+	_, md, err := getMetadata(c.h.rw, fullKey(key))
+	return md, err
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+func TestClientSharesFormatWithHandler(t *testing.T) {
+	server := fakemem.New(false)
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	c := chunked.NewClient(clientConn)
+	defer c.Close()
+
+	handlerConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	h := chunked.NewHandler(handlerConn)
+	defer h.Close()
+
+	value := bytes.Repeat([]byte("0123456789"), 5000)
+
+	// Spare capacity the chunk keys must not be written into
+	key := append(make([]byte, 0, 64), "tool"...)
+	spare := key[:cap(key)]
+	spare[len(key)] = 'x'
+
+	if err := c.Set(key, value, 3, 0); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if spare[len(key)] != 'x' {
+		t.Fatalf("Client wrote into the spare capacity of the key")
+	}
+
+	if res := get(t, h, "tool"); res.Miss || res.Flags != 3 || !bytes.Equal(res.Data, value) {
+		t.Fatalf("Handler got back a different value: miss %v, flags %d, %d bytes", res.Miss, res.Flags, len(res.Data))
+	}
+
+	data, flags, err := c.Get(key)
+	if err != nil || flags != 3 || !bytes.Equal(data, value) {
+		t.Fatalf("Client got back a different value: err %v, flags %d, %d bytes", err, flags, len(data))
+	}
+
+	md, err := c.Metadata(key)
+	if err != nil {
+		t.Fatalf("Error getting metadata: %s", err.Error())
+	}
+	if md.Length != uint32(len(value)) || md.OrigFlags != 3 || md.NumChunks < 2 {
+		t.Fatalf("Unexpected metadata %+v", md)
+	}
+
+	decoded, err := chunked.DecodeMetadata(chunked.AppendMetadata(nil, md))
+	if err != nil || decoded != md {
+		t.Fatalf("Metadata didn't survive encoding: %+v, %v", decoded, err)
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: []byte("tool")}); err != nil {
+		t.Fatalf("Error deleting: %s", err.Error())
+	}
+	if _, _, err := c.Get(key); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected key not found after delete, got %v", err)
+	}
+}
+
+func TestClientLayout(t *testing.T) {
+	server := fakemem.New(false)
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	c := chunked.NewClient(clientConn)
+	defer c.Close()
+
+	rawConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	raw := std.NewHandler(rawConn)
+	defer raw.Close()
+
+	key := []byte("layout")
+
+	layout, err := c.Layout(key)
+	if err != nil || layout.Metadata != nil || len(layout.Chunks) != 0 || layout.Complete() {
+		t.Fatalf("Expected nothing for a missing key, got %+v, %v", layout, err)
+	}
+
+	// A shorter value over a longer one leaves the longer one's last chunks
+	if err := c.Set(key, bytes.Repeat([]byte("a"), 5000), 0, 0); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	long, _ := c.Layout(key)
+	if err := c.Set(key, bytes.Repeat([]byte("b"), 1500), 0, 0); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	layout, err = c.Layout(key)
+	if err != nil {
+		t.Fatalf("Error getting layout: %s", err.Error())
+	}
+	if !layout.Complete() || len(layout.Chunks) != int(layout.Metadata.NumChunks) {
+		t.Fatalf("Expected a complete layout, got %+v", layout)
+	}
+	if len(layout.Orphans) != len(long.Chunks)-len(layout.Chunks) || len(layout.Orphans) == 0 {
+		t.Fatalf("Expected %d orphans, got %+v", len(long.Chunks)-len(layout.Chunks), layout.Orphans)
+	}
+
+	if err := raw.Delete(common.DeleteRequest{Key: layout.Chunks[0].Key}); err != nil {
+		t.Fatalf("Error deleting chunk: %s", err.Error())
+	}
+	layout, err = c.Layout(key)
+	if err != nil || layout.Complete() || layout.Chunks[0].Present || !layout.Chunks[len(layout.Chunks)-1].Present {
+		t.Fatalf("Expected the first chunk to be missing, got %+v, %v", layout, err)
+	}
+
+	var text bytes.Buffer
+	layout.WriteText(&text)
+	if !bytes.Contains(text.Bytes(), []byte("layout-0: MISSING")) || !bytes.Contains(text.Bytes(), []byte("ORPHANED")) {
+		t.Fatalf("Expected the missing and orphaned chunks to be flagged, got:\n%s", text.String())
+	}
+}
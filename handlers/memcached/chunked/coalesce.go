@@ -0,0 +1,107 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/tracing"
+)
+
+var MetricCmdGetCoalesced = metrics.AddCounter("cmd_get_coalesced", nil)
+
+// Seen by waiters if the fetch they waited on panicked. It isn't an app error,
+// so they fetch the key themselves.
+var errFetchAbandoned = errors.New("Coalesced fetch did not finish")
+
+func init() {
+	metrics.Describe("cmd_get_coalesced", metrics.UnitCount, "Gets that shared the fetch of a concurrent get for the same key instead of fetching it again")
+}
+
+// A fetch of one key in progress that other gets for the same key can wait on.
+// The results are only written before done is closed.
+type flight struct {
+	done  chan struct{}
+	flags uint32
+	data  []byte
+	err   error
+}
+
+var (
+	flightsLock sync.Mutex
+	flights     = make(map[string]*flight)
+)
+
+// Calls fetch for the key unless a fetch for the same key is already in
+// progress on another connection, in which case it waits for that one and
+// returns its results. This way many clients getting the same large key at the
+// same time only fetch all of its chunks once. The shared data is only ever
+// read, so the same slice can be sent to every client.
+//
+// A get that starts while a fetch is in progress can see the value from just
+// before a concurrent set, the same as if it had arrived slightly earlier. Once
+// a write is done, though, the fetch is detached so later gets don't join it.
+func coalesce(key []byte, span *tracing.Span, fetch func() (uint32, []byte, error)) (uint32, []byte, error) {
+	flightsLock.Lock()
+	if f, ok := flights[string(key)]; ok {
+		flightsLock.Unlock()
+
+		waitSpan := span.Child("get_coalesced", tracing.KindClient)
+		<-f.done
+		waitSpan.Finish()
+
+		// An I/O error on the other connection says nothing about this one,
+		// so fetch it here instead of failing this connection too.
+		if f.err != nil && !common.IsAppError(f.err) {
+			return fetch()
+		}
+
+		metrics.IncCounter(MetricCmdGetCoalesced)
+		return f.flags, f.data, f.err
+	}
+
+	f := &flight{
+		done: make(chan struct{}),
+		err:  errFetchAbandoned,
+	}
+	flights[string(key)] = f
+	flightsLock.Unlock()
+
+	// Waiters are released even if the fetch panics
+	defer func() {
+		flightsLock.Lock()
+		// Unless it was detached and another fetch took its place
+		if flights[string(key)] == f {
+			delete(flights, string(key))
+		}
+		flightsLock.Unlock()
+		close(f.done)
+	}()
+
+	f.flags, f.data, f.err = fetch()
+	return f.flags, f.data, f.err
+}
+
+// Keeps gets that start from now on from joining the fetch of the key in
+// progress, if any, after a write of the key is done. The gets already waiting
+// on it still get its results.
+func detachFlight(key []byte) {
+	flightsLock.Lock()
+	delete(flights, string(key))
+	flightsLock.Unlock()
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+)
+
+// Waits for a fetch of the key to start
+func waitForFlight(key string) *flight {
+	for {
+		flightsLock.Lock()
+		f, ok := flights[key]
+		flightsLock.Unlock()
+		if ok {
+			return f
+		}
+		runtime.Gosched()
+	}
+}
+
+// Waits for the gets that started to join the fetch in progress. Nothing
+// signals that they have, so they're given a moment once they're running.
+func waitToJoin(started *sync.WaitGroup) {
+	started.Wait()
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestCoalesceSharesFetch(t *testing.T) {
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() (uint32, []byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return 7, []byte("value"), nil
+	}
+
+	// The leader blocks in fetch until every waiter has joined
+	leaderDone := make(chan struct{})
+	go func() {
+		coalesce([]byte("key"), nil, fetch)
+		close(leaderDone)
+	}()
+
+	waitForFlight("key")
+
+	wg := sync.WaitGroup{}
+	started := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			flags, data, err := coalesce([]byte("key"), nil, fetch)
+			if flags != 7 || string(data) != "value" || err != nil {
+				t.Errorf("Unexpected result %d %q %v", flags, data, err)
+			}
+		}()
+	}
+	waitToJoin(&started)
+
+	close(release)
+	wg.Wait()
+	<-leaderDone
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("Expected 1 fetch, got %d", n)
+	}
+	if len(flights) != 0 {
+		t.Errorf("Expected no flights left, got %d", len(flights))
+	}
+}
+
+func TestCoalesceRefetchesAfterIOError(t *testing.T) {
+	release := make(chan struct{})
+	leaderDone := make(chan struct{})
+	go func() {
+		coalesce([]byte("k"), nil, func() (uint32, []byte, error) {
+			<-release
+			return 0, nil, io.ErrUnexpectedEOF
+		})
+		close(leaderDone)
+	}()
+	waitForFlight("k")
+
+	res := make(chan error)
+	started := sync.WaitGroup{}
+	started.Add(1)
+	go func() {
+		started.Done()
+		_, _, err := coalesce([]byte("k"), nil, func() (uint32, []byte, error) {
+			return 0, nil, common.ErrKeyNotFound
+		})
+		res <- err
+	}()
+	waitToJoin(&started)
+
+	close(release)
+	<-leaderDone
+	if err := <-res; err != common.ErrKeyNotFound {
+		t.Errorf("Expected the waiter to fetch for itself, got %v", err)
+	}
+}
+
+func TestCoalesceDetachedByWrite(t *testing.T) {
+	release := make(chan struct{})
+	leaderDone := make(chan struct{})
+	go func() {
+		coalesce([]byte("w"), nil, func() (uint32, []byte, error) {
+			<-release
+			return 0, []byte("old"), nil
+		})
+		close(leaderDone)
+	}()
+	old := waitForFlight("w")
+
+	// A write finished while the fetch was in progress
+	detachFlight([]byte("w"))
+
+	_, data, err := coalesce([]byte("w"), nil, func() (uint32, []byte, error) {
+		return 0, []byte("new"), nil
+	})
+	if err != nil || string(data) != "new" {
+		t.Errorf("Expected a get after the write to fetch for itself, got %q, %v", data, err)
+	}
+
+	// The detached fetch finishing doesn't remove a flight that took its place
+	next := &flight{done: make(chan struct{})}
+	flightsLock.Lock()
+	flights["w"] = next
+	flightsLock.Unlock()
+
+	close(release)
+	<-leaderDone
+	<-old.done
+
+	flightsLock.Lock()
+	f := flights["w"]
+	delete(flights, "w")
+	flightsLock.Unlock()
+	if f != next {
+		t.Errorf("Expected the newer flight to be left alone")
+	}
+}
+
+func TestSetDetachesFlight(t *testing.T) {
+	client, server := net.Pipe()
+	go fakemem.New(false).ServeConn(server)
+	h := NewHandler(client)
+	defer h.Close()
+
+	release := make(chan struct{})
+	leaderDone := make(chan struct{})
+	go func() {
+		coalesce([]byte("s"), nil, func() (uint32, []byte, error) {
+			<-release
+			return 0, nil, common.ErrKeyNotFound
+		})
+		close(leaderDone)
+	}()
+	waitForFlight("s")
+	defer func() {
+		close(release)
+		<-leaderDone
+	}()
+
+	if err := h.Set(common.SetRequest{Key: []byte("s"), Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// Doesn't wait on the fetch from before the set
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("s")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	var res common.GetResponse
+	select {
+	case res = <-resChan:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the get not to wait on the fetch from before the set")
+	}
+	if err, ok := <-errChan; ok {
+		t.Fatalf("Error getting: %s", err.Error())
+	}
+	if res.Miss || string(res.Data) != "value" {
+		t.Fatalf("Expected the value just set, got miss %v, %q", res.Miss, res.Data)
+	}
+}
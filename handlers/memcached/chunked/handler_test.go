@@ -0,0 +1,398 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+func newHandler(t *testing.T) chunked.Handler {
+	client, server := net.Pipe()
+	go fakemem.New(false).ServeConn(server)
+
+	h := chunked.NewHandler(client)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func get(t *testing.T, h chunked.Handler, key string) common.GetResponse {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			res = r
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			t.Fatalf("Error getting %s: %s", key, err.Error())
+		}
+	}
+
+	return res
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	h := newHandler(t)
+
+	// Many chunks, with a partial last chunk
+	value := make([]byte, 100*1024+123)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+
+	err := h.Set(common.SetRequest{Key: []byte("big"), Flags: 9, Data: value})
+	if err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	res := get(t, h, "big")
+	if res.Miss || res.Flags != 9 || !bytes.Equal(res.Data, value) {
+		t.Fatalf("Got back a different value: miss %v, flags %d, %d bytes", res.Miss, res.Flags, len(res.Data))
+	}
+
+	err = h.Append(common.SetRequest{Key: []byte("big"), Data: []byte("tail")})
+	if err != nil {
+		t.Fatalf("Error appending: %s", err.Error())
+	}
+
+	gat, err := h.GAT(common.GATRequest{Key: []byte("big"), Exptime: 100})
+	if err != nil {
+		t.Fatalf("Error in get and touch: %s", err.Error())
+	}
+	if gat.Miss || !bytes.Equal(gat.Data, append(value, "tail"...)) {
+		t.Fatalf("Got back a different value after append: miss %v, %d bytes", gat.Miss, len(gat.Data))
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: []byte("big")}); err != nil {
+		t.Fatalf("Error deleting: %s", err.Error())
+	}
+	if res := get(t, h, "big"); !res.Miss {
+		t.Fatalf("Expected a miss after delete")
+	}
+	if err := h.Delete(common.DeleteRequest{Key: []byte("big")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected key not found deleting again, got %v", err)
+	}
+}
+
+func TestChunkedExptime(t *testing.T) {
+	server := fakemem.New(false)
+
+	handlerConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	h := chunked.NewHandler(handlerConn)
+	defer h.Close()
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	c := chunked.NewClient(clientConn)
+	defer c.Close()
+
+	value := bytes.Repeat([]byte("x"), 5000)
+	set := func(key string, exptime uint32) error {
+		return h.Set(common.SetRequest{Key: []byte(key), Data: value, Exptime: exptime})
+	}
+
+	// Zero never expires
+	if err := set("forever", 0); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if md, err := c.Metadata([]byte("forever")); err != nil || md.Exptime != 0 {
+		t.Fatalf("Expected no expiration in the metadata, got %+v, %v", md, err)
+	}
+
+	// Relative exptimes are stored as unix times
+	before := uint32(time.Now().Unix())
+	if err := set("relative", 100); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if md, err := c.Metadata([]byte("relative")); err != nil || md.Exptime < before+100 || md.Exptime > before+101 {
+		t.Fatalf("Expected the metadata to expire 100s from now, got %+v, %v", md, err)
+	}
+
+	// An exptime in the past deletes what was there, metadata and chunks
+	if err := set("forever", common.ExptimeExpired); err != nil {
+		t.Fatalf("Error setting an expired value: %s", err.Error())
+	}
+	if res := get(t, h, "forever"); !res.Miss {
+		t.Fatalf("Expected a miss after setting an expired value")
+	}
+	if l, err := c.Layout([]byte("forever")); err != nil || l.Metadata != nil || len(l.Orphans) != 0 {
+		t.Fatalf("Expected the metadata and chunks to be deleted, got %+v, %v", l, err)
+	}
+
+	// Adds and replaces fail the same as they would with any exptime
+	if err := h.Add(common.SetRequest{Key: []byte("relative"), Data: value, Exptime: common.ExptimeExpired}); err != common.ErrKeyExists {
+		t.Fatalf("Expected an expired add of a stored key to fail, got %v", err)
+	}
+	if res := get(t, h, "relative"); res.Miss {
+		t.Fatalf("Expected a failed add to leave the stored value")
+	}
+	if err := h.Add(common.SetRequest{Key: []byte("new"), Data: value, Exptime: common.ExptimeExpired}); err != nil {
+		t.Fatalf("Expected an expired add of a new key to succeed, got %v", err)
+	}
+	if err := h.Replace(common.SetRequest{Key: []byte("new"), Data: value, Exptime: common.ExptimeExpired}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected an expired replace of a missing key to fail, got %v", err)
+	}
+	if err := h.Replace(common.SetRequest{Key: []byte("relative"), Data: value, Exptime: common.ExptimeExpired}); err != nil {
+		t.Fatalf("Expected an expired replace of a stored key to succeed, got %v", err)
+	}
+	if res := get(t, h, "relative"); !res.Miss {
+		t.Fatalf("Expected a miss after replacing with an expired value")
+	}
+}
+
+func TestChunkedFormatVersion(t *testing.T) {
+	common.SetFlagBits(common.DefaultFlagBits)
+	defer common.SetFlagBits(common.FlagBits{})
+
+	fm := fakemem.New(false)
+	client, server := net.Pipe()
+	go fm.ServeConn(server)
+	h := chunked.NewHandler(client)
+	defer h.Close()
+
+	rawClient, rawServer := net.Pipe()
+	go fm.ServeConn(rawServer)
+	raw := std.NewHandler(rawClient)
+	defer raw.Close()
+
+	if err := h.Set(common.SetRequest{Key: []byte("v"), Flags: 9, Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	resChan, errChan := raw.Get(common.GetRequest{
+		Keys:    [][]byte{chunked.MetaKey([]byte("v"))},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	meta := <-resChan
+	if err := <-errChan; err != nil {
+		t.Fatalf("Error getting the metadata: %s", err.Error())
+	}
+
+	if v := common.FlagVersion(meta.Flags); v != chunked.FormatVersion {
+		t.Fatalf("Expected the metadata flags to have format version %d, got %d", chunked.FormatVersion, v)
+	}
+	if flags := meta.Flags &^ common.GetFlagBits().Mask(); flags != 9 {
+		t.Fatalf("Expected the rest of the metadata flags to be the value's, got %d", flags)
+	}
+	if res := get(t, h, "v"); res.Flags != 9 {
+		t.Fatalf("Expected the value's own flags back, got %d", res.Flags)
+	}
+}
+
+func TestChunkedMissingChunk(t *testing.T) {
+	fm := fakemem.New(false)
+	client, server := net.Pipe()
+	go fm.ServeConn(server)
+	h := chunked.NewHandler(client)
+	defer h.Close()
+
+	rawClient, rawServer := net.Pipe()
+	go fm.ServeConn(rawServer)
+	raw := std.NewHandler(rawClient)
+	defer raw.Close()
+
+	value := make([]byte, 5000)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	if err := h.Set(common.SetRequest{Key: []byte("big"), Data: value}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// Losing a chunk in the middle used to shift the chunks after it down
+	if err := raw.Delete(common.DeleteRequest{Key: chunked.ChunkKey([]byte("big"), 1)}); err != nil {
+		t.Fatalf("Error deleting a chunk: %s", err.Error())
+	}
+	if res := get(t, h, "big"); !res.Miss {
+		t.Fatalf("Expected a miss with a chunk missing, got %d bytes", len(res.Data))
+	}
+
+	// The connection is still usable
+	if err := h.Set(common.SetRequest{Key: []byte("big"), Data: value}); err != nil {
+		t.Fatalf("Error setting again: %s", err.Error())
+	}
+	if res := get(t, h, "big"); res.Miss || !bytes.Equal(res.Data, value) {
+		t.Fatalf("Expected the value back after setting it again")
+	}
+}
+
+func TestChunkedGATExptime(t *testing.T) {
+	fm := fakemem.New(false)
+	client, server := net.Pipe()
+	go fm.ServeConn(server)
+	h := chunked.NewHandler(client)
+	defer h.Close()
+
+	clientConn, serverConn := net.Pipe()
+	go fm.ServeConn(serverConn)
+	c := chunked.NewClient(clientConn)
+	defer c.Close()
+
+	rawClient, rawServer := net.Pipe()
+	go fm.ServeConn(rawServer)
+	raw := std.NewHandler(rawClient)
+	defer raw.Close()
+
+	value := bytes.Repeat([]byte("x"), 5000)
+	if err := h.Set(common.SetRequest{Key: []byte("big"), Data: value}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// The metadata gets the new exptime along with the chunks, like a touch
+	before := uint32(time.Now().Unix())
+	res, err := h.GAT(common.GATRequest{Key: []byte("big"), Exptime: 100})
+	if err != nil || res.Miss || !bytes.Equal(res.Data, value) {
+		t.Fatalf("Expected the value back from a GAT, got miss %v, %v", res.Miss, err)
+	}
+	if md, err := c.Metadata([]byte("big")); err != nil || md.Exptime < before+100 || md.Exptime > before+101 {
+		t.Fatalf("Expected the metadata to expire 100s from now, got %+v, %v", md, err)
+	}
+
+	// With a chunk gone, the GAT misses and the metadata keeps its exptime
+	if err := raw.Delete(common.DeleteRequest{Key: chunked.ChunkKey([]byte("big"), 1)}); err != nil {
+		t.Fatalf("Error deleting a chunk: %s", err.Error())
+	}
+	res, err = h.GAT(common.GATRequest{Key: []byte("big"), Exptime: 0})
+	if err != nil || !res.Miss {
+		t.Fatalf("Expected a miss with a chunk missing, got %v", err)
+	}
+	if md, err := c.Metadata([]byte("big")); err != nil || md.Exptime < before+100 {
+		t.Fatalf("Expected the metadata to keep its exptime, got %+v, %v", md, err)
+	}
+	if err := h.Touch(common.TouchRequest{Key: []byte("big"), Exptime: 0}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected key not found touching with a chunk missing, got %v", err)
+	}
+}
+
+func TestChunkedLegacyFallback(t *testing.T) {
+	chunked.SetLegacyFallback(true)
+	defer chunked.SetLegacyFallback(false)
+
+	fm := fakemem.New(false)
+	client, server := net.Pipe()
+	go fm.ServeConn(server)
+	h := chunked.NewHandler(client)
+	defer h.Close()
+
+	rawClient, rawServer := net.Pipe()
+	go fm.ServeConn(rawServer)
+	raw := std.NewHandler(rawClient)
+	defer raw.Close()
+
+	// Written by a client that doesn't go through the proxy
+	if err := raw.Set(common.SetRequest{Key: []byte("old"), Flags: 3, Data: []byte("plain")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	if res := get(t, h, "old"); res.Miss || res.Flags != 3 || string(res.Data) != "plain" {
+		t.Fatalf("Expected the plain value back untouched, got %+v", res)
+	}
+	if res, err := h.GAT(common.GATRequest{Key: []byte("old"), Exptime: 100}); err != nil || res.Miss || string(res.Data) != "plain" {
+		t.Fatalf("Expected a GAT of the plain value to hit, got %+v, %v", res, err)
+	}
+	if err := h.Touch(common.TouchRequest{Key: []byte("old"), Exptime: 100}); err != nil {
+		t.Fatalf("Expected a touch of the plain value to hit, got %v", err)
+	}
+
+	// A chunked value written over it takes precedence
+	if err := h.Set(common.SetRequest{Key: []byte("old"), Data: []byte("chunked")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if res := get(t, h, "old"); res.Miss || string(res.Data) != "chunked" {
+		t.Fatalf("Expected the chunked value, got %+v", res)
+	}
+
+	// And deleting it doesn't leave the plain one behind
+	if err := h.Delete(common.DeleteRequest{Key: []byte("old")}); err != nil {
+		t.Fatalf("Error deleting: %s", err.Error())
+	}
+	if res := get(t, h, "old"); !res.Miss {
+		t.Fatalf("Expected a miss after the delete, got %+v", res)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: []byte("old")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected deleting again to miss, got %v", err)
+	}
+}
+
+func TestChunkedLegacyOverwritten(t *testing.T) {
+	chunked.SetLegacyFallback(true)
+	defer chunked.SetLegacyFallback(false)
+
+	fm := fakemem.New(false)
+	client, server := net.Pipe()
+	go fm.ServeConn(server)
+	h := chunked.NewHandler(client)
+	defer h.Close()
+
+	rawClient, rawServer := net.Pipe()
+	go fm.ServeConn(rawServer)
+	raw := std.NewHandler(rawClient)
+	defer raw.Close()
+
+	for _, key := range []string{"set", "add", "replace"} {
+		if err := raw.Set(common.SetRequest{Key: []byte(key), Data: []byte("plain")}); err != nil {
+			t.Fatalf("Error setting: %s", err.Error())
+		}
+	}
+
+	// The plain value is there as far as clients can tell
+	if err := h.Add(common.SetRequest{Key: []byte("add"), Data: []byte("chunked")}); err != common.ErrKeyExists {
+		t.Fatalf("Expected adding over a plain value to fail, got %v", err)
+	}
+	if err := h.Replace(common.SetRequest{Key: []byte("replace"), Data: []byte("chunked")}); err != nil {
+		t.Fatalf("Expected replacing a plain value to work, got %v", err)
+	}
+	if err := h.Set(common.SetRequest{Key: []byte("set"), Data: []byte("chunked")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// Once the metadata expires, the old plain value doesn't come back
+	for _, key := range []string{"set", "replace"} {
+		if res := get(t, h, key); res.Miss || string(res.Data) != "chunked" {
+			t.Fatalf("Expected the chunked value of %s, got %+v", key, res)
+		}
+		if err := raw.Delete(common.DeleteRequest{Key: chunked.MetaKey([]byte(key))}); err != nil {
+			t.Fatalf("Error deleting the metadata: %s", err.Error())
+		}
+		if res := get(t, h, key); !res.Miss {
+			t.Fatalf("Expected %s to miss once its metadata is gone, got %+v", key, res)
+		}
+		if res, err := h.GAT(common.GATRequest{Key: []byte(key), Exptime: 100}); err != nil || !res.Miss {
+			t.Fatalf("Expected a GAT of %s to miss once its metadata is gone, got %+v, %v", key, res, err)
+		}
+	}
+}
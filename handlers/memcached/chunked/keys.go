@@ -15,18 +15,23 @@
 package chunked
 
 import (
+	"bytes"
 	"math"
 	"strconv"
 )
 
-func metaKey(key []byte) []byte {
+// MetaKey returns the key the metadata for a value is stored under. It may use
+// the spare capacity of key.
+func MetaKey(key []byte) []byte {
 	// no need to copy, the header returned will point to the same array
 	// just with a longer len. It might get copied if the runtime decides
 	// to grow the slice.
 	return append(key, ([]byte("-meta"))...)
 }
 
-func chunkKey(key []byte, chunk int) []byte {
+// ChunkKey returns the key the given chunk of a value is stored under,
+// numbered from 0. It may use the spare capacity of key.
+func ChunkKey(key []byte, chunk int) []byte {
 	// TODO: POOL ME PLEASE
 	// or maybe not since pooling adds interface{} conversion overhead anyway
 	//
@@ -39,6 +44,29 @@ func chunkKey(key []byte, chunk int) []byte {
 	return strconv.AppendInt(key, int64(-chunk), 10)
 }
 
+// ClientKey returns the key a client uses for a key stored in memcached, the
+// reverse of MetaKey, for listing the keys in memcached. It returns false for
+// chunk keys, which have no key of their own. Any other key is returned as is,
+// like a plain value written without the proxy. Keys are only told apart by
+// their suffix, so a plain value whose key ends in -meta or a dash and a number
+// is mistaken for part of a chunked value.
+func ClientKey(key []byte) ([]byte, bool) {
+	if bytes.HasSuffix(key, []byte("-meta")) {
+		return key[:len(key)-len("-meta")], true
+	}
+
+	i := bytes.LastIndexByte(key, '-')
+	if i < 0 || i == len(key)-1 {
+		return key, true
+	}
+	for _, c := range key[i+1:] {
+		if c < '0' || c > '9' {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
 func chunkSliceIndices(chunkSize, chunkNum, totalLength int) (int, int) {
 	// Indices for slicing. End is exclusive
 	start := chunkSize * chunkNum
@@ -0,0 +1,183 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/netflix/rend/binprot"
+	"github.com/netflix/rend/common"
+)
+
+// The most chunks past the end of a value to look for. Chunks are written in
+// order, so leftovers from an older, longer value are found by looking until
+// one is missing.
+const maxOrphans = 64
+
+// ChunkInfo is what's stored under one chunk key.
+type ChunkInfo struct {
+	Key     []byte
+	Present bool
+	// The size of the data in the chunk, without its token
+	Size int
+	// Whether the chunk was written along with the metadata, going by its token
+	TokenMatches bool
+	// Whether the size is the chunk size in the metadata
+	SizeMatches bool
+
+	token []byte
+}
+
+// Layout is how a value is stored in chunks, for debugging partial misses.
+type Layout struct {
+	// Nil if the metadata is missing
+	Metadata *Metadata
+	// The chunks the metadata says the value has
+	Chunks []ChunkInfo
+	// Chunks after the last one the metadata says the value has, or any chunks
+	// if the metadata is missing. These are never read.
+	Orphans []ChunkInfo
+}
+
+// Complete is true if the value can be read: the metadata and every chunk are
+// there and from the same write.
+func (l Layout) Complete() bool {
+	if l.Metadata == nil {
+		return false
+	}
+	for _, c := range l.Chunks {
+		if !c.Present || !c.TokenMatches || !c.SizeMatches {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteText writes the layout for people to read, flagging anything that would
+// make a get miss.
+func (l Layout) WriteText(w io.Writer) {
+	if l.Metadata == nil {
+		fmt.Fprintln(w, "metadata: MISSING")
+	} else {
+		md := l.Metadata
+		fmt.Fprintf(w, "metadata: length=%d flags=%d chunks=%d chunk_size=%d instime=%d exptime=%d token=%x\n",
+			md.Length, md.OrigFlags, md.NumChunks, md.ChunkSize, md.Instime, md.Exptime, md.Token)
+	}
+
+	for _, c := range l.Chunks {
+		switch {
+		case !c.Present:
+			fmt.Fprintf(w, "chunk %s: MISSING\n", c.Key)
+		case !c.TokenMatches:
+			fmt.Fprintf(w, "chunk %s: size=%d STALE TOKEN\n", c.Key, c.Size)
+		case !c.SizeMatches:
+			fmt.Fprintf(w, "chunk %s: size=%d WRONG SIZE\n", c.Key, c.Size)
+		default:
+			fmt.Fprintf(w, "chunk %s: size=%d ok\n", c.Key, c.Size)
+		}
+	}
+	for _, c := range l.Orphans {
+		fmt.Fprintf(w, "chunk %s: size=%d ORPHANED\n", c.Key, c.Size)
+	}
+
+	if l.Complete() {
+		fmt.Fprintln(w, "complete")
+	} else {
+		fmt.Fprintln(w, "INCOMPLETE")
+	}
+}
+
+// Layout reads the metadata for the key and looks up each of its chunks, and
+// any orphaned chunks after them, without reading the value.
+func (c Client) Layout(key []byte) (Layout, error) {
+	key = fullKey(key)
+
+	var l Layout
+	md, err := c.Metadata(key)
+	switch err {
+	case nil:
+		l.Metadata = &md
+	case common.ErrKeyNotFound:
+	default:
+		return Layout{}, err
+	}
+
+	if l.Metadata != nil {
+		for i := 0; i < int(md.NumChunks); i++ {
+			ci, err := c.chunkInfo(key, i)
+			if err != nil {
+				return Layout{}, err
+			}
+
+			// Every chunk is the full chunk size, the last one with padding
+			ci.TokenMatches = ci.Present && bytes.Equal(ci.token, md.Token[:])
+			ci.SizeMatches = ci.Size == int(md.ChunkSize)
+			l.Chunks = append(l.Chunks, ci)
+		}
+	}
+
+	for i := int(md.NumChunks); i < int(md.NumChunks)+maxOrphans; i++ {
+		ci, err := c.chunkInfo(key, i)
+		if err != nil {
+			return Layout{}, err
+		}
+		if !ci.Present {
+			break
+		}
+		l.Orphans = append(l.Orphans, ci)
+	}
+
+	return l, nil
+}
+
+func (c Client) chunkInfo(key []byte, chunk int) (ChunkInfo, error) {
+	ci := ChunkInfo{Key: append([]byte(nil), ChunkKey(key, chunk)...)}
+
+	if err := binprot.WriteGetCmd(c.h.rw, ci.Key); err != nil {
+		return ChunkInfo{}, err
+	}
+	if err := c.h.rw.Flush(); err != nil {
+		return ChunkInfo{}, err
+	}
+
+	resHeader, err := binprot.ReadResponseHeader(c.h.rw)
+	if err != nil {
+		return ChunkInfo{}, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	body := make([]byte, resHeader.TotalBodyLength)
+	if _, err := io.ReadFull(c.h.rw, body); err != nil {
+		return ChunkInfo{}, err
+	}
+
+	if err := binprot.DecodeError(resHeader); err != nil {
+		if err == common.ErrKeyNotFound {
+			return ci, nil
+		}
+		return ChunkInfo{}, err
+	}
+
+	// The body is the flags, then the token and data
+	body = body[resHeader.ExtraLength:]
+	ci.Present = true
+	if len(body) >= tokenSize {
+		ci.token = body[:tokenSize]
+		ci.Size = len(body) - tokenSize
+	}
+	return ci, nil
+}
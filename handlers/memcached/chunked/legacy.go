@@ -0,0 +1,110 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/netflix/rend/binprot"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricCmdGetHitsLegacy = metrics.AddCounter("cmd_get_hits_legacy", nil)
+	MetricCmdGatHitsLegacy = metrics.AddCounter("cmd_gat_hits_legacy", nil)
+)
+
+func init() {
+	metrics.Describe("cmd_get_hits_legacy", metrics.UnitCount, "Gets that found no metadata and were answered with a value stored under its own key")
+	metrics.Describe("cmd_gat_hits_legacy", metrics.UnitCount, "GATs that found no metadata and were answered with a value stored under its own key")
+}
+
+var legacyFallback bool
+
+// SetLegacyFallback sets whether a key with no metadata is looked up as a
+// plain value stored under the key itself, like values written straight to
+// memcached before the proxy was put in front of it. Those values are returned
+// untouched. Gets, GATs, and touches fall back to the plain key. Sets,
+// replaces, and deletes delete it as well as writing or deleting the chunked
+// value, so an old plain value can't show up again once the chunked one is
+// gone, and adds fail if it's there. It must be called before any connections
+// are accepted.
+func SetLegacyFallback(enabled bool) {
+	legacyFallback = enabled
+}
+
+func getLegacy(rw *bufio.ReadWriter, key []byte) (uint32, []byte, error) {
+	if err := binprot.WriteGetCmd(rw, key); err != nil {
+		return 0, nil, err
+	}
+	return readLegacy(rw, binprot.OpcodeGet)
+}
+
+func gatLegacy(rw *bufio.ReadWriter, key []byte, exptime uint32) (uint32, []byte, error) {
+	if err := binprot.WriteGATCmd(rw, key, exptime); err != nil {
+		return 0, nil, err
+	}
+	return readLegacy(rw, binprot.OpcodeGat)
+}
+
+// Deletes the plain value under the key, returning whether there was one.
+func deleteLegacy(rw *bufio.ReadWriter, key []byte) (bool, error) {
+	if err := binprot.WriteDeleteCmd(rw.Writer, key); err != nil {
+		return false, err
+	}
+	err := simpleCmdLocal(rw, true, binprot.OpcodeDelete)
+	if err == common.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Reads the response to a get or GAT of a plain value. A miss is returned as
+// common.ErrKeyNotFound.
+func readLegacy(rw *bufio.ReadWriter, opcode uint8) (uint32, []byte, error) {
+	if err := rw.Flush(); err != nil {
+		return 0, nil, err
+	}
+
+	resHeader, err := readResponseHeader(rw.Reader, opcode)
+	if err != nil {
+		// read in the message "Not found" after a miss
+		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return 0, nil, ioerr
+		}
+		return 0, nil, err
+	}
+
+	// A hit has just the flags as its extras, and no key
+	if resHeader.ExtraLength != 4 || resHeader.KeyLength != 0 {
+		metrics.IncCounter(binprot.MetricBinaryResponseHeadersBad)
+		return 0, nil, binprot.ErrBadResponse
+	}
+
+	// The value is sent on to the client, so it isn't pooled
+	buf := make([]byte, resHeader.TotalBodyLength)
+	n, err := io.ReadFull(rw, buf)
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return binary.BigEndian.Uint32(buf[:4]), buf[4:], nil
+}
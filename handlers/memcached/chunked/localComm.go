@@ -16,6 +16,7 @@ package chunked
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 
 	"github.com/netflix/rend/binprot"
@@ -24,27 +25,18 @@ import (
 )
 
 // TODO: replace sending new empty metadata on miss with emptyMeta
-var emptyMeta = metadata{}
+var emptyMeta = Metadata{}
 
-func getAndTouchMetadata(rw *bufio.ReadWriter, key []byte, exptime uint32) ([]byte, metadata, error) {
-	metaKey := metaKey(key)
-	if err := binprot.WriteGATCmd(rw, metaKey, exptime); err != nil {
-		return nil, emptyMeta, err
-	}
-	metaData, err := getMetadataCommon(rw)
-	return metaKey, metaData, err
-}
-
-func getMetadata(rw *bufio.ReadWriter, key []byte) ([]byte, metadata, error) {
-	metaKey := metaKey(key)
+func getMetadata(rw *bufio.ReadWriter, key []byte) ([]byte, Metadata, error) {
+	metaKey := MetaKey(key)
 	if err := binprot.WriteGetCmd(rw, metaKey); err != nil {
 		return nil, emptyMeta, err
 	}
-	metaData, err := getMetadataCommon(rw)
+	metaData, err := getMetadataCommon(rw, binprot.OpcodeGet)
 	return metaKey, metaData, err
 }
 
-func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
+func getMetadataCommon(rw *bufio.ReadWriter, opcode uint8) (Metadata, error) {
 	if err := rw.Flush(); err != nil {
 		return emptyMeta, err
 	}
@@ -55,6 +47,10 @@ func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
 	}
 	defer binprot.PutResponseHeader(resHeader)
 
+	if err := binprot.CheckOpcode(resHeader, opcode); err != nil {
+		return emptyMeta, err
+	}
+
 	err = binprot.DecodeError(resHeader)
 	if err != nil {
 		// read in the message "Not found" after a miss
@@ -75,6 +71,12 @@ func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
 	//}
 	//serverFlags := binary.BigEndian.Uint32(buf)
 
+	// A hit has just the flags as its extras, and no key
+	if resHeader.ExtraLength != 4 || resHeader.KeyLength != 0 {
+		metrics.IncCounter(binprot.MetricBinaryResponseHeadersBad)
+		return emptyMeta, binprot.ErrBadResponse
+	}
+
 	// instead of reading and parsing flags, just discard
 	rw.Discard(4)
 	metrics.IncCounterBy(common.MetricBytesReadLocal, 4)
@@ -87,7 +89,7 @@ func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
 	return metaData, nil
 }
 
-func simpleCmdLocal(rw *bufio.ReadWriter, flush bool) error {
+func simpleCmdLocal(rw *bufio.ReadWriter, flush bool, opcode uint8) error {
 	if flush {
 		if err := rw.Flush(); err != nil {
 			return err
@@ -98,6 +100,10 @@ func simpleCmdLocal(rw *bufio.ReadWriter, flush bool) error {
 	if err != nil {
 		return err
 	}
+	if err := binprot.CheckOpcode(resHeader, opcode); err != nil {
+		binprot.PutResponseHeader(resHeader)
+		return err
+	}
 
 	n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
 	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
@@ -110,73 +116,152 @@ func simpleCmdLocal(rw *bufio.ReadWriter, flush bool) error {
 	return binprot.DecodeError(resHeader)
 }
 
-func getLocalIntoBuf(rw *bufio.Reader, metaData metadata, tokenBuf, dataBuf []byte, chunkNum, totalDataLength int) (opcodeNoop bool, err error) {
-	resHeader, err := binprot.ReadResponseHeader(rw)
-	if err != nil {
-		return false, err
-	}
-	defer binprot.PutResponseHeader(resHeader)
+// The outcome of reading the chunks of a value
+type chunksResult int
 
-	// it feels a bit dirty knowing about batch gets here, but it's the most logical place to put
-	// a check for an opcode that signals the end of a batch get or GAT. This code is a bit too big
-	// to copy-paste in multiple places.
-	if resHeader.Opcode == binprot.OpcodeNoop {
-		return true, nil
-	}
+const (
+	// Every chunk came back with the token in the metadata
+	chunksComplete chunksResult = iota
+	// A chunk didn't come back, or didn't have the size the metadata says
+	chunksMissing
+	// A chunk was written by a different set of the same key
+	chunksBadToken
+)
 
-	err = binprot.DecodeError(resHeader)
-	if err != nil {
-		// read in the message "Not found" after a miss
-		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
-		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
-		if ioerr != nil {
-			return false, ioerr
-		}
-		return false, err
-	}
+// The states of readChunks
+type chunkState int
 
-	// we currently do nothing with the flags
-	//buf := make([]byte, 4)
-	//n, err := io.ReadAtLeast(rw, buf, 4)
-	//metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
-	//if err != nil {
-	//	return emptyMeta, err
-	//}
-	//serverFlags := binary.BigEndian.Uint32(buf)
+const (
+	// Reading the next response header
+	stateHeader chunkState = iota
+	// Reading the flags, token, and data of a chunk
+	stateChunk
+	// Skipping the body of a response that isn't used
+	stateDiscard
+	// The noop came back, so every response has been read
+	stateDone
+)
 
-	// instead of reading and parsing flags, just discard
-	rw.Discard(4)
-	metrics.IncCounterBy(common.MetricBytesReadLocal, 4)
+// readChunks reads the responses to a batch of quiet gets or GATs, one for
+// each chunk of a value with the chunk number as its opaque, ended by a noop.
+// The data of the chunks is read directly into dataBuf. A response can be:
+//
+//   - a hit, with 4 bytes of flags, the token, and the padded chunk data
+//   - a miss, which quiet commands don't send but some backends do anyway
+//   - any other error status, with a message as the body
+//   - the noop, which ends the batch
+//
+// A missing chunk sends nothing, so chunks are placed by their opaque rather
+// than the order they come back in, and the value is complete only if every
+// chunk came back. Everything up to the noop is read even after a miss, so no
+// unread responses are left on the connection. A response that's none of the
+// above, or is for a chunk that wasn't asked for or already came back, means
+// the connection is out of sync, and binprot.ErrUnexpectedResponse is returned
+// right away. Otherwise the error is the last error status that wasn't a miss.
+func readChunks(r *bufio.Reader, metaData Metadata, tokenBuf, dataBuf []byte) (int, chunksResult, error) {
+	received := make([]bool, metaData.NumChunks)
+	fullSize := 4 + tokenSize + int(metaData.ChunkSize)
 
-	// Read in token if requested
-	if tokenBuf != nil {
-		n, err := io.ReadAtLeast(rw, tokenBuf, tokenSize)
-		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
-		if err != nil {
-			return false, err
-		}
-	}
+	var rh binprot.ResponseHeader
+	var count int
+	var lastErr error
+	result := chunksComplete
+	state := stateHeader
 
-	// indices for slicing, end exclusive
-	start, end := chunkSliceIndices(int(metaData.ChunkSize), chunkNum, int(metaData.Length))
-	// read data directly into buf
-	chunkBuf := dataBuf[start:end]
+	for state != stateDone {
+		switch state {
+		case stateHeader:
+			var err error
+			rh, err = binprot.ReadResponseHeader(r)
+			if err != nil {
+				return count, result, err
+			}
+			binprot.PutResponseHeader(rh)
 
-	// Read in value
-	n, err := io.ReadAtLeast(rw, chunkBuf, len(chunkBuf))
-	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
-	if err != nil {
-		return false, err
-	}
+			switch {
+			case rh.Opcode == binprot.OpcodeNoop:
+				state = stateDone
 
-	// consume padding at end of chunk if needed
-	if len(chunkBuf) < totalDataLength {
-		n, ioerr := rw.Discard(totalDataLength - len(chunkBuf))
-		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
-		if ioerr != nil {
-			return false, ioerr
+			case rh.Opcode != binprot.OpcodeGetQ && rh.Opcode != binprot.OpcodeGatQ,
+				rh.OpaqueToken >= uint32(len(received)),
+				received[rh.OpaqueToken]:
+				metrics.IncCounter(binprot.MetricBinaryResponsesUnexpected)
+				return count, result, binprot.ErrUnexpectedResponse
+
+			case rh.Status != binprot.StatusSuccess:
+				if err := binprot.DecodeError(rh); err != common.ErrKeyNotFound {
+					lastErr = err
+				}
+				result = worseChunksResult(result, chunksMissing)
+				state = stateDiscard
+
+			case rh.ExtraLength != 4 || rh.KeyLength != 0 || int(rh.TotalBodyLength) != fullSize:
+				// Chunks are always written padded to the full size, so
+				// anything else can't be part of this value
+				result = worseChunksResult(result, chunksMissing)
+				state = stateDiscard
+
+			default:
+				state = stateChunk
+			}
+
+		case stateChunk:
+			chunk := int(rh.OpaqueToken)
+			received[chunk] = true
+			count++
+
+			// The flags of a chunk are the client's, which are in the metadata
+			n, err := r.Discard(4)
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			if err != nil {
+				return count, result, err
+			}
+
+			n, err = io.ReadFull(r, tokenBuf)
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			if err != nil {
+				return count, result, err
+			}
+			if !bytes.Equal(metaData.Token[:], tokenBuf) {
+				result = worseChunksResult(result, chunksBadToken)
+			}
+
+			start, end := chunkSliceIndices(int(metaData.ChunkSize), chunk, int(metaData.Length))
+			n, err = io.ReadFull(r, dataBuf[start:end])
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			if err != nil {
+				return count, result, err
+			}
+
+			// The last chunk is padded out to the full size
+			n, err = r.Discard(int(metaData.ChunkSize) - (end - start))
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			if err != nil {
+				return count, result, err
+			}
+			state = stateHeader
+
+		case stateDiscard:
+			n, err := r.Discard(int(rh.TotalBodyLength))
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			if err != nil {
+				return count, result, err
+			}
+			state = stateHeader
 		}
 	}
 
-	return false, nil
+	if result == chunksComplete && count != len(received) {
+		result = chunksMissing
+	}
+	return count, result, lastErr
+}
+
+// Only the first reason a value is incomplete is kept, since that's the one
+// that gets counted.
+func worseChunksResult(cur, next chunksResult) chunksResult {
+	if cur != chunksComplete {
+		return cur
+	}
+	return next
 }
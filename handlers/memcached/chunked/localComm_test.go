@@ -0,0 +1,133 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/netflix/rend/binprot"
+	"github.com/netflix/rend/common"
+)
+
+// Three chunks of 8 bytes, the last one half full
+var testMeta = Metadata{
+	Length:    20,
+	NumChunks: 3,
+	ChunkSize: 8,
+	Token:     [tokenSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+}
+
+var testValue = []byte("abcdefghijklmnopqrst")
+
+func response(opcode uint8, status uint16, opaque uint32, extras, body []byte) []byte {
+	buf := make([]byte, 24, 24+len(extras)+len(body))
+	buf[0] = binprot.MagicResponse
+	buf[1] = opcode
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(buf[6:8], status)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(body)))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+	buf = append(buf, extras...)
+	return append(buf, body...)
+}
+
+// A hit for a chunk of testValue, padded to the full chunk size
+func chunkHit(opcode uint8, chunk int, token [tokenSize]byte) []byte {
+	start, end := chunkSliceIndices(int(testMeta.ChunkSize), chunk, int(testMeta.Length))
+	body := append(token[:], testValue[start:end]...)
+	body = append(body, make([]byte, int(testMeta.ChunkSize)-(end-start))...)
+	return response(opcode, binprot.StatusSuccess, uint32(chunk), make([]byte, 4), body)
+}
+
+func hit(chunk int) []byte {
+	return chunkHit(binprot.OpcodeGetQ, chunk, testMeta.Token)
+}
+
+var noop = response(binprot.OpcodeNoop, binprot.StatusSuccess, 0, nil, nil)
+
+func TestReadChunks(t *testing.T) {
+	var otherToken [tokenSize]byte
+
+	tests := []struct {
+		name      string
+		responses [][]byte
+		count     int
+		result    chunksResult
+		err       error
+	}{
+		{"all", [][]byte{hit(0), hit(1), hit(2), noop}, 3, chunksComplete, nil},
+		{"gat", [][]byte{
+			chunkHit(binprot.OpcodeGatQ, 0, testMeta.Token),
+			chunkHit(binprot.OpcodeGatQ, 1, testMeta.Token),
+			chunkHit(binprot.OpcodeGatQ, 2, testMeta.Token),
+			noop,
+		}, 3, chunksComplete, nil},
+		{"out of order", [][]byte{hit(2), hit(0), hit(1), noop}, 3, chunksComplete, nil},
+		{"missing middle", [][]byte{hit(0), hit(2), noop}, 2, chunksMissing, nil},
+		{"missing last", [][]byte{hit(0), hit(1), noop}, 2, chunksMissing, nil},
+		{"noop only", [][]byte{noop}, 0, chunksMissing, nil},
+		{"miss sent anyway", [][]byte{
+			hit(0),
+			response(binprot.OpcodeGetQ, binprot.StatusKeyEnoent, 1, nil, []byte("Not found")),
+			hit(2),
+			noop,
+		}, 2, chunksMissing, nil},
+		{"error status", [][]byte{
+			hit(0),
+			response(binprot.OpcodeGetQ, binprot.StatusEnomem, 1, nil, []byte("Out of memory")),
+			hit(2),
+			noop,
+		}, 2, chunksMissing, common.ErrNoMem},
+		{"short chunk", [][]byte{
+			hit(0),
+			response(binprot.OpcodeGetQ, binprot.StatusSuccess, 1, make([]byte, 4), []byte("short")),
+			hit(2),
+			noop,
+		}, 2, chunksMissing, nil},
+		{"other token", [][]byte{hit(0), chunkHit(binprot.OpcodeGetQ, 1, otherToken), hit(2), noop}, 3, chunksBadToken, nil},
+		{"wrong opcode", [][]byte{hit(0), response(binprot.OpcodeSet, binprot.StatusSuccess, 1, nil, nil)}, 1, chunksComplete, binprot.ErrUnexpectedResponse},
+		{"unknown chunk", [][]byte{hit(0), response(binprot.OpcodeGetQ, binprot.StatusKeyEnoent, 3, nil, nil)}, 1, chunksComplete, binprot.ErrUnexpectedResponse},
+		{"repeated chunk", [][]byte{hit(0), hit(0)}, 1, chunksComplete, binprot.ErrUnexpectedResponse},
+		{"truncated", [][]byte{hit(0), hit(1)[:40]}, 2, chunksComplete, io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(bytes.Join(test.responses, nil)))
+			tokenBuf := make([]byte, tokenSize)
+			dataBuf := make([]byte, testMeta.Length)
+
+			count, result, err := readChunks(r, testMeta, tokenBuf, dataBuf)
+			if count != test.count || result != test.result || err != test.err {
+				t.Fatalf("Expected %d chunks, result %d, and error %v, got %d, %d, and %v",
+					test.count, test.result, test.err, count, result, err)
+			}
+
+			// Everything up to the noop is read unless the connection is broken
+			if err == nil || !binprot.IsDesync(err) && err != io.ErrUnexpectedEOF {
+				if r.Buffered() != 0 {
+					t.Fatalf("Expected every response to be read, %d bytes left", r.Buffered())
+				}
+			}
+			if result == chunksComplete && err == nil && !bytes.Equal(dataBuf, testValue) {
+				t.Fatalf("Expected %q, got %q", testValue, dataBuf)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricMetaCacheHits   = metrics.AddCounter("metadata_cache_hits", nil)
+	MetricMetaCacheMisses = metrics.AddCounter("metadata_cache_misses", nil)
+	MetricMetaCacheStale  = metrics.AddCounter("metadata_cache_stale", nil)
+)
+
+func init() {
+	metrics.Describe("metadata_cache_hits", metrics.UnitCount, "Gets that used cached metadata instead of reading it from memcached")
+	metrics.Describe("metadata_cache_misses", metrics.UnitCount, "Gets that found no cached metadata for their key")
+	metrics.Describe("metadata_cache_stale", metrics.UnitCount, "Gets whose cached metadata didn't match the chunks in memcached, so it was read again")
+}
+
+// metaCache is an LRU of the metadata recently read by gets, shared by every
+// connection, so hot keys skip the metadata round trip. Entries only live for
+// a short time, and writes through this proxy drop the entry for their key.
+// Cached metadata can still be out of date if another proxy wrote the key, but
+// the chunks it points to then have another token or are gone, which gets
+// notice. A nil metaCache caches nothing.
+type metaCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// Most recently used at the front
+	lru *list.List
+}
+
+type metaCacheEntry struct {
+	key     string
+	md      Metadata
+	expires time.Time
+}
+
+var metadataCache *metaCache
+
+// SetMetadataCache keeps the metadata of up to size keys read by gets for up
+// to ttl, so gets of hot keys only fetch the chunks. Nothing is cached if size
+// is 0. It must be called before any connections are accepted.
+func SetMetadataCache(size int, ttl time.Duration) {
+	metadataCache = newMetaCache(size, ttl)
+}
+
+func newMetaCache(size int, ttl time.Duration) *metaCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &metaCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *metaCache) get(key []byte) (Metadata, bool) {
+	if c == nil {
+		return Metadata{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[string(key)]
+	if !ok {
+		metrics.IncCounter(MetricMetaCacheMisses)
+		return Metadata{}, false
+	}
+	e := el.Value.(*metaCacheEntry)
+	if time.Now().After(e.expires) {
+		c.removeElement(el)
+		metrics.IncCounter(MetricMetaCacheMisses)
+		return Metadata{}, false
+	}
+
+	c.lru.MoveToFront(el)
+	metrics.IncCounter(MetricMetaCacheHits)
+	return e.md, true
+}
+
+func (c *metaCache) put(key []byte, md Metadata) {
+	if c == nil {
+		return
+	}
+
+	// Not kept past when the value itself expires
+	expires := time.Now().Add(c.ttl)
+	if md.Exptime != 0 {
+		if valueExpires := time.Unix(int64(md.Exptime), 0); valueExpires.Before(expires) {
+			expires = valueExpires
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[string(key)]; ok {
+		e := el.Value.(*metaCacheEntry)
+		e.md = md
+		e.expires = expires
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	e := &metaCacheEntry{key: string(key), md: md, expires: expires}
+	c.entries[e.key] = c.lru.PushFront(e)
+	if c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Drops the key, after a write or when its metadata turns out to be stale.
+func (c *metaCache) remove(key []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[string(key)]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *metaCache) removeElement(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*metaCacheEntry).key)
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+)
+
+func TestMetaCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newMetaCache(2, time.Minute)
+
+	c.put([]byte("a"), Metadata{Length: 1})
+	c.put([]byte("b"), Metadata{Length: 2})
+	// a is now used more recently than b
+	if _, ok := c.get([]byte("a")); !ok {
+		t.Fatalf("Expected a to be cached")
+	}
+	c.put([]byte("c"), Metadata{Length: 3})
+
+	if _, ok := c.get([]byte("b")); ok {
+		t.Fatalf("Expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get([]byte(key)); !ok {
+			t.Fatalf("Expected %s to be cached", key)
+		}
+	}
+
+	c.remove([]byte("a"))
+	if _, ok := c.get([]byte("a")); ok {
+		t.Fatalf("Expected a to be removed")
+	}
+}
+
+func TestMetaCacheExpires(t *testing.T) {
+	c := newMetaCache(10, time.Minute)
+
+	// The value itself expired a second ago
+	c.put([]byte("a"), Metadata{Exptime: uint32(time.Now().Unix() - 1)})
+	if _, ok := c.get([]byte("a")); ok {
+		t.Fatalf("Expected metadata not to outlive its value")
+	}
+
+	c = newMetaCache(10, time.Millisecond)
+	c.put([]byte("a"), Metadata{})
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get([]byte("a")); ok {
+		t.Fatalf("Expected metadata to expire after the TTL")
+	}
+}
+
+func TestMetaCacheStaleEntry(t *testing.T) {
+	SetMetadataCache(10, time.Minute)
+	defer SetMetadataCache(0, 0)
+
+	client, server := net.Pipe()
+	go fakemem.New(false).ServeConn(server)
+	h := NewHandler(client)
+	defer h.Close()
+
+	key := []byte("key")
+	get := func() common.GetResponse {
+		resChan, errChan := h.Get(common.GetRequest{
+			Keys:    [][]byte{key},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		res := <-resChan
+		if err, ok := <-errChan; ok {
+			t.Fatalf("Error getting: %s", err.Error())
+		}
+		return res
+	}
+
+	if err := h.Set(common.SetRequest{Key: key, Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if res := get(); res.Miss || string(res.Data) != "value" {
+		t.Fatalf("Expected value, got miss %v, %q", res.Miss, res.Data)
+	}
+	md, ok := metadataCache.get(key)
+	if !ok {
+		t.Fatalf("Expected the metadata to be cached after a get")
+	}
+
+	// Like a set of the key through another proxy
+	md.Token[0]++
+	metadataCache.put(key, md)
+	if res := get(); res.Miss || string(res.Data) != "value" {
+		t.Fatalf("Expected value despite stale metadata, got miss %v, %q", res.Miss, res.Data)
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: key}); err != nil {
+		t.Fatalf("Error deleting: %s", err.Error())
+	}
+	if _, ok := metadataCache.get(key); ok {
+		t.Fatalf("Expected a delete to drop the cached metadata")
+	}
+}
@@ -22,9 +22,25 @@ import (
 	"github.com/netflix/rend/metrics"
 )
 
-const metadataSize = 24 + tokenSize
+// The size in bytes of encoded metadata
+const MetadataSize = 24 + tokenSize
 
-type metadata struct {
+// FormatVersion is the version of the metadata and chunk layout. It's stored
+// in the reserved version bits of the flags the metadata has in the backend,
+// so a future layout can tell values written in this one apart.
+const FormatVersion = 1
+
+// Returns the flags the metadata for a value with the given flags is stored
+// with in the backend
+func metaFlags(flags uint32) uint32 {
+	return common.WithFlagVersion(flags, FormatVersion)
+}
+
+// Metadata is stored in memcached under a value's MetaKey and describes how
+// the value is split into chunks. Each chunk is stored under its ChunkKey,
+// prefixed with the token so a chunk from a different write of the value can
+// be told apart.
+type Metadata struct {
 	Length    uint32
 	OrigFlags uint32
 	NumChunks uint32
@@ -34,44 +50,57 @@ type metadata struct {
 	Token     [tokenSize]byte
 }
 
-func readMetadata(r io.Reader) (metadata, error) {
-	buf := make([]byte, metadataSize)
+func readMetadata(r io.Reader) (Metadata, error) {
+	buf := common.GetBuf(MetadataSize)
+	defer common.PutBuf(buf)
 
-	n, err := io.ReadAtLeast(r, buf, metadataSize)
+	n, err := io.ReadAtLeast(r, buf, MetadataSize)
 	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 	if err != nil {
 		return emptyMeta, nil
 	}
 
-	m := metadata{}
+	return DecodeMetadata(buf)
+}
+
+// DecodeMetadata decodes metadata as it is stored in memcached.
+func DecodeMetadata(buf []byte) (Metadata, error) {
+	if len(buf) < MetadataSize {
+		return Metadata{}, common.ErrBadLength
+	}
+
+	m := Metadata{}
 	m.Length = binary.BigEndian.Uint32(buf[0:4])
 	m.OrigFlags = binary.BigEndian.Uint32(buf[4:8])
 	m.NumChunks = binary.BigEndian.Uint32(buf[8:12])
 	m.ChunkSize = binary.BigEndian.Uint32(buf[12:16])
 	m.Instime = binary.BigEndian.Uint32(buf[16:20])
 	m.Exptime = binary.BigEndian.Uint32(buf[20:24])
-	copy(m.Token[:], buf[24:])
+	copy(m.Token[:], buf[24:MetadataSize])
 
 	return m, nil
 }
 
-func writeMetadata(w io.Writer, md metadata) error {
-	buf := make([]byte, metadataSize-tokenSize)
+// AppendMetadata appends the metadata encoded as it is stored in memcached to
+// buf and returns the extended buffer.
+func AppendMetadata(buf []byte, md Metadata) []byte {
+	var fields [24]byte
+	binary.BigEndian.PutUint32(fields[0:4], md.Length)
+	binary.BigEndian.PutUint32(fields[4:8], md.OrigFlags)
+	binary.BigEndian.PutUint32(fields[8:12], md.NumChunks)
+	binary.BigEndian.PutUint32(fields[12:16], md.ChunkSize)
+	binary.BigEndian.PutUint32(fields[16:20], md.Instime)
+	binary.BigEndian.PutUint32(fields[20:24], md.Exptime)
 
-	binary.BigEndian.PutUint32(buf[0:4], md.Length)
-	binary.BigEndian.PutUint32(buf[4:8], md.OrigFlags)
-	binary.BigEndian.PutUint32(buf[8:12], md.NumChunks)
-	binary.BigEndian.PutUint32(buf[12:16], md.ChunkSize)
-	binary.BigEndian.PutUint32(buf[16:20], md.Instime)
-	binary.BigEndian.PutUint32(buf[20:24], md.Exptime)
+	buf = append(buf, fields[:]...)
+	return append(buf, md.Token[:]...)
+}
 
-	n, err := w.Write(buf)
-	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
-	if err != nil {
-		return err
-	}
+func writeMetadata(w io.Writer, md Metadata) error {
+	buf := common.GetBuf(MetadataSize)
+	defer common.PutBuf(buf)
 
-	n, err = w.Write(md.Token[:])
+	n, err := w.Write(AppendMetadata(buf[:0], md))
 	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
 	return err
 }
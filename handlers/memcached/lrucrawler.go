@@ -0,0 +1,112 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/metrics"
+)
+
+// LruCrawler returns a function that runs lru_crawler commands on the memcached
+// at the socket, for orcas.SetLruCrawler. The handlers' connections use the
+// binary protocol, which has no lru_crawler, so each command gets its own text
+// protocol connection.
+//
+// metadump and mgdump list every key, one per line, until a line that isn't a
+// key. With isChunked, the keys are translated back into the keys clients use:
+// metadata keys become the key of their value, keeping the rest of the line as
+// memcached sent it, and chunk keys are left out. Other commands have a one
+// line response.
+func LruCrawler(sock string, isChunked bool) func(args []string, line func([]byte, bool) error) error {
+	return func(args []string, line func([]byte, bool) error) error {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			log.Println("Error opening connection for lru_crawler:", err.Error())
+			return common.ErrUnavailable
+		}
+		defer conn.Close()
+
+		cmd := "lru_crawler " + strings.Join(args, " ") + "\r\n"
+		n, err := io.WriteString(conn, cmd)
+		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+		if err != nil {
+			return err
+		}
+
+		var prefix []byte
+		switch args[0] {
+		case "metadump":
+			prefix = []byte("key=")
+		case "mgdump":
+			prefix = []byte("mg ")
+		}
+
+		r := bufio.NewReader(conn)
+		for {
+			l, err := r.ReadSlice('\n')
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(len(l)))
+			if err != nil {
+				return err
+			}
+			l = bytes.TrimRight(l, "\r\n")
+
+			if prefix == nil || !bytes.HasPrefix(l, prefix) {
+				return line(l, true)
+			}
+
+			if isChunked {
+				var ok bool
+				if l, ok = clientKeyLine(l, len(prefix)); !ok {
+					continue
+				}
+			}
+			if err := line(l, false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Replaces the key starting at start in a line of a key dump with the key
+// clients use. Returns false if the line is for a chunk.
+func clientKeyLine(l []byte, start int) ([]byte, bool) {
+	end := bytes.IndexByte(l[start:], ' ')
+	if end < 0 {
+		end = len(l)
+	} else {
+		end += start
+	}
+
+	key, ok := chunked.ClientKey(l[start:end])
+	if !ok {
+		return nil, false
+	}
+	if len(key) == end-start {
+		return l, true
+	}
+
+	// The client key is a prefix of the stored one, so the rest of the line
+	// only moves down
+	n := copy(l[start+len(key):], l[end:])
+	return l[:start+len(key)+n], true
+}
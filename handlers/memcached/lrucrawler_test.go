@@ -0,0 +1,106 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memcached_test
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers/memcached"
+	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+func TestLruCrawlerMetadump(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "mem.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer l.Close()
+	go fakemem.New(false).Serve(l)
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err.Error())
+	}
+	h := chunked.NewHandler(conn)
+	defer h.Close()
+
+	conn, err = net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Error connecting: %s", err.Error())
+	}
+	raw := std.NewHandler(conn)
+	defer raw.Close()
+
+	// Several chunks, and a plain key that only looks like a chunk
+	if err := h.Set(common.SetRequest{Key: []byte("big"), Data: bytes.Repeat([]byte("a"), 3000)}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if err := raw.Set(common.SetRequest{Key: []byte("plain-1"), Data: []byte("b")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	dump := func(isChunked bool) []string {
+		var lines []string
+		err := memcached.LruCrawler(sock, isChunked)([]string{"metadump", "all"}, func(l []byte, last bool) error {
+			lines = append(lines, string(l))
+			if last != (string(l) == "END") {
+				t.Fatalf("Expected only END to be last, got %q as last %v", l, last)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error in metadump: %s", err.Error())
+		}
+		return lines
+	}
+
+	lines := dump(true)
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "key=big exp=-1 ") || lines[1] != "END" {
+		t.Fatalf("Expected one line for the chunked key, got %q", lines)
+	}
+
+	// Without chunking every stored key is listed
+	if lines := dump(false); len(lines) < 4 {
+		t.Fatalf("Expected the metadata, chunks, and plain key, got %q", lines)
+	}
+
+	var res []byte
+	err = memcached.LruCrawler(sock, true)([]string{"crawl", "all"}, func(l []byte, last bool) error {
+		if !last {
+			t.Fatalf("Expected a single line response")
+		}
+		res = append(res, l...)
+		return nil
+	})
+	if err != nil || string(res) != "OK" {
+		t.Fatalf("Expected OK, got %q, %v", res, err)
+	}
+}
+
+func TestLruCrawlerUnavailable(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "missing.sock")
+	err := memcached.LruCrawler(sock, false)([]string{"metadump", "all"}, func([]byte, bool) error { return nil })
+	if err != common.ErrUnavailable {
+		t.Fatalf("Expected unavailable, got %v", err)
+	}
+}
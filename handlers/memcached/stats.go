@@ -0,0 +1,68 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memcached
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// StatsReset returns a function that runs "stats reset" on the memcached at
+// each socket, for orcas.SetStatsReset. Like lru_crawler, each reset gets its
+// own text protocol connection. Every backend is reset even if an earlier one
+// fails, and the first error is returned.
+func StatsReset(socks ...string) func() error {
+	return func() error {
+		var ret error
+		for _, sock := range socks {
+			if err := statsReset(sock); err != nil && ret == nil {
+				ret = err
+			}
+		}
+		return ret
+	}
+}
+
+func statsReset(sock string) error {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		log.Println("Error opening connection for stats reset:", err.Error())
+		return common.ErrUnavailable
+	}
+	defer conn.Close()
+
+	n, err := io.WriteString(conn, "stats reset\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	l, err := bufio.NewReader(conn).ReadString('\n')
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(len(l)))
+	if err != nil {
+		return err
+	}
+	if l != "RESET\r\n" {
+		log.Printf("Unexpected response to stats reset from %s: %q\n", sock, l)
+		return common.ErrInternal
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memcached_test
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers/memcached"
+)
+
+func TestStatsReset(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "mem.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer l.Close()
+	go fakemem.New(false).Serve(l)
+
+	if err := memcached.StatsReset(sock)(); err != nil {
+		t.Fatalf("Error resetting stats: %s", err.Error())
+	}
+
+	// A missing backend doesn't keep the others from being reset
+	missing := filepath.Join(dir, "missing.sock")
+	if err := memcached.StatsReset(missing, sock)(); err != common.ErrUnavailable {
+		t.Fatalf("Expected unavailable, got %v", err)
+	}
+}
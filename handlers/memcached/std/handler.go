@@ -17,17 +17,23 @@ package std
 import (
 	"bufio"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/netflix/rend/binprot"
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
 )
 
-func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
+func readResponseHeader(r *bufio.Reader, opcode uint8) (binprot.ResponseHeader, error) {
 	resHeader, err := binprot.ReadResponseHeader(r)
 	if err != nil {
 		return binprot.ResponseHeader{}, err
 	}
+	if err := binprot.CheckOpcode(resHeader, opcode); err != nil {
+		binprot.PutResponseHeader(resHeader)
+		return binprot.ResponseHeader{}, err
+	}
 
 	if err := binprot.DecodeError(resHeader); err != nil {
 		binprot.PutResponseHeader(resHeader)
@@ -41,58 +47,78 @@ func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
 type Handler struct {
 	rw   *bufio.ReadWriter
 	conn io.Closer
+	once *sync.Once
 }
 
 func NewHandler(conn io.ReadWriteCloser) Handler {
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	rw := bufio.NewReadWriter(common.BackendBufio.GetReader(conn), common.BackendBufio.GetWriter(conn))
 	return Handler{
 		rw:   rw,
 		conn: conn,
+		once: new(sync.Once),
 	}
 }
 
-// Closes the Handler's underlying io.ReadWriteCloser.
-// Any calls to the handler after a Close() are invalid.
+// Closes the Handler's underlying io.ReadWriteCloser and gives its buffers
+// back to the pool. Any calls to the handler after a Close() are invalid.
 func (h Handler) Close() error {
-	return h.conn.Close()
+	err := h.conn.Close()
+	h.once.Do(func() {
+		common.BackendBufio.PutReader(h.rw.Reader)
+		common.BackendBufio.PutWriter(h.rw.Writer)
+	})
+	return err
+}
+
+// Bounds the backend I/O of a request by its deadline, if the connection
+// supports deadlines. A zero deadline clears the last one.
+func (h Handler) setDeadline(deadline time.Time) {
+	if d, ok := h.conn.(interface{ SetDeadline(time.Time) error }); ok {
+		d.SetDeadline(deadline)
+	}
 }
 
 func (h Handler) Set(cmd common.SetRequest) error {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WriteSetCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
 		return err
 	}
-	return h.handleSetCommon(cmd)
+	return h.handleSetCommon(cmd, binprot.OpcodeSet)
 }
 
 func (h Handler) Add(cmd common.SetRequest) error {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WriteAddCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
 		return err
 	}
-	return h.handleSetCommon(cmd)
+	return h.handleSetCommon(cmd, binprot.OpcodeAdd)
 }
 
 func (h Handler) Replace(cmd common.SetRequest) error {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WriteReplaceCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
 		return err
 	}
-	return h.handleSetCommon(cmd)
+	return h.handleSetCommon(cmd, binprot.OpcodeReplace)
 }
 
 func (h Handler) Append(cmd common.SetRequest) error {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WriteAppendCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
 		return err
 	}
-	return h.handleSetCommon(cmd)
+	return h.handleSetCommon(cmd, binprot.OpcodeAppend)
 }
 
 func (h Handler) Prepend(cmd common.SetRequest) error {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WritePrependCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
 		return err
 	}
-	return h.handleSetCommon(cmd)
+	return h.handleSetCommon(cmd, binprot.OpcodePrepend)
 }
 
-func (h Handler) handleSetCommon(cmd common.SetRequest) error {
+func (h Handler) handleSetCommon(cmd common.SetRequest, opcode uint8) error {
 	// TODO: should there be a unique flags value for regular data?
 
 	// Write value
@@ -104,7 +130,7 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 	}
 
 	// Read server's response
-	resHeader, err := readResponseHeader(h.rw.Reader)
+	resHeader, err := readResponseHeader(h.rw.Reader, opcode)
 	if err != nil {
 		// Discard response body
 		n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
@@ -124,6 +150,7 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 }
 
 func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	h.setDeadline(cmd.Deadline)
 	dataOut := make(chan common.GetResponse)
 	errorOut := make(chan error)
 	go realHandleGet(cmd, dataOut, errorOut, h.rw)
@@ -140,7 +167,7 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 			return
 		}
 
-		data, flags, _, err := getLocal(rw, false)
+		data, flags, _, err := getLocal(rw, false, binprot.OpcodeGet)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				dataOut <- common.GetResponse{
@@ -171,6 +198,7 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 }
 
 func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	h.setDeadline(cmd.Deadline)
 	dataOut := make(chan common.GetEResponse)
 	errorOut := make(chan error)
 	go realHandleGetE(cmd, dataOut, errorOut, h.rw)
@@ -187,7 +215,7 @@ func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, err
 			return
 		}
 
-		data, flags, exp, err := getLocal(rw, true)
+		data, flags, exp, err := getLocal(rw, true, binprot.OpcodeGetE)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				dataOut <- common.GetEResponse{
@@ -220,11 +248,12 @@ func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, err
 }
 
 func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WriteGATCmd(h.rw.Writer, cmd.Key, cmd.Exptime); err != nil {
 		return common.GetResponse{}, err
 	}
 
-	data, flags, _, err := getLocal(h.rw, false)
+	data, flags, _, err := getLocal(h.rw, false, binprot.OpcodeGat)
 	if err != nil {
 		if err == common.ErrKeyNotFound {
 			return common.GetResponse{
@@ -251,15 +280,17 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 }
 
 func (h Handler) Delete(cmd common.DeleteRequest) error {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WriteDeleteCmd(h.rw.Writer, cmd.Key); err != nil {
 		return err
 	}
-	return simpleCmdLocal(h.rw)
+	return simpleCmdLocal(h.rw, binprot.OpcodeDelete)
 }
 
 func (h Handler) Touch(cmd common.TouchRequest) error {
+	h.setDeadline(cmd.Deadline)
 	if err := binprot.WriteTouchCmd(h.rw.Writer, cmd.Key, cmd.Exptime); err != nil {
 		return err
 	}
-	return simpleCmdLocal(h.rw)
+	return simpleCmdLocal(h.rw, binprot.OpcodeTouch)
 }
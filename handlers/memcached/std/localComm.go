@@ -24,7 +24,7 @@ import (
 	"github.com/netflix/rend/metrics"
 )
 
-func simpleCmdLocal(rw *bufio.ReadWriter) error {
+func simpleCmdLocal(rw *bufio.ReadWriter, opcode uint8) error {
 	if err := rw.Flush(); err != nil {
 		return err
 	}
@@ -35,6 +35,10 @@ func simpleCmdLocal(rw *bufio.ReadWriter) error {
 	}
 	defer binprot.PutResponseHeader(resHeader)
 
+	if err := binprot.CheckOpcode(resHeader, opcode); err != nil {
+		return err
+	}
+
 	err = binprot.DecodeError(resHeader)
 	if err != nil {
 		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
@@ -52,7 +56,7 @@ func simpleCmdLocal(rw *bufio.ReadWriter) error {
 	return err
 }
 
-func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint32, err error) {
+func getLocal(rw *bufio.ReadWriter, readExp bool, opcode uint8) (data []byte, flags, exp uint32, err error) {
 	if err := rw.Flush(); err != nil {
 		return nil, 0, 0, err
 	}
@@ -63,6 +67,10 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 	}
 	defer binprot.PutResponseHeader(resHeader)
 
+	if err := binprot.CheckOpcode(resHeader, opcode); err != nil {
+		return nil, 0, 0, err
+	}
+
 	err = binprot.DecodeError(resHeader)
 	if err != nil {
 		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
@@ -73,13 +81,27 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 		return nil, 0, 0, err
 	}
 
+	// A hit has the flags, and the exptime for GetE, as its extras and no key
+	extras := uint8(4)
+	if readExp {
+		extras = 8
+	}
+	if resHeader.ExtraLength != extras || resHeader.KeyLength != 0 {
+		metrics.IncCounter(binprot.MetricBinaryResponseHeadersBad)
+		return nil, 0, 0, binprot.ErrBadResponse
+	}
+
 	var serverFlags uint32
-	binary.Read(rw, binary.BigEndian, &serverFlags)
+	if err := binary.Read(rw, binary.BigEndian, &serverFlags); err != nil {
+		return nil, 0, 0, err
+	}
 	metrics.IncCounterBy(common.MetricBytesReadLocal, 4)
 
 	var serverExp uint32
 	if readExp {
-		binary.Read(rw, binary.BigEndian, &serverExp)
+		if err := binary.Read(rw, binary.BigEndian, &serverExp); err != nil {
+			return nil, 0, 0, err
+		}
 		metrics.IncCounterBy(common.MetricBytesReadLocal, 4)
 	}
 
@@ -0,0 +1,268 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"log"
+
+	"github.com/netflix/rend/binprot"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// Resynced wraps the handlers made by the given constructor so a backend
+// connection whose responses stop lining up with its requests, like after a
+// response with a bad header or for the wrong command, is thrown away instead
+// of being read from again. A new connection is made right away, and the
+// request is retried on it once if common.IsIdempotent says that's safe, which
+// is only for gets, GATs, and touches. The keys of a get that already have a
+// response aren't fetched again. Anything else fails with
+// common.ErrTempFailure, since it may have been applied already, so the client
+// can decide whether to retry. Desyncs are counted by backend_desync, tagged
+// by backend.
+func Resynced(hc HandlerConst, backend string) HandlerConst {
+	metric := metrics.AddCounter("backend_desync", metrics.Tags{"backend": backend})
+
+	return func() (Handler, error) {
+		wrapped, err := hc()
+		if wrapped == nil || err != nil {
+			return wrapped, err
+		}
+		return &resyncHandler{hc: hc, backend: backend, metric: metric, wrapped: wrapped}, nil
+	}
+}
+
+type resyncHandler struct {
+	hc      HandlerConst
+	backend string
+	metric  uint32
+
+	// nil if a new connection couldn't be made after a desync
+	wrapped Handler
+}
+
+// Returns the handler to use for a request, making a new one if the last
+// reconnect failed.
+func (h *resyncHandler) handler() (Handler, error) {
+	if h.wrapped != nil {
+		return h.wrapped, nil
+	}
+
+	wrapped, err := h.hc()
+	if err != nil {
+		if wrapped != nil {
+			wrapped.Close()
+		}
+		return nil, err
+	}
+	h.wrapped = wrapped
+	return wrapped, nil
+}
+
+// Checks the error of a request, replacing the connection if the error means
+// it's out of sync. It returns whether the request can be retried on the new
+// connection, and the error to give if it isn't.
+func (h *resyncHandler) failed(err error) (bool, error) {
+	if !binprot.IsDesync(err) {
+		return false, err
+	}
+
+	log.Printf("Backend %s connection out of sync, reconnecting: %s\n", h.backend, err.Error())
+	metrics.IncCounter(h.metric)
+	h.wrapped.Close()
+	h.wrapped = nil
+
+	if _, cerr := h.handler(); cerr != nil {
+		return false, cerr
+	}
+	return true, common.ErrTempFailure
+}
+
+func (h *resyncHandler) do(reqType common.RequestType, f func(Handler) error) error {
+	wrapped, err := h.handler()
+	if err != nil {
+		return err
+	}
+
+	again, err := h.failed(f(wrapped))
+	if !again || !common.IsIdempotent(reqType) {
+		return err
+	}
+
+	_, err = h.failed(f(h.wrapped))
+	return err
+}
+
+func (h *resyncHandler) Set(cmd common.SetRequest) error {
+	return h.do(common.RequestSet, func(w Handler) error { return w.Set(cmd) })
+}
+
+func (h *resyncHandler) Add(cmd common.SetRequest) error {
+	return h.do(common.RequestAdd, func(w Handler) error { return w.Add(cmd) })
+}
+
+func (h *resyncHandler) Replace(cmd common.SetRequest) error {
+	return h.do(common.RequestReplace, func(w Handler) error { return w.Replace(cmd) })
+}
+
+func (h *resyncHandler) Append(cmd common.SetRequest) error {
+	return h.do(common.RequestAppend, func(w Handler) error { return w.Append(cmd) })
+}
+
+func (h *resyncHandler) Prepend(cmd common.SetRequest) error {
+	return h.do(common.RequestPrepend, func(w Handler) error { return w.Prepend(cmd) })
+}
+
+func (h *resyncHandler) Delete(cmd common.DeleteRequest) error {
+	return h.do(common.RequestDelete, func(w Handler) error { return w.Delete(cmd) })
+}
+
+func (h *resyncHandler) Touch(cmd common.TouchRequest) error {
+	return h.do(common.RequestTouch, func(w Handler) error { return w.Touch(cmd) })
+}
+
+func (h *resyncHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.do(common.RequestGat, func(w Handler) error {
+		var err error
+		res, err = w.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+// The handlers respond to the keys of a get in order, so the keys after the
+// last response are the ones to fetch again.
+func remainingKeys(cmd common.GetRequest, responded int) common.GetRequest {
+	cmd.Keys = cmd.Keys[responded:]
+	cmd.Opaques = cmd.Opaques[responded:]
+	cmd.Quiet = cmd.Quiet[responded:]
+	return cmd
+}
+
+func (h *resyncHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resOut := make(chan common.GetResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	wrapped, err := h.handler()
+	if err != nil {
+		errOut <- err
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var responded int
+		for attempt := 0; ; attempt++ {
+			resIn, errIn := wrapped.Get(remainingKeys(cmd, responded))
+
+			var failure error
+			for resIn != nil || errIn != nil {
+				select {
+				case res, ok := <-resIn:
+					if !ok {
+						resIn = nil
+						continue
+					}
+					responded++
+					resOut <- res
+				case e, ok := <-errIn:
+					if !ok {
+						errIn = nil
+						continue
+					}
+					failure = e
+				}
+			}
+
+			if failure == nil {
+				return
+			}
+			again, err := h.failed(failure)
+			if !again || attempt > 0 || responded == len(cmd.Keys) {
+				errOut <- err
+				return
+			}
+			wrapped = h.wrapped
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *resyncHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	wrapped, err := h.handler()
+	if err != nil {
+		errOut <- err
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var responded int
+		for attempt := 0; ; attempt++ {
+			resIn, errIn := wrapped.GetE(remainingKeys(cmd, responded))
+
+			var failure error
+			for resIn != nil || errIn != nil {
+				select {
+				case res, ok := <-resIn:
+					if !ok {
+						resIn = nil
+						continue
+					}
+					responded++
+					resOut <- res
+				case e, ok := <-errIn:
+					if !ok {
+						errIn = nil
+						continue
+					}
+					failure = e
+				}
+			}
+
+			if failure == nil {
+				return
+			}
+			again, err := h.failed(failure)
+			if !again || attempt > 0 || responded == len(cmd.Keys) {
+				errOut <- err
+				return
+			}
+			wrapped = h.wrapped
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *resyncHandler) Close() error {
+	if h.wrapped == nil {
+		return nil
+	}
+	return h.wrapped.Close()
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+// Returns a constructor whose first connection answers anything with a header
+// that isn't a response, and whose later ones go to a fakemem
+func desyncing() (handlers.HandlerConst, *int) {
+	fm := fakemem.New(false)
+	conns := new(int)
+	return func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		*conns++
+		if *conns == 1 {
+			go io.Copy(io.Discard, server)
+			go server.Write(make([]byte, 24))
+		} else {
+			go fm.ServeConn(server)
+		}
+		return std.NewHandler(client), nil
+	}, conns
+}
+
+func TestResyncedRetry(t *testing.T) {
+	hc, conns := desyncing()
+	h, _ := handlers.Resynced(hc, "test")()
+	defer h.Close()
+
+	// A miss means the touch reached the new connection
+	if err := h.Touch(common.TouchRequest{Key: []byte("k")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected the touch to be retried on a new connection, got %v", err)
+	}
+	if *conns != 2 {
+		t.Fatalf("Expected a new connection after the desync, got %d connections", *conns)
+	}
+}
+
+func TestResyncedNoRetry(t *testing.T) {
+	hc, conns := desyncing()
+	h, _ := handlers.Resynced(hc, "test")()
+	defer h.Close()
+
+	if err := h.Delete(common.DeleteRequest{Key: []byte("k")}); err != common.ErrTempFailure {
+		t.Fatalf("Expected the delete to fail as temporary, got %v", err)
+	}
+
+	// The connection is replaced for the next request
+	if err := h.Delete(common.DeleteRequest{Key: []byte("k")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected the next delete to reach the backend, got %v", err)
+	}
+	if *conns != 2 {
+		t.Fatalf("Expected 2 connections, got %d", *conns)
+	}
+}
+
+// A set that may have been applied isn't run again
+func TestResyncedNoRetrySet(t *testing.T) {
+	hc, _ := desyncing()
+	h, _ := handlers.Resynced(hc, "test")()
+	defer h.Close()
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}); err != common.ErrTempFailure {
+		t.Fatalf("Expected the set to fail as temporary, got %v", err)
+	}
+	if res, err := get(h, "k"); err != nil || !res.Miss {
+		t.Fatalf("Expected the set not to be retried, got %+v, %v", res, err)
+	}
+}
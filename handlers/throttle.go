@@ -0,0 +1,182 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// Throttle is when Throttled starts holding back writes to a backend. A limit
+// of 0 is no limit.
+type Throttle struct {
+	// The average time a write takes
+	MaxLatency time.Duration
+	// The writes waiting on the backend at once, over all connections
+	MaxInFlight int
+	// How long a write waits for the backend to catch up before it's shed.
+	// Writes are shed right away if 0.
+	Delay time.Duration
+	// Whether a write that's shed deletes the key, without being held back. It
+	// is for a backend written after another, like L1 behind L2, where keeping
+	// the old value after the other took the new one would serve it stale.
+	DeleteShed bool
+}
+
+// Enabled is true if there is any limit.
+func (t Throttle) Enabled() bool {
+	return t.MaxLatency > 0 || t.MaxInFlight > 0
+}
+
+// The average latency is only trusted for this long after the last write, so
+// a backend that had all its writes shed gets one through now and then to see
+// whether it has recovered.
+const throttleSampleAge = time.Second
+
+// How often a delayed write checks whether the backend has caught up
+const throttleDelayStep = time.Millisecond
+
+// The load on one backend, shared by every connection to it
+type writeLoad struct {
+	Throttle
+	inFlight int64
+	// An exponentially weighted moving average, in nanoseconds
+	latency    int64
+	lastSample int64
+
+	metricShed    uint32
+	metricDelayed uint32
+}
+
+func (l *writeLoad) overloaded(now time.Time) bool {
+	if l.MaxInFlight > 0 && atomic.LoadInt64(&l.inFlight) >= int64(l.MaxInFlight) {
+		return true
+	}
+	if l.MaxLatency > 0 && now.UnixNano()-atomic.LoadInt64(&l.lastSample) < int64(throttleSampleAge) {
+		return atomic.LoadInt64(&l.latency) > int64(l.MaxLatency)
+	}
+	return false
+}
+
+// Waits up to the delay for the backend to stop being overloaded. Returns false
+// if the write should be shed.
+func (l *writeLoad) admit() bool {
+	now := time.Now()
+	if !l.overloaded(now) {
+		return true
+	}
+
+	if l.Delay > 0 {
+		metrics.IncCounter(l.metricDelayed)
+		for end := now.Add(l.Delay); now.Before(end); now = time.Now() {
+			time.Sleep(throttleDelayStep)
+			if !l.overloaded(time.Now()) {
+				return true
+			}
+		}
+	}
+
+	metrics.IncCounter(l.metricShed)
+	return false
+}
+
+// Adds the latency of a write to the average. Concurrent updates can lose a
+// sample, which doesn't matter for an average.
+func (l *writeLoad) observe(start time.Time) {
+	now := time.Now()
+	sample := int64(now.Sub(start))
+	avg := atomic.LoadInt64(&l.latency)
+	atomic.StoreInt64(&l.latency, avg+(sample-avg)/8)
+	atomic.StoreInt64(&l.lastSample, now.UnixNano())
+}
+
+// Throttled wraps the handlers made by the given constructor so writes back off
+// when the backend falls behind, instead of piling up until reads can't get
+// through either. The latency of sets, adds, replaces, appends, and prepends
+// and the number waiting on the backend are tracked over every connection the
+// constructor makes. Once either is over its limit, those writes wait up to the
+// delay for the backend to catch up and then fail with common.ErrBusy. Gets,
+// GATs, and touches are never held back. Neither are deletes, since dropping
+// one would leave a stale value behind, and with DeleteShed a write that's shed
+// deletes its key for the same reason. Writes that were held back are counted
+// by backend_writes_delayed and backend_writes_shed, and the writes waiting on
+// the backend by the backend_writes_in_flight gauge, all tagged with the given
+// backend name.
+func Throttled(hc HandlerConst, backend string, t Throttle) HandlerConst {
+	tgs := metrics.Tags{"backend": backend}
+	load := &writeLoad{
+		Throttle:      t,
+		metricShed:    metrics.AddCounter("backend_writes_shed", tgs),
+		metricDelayed: metrics.AddCounter("backend_writes_delayed", tgs),
+	}
+	metrics.RegisterIntGaugeCallback("backend_writes_in_flight", tgs, func() uint64 {
+		return uint64(atomic.LoadInt64(&load.inFlight))
+	})
+
+	return func() (Handler, error) {
+		h, err := hc()
+		if h == nil || err != nil {
+			return h, err
+		}
+		return throttledHandler{Handler: h, load: load}, nil
+	}
+}
+
+type throttledHandler struct {
+	Handler
+	load *writeLoad
+}
+
+func (h throttledHandler) write(cmd common.SetRequest, f func() error) error {
+	if !h.load.admit() {
+		if h.load.DeleteShed {
+			err := h.Handler.Delete(common.DeleteRequest{Key: cmd.Key, Deadline: cmd.Deadline})
+			if err != nil && err != common.ErrKeyNotFound {
+				return err
+			}
+		}
+		return common.ErrBusy
+	}
+
+	atomic.AddInt64(&h.load.inFlight, 1)
+	start := time.Now()
+	err := f()
+	h.load.observe(start)
+	atomic.AddInt64(&h.load.inFlight, -1)
+	return err
+}
+
+func (h throttledHandler) Set(cmd common.SetRequest) error {
+	return h.write(cmd, func() error { return h.Handler.Set(cmd) })
+}
+
+func (h throttledHandler) Add(cmd common.SetRequest) error {
+	return h.write(cmd, func() error { return h.Handler.Add(cmd) })
+}
+
+func (h throttledHandler) Replace(cmd common.SetRequest) error {
+	return h.write(cmd, func() error { return h.Handler.Replace(cmd) })
+}
+
+func (h throttledHandler) Append(cmd common.SetRequest) error {
+	return h.write(cmd, func() error { return h.Handler.Append(cmd) })
+}
+
+func (h throttledHandler) Prepend(cmd common.SetRequest) error {
+	return h.write(cmd, func() error { return h.Handler.Prepend(cmd) })
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+// A backend whose sets take a while
+type slowSets struct {
+	handlers.Handler
+	delay time.Duration
+}
+
+func (s slowSets) Set(cmd common.SetRequest) error {
+	time.Sleep(s.delay)
+	return s.Handler.Set(cmd)
+}
+
+func TestThrottledShed(t *testing.T) {
+	hc := handlers.Throttled(func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go fakemem.New(false).ServeConn(server)
+		return slowSets{std.NewHandler(client), 5 * time.Millisecond}, nil
+	}, "test", handlers.Throttle{MaxLatency: time.Millisecond})
+	h, _ := hc()
+	defer h.Close()
+
+	// The average goes over the limit after two sets
+	var err error
+	var sets int
+	for ; sets < 10 && err == nil; sets++ {
+		err = h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")})
+	}
+	if err != common.ErrBusy || sets != 3 {
+		t.Fatalf("Expected the third set to be shed, got %v after %d sets", err, sets)
+	}
+
+	// Reads still go through
+	if res, err := get(h, "k"); err != nil || res.Miss || string(res.Data) != "v" {
+		t.Fatalf("Expected to get the value back, got %+v, %v", res, err)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: []byte("k")}); err != nil {
+		t.Fatalf("Expected deletes not to be held back, got %v", err)
+	}
+}
+
+func TestThrottledDelay(t *testing.T) {
+	hc := handlers.Throttled(func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go fakemem.New(false).ServeConn(server)
+		return slowSets{std.NewHandler(client), 5 * time.Millisecond}, nil
+	}, "test", handlers.Throttle{MaxLatency: time.Millisecond, Delay: 10 * time.Millisecond})
+	h, _ := hc()
+	defer h.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}); err != nil {
+			t.Fatalf("Error setting: %s", err.Error())
+		}
+	}
+
+	// Nothing finishes while it waits, so it's shed after the delay
+	start := time.Now()
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}); err != common.ErrBusy {
+		t.Fatalf("Expected the set to be shed, got %v", err)
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Fatalf("Expected the set to wait out the delay, waited %s", waited)
+	}
+}
+
+func TestThrottledDeleteShed(t *testing.T) {
+	hc := handlers.Throttled(func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go fakemem.New(false).ServeConn(server)
+		return slowSets{std.NewHandler(client), 5 * time.Millisecond}, nil
+	}, "test", handlers.Throttle{MaxLatency: 500 * time.Microsecond, DeleteShed: true})
+	h, _ := hc()
+	defer h.Close()
+
+	// The average goes over the limit after one set
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("old")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// Another backend already took the new value, so the old one is gone
+	// rather than served stale
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("new")}); err != common.ErrBusy {
+		t.Fatalf("Expected the set to be shed, got %v", err)
+	}
+	if res, err := get(h, "k"); err != nil || !res.Miss {
+		t.Fatalf("Expected the key to be deleted, got %+v, %v", res, err)
+	}
+
+	// A key that isn't there is fine too
+	if err := h.Set(common.SetRequest{Key: []byte("missing"), Data: []byte("new")}); err != common.ErrBusy {
+		t.Fatalf("Expected the set to be shed, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/tracing"
+)
+
+type tracedHandler struct {
+	wrapped Handler
+	backend string
+}
+
+// Traced wraps the handlers made by the given constructor to record a span
+// for each request to the backend, named with the backend and command, e.g.
+// "l1.get". Spans are only recorded for requests that are being traced, and
+// the request passed to the wrapped handler carries the new span so it can
+// record spans of its own.
+func Traced(hc HandlerConst, backend string) HandlerConst {
+	return func() (Handler, error) {
+		h, err := hc()
+		if h == nil || err != nil {
+			return h, err
+		}
+
+		return tracedHandler{
+			wrapped: h,
+			backend: backend,
+		}, nil
+	}
+}
+
+func finish(span *tracing.Span, err error) error {
+	switch {
+	case err == common.ErrKeyNotFound:
+		span.SetTag("miss", "true")
+	case err != nil:
+		span.SetTag("error", err.Error())
+	}
+	span.Finish()
+	return err
+}
+
+func (h tracedHandler) Set(cmd common.SetRequest) error {
+	cmd.Span = cmd.Span.Child(h.backend+".set", tracing.KindClient)
+	return finish(cmd.Span, h.wrapped.Set(cmd))
+}
+
+func (h tracedHandler) Add(cmd common.SetRequest) error {
+	cmd.Span = cmd.Span.Child(h.backend+".add", tracing.KindClient)
+	return finish(cmd.Span, h.wrapped.Add(cmd))
+}
+
+func (h tracedHandler) Replace(cmd common.SetRequest) error {
+	cmd.Span = cmd.Span.Child(h.backend+".replace", tracing.KindClient)
+	return finish(cmd.Span, h.wrapped.Replace(cmd))
+}
+
+func (h tracedHandler) Append(cmd common.SetRequest) error {
+	cmd.Span = cmd.Span.Child(h.backend+".append", tracing.KindClient)
+	return finish(cmd.Span, h.wrapped.Append(cmd))
+}
+
+func (h tracedHandler) Prepend(cmd common.SetRequest) error {
+	cmd.Span = cmd.Span.Child(h.backend+".prepend", tracing.KindClient)
+	return finish(cmd.Span, h.wrapped.Prepend(cmd))
+}
+
+// Get and GetE spans finish when the wrapped handler closes its channels, by a
+// hook on the goroutine that forwards the responses. Untraced requests go
+// straight through.
+func (h tracedHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return h.getHooked(cmd, nil)
+}
+
+func (h tracedHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return h.getEHooked(cmd, nil)
+}
+
+func (h tracedHandler) getHooked(cmd common.GetRequest, hooks []getHook) (<-chan common.GetResponse, <-chan error) {
+	if cmd.Span == nil {
+		return forwardGet(h.wrapped, cmd, hooks)
+	}
+
+	span := cmd.Span.Child(h.backend+".get", tracing.KindClient)
+	span.SetTag("keys", strconv.Itoa(len(cmd.Keys)))
+	cmd.Span = span
+
+	return forwardGet(h.wrapped, cmd, append(hooks, getHook{
+		done: func(err error) { finish(span, err) },
+	}))
+}
+
+func (h tracedHandler) getEHooked(cmd common.GetRequest, hooks []getEHook) (<-chan common.GetEResponse, <-chan error) {
+	if cmd.Span == nil {
+		return forwardGetE(h.wrapped, cmd, hooks)
+	}
+
+	span := cmd.Span.Child(h.backend+".gete", tracing.KindClient)
+	span.SetTag("keys", strconv.Itoa(len(cmd.Keys)))
+	cmd.Span = span
+
+	return forwardGetE(h.wrapped, cmd, append(hooks, getEHook{
+		done: func(err error) { finish(span, err) },
+	}))
+}
+
+func (h tracedHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	cmd.Span = cmd.Span.Child(h.backend+".gat", tracing.KindClient)
+	res, err := h.wrapped.GAT(cmd)
+	if err == nil && res.Miss {
+		cmd.Span.SetTag("miss", "true")
+	}
+	return res, finish(cmd.Span, err)
+}
+
+func (h tracedHandler) Delete(cmd common.DeleteRequest) error {
+	cmd.Span = cmd.Span.Child(h.backend+".delete", tracing.KindClient)
+	return finish(cmd.Span, h.wrapped.Delete(cmd))
+}
+
+func (h tracedHandler) Touch(cmd common.TouchRequest) error {
+	cmd.Span = cmd.Span.Child(h.backend+".touch", tracing.KindClient)
+	return finish(cmd.Span, h.wrapped.Touch(cmd))
+}
+
+func (h tracedHandler) Close() error {
+	return h.wrapped.Close()
+}
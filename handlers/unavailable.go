@@ -0,0 +1,252 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// How long a connection waits after failing to reach a backend before trying
+// again, so requests don't each wait on a dial to a backend that's down.
+const reconnectInterval = time.Second
+
+// MissWhenDown wraps the handlers made by the given constructor so a backend
+// that can't be reached looks like an empty cache instead of closing the client
+// connection. While it's down, gets and GATs miss and everything else fails
+// with common.ErrUnavailable. The constructor is retried at most once a second
+// per client connection, and the first request after it works again goes to
+// the backend. An error that isn't an application error, like an IO error,
+// means the backend connection can't be trusted anymore, so it's closed and
+// treated the same as being down.
+func MissWhenDown(hc HandlerConst, backend string) HandlerConst {
+	metric := metrics.AddCounter("backend_unavailable", metrics.Tags{"backend": backend})
+
+	return func() (Handler, error) {
+		h := &downHandler{hc: hc, backend: backend, metric: metric}
+		h.connect()
+		return h, nil
+	}
+}
+
+type downHandler struct {
+	hc      HandlerConst
+	backend string
+	metric  uint32
+
+	// nil while the backend is down
+	wrapped   Handler
+	lastTried time.Time
+}
+
+func (h *downHandler) connect() {
+	h.lastTried = time.Now()
+
+	wrapped, err := h.hc()
+	if err != nil {
+		if wrapped != nil {
+			wrapped.Close()
+		}
+		log.Printf("Backend %s is unavailable: %s\n", h.backend, err.Error())
+		return
+	}
+	h.wrapped = wrapped
+}
+
+// Returns the handler to use for a request, or nil if the backend is down.
+func (h *downHandler) handler() Handler {
+	if h.wrapped == nil && time.Since(h.lastTried) >= reconnectInterval {
+		h.connect()
+	}
+	if h.wrapped == nil {
+		metrics.IncCounter(h.metric)
+	}
+	return h.wrapped
+}
+
+// Checks the error of a request, marking the backend down if the error means
+// the connection is broken.
+func (h *downHandler) failed(err error) bool {
+	if err == nil || common.IsAppError(err) {
+		return false
+	}
+
+	log.Printf("Backend %s failed, treating it as unavailable: %s\n", h.backend, err.Error())
+	metrics.IncCounter(h.metric)
+	h.wrapped.Close()
+	h.wrapped = nil
+	h.lastTried = time.Now()
+	return true
+}
+
+func (h *downHandler) write(f func(Handler) error) error {
+	wrapped := h.handler()
+	if wrapped == nil {
+		return common.ErrUnavailable
+	}
+	err := f(wrapped)
+	if h.failed(err) {
+		return common.ErrUnavailable
+	}
+	return err
+}
+
+func (h *downHandler) Set(cmd common.SetRequest) error {
+	return h.write(func(w Handler) error { return w.Set(cmd) })
+}
+
+func (h *downHandler) Add(cmd common.SetRequest) error {
+	return h.write(func(w Handler) error { return w.Add(cmd) })
+}
+
+func (h *downHandler) Replace(cmd common.SetRequest) error {
+	return h.write(func(w Handler) error { return w.Replace(cmd) })
+}
+
+func (h *downHandler) Append(cmd common.SetRequest) error {
+	return h.write(func(w Handler) error { return w.Append(cmd) })
+}
+
+func (h *downHandler) Prepend(cmd common.SetRequest) error {
+	return h.write(func(w Handler) error { return w.Prepend(cmd) })
+}
+
+func (h *downHandler) Delete(cmd common.DeleteRequest) error {
+	return h.write(func(w Handler) error { return w.Delete(cmd) })
+}
+
+func (h *downHandler) Touch(cmd common.TouchRequest) error {
+	return h.write(func(w Handler) error { return w.Touch(cmd) })
+}
+
+// The handlers respond to the keys of a get in order, so the keys after the
+// last response are the ones that still need one.
+func (h *downHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resOut := make(chan common.GetResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	wrapped := h.handler()
+	if wrapped == nil {
+		for i, key := range cmd.Keys {
+			resOut <- common.GetResponse{Miss: true, Key: key, Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i]}
+		}
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	resIn, errIn := wrapped.Get(cmd)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var responded int
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				responded++
+				resOut <- res
+			case e, ok := <-errIn:
+				if !ok {
+					errIn = nil
+				} else if h.failed(e) {
+					for i := responded; i < len(cmd.Keys); i++ {
+						resOut <- common.GetResponse{Miss: true, Key: cmd.Keys[i], Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i]}
+					}
+				} else {
+					errOut <- e
+				}
+			}
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *downHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errOut := make(chan error, 1)
+
+	wrapped := h.handler()
+	if wrapped == nil {
+		for i, key := range cmd.Keys {
+			resOut <- common.GetEResponse{Miss: true, Key: key, Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i]}
+		}
+		close(resOut)
+		close(errOut)
+		return resOut, errOut
+	}
+
+	resIn, errIn := wrapped.GetE(cmd)
+
+	go func() {
+		defer close(resOut)
+		defer close(errOut)
+
+		var responded int
+		for resIn != nil || errIn != nil {
+			select {
+			case res, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				responded++
+				resOut <- res
+			case e, ok := <-errIn:
+				if !ok {
+					errIn = nil
+				} else if h.failed(e) {
+					for i := responded; i < len(cmd.Keys); i++ {
+						resOut <- common.GetEResponse{Miss: true, Key: cmd.Keys[i], Opaque: cmd.Opaques[i], Quiet: cmd.Quiet[i]}
+					}
+				} else {
+					errOut <- e
+				}
+			}
+		}
+	}()
+
+	return resOut, errOut
+}
+
+func (h *downHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	miss := common.GetResponse{Miss: true, Key: cmd.Key, Opaque: cmd.Opaque}
+
+	wrapped := h.handler()
+	if wrapped == nil {
+		return miss, nil
+	}
+	res, err := wrapped.GAT(cmd)
+	if h.failed(err) {
+		return miss, nil
+	}
+	return res, err
+}
+
+func (h *downHandler) Close() error {
+	if h.wrapped == nil {
+		return nil
+	}
+	return h.wrapped.Close()
+}
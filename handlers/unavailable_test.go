@@ -0,0 +1,74 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+func TestMissWhenDownUnreachable(t *testing.T) {
+	hc := handlers.MissWhenDown(func() (handlers.Handler, error) {
+		return nil, errors.New("connection refused")
+	}, "test")
+
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Expected a handler while the backend is down, got %s", err.Error())
+	}
+	defer h.Close()
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}); err != common.ErrUnavailable {
+		t.Fatalf("Expected the set to fail as unavailable, got %v", err)
+	}
+	if res, err := get(h, "k"); err != nil || !res.Miss || string(res.Key) != "k" {
+		t.Fatalf("Expected the get to miss, got %+v, %v", res, err)
+	}
+}
+
+func TestMissWhenDownBroken(t *testing.T) {
+	var server net.Conn
+	hc := handlers.MissWhenDown(func() (handlers.Handler, error) {
+		var client net.Conn
+		client, server = net.Pipe()
+		go fakemem.New(false).ServeConn(server)
+		return std.NewHandler(client), nil
+	}, "test")
+
+	h, _ := hc()
+	defer h.Close()
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if err := h.Delete(common.DeleteRequest{Key: []byte("missing")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected application errors to pass through, got %v", err)
+	}
+
+	server.Close()
+
+	if res, err := get(h, "k"); err != nil || !res.Miss {
+		t.Fatalf("Expected the get on a broken connection to miss, got %+v, %v", res, err)
+	}
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}); err != common.ErrUnavailable {
+		t.Fatalf("Expected the set after the connection broke to fail as unavailable, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"log"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// Values stored by Verified start with this marker, so values stored without a
+// checksum can be told apart, and end with the CRC-32C of the key and value.
+// With the marker at the start, a value cut short still has it and fails the
+// check.
+var verifyMarker = []byte("rNdV")
+
+const verifyOverhead = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	MetricVerifyCorrupt   = metrics.AddCounter("verify_corrupt", nil)
+	MetricVerifyUnchecked = metrics.AddCounter("verify_unchecked", nil)
+)
+
+// Verified wraps the handlers made by the given constructor to check values
+// end to end. A checksum of the key and value is added to every value stored
+// and checked and removed from every value read. A value that
+// fails the check is counted, logged, and returned as a miss, so corruption
+// anywhere from here to the backend and back is caught instead of sent to
+// clients. Values without a checksum, like those stored before it was turned
+// on, are returned as they are and counted as unchecked.
+//
+// Append and prepend would leave the checksum in the middle of the value, so
+// they aren't supported.
+func Verified(hc HandlerConst) HandlerConst {
+	return func() (Handler, error) {
+		h, err := hc()
+		if h == nil || err != nil {
+			return h, err
+		}
+		return verifiedHandler{wrapped: h}, nil
+	}
+}
+
+type verifiedHandler struct {
+	wrapped Handler
+}
+
+func checksum(key, data []byte) uint32 {
+	crc := crc32.Update(0, crcTable, key)
+	return crc32.Update(crc, crcTable, data)
+}
+
+func withChecksum(cmd common.SetRequest) common.SetRequest {
+	data := make([]byte, len(cmd.Data)+verifyOverhead)
+	copy(data, verifyMarker)
+	copy(data[len(verifyMarker):], cmd.Data)
+	binary.BigEndian.PutUint32(data[len(data)-4:], checksum(cmd.Key, cmd.Data))
+	cmd.Data = data
+	return cmd
+}
+
+// verify returns the value without its checksum. The value is nil and valid is
+// false if the checksum doesn't match.
+func verify(key, data []byte) (value []byte, valid bool) {
+	if !bytes.HasPrefix(data, verifyMarker) {
+		metrics.IncCounter(MetricVerifyUnchecked)
+		return data, true
+	}
+
+	if len(data) < verifyOverhead {
+		metrics.IncCounter(MetricVerifyCorrupt)
+		log.Printf("Corrupt value for key %s: %d bytes is too short for a checksum\n", common.RedactKey(key), len(data))
+		return nil, false
+	}
+
+	value = data[len(verifyMarker) : len(data)-4]
+	expected := binary.BigEndian.Uint32(data[len(data)-4:])
+	if actual := checksum(key, value); actual != expected {
+		metrics.IncCounter(MetricVerifyCorrupt)
+		log.Printf("Corrupt value for key %s: checksum %08x, expected %08x\n", common.RedactKey(key), actual, expected)
+		return nil, false
+	}
+	return value, true
+}
+
+func (h verifiedHandler) Set(cmd common.SetRequest) error {
+	return h.wrapped.Set(withChecksum(cmd))
+}
+
+func (h verifiedHandler) Add(cmd common.SetRequest) error {
+	return h.wrapped.Add(withChecksum(cmd))
+}
+
+func (h verifiedHandler) Replace(cmd common.SetRequest) error {
+	return h.wrapped.Replace(withChecksum(cmd))
+}
+
+func (h verifiedHandler) Append(cmd common.SetRequest) error {
+	return common.ErrNotSupported
+}
+
+func (h verifiedHandler) Prepend(cmd common.SetRequest) error {
+	return common.ErrNotSupported
+}
+
+// Get and GetE values are checked by a hook on the goroutine that forwards the
+// responses, so a corrupt value is a miss to everything outside.
+func (h verifiedHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return h.getHooked(cmd, nil)
+}
+
+func (h verifiedHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return h.getEHooked(cmd, nil)
+}
+
+func (h verifiedHandler) getHooked(cmd common.GetRequest, hooks []getHook) (<-chan common.GetResponse, <-chan error) {
+	return forwardGet(h.wrapped, cmd, append(hooks, getHook{
+		res: func(res *common.GetResponse) {
+			if !res.Miss {
+				var valid bool
+				res.Data, valid = verify(res.Key, res.Data)
+				res.Miss = !valid
+			}
+		},
+	}))
+}
+
+func (h verifiedHandler) getEHooked(cmd common.GetRequest, hooks []getEHook) (<-chan common.GetEResponse, <-chan error) {
+	return forwardGetE(h.wrapped, cmd, append(hooks, getEHook{
+		res: func(res *common.GetEResponse) {
+			if !res.Miss {
+				var valid bool
+				res.Data, valid = verify(res.Key, res.Data)
+				res.Miss = !valid
+			}
+		},
+	}))
+}
+
+func (h verifiedHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.wrapped.GAT(cmd)
+	if err == nil && !res.Miss {
+		var valid bool
+		res.Data, valid = verify(res.Key, res.Data)
+		res.Miss = !valid
+	}
+	return res, err
+}
+
+func (h verifiedHandler) Delete(cmd common.DeleteRequest) error {
+	return h.wrapped.Delete(cmd)
+}
+
+func (h verifiedHandler) Touch(cmd common.TouchRequest) error {
+	return h.wrapped.Touch(cmd)
+}
+
+func (h verifiedHandler) Close() error {
+	return h.wrapped.Close()
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+)
+
+// Returns a handler with the wrapper around it, and one without, both
+// connected to the same fakemem
+func wrapped(t *testing.T, wrap func(handlers.HandlerConst) handlers.HandlerConst) (handlers.Handler, handlers.Handler) {
+	mem := fakemem.New(false)
+	hc := func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go mem.ServeConn(server)
+		return std.NewHandler(client), nil
+	}
+
+	h, _ := wrap(hc)()
+	raw, _ := hc()
+	t.Cleanup(func() {
+		h.Close()
+		raw.Close()
+	})
+	return h, raw
+}
+
+func TestVerified(t *testing.T) {
+	h, raw := wrapped(t, handlers.Verified)
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if res, err := get(h, "k"); err != nil || res.Miss || string(res.Data) != "value" {
+		t.Fatalf("Expected the value without its checksum, got %+v, %v", res, err)
+	}
+	if res, _ := get(raw, "k"); len(res.Data) != len("value")+8 {
+		t.Fatalf("Expected the stored value to have a checksum, got %q", res.Data)
+	}
+
+	// Values stored without a checksum are returned as they are
+	if err := raw.Set(common.SetRequest{Key: []byte("plain"), Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if res, err := get(h, "plain"); err != nil || res.Miss || string(res.Data) != "value" {
+		t.Fatalf("Expected the value stored without a checksum, got %+v, %v", res, err)
+	}
+
+	if err := h.Append(common.SetRequest{Key: []byte("k"), Data: []byte("more")}); err != common.ErrNotSupported {
+		t.Fatalf("Expected append to be unsupported, got %v", err)
+	}
+}
+
+func TestVerifiedCorrupt(t *testing.T) {
+	h, raw := wrapped(t, handlers.Verified)
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// Storing the same value under another key is caught too, since the
+	// checksum covers the key
+	stored, _ := get(raw, "k")
+	if err := raw.Set(common.SetRequest{Key: []byte("other"), Data: stored.Data}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if res, err := get(h, "other"); err != nil || !res.Miss {
+		t.Fatalf("Expected a value with the wrong key's checksum to miss, got %+v, %v", res, err)
+	}
+
+	stored.Data[len(stored.Data)/2] ^= 1
+	if err := raw.Set(common.SetRequest{Key: []byte("k"), Data: stored.Data}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if res, err := get(h, "k"); err != nil || !res.Miss {
+		t.Fatalf("Expected a changed value to miss, got %+v, %v", res, err)
+	}
+}
+
+func TestVerifiedTruncated(t *testing.T) {
+	// Faults are injected inside the check, like a backend cutting values short
+	h, _ := wrapped(t, func(hc handlers.HandlerConst) handlers.HandlerConst {
+		return handlers.Verified(handlers.Faulty(hc, "test", handlers.Faults{TruncateProb: 1}))
+	})
+
+	if err := h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	if res, err := get(h, "k"); err != nil || !res.Miss {
+		t.Fatalf("Expected a truncated value to miss, got %+v, %v", res, err)
+	}
+}
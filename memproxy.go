@@ -16,19 +16,31 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/netflix/rend/capture"
+	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/handlers/inmem"
 	"github.com/netflix/rend/handlers/memcached"
+	chunkedmc "github.com/netflix/rend/handlers/memcached/chunked"
 	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/misses"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/server"
+	"github.com/netflix/rend/textprot"
+	"github.com/netflix/rend/tracing"
 )
 
 func init() {
@@ -55,40 +67,230 @@ func init() {
 
 // Flags
 var (
-	chunked bool
+	chunked        bool
+	legacyFallback bool
+	metaCacheSize  int
+	metaCacheTTL   time.Duration
+
 	l1sock  string
 	l1inmem bool
 
+	canaryPercent float64
+	canarySock    string
+	canaryHandler string
+
 	l2enabled bool
 	l2sock    string
 
+	orcaName      string
+	batchOrcaName string
+	shadowConns   int
+	shadowQueue   int
+
 	locked      bool
 	concurrency int
 	multiReader bool
 
+	leases   bool
+	leaseTTL time.Duration
+
+	negativeTTL     time.Duration
+	negativeMaxKeys int
+
+	tenantQuotas string
+	tenantWindow time.Duration
+	ttlRules     string
+	ttlJitter    float64
+
+	clientBufSize  int
+	backendBufSize int
+
+	profileDir   string
+	redactKeys   string
+	flagBits     string
+	badDataChunk string
+	maxGetKeys   int
+
+	gcPercent   int
+	memoryLimit int64
+	ballastSize int
+
 	port            int
 	batchPort       int
+	bulkPort        int
 	useDomainSocket bool
 	sockPath        string
+	maxConns        int
+	maxInFlight     int
+	batchMaxConns   int
+	batchInFlight   int
+	writeTimeout    time.Duration
+	maxPendingWrite int
+
+	allowCommands      string
+	denyCommands       string
+	batchAllowCommands string
+	batchDenyCommands  string
+	backendDown        string
+	batchBackendDown   string
+	getFanOut          int
+	getAnyOrder        bool
+	batchGetAnyOrder   bool
+	multiplex          int
+	latencyBudget      time.Duration
+	budgetPolicy       string
+
+	backfillRate  int
+	backfillQueue int
+
+	throttleLatency  time.Duration
+	throttleInFlight int
+	throttleDelay    time.Duration
+
+	allowCIDRs string
+	denyCIDRs  string
+
+	validate     bool
+	printVersion bool
+
+	runtimeMetrics  bool
+	metricsInterval time.Duration
+	statsdAddr      string
+	statsdPrefix    string
+	dogstatsd       bool
+	graphiteAddr    string
+	graphitePrefix  string
+	otlpURL         string
+	atlasURL        string
+	atlasTags       string
+
+	zipkinURL       string
+	traceSampleRate float64
+
+	missFile    string
+	missUDPAddr string
+
+	captureFile  string
+	captureLimit int64
+
+	faults       handlers.Faults
+	verifyValues bool
 )
 
 func init() {
 	flag.BoolVar(&chunked, "chunked", false, "If --chunked is specified, the chunked handler is used for L1")
+	flag.BoolVar(&legacyFallback, "legacy-fallback", false, "With --chunked, keys with no chunked value are looked up as plain values stored under the key itself, like ones written straight to memcached by clients that don't use the proxy. Costs an extra round trip for every miss.")
+	flag.IntVar(&metaCacheSize, "metadata-cache-size", 0, "With --chunked, the metadata of up to this many keys read by gets is kept in the proxy, so gets of hot keys skip the metadata round trip. Off if 0.")
+	flag.DurationVar(&metaCacheTTL, "metadata-cache-ttl", time.Second, "How long cached metadata is used before it's read from L1 again. Writes through the proxy drop it right away.")
 	flag.BoolVar(&l1inmem, "l1-inmem", false, "Use the debug in-memory in-process L1 cache")
+	flag.Float64Var(&canaryPercent, "canary-percent", 0, "The percentage of keys, from 0 to 100 and picked by hash, sent to a canary L1 instead of the usual one. Off if 0.")
+	flag.StringVar(&canarySock, "canary-sock", "", "The unix socket of the canary L1. --l1-sock if empty, to try out a different handler on the same memcached.")
+	flag.StringVar(&canaryHandler, "canary-handler", "", "The handler used for the canary L1: regular or chunked. The same as L1 if empty.")
 	flag.StringVar(&l1sock, "l1-sock", "invalid.sock", "Specifies the unix socket to connect to L1")
 
 	flag.BoolVar(&l2enabled, "l2-enabled", false, "Specifies if l2 is enabled")
+	flag.IntVar(&backfillRate, "l1-backfill-rate", 0, "Write values that miss L1 and are found in L2 back into L1 in the background, at most this many a second, instead of before the get is done. Only used by the l1l2 orca. Off if 0.")
+	flag.IntVar(&backfillQueue, "l1-backfill-queue", 1000, "The most values waiting to be written back into L1 at once. Values found in L2 while it's full aren't written back. Only used if --l1-backfill-rate is set.")
 	flag.StringVar(&l2sock, "l2-sock", "invalid.sock", "Specifies the unix socket to connect to L2. Only used if --l2-enabled is true.")
 
+	flag.StringVar(&orcaName, "orca", "", "How the main listener combines L1 and L2: l1only, l1l2, or l1shadowl2 to serve from L1 and copy traffic to L2 as a shadow. Defaults to l1l2 if --l2-enabled is set and l1only otherwise.")
+	flag.IntVar(&shadowConns, "shadow-conns", 4, "The connections to L2 the l1shadowl2 orca copies requests over, shared by every client connection. Only used by the l1shadowl2 orca.")
+	flag.IntVar(&shadowQueue, "shadow-queue", 1000, "The most requests waiting to be copied to L2 at once by the l1shadowl2 orca. Requests that come in while it's full aren't copied. Only used by the l1shadowl2 orca.")
+	flag.StringVar(&batchOrcaName, "batch-orca", "l1l2batch", "How the batch listener combines L1 and L2, with the same choices as --orca plus l1l2batch. Only used if --l2-enabled is set.")
+
 	flag.BoolVar(&locked, "locked", false, "Add locking to overall operations (above L1/L2 layers)")
 	flag.IntVar(&concurrency, "concurrency", 8, "Concurrency level. 2^(concurrency) parallel operations permitted, assuming no collisions. Large values (>16) are likely useless and will eat up RAM. Default of 8 means 256 operations (on different keys) can happen in parallel.")
 	flag.BoolVar(&multiReader, "multi-reader", true, "Allow (or disallow) multiple readers on the same key. If chunking is used, this will always be false and setting it to true will be ignored.")
 
+	flag.BoolVar(&leases, "leases", false, "Support the lget and lset text commands, which give only the first client to miss on a key a lease to fill it while the others get a hot miss.")
+	flag.DurationVar(&leaseTTL, "lease-ttl", 10*time.Second, "How long a lease lasts if it's never used. Only used if --leases is set.")
+
+	flag.DurationVar(&negativeTTL, "negative-ttl", 0, "How long to remember that a key missed and answer gets for it without asking the backends. Disabled if 0.")
+	flag.IntVar(&negativeMaxKeys, "negative-max-keys", 100000, "The most missing keys to remember at once. Only used if --negative-ttl is set.")
+
+	flag.StringVar(&tenantQuotas, "tenant-quotas", "", "A comma separated list of tenants as name:requests:bytes:prefix, limiting the keys requested and value bytes stored in each --tenant-window by keys with the prefix. A limit of 0 is no limit. Disabled if empty.")
+	flag.DurationVar(&tenantWindow, "tenant-window", time.Second, "The window tenant quotas are counted over. Only used if --tenant-quotas is set.")
+	flag.StringVar(&ttlRules, "ttl-rules", "", "A comma separated list of rules as cap:ttl:prefix or set:ttl:prefix, e.g. \"cap:1h:session:\". cap cuts longer exptimes for keys with the prefix to the ttl, and set replaces every exptime with it. The longest matching prefix wins. Disabled if empty.")
+	flag.Float64Var(&ttlJitter, "ttl-jitter", 0, "The most percent of its TTL each value stored is randomly shortened by, so values stored together don't all expire at once. Applied after --ttl-rules. Off if 0.")
+
+	flag.IntVar(&clientBufSize, "client-buf-size", common.DefaultBufioSize, "The size in bytes of the read and write buffers for each client connection.")
+	flag.IntVar(&backendBufSize, "backend-buf-size", common.DefaultBufioSize, "The size in bytes of the read and write buffers for each backend connection. With --chunked, a few times the chunk size lets a whole chunk be sent or read at once.")
+
+	flag.StringVar(&redactKeys, "redact-keys", "none", "How keys are hidden in hot key stats and anywhere else they leave the proxy other than responses: none, hash for their FNV-1a hash, or truncate to keep their first 8 bytes.")
+	flag.StringVar(&flagBits, "flag-bits", "none", "The bits of the flags of values the proxy reserves for its own features, numbered from 0, as a comma separated list of name=bit for compressed, encrypted, and version, which takes 4 bits from the one given. Features that aren't named get bit 31 for compressed, 30 for encrypted, and 26 for version, and default reserves those. Clients can't store values with a reserved bit set. none reserves nothing.")
+	flag.IntVar(&maxGetKeys, "max-get-keys", 0, "The most keys a get may have on any listener. Gets with more get CLIENT_ERROR too many keys. Can be changed while running on the admin port at /settings/max-get-keys. No limit if 0.")
+	flag.StringVar(&badDataChunk, "bad-data-chunk", "resync", "What happens when a text client sends more or less data than a storage command says: resync responds with CLIENT_ERROR bad data chunk and skips to the next line, close closes the connection.")
+	flag.StringVar(&profileDir, "profile-dir", os.TempDir(), "The directory the \"stats profile\" command writes CPU and heap profiles to.")
+
+	flag.IntVar(&gcPercent, "gc-percent", 0, "The heap growth percent that triggers a GC, like GOGC. -1 turns GC off until --memory-limit is reached. GOGC or 100 is used if 0.")
+	flag.Int64Var(&memoryLimit, "memory-limit", 0, "A soft limit in bytes on the memory the Go runtime uses, like GOMEMLIMIT. GC runs more often as it is approached. GOMEMLIMIT or no limit is used if 0.")
+	flag.IntVar(&ballastSize, "ballast-size", 0, "The size in bytes of a never used allocation that makes the heap look bigger so GC runs less often on small live heaps. No ballast if 0.")
+
 	flag.IntVar(&port, "p", 11211, "External port to listen on")
 	flag.IntVar(&batchPort, "bp", 11212, "External port to listen on for batch systems")
+	flag.IntVar(&bulkPort, "bulk-port", 0, "External port to listen on for bulk producers using the bulk protocol, which sends many operations in each request. Off if 0.")
 	flag.BoolVar(&useDomainSocket, "use-domain-socket", false, "Listen on a domain socket instead of a TCP port. --port will be ignored.")
 	flag.StringVar(&sockPath, "sock-path", "/tmp/invalid.sock", "The socket path to listen on. Only valid in conjunction with --use-domain-socket.")
+	flag.StringVar(&allowCommands, "allow-commands", "", "A comma separated list of the only commands the main listener serves, e.g. \"get,set,stats hotkeys\". Others get an unknown command error. All commands are served if empty.")
+	flag.StringVar(&denyCommands, "deny-commands", "", "A comma separated list of commands the main listener refuses with an unknown command error, e.g. \"stats profile\". Can't be used with --allow-commands.")
+	flag.StringVar(&batchAllowCommands, "batch-allow-commands", "", "Like --allow-commands, for the batch listener.")
+	flag.StringVar(&batchDenyCommands, "batch-deny-commands", "", "Like --deny-commands, for the batch listener.")
+	flag.StringVar(&backendDown, "backend-down", "close", "What clients of the main and bulk listeners see when a backend can't be reached: close to close their connections, or miss for gets to miss and everything else to get SERVER_ERROR, keeping connections open.")
+	flag.StringVar(&batchBackendDown, "batch-backend-down", "close", "Like --backend-down, for the batch listener.")
+	flag.IntVar(&getFanOut, "get-fanout", 1, "The most backend connections the keys of one multiget are fetched over at once, in contiguous groups. Each client connection opens up to this many connections to each backend. Keys are fetched one after another over one connection if 1.")
+	flag.DurationVar(&latencyBudget, "latency-budget", 0, "How long each request may take on every listener before the work left for it at the backends is abandoned, e.g. 50ms. No limit if 0.")
+	flag.StringVar(&budgetPolicy, "latency-budget-policy", "miss", "What clients see when a request runs past --latency-budget: miss for gets and GATs to miss and everything else to get SERVER_ERROR, or error for everything to get SERVER_ERROR.")
+	flag.DurationVar(&throttleLatency, "write-throttle-latency", 0, "Hold back sets to a backend once their average latency is over this, e.g. 20ms, so reads keep being served. Off if 0.")
+	flag.IntVar(&throttleInFlight, "write-throttle-in-flight", 0, "Hold back sets to a backend once this many are waiting on it over all connections. Off if 0.")
+	flag.DurationVar(&throttleDelay, "write-throttle-delay", 0, "How long a held back set waits for the backend to catch up before it gets a busy error. Sets get the error right away if 0.")
+	flag.BoolVar(&getAnyOrder, "get-any-order", false, "Send the values of a multiget on the main and bulk listeners as they're ready, from either backend or any of the connections it's fetched over, instead of in the order of the keys, which the memcached protocols allow.")
+	flag.BoolVar(&batchGetAnyOrder, "batch-get-any-order", false, "Like --get-any-order, for the batch listener.")
+	flag.IntVar(&multiplex, "multiplex", 1, "The most requests of a binary protocol connection run at once on the main listener, each answered as soon as it's done and matched to its request by opaque, for clients that share one connection between threads. Each client connection opens up to this many connections to each backend. Requests are answered one at a time, in order, if 1.")
+	flag.StringVar(&allowCIDRs, "allow-cidrs", "", "A comma separated list of the only client IP ranges, e.g. \"10.0.0.0/8\", that connections are accepted from on both TCP listeners. All addresses are allowed if empty.")
+	flag.StringVar(&denyCIDRs, "deny-cidrs", "", "A comma separated list of client IP ranges that connections are refused from on both TCP listeners, even if --allow-cidrs includes them.")
+	flag.IntVar(&maxConns, "max-conns", 0, "The most client connections the main and bulk listeners each keep open at once. Further connections wait in the listen backlog until one closes. Each client connection has its own backend connections, so this also caps the listener's share of them. No limit if 0.")
+	flag.IntVar(&maxInFlight, "max-in-flight", 0, "The most requests the main and bulk listeners each work on at once over all their connections. Further requests wait for one to finish. No limit if 0.")
+	flag.IntVar(&batchMaxConns, "batch-max-conns", 0, "Like --max-conns, for the batch listener. --max-conns is used if 0.")
+	flag.IntVar(&batchInFlight, "batch-max-in-flight", 0, "Like --max-in-flight, for the batch listener.")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "How long each write of a response to a client may block, e.g. 10s, before the client is taken to have stopped reading and its connection is closed. Covers every listener. No limit if 0.")
+	flag.IntVar(&maxPendingWrite, "max-pending-write-bytes", 0, "The most response bytes waiting to be written to a client before its connection is closed, so a client that stops reading doesn't pin more memory. A single response bigger than this is still written. Covers every listener. No limit if 0.")
+
+	flag.BoolVar(&runtimeMetrics, "runtime-metrics", true, "Report Go runtime and process metrics like goroutines, heap in use, GC pauses, open files, and CPU time.")
+	flag.DurationVar(&metricsInterval, "metrics-interval", 10*time.Second, "How often metrics are pushed to the configured metrics sinks.")
+	flag.StringVar(&statsdAddr, "statsd-addr", "", "The host:port of a StatsD server to push metrics to over UDP. Disabled if empty.")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "rend.", "The prefix for every metric name sent to StatsD.")
+	flag.BoolVar(&dogstatsd, "dogstatsd", false, "Send tags to StatsD using the DogStatsD extension instead of adding them to the metric name.")
+	flag.StringVar(&graphiteAddr, "graphite-addr", "", "The host:port of a Graphite server to push metrics to using the plaintext protocol. Disabled if empty.")
+	flag.StringVar(&graphitePrefix, "graphite-prefix", "rend.", "The prefix for every metric name sent to Graphite.")
+	flag.StringVar(&atlasURL, "atlas-url", "", "The Atlas publish URL to push metrics to, e.g. http://localhost:7101/api/v1/publish. Disabled if empty.")
+	flag.StringVar(&atlasTags, "atlas-tags", "nf.app=rend", "Common tags sent with every metric published to Atlas, as a comma separated list of key=value pairs.")
+	flag.StringVar(&otlpURL, "otlp-url", "", "The URL of an OpenTelemetry collector to push metrics to using OTLP over HTTP, e.g. http://localhost:4318/v1/metrics. Disabled if empty.")
+
+	flag.StringVar(&zipkinURL, "zipkin-url", "", "The Zipkin v2 URL to send request traces to, e.g. http://localhost:9411/api/v2/spans. Disabled if empty.")
+	flag.Float64Var(&traceSampleRate, "trace-sample-rate", 0.001, "The fraction of requests to trace, from 0 to 1. Only used if --zipkin-url is set.")
+
+	flag.StringVar(&missFile, "miss-file", "", "A file to append a line to for every miss, with the key hash, key size, and time, for offline analysis. Disabled if empty.")
+	flag.StringVar(&missUDPAddr, "miss-udp-addr", "", "The host:port to send a line to over UDP for every miss, in the same format as --miss-file. Disabled if empty.")
+
+	flag.StringVar(&captureFile, "capture-file", "", "A file to record everything clients send to, with timing, for replaying later with cmd/replay. Keys are recorded as clients sent them, so it can't be used with --redact-keys. Replaced if it exists. Disabled if empty.")
+	flag.Int64Var(&captureLimit, "capture-limit", 1<<30, "The largest the capture file grows to in bytes before recording stops. No limit if 0. Only used if --capture-file is set.")
+
+	flag.BoolVar(&verifyValues, "verify-values", false, "Add a checksum to every value stored and check it on every read, counting and logging corrupt values and returning them as misses. Append and prepend aren't supported while it's on.")
 
+	// Fault injection is only for testing. Every probability is 0 by default.
+	flag.DurationVar(&faults.Latency, "fault-latency", 100*time.Millisecond, "The latency added to backend requests picked by --fault-latency-prob.")
+	flag.Float64Var(&faults.LatencyProb, "fault-latency-prob", 0, "For testing. The probability from 0 to 1 that a backend request is delayed by --fault-latency.")
+	flag.Float64Var(&faults.DropProb, "fault-drop-prob", 0, "For testing. The probability from 0 to 1 that the response to a backend request is lost and the request fails.")
+	flag.Float64Var(&faults.TruncateProb, "fault-truncate-prob", 0, "For testing. The probability from 0 to 1 that a backend request's hits come back with only half their value.")
+	flag.Float64Var(&faults.ResetProb, "fault-reset-prob", 0, "For testing. The probability from 0 to 1 that a backend connection is closed before a request, failing it and the rest on the connection.")
+	flag.Int64Var(&faults.Seed, "fault-seed", 1, "Seeds the injected faults, so a test sending the same requests gets the same faults.")
+
+	flag.BoolVar(&printVersion, "version", false, "Print the version and build information and exit.")
+	flag.BoolVar(&validate, "validate", false, "Validate the configuration, print the effective settings, and exit. Exits non-zero if any problems are found.")
+
+	// Environment variables are applied first so anything given explicitly on
+	// the command line will override them.
+	envOverlay()
 	flag.Parse()
 
 	if concurrency >= 64 {
@@ -96,21 +298,113 @@ func init() {
 	}
 }
 
+// The prefix for environment variables that can be used to set flag values.
+const envPrefix = "REND_"
+
+// envOverlay sets each flag from its corresponding environment variable, if
+// present. The variable name is the flag name upper cased, with dashes changed
+// to underscores and prefixed with REND_, e.g. --l1-sock is REND_L1_SOCK.
+func envOverlay() {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		val, set := os.LookupEnv(name)
+		if !set {
+			return
+		}
+		if err := f.Value.Set(val); err != nil {
+			log.Printf("Invalid value %q for environment variable %s: %s\n", val, name, err.Error())
+			flag.Usage()
+			os.Exit(1)
+		}
+	})
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
 // And away we go
 func main() {
+	if printVersion {
+		fmt.Println(common.VersionString)
+		fmt.Println("git sha:", common.GitSHA)
+		fmt.Println("build date:", common.BuildDate)
+		os.Exit(0)
+	}
+
+	if validate {
+		if !validateConfig(os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	setupGC()
+	setupMetrics()
+	recordMisses := setupMisses()
+	common.SetBufioSizes(clientBufSize, backendBufSize)
+	orcas.SetProfileDir(profileDir)
+
+	redaction, err := common.ParseKeyRedaction(redactKeys)
+	if err != nil {
+		log.Println("Invalid value for --redact-keys:", err.Error())
+		os.Exit(1)
+	}
+	common.SetKeyRedaction(redaction)
+
+	bits, err := common.ParseFlagBits(flagBits)
+	if err != nil {
+		log.Println("Invalid value for --flag-bits:", err.Error())
+		os.Exit(1)
+	}
+	common.SetFlagBits(bits)
+
+	chunkPolicy, err := textprot.ParseDataChunkPolicy(badDataChunk)
+	if err != nil {
+		log.Println("Invalid value for --bad-data-chunk:", err.Error())
+		os.Exit(1)
+	}
+	textprot.SetDataChunkPolicy(chunkPolicy)
+
+	server.SetMaxGetKeys(maxGetKeys)
+	setupMaxGetKeys()
+
 	var l server.ListenArgs
 
 	if useDomainSocket {
 		l = server.ListenArgs{
-			Type: server.ListenUnix,
-			Path: sockPath,
+			Type:        server.ListenUnix,
+			Path:        sockPath,
+			MaxConns:    maxConns,
+			MaxInFlight: maxInFlight,
 		}
 	} else {
 		l = server.ListenArgs{
-			Type: server.ListenTCP,
-			Port: port,
+			Type:        server.ListenTCP,
+			Port:        port,
+			MaxConns:    maxConns,
+			MaxInFlight: maxInFlight,
 		}
 	}
+	l.Commands = mustCommandFilter("", allowCommands, denyCommands)
+	l.Unavailable = mustUnavailablePolicy("backend-down", backendDown)
+	l.GetFanOut = getFanOut
+	l.GetAnyOrder = getAnyOrder
+	l.Multiplex = multiplex
+	l.Budget = latencyBudget
+	l.BudgetPolicy = mustBudgetPolicy(budgetPolicy)
+	l.WriteTimeout = writeTimeout
+	l.MaxPendingWrite = maxPendingWrite
+
+	ips, err := ipFilter(allowCIDRs, denyCIDRs)
+	if err != nil {
+		log.Println("Invalid client address filter:", err.Error())
+		os.Exit(1)
+	}
+	l.IPs = ips
+
+	recorder := setupCapture()
+	l.Capture = recorder
 
 	var o orcas.OrcaConst
 	var h2 handlers.HandlerConst
@@ -120,47 +414,129 @@ func main() {
 		h1 = inmem.New
 	} else if chunked {
 		h1 = memcached.Chunked(l1sock)
+		chunkedmc.SetLegacyFallback(legacyFallback)
+		chunkedmc.SetMetadataCache(metaCacheSize, metaCacheTTL)
+		setupChunkDebug()
 	} else {
 		h1 = memcached.Regular(l1sock)
 	}
+	if !l1inmem {
+		orcas.SetLruCrawler(memcached.LruCrawler(l1sock, chunked))
+	}
 
 	if l2enabled {
-		o = orcas.L1L2
 		h2 = memcached.Regular(l2sock)
 	} else {
-		o = orcas.L1Only
 		h2 = handlers.NilHandler
 	}
 
-	// Add the locking wrapper if requested. The locking wrapper can either allow mutltiple readers
-	// or not, with the same difference in semantics between a sync.Mutex and a sync.RWMutex. If
-	// chunking is enabled, we want to ensure that stricter locking is enabled, since concurrent
-	// sets into L1 with chunking can collide and cause data corruption.
-	var lockset uint32
-	if locked {
-		if chunked || !multiReader {
-			o, lockset = orcas.Locked(o, false, uint8(concurrency))
-		} else {
-			o, lockset = orcas.Locked(o, true, uint8(concurrency))
-		}
+	// stats reset goes on to every memcached behind the proxy
+	var statsSocks []string
+	if !l1inmem {
+		statsSocks = append(statsSocks, l1sock)
+	}
+	if l2enabled {
+		statsSocks = append(statsSocks, l2sock)
+	}
+	if len(statsSocks) > 0 {
+		orcas.SetStatsReset(memcached.StatsReset(statsSocks...))
+	}
+
+	o = mustOrca("orca", mainOrcaName())
+
+	if faults.Enabled() {
+		log.Printf("Injecting backend faults: %+v\n", faults)
+	}
+	if zipkinURL != "" {
+		tracing.Start(zipkinURL, "rend", traceSampleRate)
+	}
+	throttle := handlers.Throttle{
+		MaxLatency:  throttleLatency,
+		MaxInFlight: throttleInFlight,
+		Delay:       throttleDelay,
+	}
+	// L1 is written after L2, so a set shed by L1 after L2 took it deletes the
+	// key instead of leaving the old value in L1
+	l1Throttle := throttle
+	l1Throttle.DeleteShed = l2enabled
+
+	h1 = backend(h1, "l1", faults, l1Throttle)
+	l2Faults := faults
+	l2Faults.Seed++
+	h2 = backend(h2, "l2", l2Faults, throttle)
+
+	// The canary is a backend of its own, so none of its requests are counted
+	// in l1's metrics or held back by l1's load
+	if canaryPercent > 0 {
+		canaryFaults := faults
+		canaryFaults.Seed += 2
+		h1 = handlers.Canary(h1, backend(canaryConst(), "l1_canary", canaryFaults, l1Throttle), canaryPercent)
+	}
+
+	// Values found in L2 go through the same L1 handlers as everything else
+	if l2enabled && backfillRate > 0 {
+		orcas.SetBackfiller(orcas.NewBackfiller(h1, backfillRate, backfillQueue))
 	}
 
-	go server.ListenAndServe(l, server.Default, o, h1, h2)
+	// The same middleware wraps the orca of each listener, so the locks,
+	// leases, negative cache, and quotas are shared between them.
+	mws := middleware(recordMisses)
+
+	// The shadow orca copies requests to L2 over its own connections, so
+	// listeners using it don't open L2 for every client
+	if shadowing() {
+		orcas.SetShadower(orcas.NewShadower(h2, shadowConns, shadowQueue))
+	}
+
+	go serve(server.Config{ListenArgs: l, Orca: o, Middleware: mws, L1: h1, L2: listenerL2(mainOrcaName(), h2)})
 
 	if l2enabled {
 		// If L2 is enabled, start the batch L1 / L2 orchestrator
+		if batchMaxConns == 0 {
+			batchMaxConns = maxConns
+		}
 		l = server.ListenArgs{
-			Type: server.ListenTCP,
-			Port: batchPort,
+			Type:            server.ListenTCP,
+			Port:            batchPort,
+			MaxConns:        batchMaxConns,
+			MaxInFlight:     batchInFlight,
+			Commands:        mustCommandFilter("batch-", batchAllowCommands, batchDenyCommands),
+			Unavailable:     mustUnavailablePolicy("batch-backend-down", batchBackendDown),
+			GetFanOut:       getFanOut,
+			GetAnyOrder:     batchGetAnyOrder,
+			Budget:          latencyBudget,
+			BudgetPolicy:    mustBudgetPolicy(budgetPolicy),
+			IPs:             ips,
+			Capture:         recorder,
+			WriteTimeout:    writeTimeout,
+			MaxPendingWrite: maxPendingWrite,
 		}
 
-		o := orcas.L1L2Batch
+		o := mustOrca("batch-orca", batchOrcaName)
 
-		if locked {
-			o = orcas.LockedWithExisting(o, lockset)
+		go serve(server.Config{ListenArgs: l, Orca: o, Middleware: mws, L1: h1, L2: listenerL2(batchOrcaName, h2)})
+	}
+
+	if bulkPort != 0 {
+		// Bulk producers share the orca and backends of the main listener
+		l = server.ListenArgs{
+			Type:            server.ListenTCP,
+			Port:            bulkPort,
+			MaxConns:        maxConns,
+			MaxInFlight:     maxInFlight,
+			IPs:             ips,
+			Capture:         recorder,
+			Protocol:        &server.BulkProtocol,
+			Unavailable:     mustUnavailablePolicy("backend-down", backendDown),
+			GetFanOut:       getFanOut,
+			GetAnyOrder:     getAnyOrder,
+			Budget:          latencyBudget,
+			BudgetPolicy:    mustBudgetPolicy(budgetPolicy),
+			WriteTimeout:    writeTimeout,
+			MaxPendingWrite: maxPendingWrite,
 		}
 
-		go server.ListenAndServe(l, server.Default, o, h1, h2)
+		go serve(server.Config{ListenArgs: l, Orca: o, Middleware: mws, L1: h1, L2: listenerL2(mainOrcaName(), h2)})
 	}
 
 	// Block forever
@@ -168,3 +544,514 @@ func main() {
 	wg.Add(1)
 	wg.Wait()
 }
+
+// Returns the middleware for the configured features, outermost first.
+func middleware(recordMisses bool) []orcas.Middleware {
+	var mws []orcas.Middleware
+
+	// Leases have to be the outermost wrapper so a lease from one listener
+	// can be used on the other.
+	if leases {
+		lt := orcas.NewLeaseTable(leaseTTL)
+		mws = append(mws, func(oc orcas.OrcaConst) orcas.OrcaConst {
+			return orcas.LeasedWithExisting(oc, lt)
+		})
+	}
+
+	// Stores using the flag bits the proxy reserves are refused before
+	// anything else sees them
+	if common.GetFlagBits().Enabled {
+		mws = append(mws, orcas.ReservedFlagsChecked)
+	}
+
+	// Requests over quota don't reach the backends or count as misses
+	if tenantQuotas != "" {
+		tenants, err := parseTenants(tenantQuotas)
+		if err != nil {
+			log.Printf("Invalid value for --tenant-quotas: %s\n", err.Error())
+			flag.Usage()
+			os.Exit(1)
+		}
+		qt := orcas.NewQuotaTable(tenants, tenantWindow)
+		mws = append(mws, func(oc orcas.OrcaConst) orcas.OrcaConst {
+			return orcas.QuotasWithExisting(oc, qt)
+		})
+	}
+
+	// Rewrites exptimes before anything below can store them
+	if ttlRules != "" || ttlJitter > 0 {
+		var rules []orcas.TTLRule
+		if ttlRules != "" {
+			var err error
+			if rules, err = parseTTLRules(ttlRules); err != nil {
+				log.Printf("Invalid value for --ttl-rules: %s\n", err.Error())
+				flag.Usage()
+				os.Exit(1)
+			}
+		}
+		p := orcas.NewTTLPolicy(rules, ttlJitter/100)
+		mws = append(mws, func(oc orcas.OrcaConst) orcas.OrcaConst {
+			return orcas.TTLLimited(oc, p)
+		})
+	}
+
+	if recordMisses {
+		mws = append(mws, misses.Recording)
+	}
+
+	// Misses answered from the negative cache are still recorded, and lease
+	// gets can still hand out leases for them.
+	if negativeTTL > 0 {
+		nt := orcas.NewNegativeTable(negativeTTL, negativeMaxKeys)
+		mws = append(mws, func(oc orcas.OrcaConst) orcas.OrcaConst {
+			return orcas.NegativeCachedWithExisting(oc, nt)
+		})
+	}
+
+	// Add the locking wrapper if requested. The locking wrapper can either allow mutltiple readers
+	// or not, with the same difference in semantics between a sync.Mutex and a sync.RWMutex. If
+	// chunking is enabled, we want to ensure that stricter locking is enabled, since concurrent
+	// sets into L1 with chunking can collide and cause data corruption.
+	if locked {
+		lockset := orcas.NewLockset(multiReader && !chunked, uint8(concurrency))
+		mws = append(mws, func(oc orcas.OrcaConst) orcas.OrcaConst {
+			return orcas.LockedWithExisting(oc, lockset)
+		})
+	}
+
+	return mws
+}
+
+// Serves a listener until the process exits. A listener that can't be bound is
+// fatal, since the proxy would be up without serving anything.
+func serve(c server.Config) {
+	if err := server.Serve(c); err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+}
+
+// Held so the ballast is never collected. It is never written, so the OS only
+// backs the pages the allocator touches.
+var ballast []byte
+
+// Applies the GC settings that were given, leaving the rest to the runtime's
+// own defaults and environment variables.
+func setupGC() {
+	if gcPercent != 0 {
+		debug.SetGCPercent(gcPercent)
+	}
+	if memoryLimit > 0 {
+		debug.SetMemoryLimit(memoryLimit)
+	}
+	if ballastSize > 0 {
+		ballast = make([]byte, ballastSize)
+	}
+}
+
+// Registers the optional runtime metrics, then sets up the configured metrics
+// sinks and starts pushing to them if there are any. Sinks that can't be set
+// up are fatal, since they were asked for.
+func setupMetrics() {
+	if runtimeMetrics {
+		metrics.RegisterRuntimeMetrics()
+	}
+
+	var enabled bool
+
+	if statsdAddr != "" {
+		s, err := metrics.NewStatsDSink(statsdAddr, statsdPrefix, dogstatsd)
+		if err != nil {
+			log.Printf("Error setting up StatsD sink at %s: %s\n", statsdAddr, err.Error())
+			os.Exit(1)
+		}
+		metrics.AddSink(s)
+		enabled = true
+	}
+
+	if graphiteAddr != "" {
+		metrics.AddSink(metrics.NewGraphiteSink(graphiteAddr, graphitePrefix))
+		enabled = true
+	}
+
+	if otlpURL != "" {
+		metrics.AddSink(metrics.NewOTLPSink(otlpURL, metrics.Tags{"service.name": "rend"}))
+		enabled = true
+	}
+
+	if atlasURL != "" {
+		tgs, err := parseTags(atlasTags)
+		if err != nil {
+			log.Printf("Invalid value for --atlas-tags: %s\n", err.Error())
+			flag.Usage()
+			os.Exit(1)
+		}
+		metrics.AddSink(metrics.NewAtlasSink(atlasURL, tgs))
+		enabled = true
+	}
+
+	if enabled {
+		metrics.StartFlusher(metricsInterval, metrics.DefaultPercentiles)
+	}
+}
+
+// Starts publishing misses to the configured sink, if there is one. Returns
+// true if misses should be recorded. A sink that can't be set up is fatal,
+// since it was asked for.
+func setupMisses() bool {
+	var sink misses.Sink
+
+	switch {
+	case missFile != "":
+		s, err := misses.NewFileSink(missFile)
+		if err != nil {
+			log.Printf("Error opening miss file %s: %s\n", missFile, err.Error())
+			os.Exit(1)
+		}
+		sink = s
+
+	case missUDPAddr != "":
+		s, err := misses.NewUDPSink(missUDPAddr)
+		if err != nil {
+			log.Printf("Error setting up miss UDP sink at %s: %s\n", missUDPAddr, err.Error())
+			os.Exit(1)
+		}
+		sink = s
+
+	default:
+		return false
+	}
+
+	misses.Start(sink)
+	return true
+}
+
+// Returns the recorder both listeners share, or nil if --capture-file isn't set.
+func setupCapture() *capture.Recorder {
+	if captureFile == "" {
+		return nil
+	}
+
+	// The capture has every key as clients sent it
+	if redactKeys != "none" {
+		log.Println("--capture-file can't be used with --redact-keys, since it records keys as clients sent them")
+		os.Exit(1)
+	}
+
+	r, err := capture.NewFileRecorder(captureFile, captureLimit)
+	if err != nil {
+		log.Printf("Error opening capture file %s: %s\n", captureFile, err.Error())
+		os.Exit(1)
+	}
+	return r
+}
+
+// Serves the chunk layout of a key on the admin port at /debug/chunks?key=,
+// for looking into partial misses. Each request uses its own connection to L1.
+func setupChunkDebug() {
+	http.HandleFunc("/debug/chunks", func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+
+		conn, err := net.Dial("unix", l1sock)
+		if err != nil {
+			http.Error(w, "Error connecting to L1: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		c := chunkedmc.NewClient(conn)
+		defer c.Close()
+
+		layout, err := c.Layout([]byte(key))
+		if err != nil {
+			http.Error(w, "Error reading layout: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		layout.WriteText(w)
+	})
+}
+
+// Serves the limit on keys per get on the admin port at /settings/max-get-keys.
+// A POST with ?n= changes it for every listener without a restart.
+func setupMaxGetKeys() {
+	http.HandleFunc("/settings/max-get-keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			n, err := strconv.Atoi(r.URL.Query().Get("n"))
+			if err != nil || n < 0 {
+				http.Error(w, "n must be a number of keys, or 0 for no limit", http.StatusBadRequest)
+				return
+			}
+			log.Printf("Changing the most keys per get from %d to %d\n", server.MaxGetKeys(), n)
+			server.SetMaxGetKeys(n)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, server.MaxGetKeys())
+	})
+}
+
+// Builds the command filter for a listener from comma separated allow and deny
+// lists. At most one may be set. Returns nil if neither is. The prefix names
+// the listener's flags.
+func commandFilter(prefix, allow, deny string) (*server.CommandFilter, error) {
+	switch {
+	case allow != "" && deny != "":
+		return nil, fmt.Errorf("only one of %sallow-commands and %sdeny-commands can be set", prefix, prefix)
+	case allow != "":
+		return server.AllowCommands(strings.Split(allow, ","))
+	case deny != "":
+		return server.DenyCommands(strings.Split(deny, ","))
+	}
+	return nil, nil
+}
+
+// Returns the constructor for the canary L1 connections.
+func canaryConst() handlers.HandlerConst {
+	sock := canarySock
+	if sock == "" {
+		sock = l1sock
+	}
+
+	isChunked := chunked
+	switch canaryHandler {
+	case "regular":
+		isChunked = false
+	case "chunked":
+		isChunked = true
+	}
+
+	if isChunked {
+		return memcached.Chunked(sock)
+	}
+	return memcached.Regular(sock)
+}
+
+// Returns the name of the main listener's orca, picking one by whether there
+// is an L2 if none was given.
+func mainOrcaName() string {
+	switch {
+	case orcaName != "":
+		return orcaName
+	case l2enabled:
+		return "l1l2"
+	}
+	return "l1only"
+}
+
+// Checks that the named orca exists and can run with the backends that are
+// configured.
+func checkOrca(flagName, name string) error {
+	if _, ok := orcas.Named(name); !ok {
+		return fmt.Errorf("unknown %s %q, expected one of %s", flagName, name, strings.Join(orcas.Names(), ", "))
+	}
+	if name != "l1only" && !l2enabled {
+		return fmt.Errorf("%s %s needs --l2-enabled", flagName, name)
+	}
+	return nil
+}
+
+// Whether any listener uses the shadow orca
+func shadowing() bool {
+	return mainOrcaName() == "l1shadowl2" || (l2enabled && batchOrcaName == "l1shadowl2")
+}
+
+// Wraps the handlers of one backend with the wrappers every backend gets,
+// tagging their metrics with the backend name.
+func backend(hc handlers.HandlerConst, name string, f handlers.Faults, throttle handlers.Throttle) handlers.HandlerConst {
+	// Faults are injected closest to the backend, so everything else sees them
+	// as the backend misbehaving
+	if f.Enabled() {
+		hc = handlers.Faulty(hc, name, f)
+	}
+
+	// A backend connection that gets out of step with its responses is
+	// replaced before the error reaches anything else
+	hc = handlers.Resynced(hc, name)
+
+	// Checked outside of any injected faults, so they're caught like any other
+	// corruption
+	if verifyValues {
+		hc = handlers.Verified(hc)
+	}
+
+	// Count requests, hits, misses, errors, and bytes per command
+	hc = handlers.Instrumented(hc, name)
+
+	if zipkinURL != "" {
+		hc = handlers.Traced(hc, name)
+	}
+
+	// Outside of everything else, so sets that are held back don't look like
+	// backend errors
+	if throttle.Enabled() {
+		hc = handlers.Throttled(hc, name, throttle)
+	}
+
+	return hc
+}
+
+// Returns the L2 each client connection of a listener with the named orca
+// opens. The shadow orca has its own L2 connections, so its listeners have
+// none, and L2 being down can't close their clients.
+func listenerL2(orcaName string, h2 handlers.HandlerConst) handlers.HandlerConst {
+	if orcaName == "l1shadowl2" {
+		return nil
+	}
+	return h2
+}
+
+// Returns the named orca. An orca that can't be used is fatal, since it was
+// asked for.
+func mustOrca(flagName, name string) orcas.OrcaConst {
+	if err := checkOrca(flagName, name); err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	oc, _ := orcas.Named(name)
+	return oc
+}
+
+// Builds the client address filter from comma separated lists of CIDR ranges.
+// Returns nil if neither list is set.
+func ipFilter(allow, deny string) (*server.IPFilter, error) {
+	if allow == "" && deny == "" {
+		return nil, nil
+	}
+
+	var allows, denies []string
+	if allow != "" {
+		allows = strings.Split(allow, ",")
+	}
+	if deny != "" {
+		denies = strings.Split(deny, ",")
+	}
+	return server.NewIPFilter(allows, denies)
+}
+
+// Builds a listener's command filter. An invalid filter is fatal, since it
+// was asked for.
+func mustCommandFilter(prefix, allow, deny string) *server.CommandFilter {
+	f, err := commandFilter(prefix, allow, deny)
+	if err != nil {
+		log.Println("Invalid command filter:", err.Error())
+		os.Exit(1)
+	}
+	return f
+}
+
+// Parses a listener's backend down policy. An invalid policy is fatal, like an
+// invalid command filter.
+func mustUnavailablePolicy(flagName, s string) server.UnavailablePolicy {
+	p, err := server.ParseUnavailablePolicy(s)
+	if err != nil {
+		log.Printf("Invalid value for --%s: %s\n", flagName, err.Error())
+		os.Exit(1)
+	}
+	return p
+}
+
+// Parses the latency budget policy. An invalid policy is fatal.
+func mustBudgetPolicy(s string) server.BudgetPolicy {
+	p, err := server.ParseBudgetPolicy(s)
+	if err != nil {
+		log.Println("Invalid value for --latency-budget-policy:", err.Error())
+		os.Exit(1)
+	}
+	return p
+}
+
+// Parses a comma separated list of tenants as name:requests:bytes:prefix. The
+// prefix is last so it can contain colons.
+func parseTenants(s string) ([]orcas.Tenant, error) {
+	var tenants []orcas.Tenant
+	names := make(map[string]bool)
+
+	for _, t := range strings.Split(s, ",") {
+		parts := strings.SplitN(t, ":", 4)
+		if len(parts) != 4 || parts[0] == "" {
+			return nil, fmt.Errorf("expected name:requests:bytes:prefix, got %q", t)
+		}
+		if names[parts[0]] {
+			return nil, fmt.Errorf("tenant %s is given more than once", parts[0])
+		}
+		names[parts[0]] = true
+
+		requests, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request limit for tenant %s: %q", parts[0], parts[1])
+		}
+		bytes, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid byte limit for tenant %s: %q", parts[0], parts[2])
+		}
+
+		tenants = append(tenants, orcas.Tenant{
+			Name:     parts[0],
+			Prefix:   parts[3],
+			Requests: requests,
+			Bytes:    bytes,
+		})
+	}
+
+	return tenants, nil
+}
+
+// Parses a comma separated list of TTL rules as mode:ttl:prefix, where mode is
+// cap or set. The prefix is last so it can contain colons.
+func parseTTLRules(s string) ([]orcas.TTLRule, error) {
+	var rules []orcas.TTLRule
+	prefixes := make(map[string]bool)
+
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(r, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("expected mode:ttl:prefix, got %q", r)
+		}
+		if prefixes[parts[2]] {
+			return nil, fmt.Errorf("duplicate TTL rule for prefix %q", parts[2])
+		}
+		prefixes[parts[2]] = true
+
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid ttl for prefix %q: %q", parts[2], parts[1])
+		}
+
+		rule := orcas.TTLRule{Prefix: parts[2], TTL: ttl}
+		switch parts[0] {
+		case "cap":
+			if ttl < time.Second {
+				return nil, fmt.Errorf("capped ttl for prefix %q must be at least 1s, got %s", parts[2], ttl)
+			}
+		case "set":
+			rule.Override = true
+		default:
+			return nil, fmt.Errorf("unknown TTL rule mode %q, expected cap or set", parts[0])
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Parses a comma separated list of key=value pairs
+func parseTags(s string) (metrics.Tags, error) {
+	tgs := make(metrics.Tags)
+	if s == "" {
+		return tgs, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", kv)
+		}
+		tgs[parts[0]] = parts[1]
+	}
+
+	return tgs, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// The most datapoints sent in one publish request
+const atlasBatchSize = 10000
+
+// AtlasSink publishes metrics to the Atlas publish API as batched JSON POSTs.
+// The common tags are sent once per request and apply to every datapoint,
+// e.g. nf.app or nf.node.
+//
+// Following the Atlas conventions, counters are sent as a rate per second
+// with statistic=count, and gauges with statistic=gauge. Histograms are sent
+// as the rate of observations (statistic=count) and of their total
+// (statistic=totalAmount), the max as a gauge, and each percentile with
+// statistic=percentile and a percentile tag like p99.
+type AtlasSink struct {
+	url    string
+	common Tags
+	client *http.Client
+
+	prevCtrs     map[string]uint64
+	prevCtrsTime time.Time
+	prevHistTime time.Time
+}
+
+type atlasPayload struct {
+	Tags    Tags          `json:"tags"`
+	Metrics []atlasMetric `json:"metrics"`
+}
+
+type atlasMetric struct {
+	Tags      Tags    `json:"tags"`
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// Creates an Atlas sink that posts to the given publish URL, normally ending in
+// /api/v1/publish.
+func NewAtlasSink(url string, common Tags) *AtlasSink {
+	now := time.Now()
+	return &AtlasSink{
+		url:          url,
+		common:       copyTags(common),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		prevCtrs:     make(map[string]uint64),
+		prevCtrsTime: now,
+		prevHistTime: now,
+	}
+}
+
+func (a *AtlasSink) FlushCounters(ctrs []Counter) error {
+	now := time.Now()
+	secs := now.Sub(a.prevCtrsTime).Seconds()
+	a.prevCtrsTime = now
+
+	var ms []atlasMetric
+	for _, c := range ctrs {
+		key := metricKey(c.Name, c.Tags)
+		prev, ok := a.prevCtrs[key]
+		a.prevCtrs[key] = c.Value
+
+		// The first flush only establishes the baseline
+		if !ok || secs <= 0 {
+			continue
+		}
+
+		delta := counterDelta(prev, c.Value)
+		ms = append(ms, atlasDatapoint(c.Name, c.Tags, "count", now, float64(delta)/secs))
+	}
+
+	return a.publish(ms)
+}
+
+func (a *AtlasSink) FlushGauges(ints []IntGauge, floats []FloatGauge) error {
+	now := time.Now()
+
+	var ms []atlasMetric
+	for _, g := range ints {
+		ms = append(ms, atlasDatapoint(g.Name, g.Tags, "gauge", now, float64(g.Value)))
+	}
+	for _, g := range floats {
+		ms = append(ms, atlasDatapoint(g.Name, g.Tags, "gauge", now, g.Value))
+	}
+
+	return a.publish(ms)
+}
+
+func (a *AtlasSink) FlushHistograms(hists []HistSummary) error {
+	now := time.Now()
+	secs := now.Sub(a.prevHistTime).Seconds()
+	a.prevHistTime = now
+
+	if secs <= 0 {
+		return nil
+	}
+
+	var ms []atlasMetric
+	for _, h := range hists {
+		ms = append(ms, atlasDatapoint(h.Name, h.Tags, "count", now, float64(h.Count)/secs))
+
+		if h.Count == 0 {
+			continue
+		}
+
+		total := h.Avg * float64(h.Count)
+		ms = append(ms, atlasDatapoint(h.Name, h.Tags, "totalAmount", now, total/secs))
+		ms = append(ms, atlasDatapoint(h.Name, h.Tags, "max", now, float64(h.Max)))
+
+		for i, p := range h.Pctls {
+			m := atlasDatapoint(h.Name, h.Tags, "percentile", now, float64(p))
+			m.Tags["percentile"] = percentileName(h.Percentiles[i])
+			ms = append(ms, m)
+		}
+	}
+
+	return a.publish(ms)
+}
+
+func atlasDatapoint(name string, tgs Tags, stat string, ts time.Time, val float64) atlasMetric {
+	t := make(Tags, len(tgs)+2)
+	for k, v := range tgs {
+		t[k] = v
+	}
+	t["name"] = name
+	t["statistic"] = stat
+
+	return atlasMetric{
+		Tags:      t,
+		Timestamp: ts.UnixNano() / int64(time.Millisecond),
+		Value:     val,
+	}
+}
+
+func (a *AtlasSink) publish(ms []atlasMetric) error {
+	for len(ms) > 0 {
+		n := len(ms)
+		if n > atlasBatchSize {
+			n = atlasBatchSize
+		}
+
+		if err := a.post(ms[:n]); err != nil {
+			return err
+		}
+
+		ms = ms[n:]
+	}
+
+	return nil
+}
+
+func (a *AtlasSink) post(ms []atlasMetric) error {
+	body, err := json.Marshal(atlasPayload{Tags: a.common, Metrics: ms})
+	if err != nil {
+		return err
+	}
+
+	res, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Atlas publish to %s failed with status %s", a.url, res.Status)
+	}
+
+	return nil
+}
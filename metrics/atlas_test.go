@@ -0,0 +1,94 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAtlasSinkBatches(t *testing.T) {
+	var payloads []atlasPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p atlasPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("Error decoding request: %s", err.Error())
+		}
+		payloads = append(payloads, p)
+	}))
+	defer srv.Close()
+
+	a := NewAtlasSink(srv.URL+"/api/v1/publish", Tags{"nf.app": "rend"})
+
+	gauges := make([]IntGauge, atlasBatchSize+1)
+	for i := range gauges {
+		gauges[i] = IntGauge{Name: "conns", Tags: Tags{"id": string(rune('a' + i%26))}, Value: 3}
+	}
+
+	if err := a.FlushGauges(gauges, nil); err != nil {
+		t.Fatalf("Error flushing: %s", err.Error())
+	}
+
+	if len(payloads) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(payloads))
+	}
+	if len(payloads[0].Metrics) != atlasBatchSize || len(payloads[1].Metrics) != 1 {
+		t.Fatalf("Unexpected batch sizes %d and %d", len(payloads[0].Metrics), len(payloads[1].Metrics))
+	}
+
+	p := payloads[1]
+	if p.Tags["nf.app"] != "rend" {
+		t.Fatalf("Expected common tags, got %v", p.Tags)
+	}
+
+	m := p.Metrics[0]
+	if m.Tags["name"] != "conns" || m.Tags["statistic"] != "gauge" || m.Value != 3 {
+		t.Fatalf("Unexpected datapoint %+v", m)
+	}
+}
+
+func TestAtlasSinkCounterReset(t *testing.T) {
+	var payloads []atlasPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p atlasPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Errorf("Error decoding request: %s", err.Error())
+		}
+		payloads = append(payloads, p)
+	}))
+	defer srv.Close()
+
+	a := NewAtlasSink(srv.URL+"/api/v1/publish", nil)
+
+	if err := a.FlushCounters([]Counter{{Name: "hits", Value: 10}}); err != nil {
+		t.Fatalf("Error flushing: %s", err.Error())
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := a.FlushCounters([]Counter{{Name: "hits", Value: 3}}); err != nil {
+		t.Fatalf("Error flushing: %s", err.Error())
+	}
+
+	// Everything counted since the reset is sent as a rate
+	var ms []atlasMetric
+	for _, p := range payloads {
+		ms = append(ms, p.Metrics...)
+	}
+	if len(ms) != 1 || ms[0].Tags["name"] != "hits" || ms[0].Value <= 0 {
+		t.Fatalf("Expected a positive rate for the reset counter, got %+v", ms)
+	}
+}
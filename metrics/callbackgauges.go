@@ -1,6 +1,23 @@
+// Copyright 2015 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
 package metrics
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type IntGaugeCallback func() uint64
 type FloatGaugeCallback func() float64
@@ -10,16 +27,25 @@ const maxNumCallbacks = 10240
 var (
 	intcbnames     = make([]string, maxNumCallbacks)
 	floatcbnames   = make([]string, maxNumCallbacks)
+	intcbtags      = make([]Tags, maxNumCallbacks)
+	floatcbtags    = make([]Tags, maxNumCallbacks)
 	intcallbacks   = make([]IntGaugeCallback, maxNumCallbacks)
 	floatcallbacks = make([]FloatGaugeCallback, maxNumCallbacks)
 	curIntCbID     = new(uint32)
 	curFloatCbID   = new(uint32)
+
+	// Guards registration. Readers don't take the lock; a callback is only
+	// visible to them once its ID is published by storing the new count.
+	callbackLock sync.Mutex
 )
 
 // Registers a gauge callback which will be called every time metrics are requested.
-// There is a maximum of 1024 callbacks, after which adding a new one will panic
-func RegisterIntGaugeCallback(name string, cb IntGaugeCallback) {
-	id := atomic.AddUint32(curIntCbID, 1) - 1
+// There is a maximum of 10240 callbacks, after which adding a new one will panic
+func RegisterIntGaugeCallback(name string, tgs Tags, cb IntGaugeCallback) {
+	callbackLock.Lock()
+	defer callbackLock.Unlock()
+
+	id := atomic.LoadUint32(curIntCbID)
 
 	if id >= maxNumCallbacks {
 		panic("Too many callbacks")
@@ -27,12 +53,18 @@ func RegisterIntGaugeCallback(name string, cb IntGaugeCallback) {
 
 	intcallbacks[id] = cb
 	intcbnames[id] = name
+	intcbtags[id] = copyTags(tgs)
+
+	atomic.StoreUint32(curIntCbID, id+1)
 }
 
 // Registers a gauge callback which will be called every time metrics are requested.
-// There is a maximum of 1024 callbacks, after which adding a new one will panic
-func RegisterFloatGaugeCallback(name string, cb FloatGaugeCallback) {
-	id := atomic.AddUint32(curFloatCbID, 1) - 1
+// There is a maximum of 10240 callbacks, after which adding a new one will panic
+func RegisterFloatGaugeCallback(name string, tgs Tags, cb FloatGaugeCallback) {
+	callbackLock.Lock()
+	defer callbackLock.Unlock()
+
+	id := atomic.LoadUint32(curFloatCbID)
 
 	if id >= maxNumCallbacks {
 		panic("Too many callbacks")
@@ -40,21 +72,32 @@ func RegisterFloatGaugeCallback(name string, cb FloatGaugeCallback) {
 
 	floatcallbacks[id] = cb
 	floatcbnames[id] = name
+	floatcbtags[id] = copyTags(tgs)
+
+	atomic.StoreUint32(curFloatCbID, id+1)
 }
 
-func getAllCallbackGauges() (map[string]uint64, map[string]float64) {
-	retint := make(map[string]uint64)
+func getAllCallbackGauges() ([]intGaugeData, []floatGaugeData) {
 	numIDs := int(atomic.LoadUint32(curIntCbID))
+	retint := make([]intGaugeData, numIDs)
 
 	for i := 0; i < numIDs; i++ {
-		retint[intcbnames[i]] = intcallbacks[i]()
+		retint[i] = intGaugeData{
+			name: intcbnames[i],
+			tgs:  intcbtags[i],
+			val:  intcallbacks[i](),
+		}
 	}
 
-	retfloat := make(map[string]float64)
 	numIDs = int(atomic.LoadUint32(curFloatCbID))
+	retfloat := make([]floatGaugeData, numIDs)
 
 	for i := 0; i < numIDs; i++ {
-		retfloat[floatcbnames[i]] = floatcallbacks[i]()
+		retfloat[i] = floatGaugeData{
+			name: floatcbnames[i],
+			tgs:  floatcbtags[i],
+			val:  floatcallbacks[i](),
+		}
 	}
 
 	return retint, retfloat
@@ -14,44 +14,129 @@
 
 package metrics
 
-import "sync/atomic"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 const maxNumCounters = 1024
 
+// The counter values are accessed atomically without a lock. The lock guards
+// the registration metadata, which only changes on registration and removal.
 var (
-	cnames       = make([]string, maxNumCounters)
-	counters     = make([]uint64, maxNumCounters)
-	curCounterID = new(uint32)
+	counterLock    sync.Mutex
+	cnames         = make([]string, maxNumCounters)
+	ctags          = make([]Tags, maxNumCounters)
+	cremoved       = make([]bool, maxNumCounters)
+	counters       = make([]uint64, maxNumCounters)
+	counterFreeIDs []uint32
+	counterIDs     = make(map[string]uint32)
+	curCounterID   = new(uint32)
 )
 
 // Registers a counter and returns an ID that can be used to access it
 // There is a maximum of 1024 metrics, after which adding a new one will panic
-func AddCounter(name string) uint32 {
-	id := atomic.AddUint32(curCounterID, 1) - 1
+// IDs freed by RemoveCounter are reused and do not count against the maximum.
+//
+// Registration is idempotent: adding a counter with the same name and tags as an
+// existing one returns the existing ID.
+//
+// Tags are optional and may be nil.
+func AddCounter(name string, tgs Tags) uint32 {
+	key := metricKey(name, tgs)
+
+	counterLock.Lock()
+	defer counterLock.Unlock()
+
+	if id, ok := counterIDs[key]; ok {
+		return id
+	}
 
-	if id >= maxNumCounters {
-		panic("Too many counters")
+	var id uint32
+	if n := len(counterFreeIDs); n > 0 {
+		id = counterFreeIDs[n-1]
+		counterFreeIDs = counterFreeIDs[:n-1]
+		cremoved[id] = false
+		atomic.StoreUint64(&counters[id], 0)
+	} else {
+		id = atomic.LoadUint32(curCounterID)
+		if id >= maxNumCounters {
+			panic("Too many counters")
+		}
+		atomic.StoreUint32(curCounterID, id+1)
 	}
 
 	cnames[id] = name
+	ctags[id] = copyTags(tgs)
+	counterIDs[key] = id
 	return id
 }
 
+// Removes a counter so it no longer shows up in extracted metrics. Its ID may be
+// reused by a later call to AddCounter, so the caller must stop using it.
+// Removing an unknown or already removed ID does nothing.
+func RemoveCounter(id uint32) {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+
+	if id >= atomic.LoadUint32(curCounterID) || cremoved[id] {
+		return
+	}
+
+	delete(counterIDs, metricKey(cnames[id], ctags[id]))
+	cremoved[id] = true
+	cnames[id] = ""
+	ctags[id] = nil
+	counterFreeIDs = append(counterFreeIDs, id)
+}
+
+// Atomically increments the counter with the given ID by 1
 func IncCounter(id uint32) {
 	atomic.AddUint64(&counters[id], 1)
 }
 
+// Atomically increments the counter with the given ID by the given amount
 func IncCounterBy(id uint32, amount uint64) {
 	atomic.AddUint64(&counters[id], amount)
 }
 
-func getAllCounters() map[string]uint64 {
-	ret := make(map[string]uint64)
+type counterData struct {
+	name string
+	tgs  Tags
+	val  uint64
+}
+
+// Returns the current value of every registered counter.
+// Counters are monotonic and are never reset on extraction.
+func getAllCounters() []counterData {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+
 	numIDs := int(atomic.LoadUint32(curCounterID))
+	ret := make([]counterData, 0, numIDs)
 
 	for i := 0; i < numIDs; i++ {
-		ret[cnames[i]] = atomic.LoadUint64(&counters[i])
+		if cremoved[i] {
+			continue
+		}
+		ret = append(ret, counterData{
+			name: cnames[i],
+			tgs:  ctags[i],
+			val:  atomic.LoadUint64(&counters[i]),
+		})
 	}
 
 	return ret
 }
+
+// Zeroes every registered counter. Increments racing with the reset may land
+// on either side of it.
+func resetCounters() {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+
+	numIDs := int(atomic.LoadUint32(curCounterID))
+	for i := 0; i < numIDs; i++ {
+		atomic.StoreUint64(&counters[i], 0)
+	}
+}
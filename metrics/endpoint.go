@@ -28,6 +28,16 @@ func SetPrefix(p string) {
 	prefix = p
 }
 
+var deltaBuckets = false
+
+// Sets whether the bucketized histograms on the /metrics endpoint show the
+// counts since the last read (delta) or since startup (cumulative, the
+// default). Delta counts cover exactly the same observations as the rest of
+// the histogram output from the same read.
+func SetDeltaBuckets(delta bool) {
+	deltaBuckets = delta
+}
+
 var memstats = new(runtime.MemStats)
 
 func init() {
@@ -91,26 +101,27 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 	//////////////////////////
 	// Histograms
 	//////////////////////////
-	hists := getAllHistograms()
-	for name, dat := range hists {
-		fmt.Fprintf(w, "%shist_%s_count %d\n", prefix, name, dat.count)
-		fmt.Fprintf(w, "%shist_%s_kept %d\n", prefix, name, dat.kept)
+	hists, _, _ := getAllHistograms()
+	for _, h := range hists {
+		name, tgs, dat := h.name, h.tgs.String(), h.dat
+		fmt.Fprintf(w, "%shist_%s_count%s %d\n", prefix, name, tgs, dat.count)
+		fmt.Fprintf(w, "%shist_%s_kept%s %d\n", prefix, name, tgs, dat.kept)
 
 		if dat.total > 0 && dat.count > 0 {
 			avg := float64(dat.total) / float64(dat.count)
-			fmt.Fprintf(w, "%shist_%s_avg %f\n", prefix, name, avg)
+			fmt.Fprintf(w, "%shist_%s_avg%s %f\n", prefix, name, tgs, avg)
 		}
 
-		pctls := hdatPercentiles(dat)
+		pctls := dat.percentiles(endpointPercentiles)
 		if len(pctls) == 0 {
 			continue
 		}
 		for i := 0; i < 20; i++ {
 			p := pctls[i]
-			fmt.Fprintf(w, "%shist_%s_pctl_%d %d\n", prefix, name, i*5, p)
+			fmt.Fprintf(w, "%shist_%s_pctl_%d%s %d\n", prefix, name, i*5, tgs, p)
 		}
-		fmt.Fprintf(w, "%shist_%s_pctl_%d %d\n", prefix, name, 99, pctls[20])
-		fmt.Fprintf(w, "%shist_%s_pctl_%d %d\n", prefix, name, 100, pctls[21])
+		fmt.Fprintf(w, "%shist_%s_pctl_%d%s %d\n", prefix, name, 99, tgs, pctls[20])
+		fmt.Fprintf(w, "%shist_%s_pctl_%d%s %d\n", prefix, name, 100, tgs, pctls[21])
 	}
 
 	//////////////////////////
@@ -122,11 +133,33 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 	// and less than or equal to 0xFFFF_FFFF_FFFF_FFFF, which would be a huge
 	// duration but it's a good example. As well, bucket 63 only hold values
 	// 0x0 and 0x1. Bucket 62 hold 0x10 and 0x11. 61: 0x100, 0x101, 0x110, 0x111
-	bhists := getAllBucketHistograms()
-	for name, bh := range bhists {
+	//
+	// Histograms registered with explicit bounds label each bucket with its
+	// inclusive upper bound instead, in increasing order.
+	var bhists []bhistData
+	if deltaBuckets {
+		for _, h := range hists {
+			bhists = append(bhists, bhistData{
+				name:    h.name,
+				tgs:     h.tgs,
+				bounds:  h.bounds,
+				buckets: h.buckets,
+			})
+		}
+	} else {
+		bhists = getAllBucketHistograms()
+	}
+	for _, bh := range bhists {
+		tgs := bh.tgs.String()
+		if bh.bounds != nil {
+			for i, b := range bh.bounds {
+				fmt.Fprintf(w, "%sbhist_%s_bucket_%d%s %d\n", prefix, bh.name, b, tgs, bh.buckets[i])
+			}
+			continue
+		}
 		var bmax uint64 = math.MaxUint64 // 0xFFFF_FFFF_FFFF_FFFF
 		for i := 0; i < bhistlen; i++ {
-			fmt.Fprintf(w, "%sbhist_%s_bucket_%d %d\n", prefix, name, bmax, bh[i])
+			fmt.Fprintf(w, "%sbhist_%s_bucket_%d%s %d\n", prefix, bh.name, bmax, tgs, bh.buckets[i])
 			bmax >>= 1
 		}
 	}
@@ -135,30 +168,30 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 	// Counters
 	//////////////////////////
 	ctrs := getAllCounters()
-	for name, val := range ctrs {
-		fmt.Fprintf(w, "%s%s %d\n", prefix, name, val)
+	for _, c := range ctrs {
+		fmt.Fprintf(w, "%s%s%s %d\n", prefix, c.name, c.tgs.String(), c.val)
 	}
 
 	//////////////////////////
 	// Gauges
 	//////////////////////////
 	intg, floatg := getAllGauges()
-	for name, val := range intg {
-		fmt.Fprintf(w, "%s%s %d\n", prefix, name, val)
+	for _, g := range intg {
+		fmt.Fprintf(w, "%s%s%s %d\n", prefix, g.name, g.tgs.String(), g.val)
 	}
-	for name, val := range floatg {
-		fmt.Fprintf(w, "%s%s %f\n", prefix, name, val)
+	for _, g := range floatg {
+		fmt.Fprintf(w, "%s%s%s %f\n", prefix, g.name, g.tgs.String(), g.val)
 	}
 
 	//////////////////////////
 	// Gauge Callbacks
 	//////////////////////////
 	intg, floatg = getAllCallbackGauges()
-	for name, val := range intg {
-		fmt.Fprintf(w, "%s%s %d\n", prefix, name, val)
+	for _, g := range intg {
+		fmt.Fprintf(w, "%s%s%s %d\n", prefix, g.name, g.tgs.String(), g.val)
 	}
-	for name, val := range floatg {
-		fmt.Fprintf(w, "%s%s %f\n", prefix, name, val)
+	for _, g := range floatg {
+		fmt.Fprintf(w, "%s%s%s %f\n", prefix, g.name, g.tgs.String(), g.val)
 	}
 }
 
@@ -174,36 +207,8 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 //  [19]: 95th
 //  [20]: 99th
 //  [21]: max (100th)
-func hdatPercentiles(dat *hdat) []uint64 {
-	buf := dat.buf
-	kept := dat.kept
-
-	if kept == 0 {
-		return nil
-	}
-	if kept < uint64(len(buf)) {
-		buf = buf[:kept]
-	}
-
-	sort.Sort(uint64slice(buf))
-
-	pctls := make([]uint64, 22)
-
-	// Take care of 0th and 100th specially
-	pctls[0] = dat.min
-	pctls[21] = dat.max
-
-	// 5th - 95th
-	for i := 1; i < 20; i++ {
-		idx := len(buf) * i / 20
-		pctls[i] = buf[idx]
-	}
-
-	// Add 99th
-	idx := len(buf) * 99 / 100
-	pctls[20] = buf[idx]
-
-	return pctls
+var endpointPercentiles = []float64{
+	0, 5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 60, 65, 70, 75, 80, 85, 90, 95, 99, 100,
 }
 
 func pausePercentiles(pauses []uint64, ngc uint32) []uint64 {
@@ -0,0 +1,91 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"expvar"
+	"math"
+	"strconv"
+)
+
+// All registered metrics are published as the "metrics" expvar, which shows up
+// at /debug/vars wherever the default HTTP mux is served. Each metric is keyed
+// by its name and tags as they appear on the /metrics endpoint.
+//
+// Reading expvars must not disturb other consumers, so histograms are taken
+// from the bucketized histograms, which are cumulative and never reset. Only
+// the non-empty buckets are included, keyed by their inclusive upper bound.
+func init() {
+	expvar.Publish("metrics", expvar.Func(expvarMetrics))
+}
+
+type expvarHist struct {
+	Count   uint64            `json:"count"`
+	Sum     uint64            `json:"sum"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+func expvarMetrics() interface{} {
+	ctrs := make(map[string]uint64)
+	for _, c := range getAllCounters() {
+		ctrs[c.name+c.tgs.String()] = c.val
+	}
+
+	gauges := make(map[string]interface{})
+	intg, floatg := getAllGauges()
+	cbintg, cbfloatg := getAllCallbackGauges()
+	for _, g := range append(intg, cbintg...) {
+		gauges[g.name+g.tgs.String()] = g.val
+	}
+	for _, g := range append(floatg, cbfloatg...) {
+		// NaN and infinity can't be encoded as JSON
+		if math.IsNaN(g.val) || math.IsInf(g.val, 0) {
+			continue
+		}
+		gauges[g.name+g.tgs.String()] = g.val
+	}
+
+	hists := make(map[string]expvarHist)
+	for _, bh := range getAllBucketHistograms() {
+		h := expvarHist{
+			Sum:     bh.sum,
+			Buckets: make(map[string]uint64),
+		}
+
+		for i, c := range bh.buckets {
+			if c == 0 {
+				continue
+			}
+
+			var le uint64
+			if bh.bounds == nil {
+				le = math.MaxUint64 >> uint(i)
+			} else {
+				le = bh.bounds[i]
+			}
+
+			h.Count += c
+			h.Buckets[strconv.FormatUint(le, 10)] = c
+		}
+
+		hists[bh.name+bh.tgs.String()] = h
+	}
+
+	return map[string]interface{}{
+		"counters":   ctrs,
+		"gauges":     gauges,
+		"histograms": hists,
+	}
+}
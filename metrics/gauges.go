@@ -1,6 +1,21 @@
+// Copyright 2015 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
 package metrics
 
 import (
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
@@ -8,8 +23,13 @@ import (
 const maxNumGauges = 1024
 
 var (
+	gaugeLock       sync.Mutex
+	intgIDs         = make(map[string]uint32)
+	floatgIDs       = make(map[string]uint32)
 	intgnames       = make([]string, maxNumGauges)
 	floatgnames     = make([]string, maxNumGauges)
+	intgtags        = make([]Tags, maxNumGauges)
+	floatgtags      = make([]Tags, maxNumGauges)
 	intgauges       = make([]uint64, maxNumGauges)
 	floatgauges     = make([]uint64, maxNumGauges)
 	curIntGaugeID   = new(uint32)
@@ -23,27 +43,61 @@ func init() {
 
 // Registers a gauge and returns an ID that can be used to access it
 // There is a maximum of 1024 gauges, after which adding a new one will panic
-func AddIntGauge(name string) uint32 {
-	id := atomic.AddUint32(curIntGaugeID, 1) - 1
+// Adding a gauge with the same name and tags as an existing one returns the
+// existing ID.
+func AddIntGauge(name string, tgs Tags) uint32 {
+	key := metricKey(name, tgs)
+
+	gaugeLock.Lock()
+	defer gaugeLock.Unlock()
+
+	if id, ok := intgIDs[key]; ok {
+		return id
+	}
+
+	id := atomic.LoadUint32(curIntGaugeID)
 
 	if id >= maxNumGauges {
 		panic("Too many gauges")
 	}
 
 	intgnames[id] = name
+	intgtags[id] = copyTags(tgs)
+
+	// Publish the new gauge only after its metadata is written so a concurrent
+	// getAllGauges never sees a partially registered gauge.
+	atomic.StoreUint32(curIntGaugeID, id+1)
+	intgIDs[key] = id
 	return id
 }
 
 // Registers a gauge and returns an ID that can be used to access it
 // There is a maximum of 1024 gauges, after which adding a new one will panic
-func AddFloatGauge(name string) uint32 {
-	id := atomic.AddUint32(curFloatGaugeID, 1) - 1
+// Adding a gauge with the same name and tags as an existing one returns the
+// existing ID.
+func AddFloatGauge(name string, tgs Tags) uint32 {
+	key := metricKey(name, tgs)
+
+	gaugeLock.Lock()
+	defer gaugeLock.Unlock()
+
+	if id, ok := floatgIDs[key]; ok {
+		return id
+	}
+
+	id := atomic.LoadUint32(curFloatGaugeID)
 
 	if id >= maxNumGauges {
 		panic("Too many gauges")
 	}
 
 	floatgnames[id] = name
+	floatgtags[id] = copyTags(tgs)
+
+	// Publish the new gauge only after its metadata is written so a concurrent
+	// getAllGauges never sees a partially registered gauge.
+	atomic.StoreUint32(curFloatGaugeID, id+1)
+	floatgIDs[key] = id
 	return id
 }
 
@@ -51,6 +105,18 @@ func SetIntGauge(id uint32, value uint64) {
 	atomic.StoreUint64(&intgauges[id], value)
 }
 
+// Atomically increments the int gauge with the given ID by 1. Useful for
+// gauges that track a number of things currently in use, e.g. connections.
+func IncIntGauge(id uint32) {
+	atomic.AddUint64(&intgauges[id], 1)
+}
+
+// Atomically decrements the int gauge with the given ID by 1. The caller is
+// responsible for not decrementing below 0.
+func DecIntGauge(id uint32) {
+	atomic.AddUint64(&intgauges[id], ^uint64(0))
+}
+
 func SetFloatGauge(id uint32, value float64) {
 	// The float64 value needs to be converted into an int64 here because
 	// there is no atomic store for float values. This is a literal
@@ -59,16 +125,32 @@ func SetFloatGauge(id uint32, value float64) {
 	atomic.StoreUint64(&floatgauges[id], v2)
 }
 
-func getAllGauges() (map[string]uint64, map[string]float64) {
-	retint := make(map[string]uint64)
+type intGaugeData struct {
+	name string
+	tgs  Tags
+	val  uint64
+}
+
+type floatGaugeData struct {
+	name string
+	tgs  Tags
+	val  float64
+}
+
+func getAllGauges() ([]intGaugeData, []floatGaugeData) {
 	numIDs := int(atomic.LoadUint32(curIntGaugeID))
+	retint := make([]intGaugeData, numIDs)
 
 	for i := 0; i < numIDs; i++ {
-		retint[intgnames[i]] = atomic.LoadUint64(&intgauges[i])
+		retint[i] = intGaugeData{
+			name: intgnames[i],
+			tgs:  intgtags[i],
+			val:  atomic.LoadUint64(&intgauges[i]),
+		}
 	}
 
-	retfloat := make(map[string]float64)
 	numIDs = int(atomic.LoadUint32(curFloatGaugeID))
+	retfloat := make([]floatGaugeData, numIDs)
 
 	for i := 0; i < numIDs; i++ {
 		// The int64 bit pattern of the float value needs to be converted back
@@ -76,7 +158,11 @@ func getAllGauges() (map[string]uint64, map[string]float64) {
 		// exact bits.
 		intval := atomic.LoadUint64(&floatgauges[i])
 		floatval := *(*float64)(unsafe.Pointer(&intval))
-		retfloat[floatgnames[i]] = floatval
+		retfloat[i] = floatGaugeData{
+			name: floatgnames[i],
+			tgs:  floatgtags[i],
+			val:  floatval,
+		}
 	}
 
 	return retint, retfloat
@@ -0,0 +1,114 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const graphiteTimeout = 5 * time.Second
+
+// GraphiteSink writes metrics over TCP using the Graphite plaintext protocol,
+// one "name value timestamp" line per value. Counters are sent as their
+// cumulative value; Graphite's nonNegativeDerivative turns them into rates.
+// Tags are folded into the metric name as .key.value pairs.
+//
+// The connection is made on the first flush. If a write fails the connection
+// is dropped and the next flush reconnects, so a restart of the Graphite
+// server only loses the metrics from the flushes while it was down.
+type GraphiteSink struct {
+	addr   string
+	prefix string
+	conn   net.Conn
+	buf    bytes.Buffer
+}
+
+// Creates a Graphite sink that sends to the given host:port. The prefix is
+// prepended to every metric name as is, so it should normally end in a dot.
+func NewGraphiteSink(addr, prefix string) *GraphiteSink {
+	return &GraphiteSink{
+		addr:   addr,
+		prefix: prefix,
+	}
+}
+
+func (g *GraphiteSink) FlushCounters(ctrs []Counter) error {
+	now := time.Now().Unix()
+	for _, c := range ctrs {
+		g.add(c.Name, c.Tags, strconv.FormatUint(c.Value, 10), now)
+	}
+	return g.send()
+}
+
+func (g *GraphiteSink) FlushGauges(ints []IntGauge, floats []FloatGauge) error {
+	now := time.Now().Unix()
+	for _, v := range ints {
+		g.add(v.Name, v.Tags, strconv.FormatUint(v.Value, 10), now)
+	}
+	for _, v := range floats {
+		g.add(v.Name, v.Tags, strconv.FormatFloat(v.Value, 'f', -1, 64), now)
+	}
+	return g.send()
+}
+
+func (g *GraphiteSink) FlushHistograms(hists []HistSummary) error {
+	now := time.Now().Unix()
+	for _, h := range hists {
+		g.add(h.Name+".count", h.Tags, strconv.FormatUint(h.Count, 10), now)
+
+		if h.Count == 0 {
+			continue
+		}
+
+		g.add(h.Name+".min", h.Tags, strconv.FormatUint(h.Min, 10), now)
+		g.add(h.Name+".max", h.Tags, strconv.FormatUint(h.Max, 10), now)
+		g.add(h.Name+".avg", h.Tags, strconv.FormatFloat(h.Avg, 'f', -1, 64), now)
+
+		for i, p := range h.Pctls {
+			g.add(h.Name+"."+percentileName(h.Percentiles[i]), h.Tags, strconv.FormatUint(p, 10), now)
+		}
+	}
+	return g.send()
+}
+
+func (g *GraphiteSink) add(name string, tgs Tags, val string, ts int64) {
+	writeDottedName(&g.buf, g.prefix, name, tgs)
+	fmt.Fprintf(&g.buf, " %s %d\n", val, ts)
+}
+
+func (g *GraphiteSink) send() error {
+	defer g.buf.Reset()
+
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.addr, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+
+	g.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	if _, err := g.conn.Write(g.buf.Bytes()); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphiteSinkReconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer l.Close()
+
+	g := NewGraphiteSink(l.Addr().String(), "rend.")
+
+	// Each connection is read for one line and then closed to force the sink
+	// to reconnect on a later flush.
+	for i := 0; i < 2; i++ {
+		ctrs := []Counter{{Name: "hits", Tags: Tags{"op": "get"}, Value: 7}}
+
+		// A write to a connection the other side closed can succeed once before
+		// the error shows up, so keep flushing until the line arrives.
+		lines := make(chan string, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			lines <- line
+		}()
+
+		deadline := time.After(time.Second)
+	retry:
+		for {
+			g.FlushCounters(ctrs)
+			select {
+			case line := <-lines:
+				if !strings.HasPrefix(line, "rend.hits.op.get 7 ") {
+					t.Fatalf("Unexpected line %q", line)
+				}
+				break retry
+			case <-deadline:
+				t.Fatalf("Line not received on connection %d", i)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+}
@@ -16,182 +16,628 @@ package metrics
 
 import (
 	"math"
+	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
-	maxNumHists = 1024
-	buflen      = 0x7FFF // max index, 32769 entries
-	bhistlen    = 65
+	buflen   = 0x7FFF // max index of the default buffer, 32768 entries
+	bhistlen = 65
+
+	// Sample rate used for histograms registered as sampled
+	defaultSampleRate = 4
 )
 
+// The histogram registry is a copy-on-write slice indexed by histogram ID.
+// Registration takes the lock and publishes a new slice header, so readers on
+// the observation path only need an atomic load. Readers never look past the
+// length of the slice they loaded, so appending in place is safe even when the
+// backing array is shared with a previously published slice. Changing an
+// existing slot (removal or reuse) always copies the slice first.
+//
+// Removed histograms leave a nil slot behind and their ID goes on the free list
+// to be handed out again by a later AddHistogram.
 var (
-	hnames    = make([]string, maxNumHists)
-	hsampled  = make([]bool, maxNumHists)
-	hists     = make([]*hist, maxNumHists)
-	bhists    = make([]*bhist, maxNumHists)
-	curHistID = new(uint32)
+	histRegLock sync.Mutex
+	histReg     atomic.Value // []*hist
+	histFreeIDs []uint32
+	histIDs     = make(map[string]uint32)
 )
 
 func init() {
-	// start at "-1" so the first ID is 0
-	atomic.StoreUint32(curHistID, 0)
+	histReg.Store([]*hist(nil))
+}
+
+func loadHists() []*hist {
+	return histReg.Load().([]*hist)
 }
 
-// The hist struct holds a primary and secondary data structure so the reader of
-// the histograms will get to read the data out while new observations are made.
-// As well, pulling and resetting the histogram does not require a malloc in the
-// path of pulling the data, and the large circular buffers can be reused.
+// The hist struct holds two data structures, one of which is current and takes
+// new observations while the other is being read after an extraction. As well,
+// pulling and resetting the histogram does not require a malloc in the path of
+// pulling the data, and the large circular buffers can be reused.
+//
+// Observations never take a lock. An observer announces itself on the current
+// hdat by incrementing its writers count, then checks that the hdat is still
+// current before writing to it; if not, it backs off and tries again with the
+// new one. An extraction makes the other hdat current and then waits for the
+// writers on the old one to finish, after which the old one is stable and no
+// new observations will touch it.
 type hist struct {
-	lock sync.RWMutex
-	prim *hdat
-	sec  *hdat
+	name string
+	tgs  Tags
+	rate uint64 // keep every rate-th observation, accessed atomically
+	bh   *bhist
+	win  *window    // nil unless this is a sliding window histogram
+	res  *reservoir // nil unless this histogram uses a decaying reservoir
+
+	cur      uint32     // index of the current hdat, accessed atomically
+	dats     [2]*hdat   // current and previous period's data
+	swapLock sync.Mutex // serializes extractions and peeks
 }
+
+// The bucket counts in hdat are only those observed during its period, in the
+// same order as the bucketized histogram's buckets.
 type hdat struct {
-	count uint64
-	kept  uint64
-	total uint64
-	min   uint64
-	max   uint64
-	buf   []uint64
+	writers int64
+	count   uint64
+	kept    uint64
+	total   uint64
+	min     uint64
+	max     uint64
+	buf     []uint64
+	buckets []uint64
+}
+
+// The settings a histogram is registered with. Only the name and tags identify
+// the histogram; the rest are taken from the first registration.
+type histOpts struct {
+	rate    uint64
+	bounds  []uint64
+	windows int
+	width   time.Duration
+
+	resSize  int
+	resAlpha float64
+
+	bufSize int // number of samples kept, a power of two; 0 means buflen+1
 }
 
-func newHist() *hist {
+func newHist(name string, tgs Tags, opts histOpts) *hist {
+	bh := newBHist(opts.bounds)
+
+	var win *window
+	if opts.windows > 0 {
+		win = newWindow(opts.windows, opts.width)
+	}
+
+	var res *reservoir
+	if opts.resSize > 0 {
+		res = newReservoir(opts.resSize, opts.resAlpha)
+	}
+
 	return &hist{
-		// read: primary and secondary data structures
-		prim: newHdat(),
-		sec:  newHdat(),
+		name: name,
+		tgs:  copyTags(tgs),
+		rate: opts.rate,
+		bh:   bh,
+		win:  win,
+		res:  res,
+		dats: [2]*hdat{
+			newHdat(opts.bufSize, len(bh.buckets)),
+			newHdat(opts.bufSize, len(bh.buckets)),
+		},
 	}
 }
-func newHdat() *hdat {
+func newHdat(bufSize, nbuckets int) *hdat {
+	if bufSize == 0 {
+		bufSize = buflen + 1
+	}
 	ret := &hdat{
-		buf: make([]uint64, buflen+1),
+		buf:     make([]uint64, bufSize),
+		buckets: make([]uint64, nbuckets),
 	}
 	atomic.StoreUint64(&ret.min, math.MaxUint64)
 	return ret
 }
 
+// The bucketized histogram either buckets by the number of leading zeros in the
+// observed value (power of two resolution) or, if bounds is set, by the first
+// upper bound that is greater than or equal to the observed value. The sum of
+// all observed values is kept alongside, and like the buckets is never reset.
 type bhist struct {
+	sum     uint64
+	bounds  []uint64
 	buckets []uint64
 }
 
-func newBHist() *bhist {
+func newBHist(bounds []uint64) *bhist {
+	if bounds == nil {
+		return &bhist{
+			// Holds enough for the entire length of a uint64
+			buckets: make([]uint64, bhistlen),
+		}
+	}
+
 	return &bhist{
-		// Holds enough for the entire length of a uint64
-		buckets: make([]uint64, 65),
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
 	}
 }
 
-func AddHistogram(name string, sampled bool) uint32 {
-	idx := atomic.AddUint32(curHistID, 1) - 1
+func (b *bhist) bucket(value uint64) uint64 {
+	if b.bounds == nil {
+		return lzcnt(value)
+	}
+
+	return uint64(sort.Search(len(b.bounds), func(i int) bool {
+		return b.bounds[i] >= value
+	}))
+}
 
-	if idx >= maxNumHists {
-		panic("Too many histograms")
+// LogLinearBuckets returns bucket upper bounds that split each power of 10 into
+// subBuckets evenly sized buckets, e.g. with 9 sub buckets the bounds are 1, 2,
+// 3, ... 9, 10, 20, 30, ... 90, 100, 200 and so on. This gives a roughly
+// constant relative error across the whole range of values, which is good
+// enough to estimate percentiles of latencies from the buckets alone. The last
+// bound is always math.MaxUint64 so every value has a bucket.
+func LogLinearBuckets(subBuckets int) []uint64 {
+	if subBuckets < 1 {
+		panic("Log-linear buckets need at least 1 sub bucket")
 	}
 
-	hnames[idx] = name
-	hsampled[idx] = sampled
-	hists[idx] = newHist()
-	bhists[idx] = newBHist()
+	bounds := []uint64{1}
+	n := uint64(subBuckets)
+
+	// Stop at the last decade whose upper end still fits in a uint64
+	for decade := uint64(1); decade <= math.MaxUint64/10; decade *= 10 {
+		// Split the 9*decade values above decade into n parts, computed in two
+		// pieces to avoid overflowing in the multiplication.
+		width := 9 * decade
+		for i := uint64(1); i <= n; i++ {
+			b := decade + (width/n)*i + (width%n)*i/n
+
+			// Small decades with more sub buckets than values would repeat
+			if b > bounds[len(bounds)-1] {
+				bounds = append(bounds, b)
+			}
+		}
+	}
 
-	return idx
+	return append(bounds, math.MaxUint64)
+}
+
+// Registers a histogram and returns an ID that can be used to access it. If
+// sampled is true, only every 4th observation is kept in the sample buffer.
+// There is no limit on the number of histograms.
+//
+// Registration is idempotent: adding a histogram with the same name and tags as
+// an existing one returns the existing ID, so two parts of the code can never
+// end up reporting separate data under the same name. The sample rate of
+// the first registration wins.
+//
+// Tags are optional and may be nil.
+func AddHistogram(name string, sampled bool, tgs Tags) uint32 {
+	return addHistogram(name, tgs, histOpts{rate: sampledRate(sampled)})
+}
+
+// Registers a histogram like AddHistogram, but only every rate-th observation
+// is kept in the sample buffer. A rate of 1 keeps every observation. Very hot
+// paths can use a high rate to reduce the cost of keeping samples. The count,
+// total, min, max, and buckets always include every observation.
+func AddSampledHistogram(name string, rate uint64, tgs Tags) uint32 {
+	if rate == 0 {
+		panic("Histogram sample rate must be at least 1")
+	}
+	return addHistogram(name, tgs, histOpts{rate: rate})
+}
+
+// Changes the sample rate of a histogram at runtime. It takes effect on the
+// next observation. Setting the rate of an unknown or removed ID does nothing.
+func SetHistogramSampleRate(id uint32, rate uint64) {
+	if rate == 0 {
+		panic("Histogram sample rate must be at least 1")
+	}
+
+	hists := loadHists()
+	if int(id) >= len(hists) || hists[id] == nil {
+		return
+	}
+
+	atomic.StoreUint64(&hists[id].rate, rate)
+}
+
+func sampledRate(sampled bool) uint64 {
+	if sampled {
+		return defaultSampleRate
+	}
+	return 1
+}
+
+// Registers a histogram like AddHistogram, but the bucketized histogram uses
+// the given bucket upper bounds instead of power of two buckets. The bounds
+// must be sorted in increasing order and the last one should be math.MaxUint64
+// so that every value is counted. LogLinearBuckets provides a good default for
+// latencies. As with the sample rate, the bounds of the first registration win.
+func AddHistogramWithBuckets(name string, sampled bool, bounds []uint64, tgs Tags) uint32 {
+	if len(bounds) == 0 {
+		panic("Histogram bucket bounds must not be empty")
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			panic("Histogram bucket bounds must be strictly increasing")
+		}
+	}
+	if bounds[len(bounds)-1] != math.MaxUint64 {
+		bounds = append(bounds[:len(bounds):len(bounds)], math.MaxUint64)
+	}
+
+	return addHistogram(name, tgs, histOpts{rate: sampledRate(sampled), bounds: bounds})
+}
+
+// Registers a histogram like AddHistogram that keeps up to size samples per
+// period instead of the default 32768. Each histogram has two buffers of 8
+// bytes per sample, so rarely observed histograms can save most of the 512KB
+// the default costs. The size is rounded up to the next power of two. As with
+// other settings, the size of the first registration wins.
+func AddHistogramWithBufferSize(name string, sampled bool, size int, tgs Tags) uint32 {
+	if size < 1 {
+		panic("Histogram buffer size must be at least 1")
+	}
+
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+
+	return addHistogram(name, tgs, histOpts{rate: sampledRate(sampled), bufSize: n})
+}
+
+func addHistogram(name string, tgs Tags, opts histOpts) uint32 {
+	key := metricKey(name, tgs)
+
+	histRegLock.Lock()
+	defer histRegLock.Unlock()
+
+	if id, ok := histIDs[key]; ok {
+		return id
+	}
+
+	h := newHist(name, tgs, opts)
+	hists := loadHists()
+
+	var id uint32
+	if n := len(histFreeIDs); n > 0 {
+		id = histFreeIDs[n-1]
+		histFreeIDs = histFreeIDs[:n-1]
+		histReg.Store(replaceHist(hists, id, h))
+	} else {
+		id = uint32(len(hists))
+		histReg.Store(append(hists, h))
+	}
+
+	histIDs[key] = id
+	return id
+}
+
+// Removes a histogram from the registry so it no longer shows up in extracted
+// metrics. Its ID may be reused by a later call to AddHistogram, so the caller
+// must stop using it. Observations made to a removed ID are dropped until it is
+// reused. Removing an unknown or already removed ID does nothing.
+func RemoveHistogram(id uint32) {
+	histRegLock.Lock()
+	defer histRegLock.Unlock()
+
+	hists := loadHists()
+	if int(id) >= len(hists) || hists[id] == nil {
+		return
+	}
+
+	delete(histIDs, metricKey(hists[id].name, hists[id].tgs))
+	histReg.Store(replaceHist(hists, id, nil))
+	histFreeIDs = append(histFreeIDs, id)
+}
+
+func replaceHist(hists []*hist, id uint32, h *hist) []*hist {
+	ret := make([]*hist, len(hists))
+	copy(ret, hists)
+	ret[id] = h
+	return ret
 }
 
 func ObserveHist(id uint32, value uint64) {
-	h := hists[id]
+	h := loadHists()[id]
+	if h == nil {
+		return
+	}
 
-	// We lock here to ensure that the min and max values are true to this time
-	// period, meaning extractAndReset won't pull the data out from under us
-	// while the current observation is being compared. Otherwise, min and max
-	// could come from the previous period on the next read. Same with average.
-	h.lock.RLock()
+	// Announce this observer on the current data so extraction waits for it.
+	// This ensures that the min and max values are true to this time period,
+	// meaning extractAndReset won't pull the data out from under us while the
+	// current observation is being compared. Otherwise, min and max could come
+	// from the previous period on the next read. Same with average.
+	d := h.acquire()
 
 	// Keep a running total for average
-	atomic.AddUint64(&h.prim.total, value)
+	atomic.AddUint64(&d.total, value)
 
 	// Set max and min (if needed) in an atomic fashion
 	for {
-		max := atomic.LoadUint64(&h.prim.max)
-		if value < max || atomic.CompareAndSwapUint64(&h.prim.max, max, value) {
+		max := atomic.LoadUint64(&d.max)
+		if value < max || atomic.CompareAndSwapUint64(&d.max, max, value) {
 			break
 		}
 	}
 	for {
-		min := atomic.LoadUint64(&h.prim.min)
-		if value > min || atomic.CompareAndSwapUint64(&h.prim.min, min, value) {
+		min := atomic.LoadUint64(&d.min)
+		if value > min || atomic.CompareAndSwapUint64(&d.min, min, value) {
 			break
 		}
 	}
 
-	// Record the bucketized histograms
-	bucket := lzcnt(value)
-	atomic.AddUint64(&bhists[id].buckets[bucket], 1)
+	// Record the bucketized histograms, both for this period and cumulative
+	bucket := h.bh.bucket(value)
+	atomic.AddUint64(&d.buckets[bucket], 1)
+	atomic.AddUint64(&h.bh.buckets[bucket], 1)
+	atomic.AddUint64(&h.bh.sum, value)
+
+	if h.win != nil {
+		h.win.observe(value)
+	}
+	if h.res != nil {
+		h.res.observe(value)
+	}
 
 	// Count and possibly return for sampling
-	c := atomic.AddUint64(&h.prim.count, 1)
-	if hsampled[id] {
-		// Sample, keep every 4th observation
-		if (c & 0x3) > 0 {
-			h.lock.RUnlock()
+	c := atomic.AddUint64(&d.count, 1)
+	if rate := atomic.LoadUint64(&h.rate); rate > 1 {
+		// Sample, keep every rate-th observation
+		if c%rate > 0 {
+			atomic.AddInt64(&d.writers, -1)
 			return
 		}
 	}
 
-	// Get the current index as the count % buflen
-	idx := atomic.AddUint64(&h.prim.kept, 1) & buflen
+	// Get the current index as the count % the buffer size, which is always a
+	// power of two. The index is the count before incrementing so the samples
+	// fill the buffer starting at 0.
+	idx := (atomic.AddUint64(&d.kept, 1) - 1) & uint64(len(d.buf)-1)
+
+	// Add observation. This is atomic so peek can read the buffer while
+	// observations are still being made.
+	atomic.StoreUint64(&d.buf[idx], value)
+
+	// No longer writing
+	atomic.AddInt64(&d.writers, -1)
+}
+
+// Returns the current data with this observer counted as a writer on it
+func (h *hist) acquire() *hdat {
+	for {
+		i := atomic.LoadUint32(&h.cur)
+		d := h.dats[i]
+		atomic.AddInt64(&d.writers, 1)
+
+		// If an extraction switched the current data in between, this data
+		// may already be being read
+		if atomic.LoadUint32(&h.cur) == i {
+			return d
+		}
+
+		atomic.AddInt64(&d.writers, -1)
+	}
+}
+
+// The bucket counts in histData are only those observed during the period,
+// in the same order as the bucketized histogram's buckets.
+type histData struct {
+	name    string
+	tgs     Tags
+	dat     *hdat
+	bounds  []uint64
+	buckets []uint64
+}
+
+// The start of the current histogram period in unix nanoseconds. Every
+// extraction ends the current period and starts the next one.
+var histPeriodStart = time.Now().UnixNano()
+
+// Extracts and resets all histograms. Also returns the start and end of the
+// period the data covers, which is since the previous extraction by anyone.
+func getAllHistograms() ([]histData, time.Time, time.Time) {
+	end := time.Now().UnixNano()
+	start := atomic.SwapInt64(&histPeriodStart, end)
+
+	hists := loadHists()
+	ret := make([]histData, 0, len(hists))
+
+	for _, h := range hists {
+		if h == nil {
+			continue
+		}
+		dat := extractAndReset(h)
+		buckets := dat.buckets
+		ret = append(ret, histData{
+			name:    h.name,
+			tgs:     h.tgs,
+			dat:     h.alternateSamples(dat),
+			bounds:  h.bh.bounds,
+			buckets: buckets,
+		})
+	}
+
+	return ret, time.Unix(0, start), time.Unix(0, end)
+}
+
+// Copies the data of the current period of all histograms without resetting
+// them. Also returns the start of the current period and now as its end.
+func peekAllHistograms() ([]histData, time.Time, time.Time) {
+	start := atomic.LoadInt64(&histPeriodStart)
+	end := time.Now()
+
+	hists := loadHists()
+	ret := make([]histData, 0, len(hists))
 
-	// Add observation
-	h.prim.buf[idx] = value
+	for _, h := range hists {
+		if h == nil {
+			continue
+		}
+		dat := peek(h)
+		buckets := dat.buckets
+		ret = append(ret, histData{
+			name:    h.name,
+			tgs:     h.tgs,
+			dat:     h.alternateSamples(dat),
+			bounds:  h.bh.bounds,
+			buckets: buckets,
+		})
+	}
 
-	// No longer "reading"
-	h.lock.RUnlock()
+	return ret, time.Unix(0, start), end
 }
 
-func getAllHistograms() map[string]*hdat {
-	n := int(atomic.LoadUint32(curHistID))
+// Sliding window and decaying reservoir histograms report data other than what
+// is in the primary buffers. The returned hdat is always a new one, because the
+// one passed in is still owned by the histogram.
+func (h *hist) alternateSamples(dat *hdat) *hdat {
+	switch {
+	case h.win != nil:
+		return h.win.snapshot()
+
+	case h.res != nil:
+		ret := *dat
+		ret.buf = h.res.snapshot()
+		ret.kept = uint64(len(ret.buf))
+		return &ret
+	}
 
-	ret := make(map[string]*hdat)
+	return dat
+}
+
+// Copies the current data out from under the observers without disturbing
+// them. Each value is read atomically, but since observations continue while
+// copying, the fields may be off from each other by a few observations.
+func peek(h *hist) *hdat {
+	h.swapLock.Lock()
+	defer h.swapLock.Unlock()
+
+	d := h.dats[atomic.LoadUint32(&h.cur)]
+
+	ret := &hdat{
+		count:   atomic.LoadUint64(&d.count),
+		kept:    atomic.LoadUint64(&d.kept),
+		total:   atomic.LoadUint64(&d.total),
+		min:     atomic.LoadUint64(&d.min),
+		max:     atomic.LoadUint64(&d.max),
+		buckets: make([]uint64, len(d.buckets)),
+	}
+
+	n := ret.kept
+	if n > uint64(len(d.buf)) {
+		n = uint64(len(d.buf))
+	}
+	ret.buf = make([]uint64, n)
+	for i := range ret.buf {
+		ret.buf[i] = atomic.LoadUint64(&d.buf[i])
+	}
 
-	for i := 0; i < n; i++ {
-		ret[hnames[i]] = extractAndReset(hists[i])
+	for i := range ret.buckets {
+		ret.buckets[i] = atomic.LoadUint64(&d.buckets[i])
 	}
 
 	return ret
 }
 
+// Switches observations over to the other data and returns the data for the
+// period that just ended once all of its observers are done with it. The
+// returned data is owned by the histogram again after the next extraction.
 func extractAndReset(h *hist) *hdat {
-	h.lock.Lock()
+	h.swapLock.Lock()
+	defer h.swapLock.Unlock()
+
+	i := atomic.LoadUint32(&h.cur)
+	old, next := h.dats[i], h.dats[1-i]
+
+	// Nothing writes to the next data until it is made current, since every
+	// observer from its last period was waited on in the previous extraction
+	next.count = 0
+	next.kept = 0
+	next.total = 0
+	next.max = 0
+	next.min = math.MaxUint64
+	for j := range next.buckets {
+		next.buckets[j] = 0
+	}
+
+	atomic.StoreUint32(&h.cur, 1-i)
+
+	// Wait for observers that started before the switch
+	for atomic.LoadInt64(&old.writers) > 0 {
+		runtime.Gosched()
+	}
 
-	// flip and reset the count
-	h.prim, h.sec = h.sec, h.prim
+	return old
+}
 
-	atomic.StoreUint64(&h.prim.count, 0)
-	atomic.StoreUint64(&h.prim.kept, 0)
-	atomic.StoreUint64(&h.prim.total, 0)
-	atomic.StoreUint64(&h.prim.max, 0)
-	atomic.StoreUint64(&h.prim.min, math.MaxUint64)
+// Drops everything every histogram has observed, including the bucketized
+// histogram that is otherwise never reset, and starts a new period.
+func resetHistograms() {
+	atomic.StoreInt64(&histPeriodStart, time.Now().UnixNano())
 
-	h.lock.Unlock()
+	for _, h := range loadHists() {
+		if h == nil {
+			continue
+		}
+		extractAndReset(h)
 
-	return h.sec
+		for i := range h.bh.buckets {
+			atomic.StoreUint64(&h.bh.buckets[i], 0)
+		}
+		atomic.StoreUint64(&h.bh.sum, 0)
+
+		if h.win != nil {
+			h.win.reset()
+		}
+		if h.res != nil {
+			h.res.reset()
+		}
+	}
 }
 
-func getAllBucketHistograms() map[string][]uint64 {
-	n := int(atomic.LoadUint32(curHistID))
+type bhistData struct {
+	name    string
+	tgs     Tags
+	bounds  []uint64
+	buckets []uint64
+	sum     uint64
+}
 
-	ret := make(map[string][]uint64)
+func getAllBucketHistograms() []bhistData {
+	hists := loadHists()
+	ret := make([]bhistData, 0, len(hists))
 
-	for i := 0; i < n; i++ {
-		ret[hnames[i]] = extractBHist(bhists[i])
+	for _, h := range hists {
+		if h == nil {
+			continue
+		}
+		ret = append(ret, bhistData{
+			name:    h.name,
+			tgs:     h.tgs,
+			bounds:  h.bh.bounds,
+			buckets: extractBHist(h.bh),
+			sum:     atomic.LoadUint64(&h.bh.sum),
+		})
 	}
 
 	return ret
 }
 
 func extractBHist(b *bhist) []uint64 {
-	ret := make([]uint64, bhistlen)
-	for i := 0; i < bhistlen; i++ {
+	ret := make([]uint64, len(b.buckets))
+	for i := range ret {
 		ret[i] = atomic.LoadUint64(&b.buckets[i])
 	}
 	return ret
@@ -0,0 +1,451 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddHistogramConcurrent(t *testing.T) {
+	// More than the old fixed limit of 1024, registered while observing
+	const numHists = 2000
+	const numWorkers = 8
+
+	ids := make(chan uint32, numHists)
+	wg := &sync.WaitGroup{}
+
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < numHists; i += numWorkers {
+				id := AddHistogram(fmt.Sprintf("test_concurrent_%d", i), false, nil)
+				ObserveHist(id, uint64(i))
+				ids <- id
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint32]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("ID %d returned more than once", id)
+		}
+		seen[id] = true
+	}
+
+	for id := range seen {
+		h := loadHists()[id]
+		if h.dats[h.cur].count != 1 {
+			t.Fatalf("Expected histogram %s to have 1 observation, got %d", h.name, h.dats[h.cur].count)
+		}
+	}
+}
+
+func TestRemoveHistogramReusesID(t *testing.T) {
+	id := AddHistogram("test_remove", false, nil)
+	ObserveHist(id, 1)
+	RemoveHistogram(id)
+
+	// Observing a removed histogram is dropped instead of panicking
+	ObserveHist(id, 1)
+
+	hists, _, _ := getAllHistograms()
+	for _, h := range hists {
+		if h.name == "test_remove" {
+			t.Fatal("Removed histogram was still extracted")
+		}
+	}
+
+	id2 := AddHistogram("test_remove_reuse", false, nil)
+	if id2 != id {
+		t.Fatalf("Expected removed ID %d to be reused, got %d", id, id2)
+	}
+	if c := peek(loadHists()[id2]).count; c != 0 {
+		t.Fatalf("Expected reused histogram to start empty, got count %d", c)
+	}
+}
+
+func TestAddHistogramDuplicate(t *testing.T) {
+	id := AddHistogram("test_dup", false, Tags{"backend": "l1"})
+	if dup := AddHistogram("test_dup", true, Tags{"backend": "l1"}); dup != id {
+		t.Fatalf("Expected duplicate registration to return ID %d, got %d", id, dup)
+	}
+	if other := AddHistogram("test_dup", false, Tags{"backend": "l2"}); other == id {
+		t.Fatal("Expected different tags to register a different histogram")
+	}
+}
+
+func TestHistSummary(t *testing.T) {
+	id := AddHistogram("test_summary", false, nil)
+
+	// 1 through 1000, so the value at a percentile is easy to predict
+	for i := uint64(1000); i > 0; i-- {
+		ObserveHist(id, i)
+	}
+
+	var s HistSummary
+	for _, sum := range ExtractHistSummaries(DefaultPercentiles) {
+		if sum.Name == "test_summary" {
+			s = sum
+		}
+	}
+
+	if s.Count != 1000 || s.Kept != 1000 {
+		t.Fatalf("Expected 1000 observations, got count %d kept %d", s.Count, s.Kept)
+	}
+	if s.Min != 1 || s.Max != 1000 {
+		t.Fatalf("Expected min 1 and max 1000, got %d and %d", s.Min, s.Max)
+	}
+	if s.Avg != 500.5 {
+		t.Fatalf("Expected avg 500.5, got %f", s.Avg)
+	}
+
+	expected := []uint64{501, 901, 991, 1000}
+	for i, e := range expected {
+		if s.Pctls[i] != e {
+			t.Fatalf("Expected p%v to be %d, got %d", DefaultPercentiles[i], e, s.Pctls[i])
+		}
+	}
+}
+
+func TestLogLinearBuckets(t *testing.T) {
+	bounds := LogLinearBuckets(9)
+
+	expected := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 200}
+	for i, e := range expected {
+		if bounds[i] != e {
+			t.Fatalf("Expected bound %d to be %d, got %d", i, e, bounds[i])
+		}
+	}
+	if bounds[len(bounds)-1] != math.MaxUint64 {
+		t.Fatalf("Expected last bound to be max uint64, got %d", bounds[len(bounds)-1])
+	}
+
+	id := AddHistogramWithBuckets("test_loglinear", false, bounds, nil)
+	for _, v := range []uint64{0, 1, 15, 20, 21, math.MaxUint64} {
+		ObserveHist(id, v)
+	}
+
+	for _, bh := range getAllBucketHistograms() {
+		if bh.name != "test_loglinear" {
+			continue
+		}
+		// 0 and 1 are in the first bucket, 15 and 20 in the 20 bucket, 21 in the 30
+		// bucket, and max uint64 in the last bucket
+		counts := map[int]uint64{0: 2, 10: 2, 11: 1, len(bounds) - 1: 1}
+		for i, c := range bh.buckets {
+			if c != counts[i] {
+				t.Fatalf("Expected bucket %d to have %d observations, got %d", i, counts[i], c)
+			}
+		}
+		return
+	}
+
+	t.Fatalf("Histogram test_loglinear not found")
+}
+
+func TestHistogramSampleRate(t *testing.T) {
+	id := AddSampledHistogram("test_sample_rate", 10, nil)
+
+	for i := uint64(0); i < 100; i++ {
+		ObserveHist(id, i)
+	}
+
+	SetHistogramSampleRate(id, 1)
+
+	for i := uint64(0); i < 100; i++ {
+		ObserveHist(id, i)
+	}
+
+	for _, s := range ExtractHistSummaries(nil) {
+		if s.Name != "test_sample_rate" {
+			continue
+		}
+		if s.Count != 200 {
+			t.Fatalf("Expected 200 observations, got %d", s.Count)
+		}
+		// 10 from the first 100 at 1 in 10, then all of the second 100
+		if s.Kept != 110 {
+			t.Fatalf("Expected 110 kept samples, got %d", s.Kept)
+		}
+		return
+	}
+
+	t.Fatalf("Histogram test_sample_rate not found")
+}
+
+func TestTimer(t *testing.T) {
+	id := AddHistogram("test_timer", false, nil)
+
+	tm := StartTimer(id)
+	time.Sleep(time.Millisecond)
+	dur := tm.Stop()
+
+	if dur < time.Millisecond {
+		t.Fatalf("Expected at least 1ms, got %v", dur)
+	}
+
+	for _, s := range ExtractHistSummaries(nil) {
+		if s.Name != "test_timer" {
+			continue
+		}
+		if s.Count != 1 || s.Min != uint64(dur) {
+			t.Fatalf("Expected one observation of %d, got count %d min %d", dur, s.Count, s.Min)
+		}
+		return
+	}
+
+	t.Fatalf("Histogram test_timer not found")
+}
+
+func TestPeekDoesNotReset(t *testing.T) {
+	id := AddHistogram("test_peek", false, nil)
+	defer RemoveHistogram(id)
+	ObserveHist(id, 5)
+
+	find := func(sums []HistSummary) HistSummary {
+		for _, s := range sums {
+			if s.Name == "test_peek" {
+				return s
+			}
+		}
+		t.Fatalf("Histogram test_peek not found")
+		return HistSummary{}
+	}
+
+	if s := find(PeekHistSummaries(DefaultPercentiles)); s.Count != 1 || s.Pctls[0] != 5 {
+		t.Fatalf("Unexpected peek %+v", s)
+	}
+
+	ObserveHist(id, 7)
+
+	if s := find(ExtractHistSummaries(DefaultPercentiles)); s.Count != 2 || s.Max != 7 {
+		t.Fatalf("Expected peek to leave both observations, got %+v", s)
+	}
+}
+
+func TestBucketDeltas(t *testing.T) {
+	id := AddHistogramWithBuckets("test_bucket_delta", false, []uint64{10}, nil)
+	defer RemoveHistogram(id)
+
+	find := func() HistSummary {
+		for _, s := range ExtractHistSummaries(nil) {
+			if s.Name == "test_bucket_delta" {
+				return s
+			}
+		}
+		t.Fatalf("Histogram test_bucket_delta not found")
+		return HistSummary{}
+	}
+
+	ObserveHist(id, 5)
+	ObserveHist(id, 50)
+	if s := find(); s.Buckets[0] != 1 || s.Buckets[1] != 1 {
+		t.Fatalf("Unexpected first period buckets %v", s.Buckets)
+	}
+
+	ObserveHist(id, 6)
+	if s := find(); s.Buckets[0] != 1 || s.Buckets[1] != 0 {
+		t.Fatalf("Unexpected second period buckets %v", s.Buckets)
+	}
+
+	// The cumulative buckets are unaffected by extraction
+	for _, bh := range getAllBucketHistograms() {
+		if bh.name == "test_bucket_delta" && (bh.buckets[0] != 2 || bh.buckets[1] != 1) {
+			t.Fatalf("Unexpected cumulative buckets %v", bh.buckets)
+		}
+	}
+}
+
+func TestWindowedHistogram(t *testing.T) {
+	id := AddWindowedHistogram("test_window", 3, 20*time.Millisecond, nil)
+	defer RemoveHistogram(id)
+
+	find := func() HistSummary {
+		for _, s := range ExtractHistSummaries(DefaultPercentiles) {
+			if s.Name == "test_window" {
+				return s
+			}
+		}
+		t.Fatalf("Histogram test_window not found")
+		return HistSummary{}
+	}
+
+	ObserveHist(id, 100)
+
+	// Extracting doesn't clear the window
+	find()
+	if s := find(); s.Count != 1 || s.Max != 100 {
+		t.Fatalf("Expected the observation to still be in the window, got %+v", s)
+	}
+
+	// Once the whole window has passed, the observation ages out
+	time.Sleep(80 * time.Millisecond)
+	ObserveHist(id, 1)
+	if s := find(); s.Count != 1 || s.Max != 1 {
+		t.Fatalf("Expected only the newest observation, got %+v", s)
+	}
+}
+
+func TestDecayingHistogram(t *testing.T) {
+	id := AddDecayingHistogram("test_decaying", 100, DefaultReservoirAlpha, nil)
+	defer RemoveHistogram(id)
+
+	for i := uint64(0); i < 10000; i++ {
+		ObserveHist(id, i)
+	}
+
+	for _, s := range ExtractHistSummaries([]float64{50}) {
+		if s.Name != "test_decaying" {
+			continue
+		}
+		if s.Count != 10000 || s.Kept != 100 {
+			t.Fatalf("Expected 10000 observations and 100 kept, got %d and %d", s.Count, s.Kept)
+		}
+		// All observations have nearly the same weight, so the median of the
+		// reservoir should be near the true median
+		if s.Pctls[0] < 3000 || s.Pctls[0] > 7000 {
+			t.Fatalf("Median %d too far from 5000", s.Pctls[0])
+		}
+		return
+	}
+
+	t.Fatalf("Histogram test_decaying not found")
+}
+
+func TestMergeHistSnapshots(t *testing.T) {
+	a := HistSnapshot{Name: "merge", Count: 2, Total: 30, Min: 10, Max: 20, Samples: []uint64{10, 20},
+		Bounds: []uint64{15, math.MaxUint64}, Buckets: []uint64{1, 1}}
+	b := HistSnapshot{Name: "merge", Count: 2, Total: 70, Min: 30, Max: 40, Samples: []uint64{30, 40},
+		Bounds: []uint64{15, math.MaxUint64}, Buckets: []uint64{0, 2}}
+	empty := HistSnapshot{Name: "merge", Min: math.MaxUint64,
+		Bounds: []uint64{15, math.MaxUint64}, Buckets: []uint64{0, 0}}
+
+	m, err := MergeHistSnapshots(a, empty, b)
+	if err != nil {
+		t.Fatalf("Error merging: %s", err.Error())
+	}
+
+	if m.Count != 4 || m.Total != 100 || m.Min != 10 || m.Max != 40 {
+		t.Fatalf("Unexpected merged snapshot %+v", m)
+	}
+	if m.Buckets[0] != 1 || m.Buckets[1] != 3 {
+		t.Fatalf("Unexpected merged buckets %v", m.Buckets)
+	}
+
+	s := m.Summarize([]float64{50})
+	if s.Avg != 25 || s.Pctls[0] != 30 {
+		t.Fatalf("Unexpected summary %+v", s)
+	}
+
+	b.Bounds = []uint64{math.MaxUint64}
+	b.Buckets = []uint64{2}
+	if _, err := MergeHistSnapshots(a, b); err != ErrBucketMismatch {
+		t.Fatalf("Expected bucket mismatch error, got %v", err)
+	}
+}
+
+// Extracts while observing from several goroutines. Every observation must be
+// counted in exactly one period.
+func TestObserveDuringExtraction(t *testing.T) {
+	id := AddHistogram("test_observe_extract", false, nil)
+	defer RemoveHistogram(id)
+
+	const workers, perWorker = 4, 20000
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				ObserveHist(id, 1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var count, total, buckets uint64
+	collect := func() {
+		for _, s := range ExtractHistSnapshots() {
+			if s.Name == "test_observe_extract" {
+				count += s.Count
+				total += s.Total
+				for _, b := range s.Buckets {
+					buckets += b
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			collect()
+			if count != workers*perWorker || total != count || buckets != count {
+				t.Fatalf("Expected %d observations, got count %d total %d buckets %d",
+					workers*perWorker, count, total, buckets)
+			}
+			return
+		default:
+			collect()
+		}
+	}
+}
+
+func TestHistogramBufferSize(t *testing.T) {
+	id := AddHistogramWithBufferSize("test_buffer_size", false, 100, nil)
+	defer RemoveHistogram(id)
+
+	h := loadHists()[id]
+	if len(h.dats[0].buf) != 128 {
+		t.Fatalf("Expected buffer size rounded up to 128, got %d", len(h.dats[0].buf))
+	}
+
+	// Wrap the buffer; the newest 128 values remain
+	for i := uint64(0); i < 1000; i++ {
+		ObserveHist(id, i)
+	}
+
+	for _, s := range ExtractHistSnapshots() {
+		if s.Name != "test_buffer_size" {
+			continue
+		}
+		if s.Count != 1000 || len(s.Samples) != 128 {
+			t.Fatalf("Expected 1000 observations and 128 samples, got %d and %d", s.Count, len(s.Samples))
+		}
+		for _, v := range s.Samples {
+			if v < 1000-128 {
+				t.Fatalf("Expected only the newest samples, found %d", v)
+			}
+		}
+		return
+	}
+
+	t.Fatalf("Histogram test_buffer_size not found")
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+func init() {
+	http.Handle("/metrics.json", http.HandlerFunc(printJSON))
+}
+
+// The JSON endpoint returns the same data as the /metrics endpoint, with
+// histograms as summaries, along with the period the histograms cover. Like
+// the /metrics endpoint, reading it resets the histograms, so the period
+// starts at the previous read of either endpoint or any other extraction.
+// Counters are cumulative; the period end doubles as the time they were read
+// so pollers can compute rates between reads.
+//
+// Adding ?peek=true shows the current period so far without resetting it, for
+// looking at the data by hand without disturbing the regular poller.
+type jsonMetrics struct {
+	PeriodStart time.Time         `json:"period_start"`
+	PeriodEnd   time.Time         `json:"period_end"`
+	Counters    []jsonValue       `json:"counters"`
+	Gauges      []jsonValue       `json:"gauges"`
+	Histograms  []jsonHistSummary `json:"histograms"`
+}
+
+type jsonValue struct {
+	Name  string      `json:"name"`
+	Tags  Tags        `json:"tags,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+type jsonHistSummary struct {
+	Name        string            `json:"name"`
+	Tags        Tags              `json:"tags,omitempty"`
+	Count       uint64            `json:"count"`
+	Kept        uint64            `json:"kept"`
+	Min         uint64            `json:"min"`
+	Max         uint64            `json:"max"`
+	Avg         float64           `json:"avg"`
+	Percentiles map[string]uint64 `json:"percentiles"`
+}
+
+func printJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, r.URL.Query().Get("peek") == "true")
+}
+
+func writeJSON(w io.Writer, peek bool) error {
+	extract := extractHistSummaries
+	if peek {
+		extract = peekHistSummaries
+	}
+
+	hists, start, end := extract(DefaultPercentiles)
+
+	m := jsonMetrics{
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Counters:    []jsonValue{},
+		Gauges:      []jsonValue{},
+		Histograms:  make([]jsonHistSummary, len(hists)),
+	}
+
+	for _, c := range extractCounters() {
+		m.Counters = append(m.Counters, jsonValue{c.Name, c.Tags, c.Value})
+	}
+
+	ints, floats := extractGauges()
+	for _, g := range ints {
+		m.Gauges = append(m.Gauges, jsonValue{g.Name, g.Tags, g.Value})
+	}
+	for _, g := range floats {
+		m.Gauges = append(m.Gauges, jsonValue{g.Name, g.Tags, g.Value})
+	}
+
+	for i, h := range hists {
+		pctls := make(map[string]uint64, len(h.Pctls))
+		for j, p := range h.Pctls {
+			pctls[percentileName(h.Percentiles[j])] = p
+		}
+
+		m.Histograms[i] = jsonHistSummary{
+			Name:        h.Name,
+			Tags:        h.Tags,
+			Count:       h.Count,
+			Kept:        h.Kept,
+			Min:         h.Min,
+			Max:         h.Max,
+			Avg:         h.Avg,
+			Percentiles: pctls,
+		}
+	}
+
+	return json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONPeriods(t *testing.T) {
+	id := AddHistogram("test_json", false, nil)
+	defer RemoveHistogram(id)
+	ObserveHist(id, 10)
+
+	var first, second jsonMetrics
+
+	buf := &bytes.Buffer{}
+	writeJSON(buf, false)
+	if err := json.Unmarshal(buf.Bytes(), &first); err != nil {
+		t.Fatalf("Error decoding output: %s", err.Error())
+	}
+
+	buf.Reset()
+	writeJSON(buf, false)
+	if err := json.Unmarshal(buf.Bytes(), &second); err != nil {
+		t.Fatalf("Error decoding output: %s", err.Error())
+	}
+
+	if !first.PeriodEnd.After(first.PeriodStart) {
+		t.Fatalf("Expected period end %v after start %v", first.PeriodEnd, first.PeriodStart)
+	}
+	if !second.PeriodStart.Equal(first.PeriodEnd) {
+		t.Fatalf("Expected second period to start at %v, got %v", first.PeriodEnd, second.PeriodStart)
+	}
+
+	for _, h := range first.Histograms {
+		if h.Name == "test_json" {
+			if h.Count != 1 || h.Percentiles["p50"] != 10 {
+				t.Fatalf("Unexpected summary %+v", h)
+			}
+			return
+		}
+	}
+
+	t.Fatalf("Histogram test_json not found")
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrBucketMismatch = errors.New("Histogram snapshots have different bucket bounds")
+
+// HistSnapshot is the raw data of one period of a histogram. Unlike a
+// HistSummary it can be merged with snapshots of the same histogram taken
+// elsewhere, e.g. from other listeners or other processes, and summarized
+// after. It can be encoded as JSON to send it between processes.
+//
+// Buckets holds the number of observations in the period in each bucket, and
+// Bounds the inclusive upper bound of each bucket, in increasing order.
+type HistSnapshot struct {
+	Name    string   `json:"name"`
+	Tags    Tags     `json:"tags,omitempty"`
+	Count   uint64   `json:"count"`
+	Total   uint64   `json:"total"`
+	Min     uint64   `json:"min"`
+	Max     uint64   `json:"max"`
+	Samples []uint64 `json:"samples"`
+	Bounds  []uint64 `json:"bounds"`
+	Buckets []uint64 `json:"buckets"`
+}
+
+// ExtractHistSnapshots pulls the raw data out of every histogram. Like
+// ExtractHistSummaries, this resets the histograms.
+func ExtractHistSnapshots() []HistSnapshot {
+	hists, _, _ := getAllHistograms()
+	ret := make([]HistSnapshot, len(hists))
+
+	for i, h := range hists {
+		d := h.dat
+
+		kept := d.kept
+		if kept > uint64(len(d.buf)) {
+			kept = uint64(len(d.buf))
+		}
+		samples := make([]uint64, kept)
+		copy(samples, d.buf)
+
+		bounds, buckets := ascendingBuckets(h.bounds, h.buckets)
+
+		ret[i] = HistSnapshot{
+			Name:    h.name,
+			Tags:    h.tgs,
+			Count:   d.count,
+			Total:   d.total,
+			Min:     d.min,
+			Max:     d.max,
+			Samples: samples,
+			Bounds:  bounds,
+			Buckets: buckets,
+		}
+	}
+
+	return ret
+}
+
+// MergeHistSnapshots combines snapshots of the same histogram into one. Counts,
+// totals, and buckets are summed, the min and max are the smallest and largest
+// of all of them, and the samples are combined. The snapshots must all have the
+// same bucket bounds. The name and tags are taken from the first snapshot.
+//
+// Percentiles of the merged samples are only representative if every snapshot
+// kept samples at the same rate, since each sample counts the same.
+func MergeHistSnapshots(snaps ...HistSnapshot) (HistSnapshot, error) {
+	if len(snaps) == 0 {
+		return HistSnapshot{Min: math.MaxUint64}, nil
+	}
+
+	ret := HistSnapshot{
+		Name:    snaps[0].Name,
+		Tags:    snaps[0].Tags,
+		Min:     math.MaxUint64,
+		Bounds:  snaps[0].Bounds,
+		Buckets: make([]uint64, len(snaps[0].Buckets)),
+	}
+
+	for _, s := range snaps {
+		if !equalBounds(s.Bounds, ret.Bounds) || len(s.Buckets) != len(ret.Buckets) {
+			return HistSnapshot{}, ErrBucketMismatch
+		}
+
+		ret.Count += s.Count
+		ret.Total += s.Total
+
+		// An empty snapshot has a min of max uint64 and max of 0, so it
+		// doesn't change either
+		if s.Min < ret.Min {
+			ret.Min = s.Min
+		}
+		if s.Max > ret.Max {
+			ret.Max = s.Max
+		}
+
+		ret.Samples = append(ret.Samples, s.Samples...)
+
+		for i, c := range s.Buckets {
+			ret.Buckets[i] += c
+		}
+	}
+
+	return ret, nil
+}
+
+// Summarize computes the summary of the snapshot with the given percentiles.
+func (s HistSnapshot) Summarize(pctls []float64) HistSummary {
+	buf := make([]uint64, len(s.Samples))
+	copy(buf, s.Samples)
+
+	h := histData{
+		name: s.Name,
+		tgs:  s.Tags,
+		dat: &hdat{
+			count: s.Count,
+			kept:  uint64(len(buf)),
+			total: s.Total,
+			min:   s.Min,
+			max:   s.Max,
+			buf:   buf,
+		},
+		bounds:  s.Bounds,
+		buckets: s.Buckets,
+	}
+
+	return h.summarize(pctls)
+}
+
+func equalBounds(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import "sync"
+
+// Unit is the unit of the values of a metric.
+type Unit string
+
+const (
+	UnitNone        Unit = ""
+	UnitNanoseconds Unit = "nanoseconds"
+	UnitBytes       Unit = "bytes"
+	UnitCount       Unit = "count"
+)
+
+type metadata struct {
+	unit Unit
+	help string
+}
+
+var (
+	metadataLock sync.RWMutex
+	metadatas    = make(map[string]metadata)
+)
+
+// Describe attaches a unit and help text to every metric with the given name,
+// regardless of tags. It is meant to be called alongside registration. The
+// exporters that support it pass the description along, e.g. as the HELP
+// line for Prometheus and the unit and description in OTLP. Describing the
+// same name again replaces the previous description.
+func Describe(name string, unit Unit, help string) {
+	metadataLock.Lock()
+	metadatas[name] = metadata{unit: unit, help: help}
+	metadataLock.Unlock()
+}
+
+func getMetadata(name string) (metadata, bool) {
+	metadataLock.RLock()
+	m, ok := metadatas[name]
+	metadataLock.RUnlock()
+	return m, ok
+}
+
+// The UCUM unit codes that OTLP expects
+func (u Unit) ucum() string {
+	switch u {
+	case UnitNanoseconds:
+		return "ns"
+	case UnitBytes:
+		return "By"
+	case UnitCount:
+		return "1"
+	}
+	return string(u)
+}
@@ -0,0 +1,356 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// OTLP aggregation temporality, from the OpenTelemetry metrics proto
+const otlpCumulative = 2
+
+// Everything the OTLP sink reports is cumulative since startup or the last
+// Reset, in unix nanoseconds. It's accessed atomically.
+var otlpStart = time.Now().UnixNano()
+
+// OTLPSink exports metrics to an OpenTelemetry collector using OTLP over HTTP
+// with the JSON encoding, which needs nothing outside the standard library.
+// Counters are exported as cumulative monotonic sums and gauges as gauges.
+//
+// Histograms are exported from the bucketized histograms, which are
+// cumulative since startup. The default power of two buckets map to OTLP
+// exponential histograms at scale 0. OTLP buckets include their upper bound
+// while the power of two buckets include their lower bound, so values that
+// are exact powers of two are reported one bucket higher than OTLP would put
+// them. Histograms registered with explicit bounds are exported as OTLP
+// histograms with those bounds. The summaries passed to FlushHistograms are
+// not used, but extracting them still resets the periodic histogram data.
+type OTLPSink struct {
+	url     string
+	attrs   []otlpKeyValue
+	client  *http.Client
+	metrics []otlpMetric
+}
+
+// Creates an OTLP sink that posts to the given URL, normally ending in
+// /v1/metrics. The resource attributes describe the process and are attached
+// to everything it sends, e.g. service.name.
+func NewOTLPSink(url string, resource Tags) *OTLPSink {
+	return &OTLPSink{
+		url:    url,
+		attrs:  otlpAttributes(resource),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (o *OTLPSink) FlushCounters(ctrs []Counter) error {
+	start, now := otlpTimes()
+
+	for _, c := range ctrs {
+		o.metrics = append(o.metrics, otlpMetric{
+			Name: c.Name,
+			Sum: &otlpSum{
+				AggregationTemporality: otlpCumulative,
+				IsMonotonic:            true,
+				DataPoints: []otlpNumberDataPoint{{
+					Attributes:        otlpAttributes(c.Tags),
+					StartTimeUnixNano: start,
+					TimeUnixNano:      now,
+					AsInt:             strconv.FormatUint(c.Value, 10),
+				}},
+			},
+		})
+	}
+
+	return o.send()
+}
+
+func (o *OTLPSink) FlushGauges(ints []IntGauge, floats []FloatGauge) error {
+	_, now := otlpTimes()
+
+	for _, g := range ints {
+		o.metrics = append(o.metrics, otlpMetric{
+			Name: g.Name,
+			Gauge: &otlpGauge{DataPoints: []otlpNumberDataPoint{{
+				Attributes:   otlpAttributes(g.Tags),
+				TimeUnixNano: now,
+				AsInt:        strconv.FormatUint(g.Value, 10),
+			}}},
+		})
+	}
+	for _, g := range floats {
+		v := g.Value
+		o.metrics = append(o.metrics, otlpMetric{
+			Name: g.Name,
+			Gauge: &otlpGauge{DataPoints: []otlpNumberDataPoint{{
+				Attributes:   otlpAttributes(g.Tags),
+				TimeUnixNano: now,
+				AsDouble:     &v,
+			}}},
+		})
+	}
+
+	return o.send()
+}
+
+func (o *OTLPSink) FlushHistograms(hists []HistSummary) error {
+	start, now := otlpTimes()
+
+	for _, bh := range getAllBucketHistograms() {
+		var count uint64
+		for _, c := range bh.buckets {
+			count += c
+		}
+
+		m := otlpMetric{Name: bh.name}
+
+		if bh.bounds == nil {
+			m.ExponentialHistogram = &otlpExpHistogram{
+				AggregationTemporality: otlpCumulative,
+				DataPoints: []otlpExpHistogramDataPoint{
+					otlpExpPoint(bh, count, start, now),
+				},
+			}
+		} else {
+			m.Histogram = &otlpHistogram{
+				AggregationTemporality: otlpCumulative,
+				DataPoints: []otlpHistogramDataPoint{
+					otlpExplicitPoint(bh, count, start, now),
+				},
+			}
+		}
+
+		o.metrics = append(o.metrics, m)
+	}
+
+	return o.send()
+}
+
+// The power of two buckets are stored by leading zero count, so the bucket for
+// values in [2^i, 2^(i+1)) is at index 63-i and zero is at index 64. At scale
+// 0 the OTLP bucket at index i is (2^i, 2^(i+1)].
+func otlpExpPoint(bh bhistData, count uint64, start, now string) otlpExpHistogramDataPoint {
+	counts := make([]string, bhistlen-1)
+	for i := range counts {
+		counts[i] = strconv.FormatUint(bh.buckets[bhistlen-2-i], 10)
+	}
+
+	return otlpExpHistogramDataPoint{
+		Attributes:        otlpAttributes(bh.tgs),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             strconv.FormatUint(count, 10),
+		Sum:               float64(bh.sum),
+		Scale:             0,
+		ZeroCount:         strconv.FormatUint(bh.buckets[bhistlen-1], 10),
+		Positive: otlpBuckets{
+			Offset:       0,
+			BucketCounts: counts,
+		},
+	}
+}
+
+// OTLP explicit bounds are the upper bounds of every bucket but the last, which
+// is unbounded. The last bound here is always max uint64, so it is left off.
+func otlpExplicitPoint(bh bhistData, count uint64, start, now string) otlpHistogramDataPoint {
+	counts := make([]string, len(bh.buckets))
+	for i, c := range bh.buckets {
+		counts[i] = strconv.FormatUint(c, 10)
+	}
+
+	bounds := make([]float64, len(bh.bounds)-1)
+	for i := range bounds {
+		bounds[i] = float64(bh.bounds[i])
+	}
+
+	return otlpHistogramDataPoint{
+		Attributes:        otlpAttributes(bh.tgs),
+		StartTimeUnixNano: start,
+		TimeUnixNano:      now,
+		Count:             strconv.FormatUint(count, 10),
+		Sum:               float64(bh.sum),
+		BucketCounts:      counts,
+		ExplicitBounds:    bounds,
+	}
+}
+
+func (o *OTLPSink) send() error {
+	if len(o.metrics) == 0 {
+		return nil
+	}
+
+	for i := range o.metrics {
+		if md, ok := getMetadata(o.metrics[i].Name); ok {
+			o.metrics[i].Description = md.help
+			o.metrics[i].Unit = md.unit.ucum()
+		}
+	}
+
+	req := otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{Attributes: o.attrs},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "github.com/netflix/rend/metrics"},
+				Metrics: o.metrics,
+			}},
+		}},
+	}
+	o.metrics = nil
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	res, err := o.client.Post(o.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export to %s failed with status %s", o.url, res.Status)
+	}
+
+	return nil
+}
+
+func otlpTimes() (start, now string) {
+	start = strconv.FormatInt(atomic.LoadInt64(&otlpStart), 10)
+	now = strconv.FormatInt(time.Now().UnixNano(), 10)
+	return
+}
+
+func otlpAttributes(tgs Tags) []otlpKeyValue {
+	if len(tgs) == 0 {
+		return nil
+	}
+
+	ret := make([]otlpKeyValue, 0, len(tgs))
+	for _, k := range tgs.keys() {
+		ret = append(ret, otlpKeyValue{
+			Key:   k,
+			Value: otlpAnyValue{StringValue: tgs[k]},
+		})
+	}
+	return ret
+}
+
+// The types below mirror the JSON encoding of the OTLP metrics protobufs. 64 bit
+// integers are encoded as strings, as the protobuf JSON mapping requires.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name                 string            `json:"name"`
+	Description          string            `json:"description,omitempty"`
+	Unit                 string            `json:"unit,omitempty"`
+	Sum                  *otlpSum          `json:"sum,omitempty"`
+	Gauge                *otlpGauge        `json:"gauge,omitempty"`
+	Histogram            *otlpHistogram    `json:"histogram,omitempty"`
+	ExponentialHistogram *otlpExpHistogram `json:"exponentialHistogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpExpHistogram struct {
+	DataPoints             []otlpExpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                         `json:"aggregationTemporality"`
+}
+
+type otlpExpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	Scale             int            `json:"scale"`
+	ZeroCount         string         `json:"zeroCount"`
+	Positive          otlpBuckets    `json:"positive"`
+}
+
+type otlpBuckets struct {
+	Offset       int      `json:"offset"`
+	BucketCounts []string `json:"bucketCounts"`
+}
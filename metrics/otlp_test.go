@@ -0,0 +1,70 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOTLPExponentialHistogram(t *testing.T) {
+	id := AddHistogram("test_otlp", false, Tags{"op": "get"})
+	defer RemoveHistogram(id)
+	ObserveHist(id, 0)
+	ObserveHist(id, 1)
+	ObserveHist(id, 5)
+	ObserveHist(id, 6)
+
+	reqs := make(chan otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Error decoding request: %s", err.Error())
+		}
+		reqs <- req
+	}))
+	defer srv.Close()
+
+	o := NewOTLPSink(srv.URL+"/v1/metrics", Tags{"service.name": "rend"})
+	if err := o.FlushHistograms(nil); err != nil {
+		t.Fatalf("Error flushing: %s", err.Error())
+	}
+
+	req := <-reqs
+	if req.ResourceMetrics[0].Resource.Attributes[0].Value.StringValue != "rend" {
+		t.Fatalf("Expected service.name resource attribute")
+	}
+
+	for _, m := range req.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if m.Name != "test_otlp" {
+			continue
+		}
+
+		p := m.ExponentialHistogram.DataPoints[0]
+		if p.Count != "4" || p.Sum != 12 || p.ZeroCount != "1" {
+			t.Fatalf("Unexpected count %s, sum %f, or zero count %s", p.Count, p.Sum, p.ZeroCount)
+		}
+		// 1 is in the bucket starting at 2^0 and both 5 and 6 in the one at 2^2
+		counts := p.Positive.BucketCounts
+		if counts[0] != "1" || counts[1] != "0" || counts[2] != "2" {
+			t.Fatalf("Unexpected bucket counts %v", counts[:3])
+		}
+		return
+	}
+
+	t.Fatalf("Histogram test_otlp not exported")
+}
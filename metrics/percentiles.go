@@ -0,0 +1,165 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultPercentiles are the percentiles most consumers care about: p50, p90,
+// p99, and p99.9.
+var DefaultPercentiles = []float64{50, 90, 99, 99.9}
+
+// HistSummary is the summary of one period of observations for a histogram.
+// Pctls holds the value at each of the requested Percentiles, in the same
+// order. Avg and Pctls are zero if there were no observations in the period.
+//
+// Buckets holds the number of observations in the period that fell in each
+// bucket of the bucketized histogram, and Bounds the inclusive upper bound of
+// each bucket, both in increasing order of the bounds.
+type HistSummary struct {
+	Name        string
+	Tags        Tags
+	Count       uint64
+	Kept        uint64
+	Min         uint64
+	Max         uint64
+	Avg         float64
+	Percentiles []float64
+	Pctls       []uint64
+	Bounds      []uint64
+	Buckets     []uint64
+}
+
+// ExtractHistSummaries pulls the data out of every histogram and summarizes it
+// with the given percentiles, each between 0 and 100. Like the /metrics
+// endpoint, extracting resets the histograms, so the summary covers the time
+// since the previous extraction by any consumer.
+func ExtractHistSummaries(pctls []float64) []HistSummary {
+	ret, _, _ := extractHistSummaries(pctls)
+	return ret
+}
+
+// PeekHistSummaries summarizes the data every histogram has collected so far in
+// the current period without resetting anything. It is meant for debugging
+// tools that must not disturb the regular consumer of the histograms.
+func PeekHistSummaries(pctls []float64) []HistSummary {
+	ret, _, _ := peekHistSummaries(pctls)
+	return ret
+}
+
+func extractHistSummaries(pctls []float64) ([]HistSummary, time.Time, time.Time) {
+	hists, start, end := getAllHistograms()
+	return summarizeHists(hists, pctls), start, end
+}
+
+func peekHistSummaries(pctls []float64) ([]HistSummary, time.Time, time.Time) {
+	hists, start, end := peekAllHistograms()
+	return summarizeHists(hists, pctls), start, end
+}
+
+func summarizeHists(hists []histData, pctls []float64) []HistSummary {
+	ret := make([]HistSummary, len(hists))
+
+	for i, h := range hists {
+		ret[i] = h.summarize(pctls)
+	}
+
+	return ret
+}
+
+func (h histData) summarize(pctls []float64) HistSummary {
+	d := h.dat
+	s := HistSummary{
+		Name:        h.name,
+		Tags:        h.tgs,
+		Count:       d.count,
+		Kept:        d.kept,
+		Percentiles: pctls,
+		Pctls:       make([]uint64, len(pctls)),
+	}
+
+	s.Bounds, s.Buckets = ascendingBuckets(h.bounds, h.buckets)
+
+	if d.count == 0 {
+		return s
+	}
+
+	s.Min = d.min
+	s.Max = d.max
+	s.Avg = float64(d.total) / float64(d.count)
+	copy(s.Pctls, d.percentiles(pctls))
+
+	return s
+}
+
+// percentiles sorts the kept samples and returns the value at each of the given
+// percentiles. The 0th and 100th percentiles are the true min and max, which
+// may not be in the samples if the histogram is sampled or the buffer wrapped.
+// Returns nil if there are no samples.
+func (d *hdat) percentiles(pctls []float64) []uint64 {
+	buf := d.buf
+	kept := d.kept
+
+	if kept == 0 {
+		return nil
+	}
+	if kept < uint64(len(buf)) {
+		buf = buf[:kept]
+	}
+
+	sort.Sort(uint64slice(buf))
+
+	ret := make([]uint64, len(pctls))
+
+	for i, p := range pctls {
+		switch {
+		case p <= 0:
+			ret[i] = d.min
+		case p >= 100:
+			ret[i] = d.max
+		default:
+			idx := int(float64(len(buf)) * p / 100)
+			if idx >= len(buf) {
+				idx = len(buf) - 1
+			}
+			ret[i] = buf[idx]
+		}
+	}
+
+	return ret
+}
+
+// Puts the buckets in increasing order of their upper bounds. The power of two
+// buckets are stored by leading zero count, so they are reversed, and the
+// bucket at index i in the result holds values up to 2^i - 1.
+func ascendingBuckets(bounds, buckets []uint64) ([]uint64, []uint64) {
+	if bounds != nil {
+		return bounds, buckets
+	}
+
+	n := len(buckets)
+	asc := make([]uint64, n)
+	bnds := make([]uint64, n)
+
+	for i := range asc {
+		asc[i] = buckets[n-1-i]
+		bnds[i] = math.MaxUint64 >> uint(n-1-i)
+	}
+
+	return bnds, asc
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	http.Handle("/metrics/prometheus", http.HandlerFunc(printPrometheus))
+}
+
+// The Prometheus endpoint renders metrics in the Prometheus text exposition
+// format. Histograms are rendered from the bucketized histograms, which are
+// cumulative since startup as Prometheus expects, so scraping this endpoint
+// does not reset anything and can be done alongside the /metrics endpoint.
+func printPrometheus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writePrometheus(w)
+}
+
+type promSample struct {
+	name string
+	tgs  Tags
+	val  string
+}
+
+func writePrometheus(w io.Writer) {
+	//////////////////////////
+	// Counters
+	//////////////////////////
+	var samples []promSample
+	for _, c := range getAllCounters() {
+		samples = append(samples, promSample{c.name, c.tgs, strconv.FormatUint(c.val, 10)})
+	}
+	writePromFamilies(w, "counter", samples)
+
+	//////////////////////////
+	// Gauges
+	//////////////////////////
+	samples = nil
+	intg, floatg := getAllGauges()
+	cbintg, cbfloatg := getAllCallbackGauges()
+	for _, g := range append(intg, cbintg...) {
+		samples = append(samples, promSample{g.name, g.tgs, strconv.FormatUint(g.val, 10)})
+	}
+	for _, g := range append(floatg, cbfloatg...) {
+		samples = append(samples, promSample{g.name, g.tgs, formatPromFloat(g.val)})
+	}
+	writePromFamilies(w, "gauge", samples)
+
+	//////////////////////////
+	// Histograms
+	//////////////////////////
+	bhists := getAllBucketHistograms()
+	sort.SliceStable(bhists, func(i, j int) bool { return bhists[i].name < bhists[j].name })
+
+	last := ""
+	for _, bh := range bhists {
+		name := promName(bh.name)
+		if name != last {
+			writePromHelp(w, name, bh.name)
+			fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+			last = name
+		}
+
+		// Prometheus buckets are cumulative and in increasing order of their
+		// upper bound. The power of two buckets are stored largest first.
+		var count uint64
+		for i := range bh.buckets {
+			idx, le := i, uint64(0)
+			if bh.bounds == nil {
+				idx = len(bh.buckets) - 1 - i
+				le = math.MaxUint64 >> uint(idx)
+			} else {
+				le = bh.bounds[i]
+			}
+
+			count += bh.buckets[idx]
+
+			lestr := strconv.FormatUint(le, 10)
+			if le == math.MaxUint64 {
+				lestr = "+Inf"
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(bh.tgs, "le", lestr), count)
+		}
+
+		fmt.Fprintf(w, "%s_sum%s %d\n", name, promLabels(bh.tgs, "", ""), bh.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, promLabels(bh.tgs, "", ""), count)
+	}
+}
+
+// All samples with the same name must be grouped under one TYPE line
+func writePromFamilies(w io.Writer, typ string, samples []promSample) {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].name < samples[j].name })
+
+	last := ""
+	for _, s := range samples {
+		name := promName(s.name)
+		if name != last {
+			writePromHelp(w, name, s.name)
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			last = name
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, promLabels(s.tgs, "", ""), s.val)
+	}
+}
+
+var promHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// Writes the HELP line for a described metric, with the unit in parentheses
+func writePromHelp(w io.Writer, promname, name string) {
+	md, ok := getMetadata(name)
+	if !ok {
+		return
+	}
+
+	help := md.help
+	if md.unit != UnitNone {
+		help += " (" + string(md.unit) + ")"
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", promname, promHelpEscaper.Replace(help))
+}
+
+// Metric names may only contain letters, digits, underscores, and colons, and
+// may not start with a digit. Anything else is replaced with an underscore.
+func promName(name string) string {
+	name = prefix + name
+
+	buf := []byte(name)
+	for i, c := range buf {
+		valid := c == '_' || c == ':' ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9' && i > 0)
+		if !valid {
+			buf[i] = '_'
+		}
+	}
+
+	return string(buf)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Renders the tags as {k1="v1",k2="v2"} with an optional extra label at the
+// end, or an empty string if there are none.
+func promLabels(tgs Tags, extraKey, extraVal string) string {
+	if len(tgs) == 0 && extraKey == "" {
+		return ""
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, k := range tgs.keys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, `%s="%s"`, k, promEscaper.Replace(tgs[k]))
+	}
+	if extraKey != "" {
+		if len(tgs) > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, `%s="%s"`, extraKey, promEscaper.Replace(extraVal))
+	}
+	buf.WriteByte('}')
+
+	return buf.String()
+}
+
+func formatPromFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusOutput(t *testing.T) {
+	c := AddCounter("test_prom_ctr", Tags{"op": "get"})
+	IncCounterBy(c, 3)
+
+	h := AddHistogramWithBuckets("test_prom_hist", false, []uint64{10, 100}, nil)
+	ObserveHist(h, 5)
+	ObserveHist(h, 50)
+	ObserveHist(h, 500)
+
+	buf := &bytes.Buffer{}
+	writePrometheus(buf)
+	out := buf.String()
+
+	expected := []string{
+		"# TYPE test_prom_ctr counter\n",
+		"test_prom_ctr{op=\"get\"} 3\n",
+		"# TYPE test_prom_hist histogram\n",
+		"test_prom_hist_bucket{le=\"10\"} 1\n",
+		"test_prom_hist_bucket{le=\"100\"} 2\n",
+		"test_prom_hist_bucket{le=\"+Inf\"} 3\n",
+		"test_prom_hist_sum 555\n",
+		"test_prom_hist_count 3\n",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(out, e) {
+			t.Fatalf("Expected output to contain %q, got:\n%s", e, out)
+		}
+	}
+}
+
+func TestPrometheusHelp(t *testing.T) {
+	AddCounter("test_prom_help", nil)
+	Describe("test_prom_help", UnitBytes, "Bytes read\nfrom clients")
+
+	buf := &bytes.Buffer{}
+	writePrometheus(buf)
+
+	e := "# HELP test_prom_help Bytes read\\nfrom clients (bytes)\n# TYPE test_prom_help counter\n"
+	if !strings.Contains(buf.String(), e) {
+		t.Fatalf("Expected output to contain %q, got:\n%s", e, buf.String())
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+// Registers every kind of metric while they are being extracted. Run with
+// -race to check the publication of new metrics to readers.
+func TestRegistrationDuringExtraction(t *testing.T) {
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ExtractHistSummaries(nil)
+			writePrometheus(ioutil.Discard)
+			extractCounters()
+			extractGauges()
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		tgs := Tags{"backend": fmt.Sprintf("b%d", i)}
+		ObserveHist(AddHistogram("test_reg_hist", false, tgs), 1)
+		IncCounter(AddCounter("test_reg_ctr", tgs))
+		SetIntGauge(AddIntGauge("test_reg_intg", tgs), 1)
+		SetFloatGauge(AddFloatGauge("test_reg_floatg", tgs), 1)
+		RegisterIntGaugeCallback("test_reg_intcb", tgs, func() uint64 { return 1 })
+		RegisterFloatGaugeCallback("test_reg_floatcb", tgs, func() float64 { return 1 })
+	}
+
+	close(done)
+	wg.Wait()
+}
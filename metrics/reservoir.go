@@ -0,0 +1,153 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// The default reservoir size and decay, which gives a 99.9% confidence
+	// level with a 5% margin of error, biased to the last 5 minutes.
+	DefaultReservoirSize  = 1028
+	DefaultReservoirAlpha = 0.015
+
+	// The priorities are relative to a landmark time, which is moved forward
+	// periodically so they don't overflow.
+	reservoirRescale = time.Hour
+)
+
+// Registers a histogram like AddHistogram whose percentiles come from an
+// exponentially decaying reservoir of size samples instead of the sample
+// buffer. The reservoir uses forward decay: each observation is kept with a
+// probability weighted by exp(alpha * age in seconds), so recent observations
+// are favored but older ones still count, and the reservoir never silently
+// drops a whole period the way the circular buffer does when it wraps. The
+// count, total, min, and max still cover the time since the last extraction.
+//
+// As with other settings, the reservoir of the first registration wins.
+func AddDecayingHistogram(name string, size int, alpha float64, tgs Tags) uint32 {
+	if size < 1 || alpha <= 0 {
+		panic("Histogram reservoirs must have a positive size and alpha")
+	}
+	return addHistogram(name, tgs, histOpts{rate: 1, resSize: size, resAlpha: alpha})
+}
+
+type reservoir struct {
+	lock     sync.Mutex
+	size     int
+	alpha    float64
+	landmark time.Time
+	rescale  time.Time
+	rng      *rand.Rand
+	samples  resHeap
+}
+
+type resSample struct {
+	priority float64
+	value    uint64
+}
+
+// A min heap on priority, so the lowest priority sample is the one replaced
+type resHeap []resSample
+
+func (h resHeap) Len() int            { return len(h) }
+func (h resHeap) Less(i, j int) bool  { return h[i].priority < h[j].priority }
+func (h resHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *resHeap) Push(x interface{}) { *h = append(*h, x.(resSample)) }
+func (h *resHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func newReservoir(size int, alpha float64) *reservoir {
+	now := time.Now()
+	return &reservoir{
+		size:     size,
+		alpha:    alpha,
+		landmark: now,
+		rescale:  now.Add(reservoirRescale),
+		rng:      rand.New(rand.NewSource(now.UnixNano())),
+		samples:  make(resHeap, 0, size),
+	}
+}
+
+func (r *reservoir) observe(value uint64) {
+	now := time.Now()
+
+	r.lock.Lock()
+
+	if now.After(r.rescale) {
+		r.rescaleTo(now)
+	}
+
+	// 1 - Float64 is in (0, 1] so the division is always safe
+	weight := math.Exp(r.alpha * now.Sub(r.landmark).Seconds())
+	s := resSample{
+		priority: weight / (1 - r.rng.Float64()),
+		value:    value,
+	}
+
+	if len(r.samples) < r.size {
+		heap.Push(&r.samples, s)
+	} else if s.priority > r.samples[0].priority {
+		r.samples[0] = s
+		heap.Fix(&r.samples, 0)
+	}
+
+	r.lock.Unlock()
+}
+
+// Moves the landmark to now and scales down the existing priorities to match.
+// Scaling every priority by the same factor keeps the heap order intact.
+func (r *reservoir) rescaleTo(now time.Time) {
+	factor := math.Exp(-r.alpha * now.Sub(r.landmark).Seconds())
+	for i := range r.samples {
+		r.samples[i].priority *= factor
+	}
+	r.landmark = now
+	r.rescale = now.Add(reservoirRescale)
+}
+
+// Drops every sample and starts over with a new landmark.
+func (r *reservoir) reset() {
+	now := time.Now()
+
+	r.lock.Lock()
+	r.samples = r.samples[:0]
+	r.landmark = now
+	r.rescale = now.Add(reservoirRescale)
+	r.lock.Unlock()
+}
+
+func (r *reservoir) snapshot() []uint64 {
+	r.lock.Lock()
+
+	ret := make([]uint64, len(r.samples))
+	for i, s := range r.samples {
+		ret[i] = s.value
+	}
+
+	r.lock.Unlock()
+
+	return ret
+}
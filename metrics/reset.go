@@ -0,0 +1,34 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Reset zeroes every counter and drops everything every histogram has
+// observed, as if the process had just started, for memcached's "stats reset".
+// Gauges are current levels rather than totals, so they are left alone.
+//
+// Counters are otherwise monotonic. Sinks that send the change in a counter
+// since their last read take a counter going down as a reset and send its new
+// value, and Prometheus does the same on its end. The OTLP sink starts its
+// cumulative sums over from the time of the reset.
+func Reset() {
+	atomic.StoreInt64(&otlpStart, time.Now().UnixNano())
+	resetCounters()
+	resetHistograms()
+}
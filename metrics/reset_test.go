@@ -0,0 +1,92 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReset(t *testing.T) {
+	ctr := AddCounter("test_reset_ctr", nil)
+	gauge := AddIntGauge("test_reset_gauge", nil)
+	hist := AddHistogram("test_reset_hist", false, nil)
+	win := AddWindowedHistogram("test_reset_win", 4, time.Minute, nil)
+	res := AddDecayingHistogram("test_reset_res", 16, 0.015, nil)
+
+	IncCounterBy(ctr, 5)
+	SetIntGauge(gauge, 3)
+	for _, id := range []uint32{hist, win, res} {
+		ObserveHist(id, 10)
+	}
+
+	Reset()
+
+	for _, c := range GetCounters() {
+		if c.Name == "test_reset_ctr" && c.Value != 0 {
+			t.Fatalf("Expected the counter to be reset, got %d", c.Value)
+		}
+	}
+	ints, _ := GetGauges()
+	for _, g := range ints {
+		if g.Name == "test_reset_gauge" && g.Value != 3 {
+			t.Fatalf("Expected the gauge to be left alone, got %d", g.Value)
+		}
+	}
+
+	for _, bh := range getAllBucketHistograms() {
+		if bh.name != "test_reset_hist" {
+			continue
+		}
+		if bh.sum != 0 {
+			t.Fatalf("Expected the bucketized sum to be reset, got %d", bh.sum)
+		}
+		for i, c := range bh.buckets {
+			if c != 0 {
+				t.Fatalf("Expected bucket %d to be reset, got %d", i, c)
+			}
+		}
+	}
+
+	hists, _, _ := peekAllHistograms()
+	for _, h := range hists {
+		switch h.name {
+		case "test_reset_hist", "test_reset_win", "test_reset_res":
+			if h.dat.count != 0 || h.dat.kept != 0 {
+				t.Fatalf("Expected %s to be reset, got count %d and %d kept", h.name, h.dat.count, h.dat.kept)
+			}
+		}
+	}
+
+	// Observations carry on from nothing
+	ObserveHist(win, 20)
+	hists, _, _ = peekAllHistograms()
+	for _, h := range hists {
+		if h.name == "test_reset_win" && (h.dat.count != 1 || h.dat.max != 20) {
+			t.Fatalf("Expected one observation of 20 after the reset, got count %d, max %d", h.dat.count, h.dat.max)
+		}
+	}
+}
+
+func TestResetRestartsOTLPSums(t *testing.T) {
+	before, _ := otlpTimes()
+	time.Sleep(time.Millisecond)
+	Reset()
+	after, _ := otlpTimes()
+
+	if len(after) < len(before) || after <= before {
+		t.Fatalf("Expected the start of the OTLP sums to move up to the reset, got %s then %s", before, after)
+	}
+}
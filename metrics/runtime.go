@@ -0,0 +1,104 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reading the memstats stops the world, so one read is shared by all of the
+// gauges that need it during a single extraction of metrics.
+const runtimeStatsMaxAge = time.Second
+
+var (
+	runtimeLock     sync.Mutex
+	runtimeMemstats runtime.MemStats
+	runtimeRead     time.Time
+	runtimeOnce     sync.Once
+)
+
+// Registers callback gauges for the health of the Go runtime and the process:
+// goroutine count, heap in use, GC count and total pause time, open file
+// descriptors, and user and system CPU time in nanoseconds. The gauges are
+// computed when metrics are extracted, so they are always current as of the
+// last read or flush. Calling this more than once has no further effect.
+//
+// Open file descriptors are only available where /proc/self/fd exists.
+func RegisterRuntimeMetrics() {
+	runtimeOnce.Do(registerRuntimeMetrics)
+}
+
+func registerRuntimeMetrics() {
+	RegisterIntGaugeCallback("runtime_goroutines", nil, func() uint64 {
+		return uint64(runtime.NumGoroutine())
+	})
+	RegisterIntGaugeCallback("runtime_heap_in_use", nil, func() uint64 {
+		return readMemstats().HeapInuse
+	})
+	RegisterIntGaugeCallback("runtime_gc_count", nil, func() uint64 {
+		return uint64(readMemstats().NumGC)
+	})
+	RegisterIntGaugeCallback("runtime_gc_pause_total", nil, func() uint64 {
+		return readMemstats().PauseTotalNs
+	})
+
+	if _, err := openFDs(); err == nil {
+		RegisterIntGaugeCallback("process_open_fds", nil, func() uint64 {
+			n, _ := openFDs()
+			return n
+		})
+	}
+
+	RegisterIntGaugeCallback("process_cpu_user", nil, func() uint64 {
+		user, _ := cpuTime()
+		return user
+	})
+	RegisterIntGaugeCallback("process_cpu_system", nil, func() uint64 {
+		_, sys := cpuTime()
+		return sys
+	})
+}
+
+func readMemstats() runtime.MemStats {
+	runtimeLock.Lock()
+	defer runtimeLock.Unlock()
+
+	if time.Since(runtimeRead) > runtimeStatsMaxAge {
+		runtime.ReadMemStats(&runtimeMemstats)
+		runtimeRead = time.Now()
+	}
+
+	return runtimeMemstats
+}
+
+func openFDs() (uint64, error) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(fds)), nil
+}
+
+func cpuTime() (user, sys uint64) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	return uint64(ru.Utime.Nano()), uint64(ru.Stime.Nano())
+}
@@ -0,0 +1,190 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Counter is the value of a counter at the time of a flush.
+type Counter struct {
+	Name  string
+	Tags  Tags
+	Value uint64
+}
+
+// IntGauge is the value of an integer gauge at the time of a flush.
+type IntGauge struct {
+	Name  string
+	Tags  Tags
+	Value uint64
+}
+
+// FloatGauge is the value of a float gauge at the time of a flush.
+type FloatGauge struct {
+	Name  string
+	Tags  Tags
+	Value float64
+}
+
+// Sink receives metrics from the flusher and sends them to some external
+// system. Names are passed through without the prefix set by SetPrefix; each
+// sink decides how to name things for the system it talks to.
+//
+// The flush methods are called one at a time from the flusher goroutine, so a
+// sink doesn't need to be safe for concurrent use unless it is shared with
+// something else. An error is logged and the flush continues with the next
+// sink.
+type Sink interface {
+	FlushCounters(ctrs []Counter) error
+	FlushGauges(ints []IntGauge, floats []FloatGauge) error
+	FlushHistograms(hists []HistSummary) error
+}
+
+// Returns how much a counter went up between two flushes. A counter that went
+// down was reset, so all of it was counted since the reset.
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+var (
+	sinkLock    sync.Mutex
+	sinks       []Sink
+	flusherStop chan struct{}
+)
+
+// Adds a sink that will receive metrics on every flush.
+func AddSink(s Sink) {
+	sinkLock.Lock()
+	sinks = append(sinks, s)
+	sinkLock.Unlock()
+}
+
+// Starts a background goroutine that flushes all metrics to the registered
+// sinks every interval. Histograms are summarized with the given percentiles.
+//
+// Flushing extracts the histograms, which resets them just like a read of the
+// /metrics endpoint does. If both are in use, each will only see the
+// observations since the last read by either one.
+func StartFlusher(interval time.Duration, pctls []float64) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+
+	if flusherStop != nil {
+		panic("Metrics flusher already started")
+	}
+
+	stop := make(chan struct{})
+	flusherStop = stop
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				Flush(pctls)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops the background flusher, if one is running.
+func StopFlusher() {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+
+	if flusherStop != nil {
+		close(flusherStop)
+		flusherStop = nil
+	}
+}
+
+// Flush extracts all metrics and sends them to the registered sinks right away.
+// This is what the background flusher does on every tick.
+func Flush(pctls []float64) {
+	sinkLock.Lock()
+	cur := sinks
+	sinkLock.Unlock()
+
+	if len(cur) == 0 {
+		return
+	}
+
+	ctrs := extractCounters()
+	ints, floats := extractGauges()
+	hists := ExtractHistSummaries(pctls)
+
+	for _, s := range cur {
+		if err := s.FlushCounters(ctrs); err != nil {
+			log.Println("Error flushing counters to metrics sink:", err)
+		}
+		if err := s.FlushGauges(ints, floats); err != nil {
+			log.Println("Error flushing gauges to metrics sink:", err)
+		}
+		if err := s.FlushHistograms(hists); err != nil {
+			log.Println("Error flushing histograms to metrics sink:", err)
+		}
+	}
+}
+
+// Returns the current value of every counter.
+func GetCounters() []Counter {
+	return extractCounters()
+}
+
+// Returns the current value of every gauge, including callback gauges.
+func GetGauges() ([]IntGauge, []FloatGauge) {
+	return extractGauges()
+}
+
+func extractCounters() []Counter {
+	ctrs := getAllCounters()
+	ret := make([]Counter, len(ctrs))
+
+	for i, c := range ctrs {
+		ret[i] = Counter{Name: c.name, Tags: c.tgs, Value: c.val}
+	}
+
+	return ret
+}
+
+// Includes both regular and callback gauges
+func extractGauges() ([]IntGauge, []FloatGauge) {
+	intg, floatg := getAllGauges()
+	cbintg, cbfloatg := getAllCallbackGauges()
+	intg = append(intg, cbintg...)
+	floatg = append(floatg, cbfloatg...)
+
+	ints := make([]IntGauge, len(intg))
+	for i, g := range intg {
+		ints[i] = IntGauge{Name: g.name, Tags: g.tgs, Value: g.val}
+	}
+
+	floats := make([]FloatGauge, len(floatg))
+	for i, g := range floatg {
+		floats[i] = FloatGauge{Name: g.name, Tags: g.tgs, Value: g.val}
+	}
+
+	return ints, floats
+}
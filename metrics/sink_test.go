@@ -0,0 +1,62 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+type chanSink struct {
+	ctrs chan []Counter
+}
+
+func (c chanSink) FlushCounters(ctrs []Counter) error {
+	// Don't block the flusher if the test already has what it needs
+	select {
+	case c.ctrs <- ctrs:
+	default:
+	}
+	return nil
+}
+func (c chanSink) FlushGauges(ints []IntGauge, floats []FloatGauge) error { return nil }
+func (c chanSink) FlushHistograms(hists []HistSummary) error              { return nil }
+
+func TestFlusher(t *testing.T) {
+	id := AddCounter("test_flusher", nil)
+	defer RemoveCounter(id)
+	IncCounterBy(id, 42)
+
+	s := chanSink{ctrs: make(chan []Counter, 1)}
+	AddSink(s)
+
+	StartFlusher(10*time.Millisecond, DefaultPercentiles)
+	defer StopFlusher()
+
+	select {
+	case ctrs := <-s.ctrs:
+		for _, c := range ctrs {
+			if c.Name == "test_flusher" {
+				if c.Value != 42 {
+					t.Fatalf("Expected 42, got %d", c.Value)
+				}
+				return
+			}
+		}
+		t.Fatalf("Counter test_flusher not flushed")
+	case <-time.After(time.Second):
+		t.Fatalf("Flusher did not flush within a second")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Keeps each packet under the common 1500 byte MTU after IP and UDP headers
+const statsdMaxPacket = 1432
+
+// StatsDSink sends metrics over UDP in the StatsD line format. Counters are
+// sent as the change since the last flush, gauges as their current value, and
+// histograms as a count plus min, max, avg, and percentile gauges.
+//
+// With DogStatsD enabled, tags are sent with the DataDog tag extension.
+// Otherwise they are folded into the metric name as .key.value pairs.
+type StatsDSink struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+
+	prevCtrs map[string]uint64
+	buf      bytes.Buffer
+	line     bytes.Buffer
+	err      error // first error sending a packet during the current flush
+}
+
+// Creates a StatsD sink that sends to the given host:port. The prefix is
+// prepended to every metric name as is, so it should normally end in a dot.
+func NewStatsDSink(addr, prefix string, dogstatsd bool) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsDSink{
+		conn:      conn,
+		prefix:    prefix,
+		dogstatsd: dogstatsd,
+		prevCtrs:  make(map[string]uint64),
+	}, nil
+}
+
+func (s *StatsDSink) FlushCounters(ctrs []Counter) error {
+	for _, c := range ctrs {
+		key := metricKey(c.Name, c.Tags)
+		prev, ok := s.prevCtrs[key]
+		s.prevCtrs[key] = c.Value
+
+		// The first flush only establishes the baseline, otherwise everything
+		// counted since startup would show up as a spike.
+		if !ok {
+			continue
+		}
+
+		delta := counterDelta(prev, c.Value)
+		s.add(c.Name, c.Tags, strconv.FormatUint(delta, 10), "c")
+	}
+
+	return s.finish()
+}
+
+func (s *StatsDSink) FlushGauges(ints []IntGauge, floats []FloatGauge) error {
+	for _, g := range ints {
+		s.add(g.Name, g.Tags, strconv.FormatUint(g.Value, 10), "g")
+	}
+	for _, g := range floats {
+		s.add(g.Name, g.Tags, strconv.FormatFloat(g.Value, 'f', -1, 64), "g")
+	}
+
+	return s.finish()
+}
+
+func (s *StatsDSink) FlushHistograms(hists []HistSummary) error {
+	for _, h := range hists {
+		s.add(h.Name+".count", h.Tags, strconv.FormatUint(h.Count, 10), "c")
+
+		if h.Count == 0 {
+			continue
+		}
+
+		s.add(h.Name+".min", h.Tags, strconv.FormatUint(h.Min, 10), "g")
+		s.add(h.Name+".max", h.Tags, strconv.FormatUint(h.Max, 10), "g")
+		s.add(h.Name+".avg", h.Tags, strconv.FormatFloat(h.Avg, 'f', -1, 64), "g")
+
+		for i, p := range h.Pctls {
+			s.add(h.Name+"."+percentileName(h.Percentiles[i]), h.Tags, strconv.FormatUint(p, 10), "g")
+		}
+	}
+
+	return s.finish()
+}
+
+// Names a percentile like p50 or p99_9. Dots separate levels of the hierarchy
+// in StatsD so they can't be used in the name.
+func percentileName(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", -1)
+}
+
+// Adds one line to the pending packet, sending the packet first if the line
+// would make it too big.
+func (s *StatsDSink) add(name string, tgs Tags, val, typ string) {
+	s.line.Reset()
+
+	if s.dogstatsd {
+		s.line.WriteString(s.prefix)
+		s.line.WriteString(name)
+	} else {
+		writeDottedName(&s.line, s.prefix, name, tgs)
+	}
+
+	fmt.Fprintf(&s.line, ":%s|%s", val, typ)
+
+	if s.dogstatsd && len(tgs) > 0 {
+		s.line.WriteString("|#")
+		for i, k := range tgs.keys() {
+			if i > 0 {
+				s.line.WriteByte(',')
+			}
+			fmt.Fprintf(&s.line, "%s:%s", k, tgs[k])
+		}
+	}
+
+	if s.buf.Len() > 0 && s.buf.Len()+1+s.line.Len() > statsdMaxPacket {
+		if err := s.send(); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.Write(s.line.Bytes())
+}
+
+// Writes the metric name with the tags folded in as .key.value pairs, for
+// systems that only understand a dotted hierarchy of names.
+func writeDottedName(buf *bytes.Buffer, prefix, name string, tgs Tags) {
+	buf.WriteString(prefix)
+	buf.WriteString(name)
+	for _, k := range tgs.keys() {
+		fmt.Fprintf(buf, ".%s.%s", k, tgs[k])
+	}
+}
+
+// Sends whatever is left at the end of a flush and returns the first error
+// seen during the flush.
+func (s *StatsDSink) finish() error {
+	err := s.send()
+	if s.err != nil {
+		err = s.err
+		s.err = nil
+	}
+	return err
+}
+
+func (s *StatsDSink) send() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+	return err
+}
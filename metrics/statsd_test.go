@@ -0,0 +1,95 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsDSink(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer l.Close()
+
+	s, err := NewStatsDSink(l.LocalAddr().String(), "rend.", true)
+	if err != nil {
+		t.Fatalf("Error creating sink: %s", err.Error())
+	}
+
+	tgs := Tags{"op": "get"}
+
+	// The first flush only sets the baseline for counters
+	s.FlushCounters([]Counter{{Name: "hits", Tags: tgs, Value: 10}})
+	s.FlushCounters([]Counter{{Name: "hits", Tags: tgs, Value: 15}})
+	s.FlushGauges([]IntGauge{{Name: "conns", Value: 3}}, nil)
+	s.FlushHistograms([]HistSummary{{
+		Name:        "lat",
+		Count:       2,
+		Min:         1,
+		Max:         9,
+		Avg:         5,
+		Percentiles: []float64{99.9},
+		Pctls:       []uint64{9},
+	}})
+
+	expected := []string{
+		"rend.hits:5|c|#op:get",
+		"rend.conns:3|g",
+		"rend.lat.count:2|c\nrend.lat.min:1|g\nrend.lat.max:9|g\nrend.lat.avg:5|g\nrend.lat.p99_9:9|g",
+	}
+
+	buf := make([]byte, statsdMaxPacket)
+	for _, e := range expected {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading packet: %s", err.Error())
+		}
+		if string(buf[:n]) != e {
+			t.Fatalf("Expected packet %q, got %q", e, string(buf[:n]))
+		}
+	}
+}
+
+func TestStatsDSinkCounterReset(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer l.Close()
+
+	s, err := NewStatsDSink(l.LocalAddr().String(), "rend.", false)
+	if err != nil {
+		t.Fatalf("Error creating sink: %s", err.Error())
+	}
+
+	// Everything counted since the reset is sent
+	s.FlushCounters([]Counter{{Name: "hits", Value: 10}})
+	s.FlushCounters([]Counter{{Name: "hits", Value: 3}})
+
+	buf := make([]byte, statsdMaxPacket)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	if string(buf[:n]) != "rend.hits:3|c" {
+		t.Fatalf("Expected the count since the reset, got %q", string(buf[:n]))
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Tags are a set of key / value pairs that are attached to a metric when it is
+// registered. They allow the same metric to be split by a dimension like the
+// backend or the command without mangling that information into the name. A
+// nil Tags is valid and means the metric has no tags.
+type Tags map[string]string
+
+// copyTags makes a private copy of the tags passed in at registration so the
+// caller modifying their map afterward doesn't change the metric.
+func copyTags(tgs Tags) Tags {
+	if len(tgs) == 0 {
+		return nil
+	}
+
+	ret := make(Tags, len(tgs))
+	for k, v := range tgs {
+		ret[k] = v
+	}
+	return ret
+}
+
+// metricKey is the identity of a metric in a registry. Two registrations with
+// the same name and tags refer to the same metric.
+func metricKey(name string, tgs Tags) string {
+	return name + tgs.String()
+}
+
+// String renders the tags in a stable order as {k1=v1,k2=v2}. Empty tags
+// render as an empty string so untagged metrics print exactly as before.
+func (t Tags) String() string {
+	if len(t) == 0 {
+		return ""
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, k := range t.keys() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(t[k])
+	}
+	buf.WriteByte('}')
+
+	return buf.String()
+}
+
+func (t Tags) keys() []string {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
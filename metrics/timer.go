@@ -0,0 +1,48 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import "time"
+
+// Timer measures the duration of an operation and records it in a histogram in
+// nanoseconds. The duration uses the monotonic clock, so it is not affected by
+// changes to the wall clock while the operation is running.
+//
+//	t := metrics.StartTimer(HistGet)
+//	...
+//	t.Stop()
+//
+// A Timer is a value type and does not allocate.
+type Timer struct {
+	id    uint32
+	start time.Time
+}
+
+// Starts a timer that will record into the histogram with the given ID.
+func StartTimer(id uint32) Timer {
+	return Timer{
+		id:    id,
+		start: time.Now(),
+	}
+}
+
+// Records the time since the timer was started and returns it. Calling Stop
+// more than once records one observation per call, each measured from the
+// original start.
+func (t Timer) Stop() time.Duration {
+	dur := time.Since(t.start)
+	ObserveHist(t.id, uint64(dur))
+	return dur
+}
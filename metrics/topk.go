@@ -0,0 +1,290 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxNumTopKs = 64
+	sketchDepth = 4
+	sketchWidth = 4096 // must be a power of two
+)
+
+// A top-K tracker estimates the most frequently observed keys in fixed windows
+// of time. Counts are kept in a count-min sketch of 4 x 4096 counters, so the
+// memory used does not depend on the number of distinct keys, and the K keys
+// with the highest estimates are kept in a min-heap. Estimates can only be too
+// high, never too low, and are close for the hot keys this is meant to find.
+//
+// Observing a key only takes the heap lock when its estimate is higher than
+// the smallest count in the heap, which is rare once the heap is full.
+type topk struct {
+	name   string
+	tgs    Tags
+	k      int
+	window time.Duration
+
+	// Read-locked by observers, write-locked to roll over to the next window
+	lock   sync.RWMutex
+	sketch []uint64
+	min    uint64 // smallest count in a full heap, accessed atomically
+	start  time.Time
+	last   TopKeys
+
+	heapLock sync.Mutex
+	heap     keyHeap
+}
+
+// KeyCount is a key and its estimated number of observations in a window.
+type KeyCount struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// TopKeys holds the hottest keys of a top-K tracker for one window, hottest
+// first.
+type TopKeys struct {
+	Name  string     `json:"name"`
+	Tags  Tags       `json:"tags,omitempty"`
+	Start time.Time  `json:"window_start"`
+	End   time.Time  `json:"window_end"`
+	Keys  []KeyCount `json:"keys"`
+}
+
+var (
+	topkLock sync.Mutex
+	topkIDs  = make(map[string]uint32)
+	topkReg  atomic.Value // []*topk, copied on write
+)
+
+func init() {
+	topkReg.Store([]*topk(nil))
+	http.Handle("/metrics/hotkeys", http.HandlerFunc(printTopKeys))
+}
+
+// Registers a top-K tracker that reports the k most frequently observed keys
+// in each window of the given length. The keys of the last complete window
+// are returned by GetTopKeys. There is a maximum of 64 trackers, after which
+// adding a new one will panic.
+//
+// Registration is idempotent: adding a tracker with the same name and tags as
+// an existing one returns the existing ID.
+//
+// Tags are optional and may be nil.
+func AddTopK(name string, k int, window time.Duration, tgs Tags) uint32 {
+	if k < 1 {
+		panic("Top-K size must be at least 1")
+	}
+	if window <= 0 {
+		panic("Top-K window must be positive")
+	}
+
+	key := metricKey(name, tgs)
+
+	topkLock.Lock()
+	defer topkLock.Unlock()
+
+	if id, ok := topkIDs[key]; ok {
+		return id
+	}
+
+	old := topkReg.Load().([]*topk)
+	if len(old) >= maxNumTopKs {
+		panic("Too many top-K trackers")
+	}
+
+	now := time.Now()
+	t := &topk{
+		name:   name,
+		tgs:    copyTags(tgs),
+		k:      k,
+		window: window,
+		sketch: make([]uint64, sketchDepth*sketchWidth),
+		start:  now,
+		last: TopKeys{
+			Name:  name,
+			Tags:  copyTags(tgs),
+			Start: now,
+			End:   now,
+			Keys:  []KeyCount{},
+		},
+		heap: keyHeap{idx: make(map[string]int)},
+	}
+
+	id := uint32(len(old))
+	reg := make([]*topk, len(old)+1)
+	copy(reg, old)
+	reg[id] = t
+	topkReg.Store(reg)
+	topkIDs[key] = id
+
+	go t.roll()
+
+	return id
+}
+
+// Records one observation of the key in the given top-K tracker. The key is
+// copied if it is kept, so the caller may reuse it.
+func ObserveTopK(id uint32, key []byte) {
+	topkReg.Load().([]*topk)[id].observe(key)
+}
+
+// Returns the hottest keys of every top-K tracker for its last complete window.
+func GetTopKeys() []TopKeys {
+	reg := topkReg.Load().([]*topk)
+	ret := make([]TopKeys, len(reg))
+
+	for i, t := range reg {
+		t.lock.RLock()
+		ret[i] = t.last
+		t.lock.RUnlock()
+	}
+
+	return ret
+}
+
+func printTopKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetTopKeys())
+}
+
+func (t *topk) observe(key []byte) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	h1, h2 := hashKey(key)
+
+	est := ^uint64(0)
+	for i := uint64(0); i < sketchDepth; i++ {
+		pos := i*sketchWidth + (h1+i*h2)&(sketchWidth-1)
+		if c := atomic.AddUint64(&t.sketch[pos], 1); c < est {
+			est = c
+		}
+	}
+
+	if est <= atomic.LoadUint64(&t.min) {
+		return
+	}
+
+	t.heapLock.Lock()
+	t.heap.offer(key, est, t.k)
+	if len(t.heap.keys) == t.k {
+		atomic.StoreUint64(&t.min, t.heap.keys[0].Count)
+	}
+	t.heapLock.Unlock()
+}
+
+func (t *topk) roll() {
+	for range time.Tick(t.window) {
+		t.rollover()
+	}
+}
+
+// Saves the current window's keys as the last window and starts a new one.
+func (t *topk) rollover() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+
+	keys := make([]KeyCount, len(t.heap.keys))
+	copy(keys, t.heap.keys)
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Count > keys[j].Count
+	})
+
+	t.last = TopKeys{
+		Name:  t.name,
+		Tags:  t.tgs,
+		Start: t.start,
+		End:   now,
+		Keys:  keys,
+	}
+
+	for i := range t.sketch {
+		t.sketch[i] = 0
+	}
+	t.heap = keyHeap{idx: make(map[string]int)}
+	t.min = 0
+	t.start = now
+}
+
+// FNV-1a, split into two hashes for the rows of the sketch using double hashing.
+// The second hash is odd so it cycles through every column.
+func hashKey(key []byte) (uint64, uint64) {
+	h := uint64(14695981039346656037)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+
+	h2 := (h>>33 ^ h) * 0xff51afd7ed558ccd
+	return h, h2 | 1
+}
+
+// A min-heap of keys by count, with an index to find keys already in the heap.
+type keyHeap struct {
+	keys []KeyCount
+	idx  map[string]int
+}
+
+func (h *keyHeap) Len() int           { return len(h.keys) }
+func (h *keyHeap) Less(i, j int) bool { return h.keys[i].Count < h.keys[j].Count }
+func (h *keyHeap) Swap(i, j int) {
+	h.keys[i], h.keys[j] = h.keys[j], h.keys[i]
+	h.idx[h.keys[i].Key] = i
+	h.idx[h.keys[j].Key] = j
+}
+func (h *keyHeap) Push(x interface{}) {
+	kc := x.(KeyCount)
+	h.idx[kc.Key] = len(h.keys)
+	h.keys = append(h.keys, kc)
+}
+func (h *keyHeap) Pop() interface{} {
+	kc := h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	delete(h.idx, kc.Key)
+	return kc
+}
+
+// Updates the key's count if it is in the heap, otherwise adds it if there is
+// room or its count is higher than the smallest count in the heap.
+func (h *keyHeap) offer(key []byte, count uint64, k int) {
+	if i, ok := h.idx[string(key)]; ok {
+		h.keys[i].Count = count
+		heap.Fix(h, i)
+		return
+	}
+
+	if len(h.keys) < k {
+		heap.Push(h, KeyCount{Key: string(key), Count: count})
+		return
+	}
+
+	if count > h.keys[0].Count {
+		delete(h.idx, h.keys[0].Key)
+		h.keys[0] = KeyCount{Key: string(key), Count: count}
+		h.idx[h.keys[0].Key] = 0
+		heap.Fix(h, 0)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTopK(t *testing.T) {
+	id := AddTopK("test_topk", 3, time.Hour, nil)
+	tk := topkReg.Load().([]*topk)[id]
+
+	// Keys "hot0" through "hot2" are observed far more than the long tail
+	for i := 0; i < 10000; i++ {
+		ObserveTopK(id, []byte("cold"+strconv.Itoa(i)))
+		if i%10 == 0 {
+			ObserveTopK(id, []byte("hot"+strconv.Itoa(i%3)))
+			ObserveTopK(id, []byte("hot0"))
+		}
+	}
+
+	tk.rollover()
+
+	var keys []KeyCount
+	for _, k := range GetTopKeys() {
+		if k.Name == "test_topk" {
+			keys = k.Keys
+		}
+	}
+
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 keys, got %v", keys)
+	}
+	if keys[0].Key != "hot0" || keys[0].Count < 1334 {
+		t.Fatalf("Expected hot0 first with at least 1334 observations, got %v", keys)
+	}
+	for _, k := range keys[1:] {
+		if k.Key != "hot1" && k.Key != "hot2" {
+			t.Fatalf("Expected hot1 and hot2 after hot0, got %v", keys)
+		}
+	}
+
+	// The next window starts empty
+	tk.rollover()
+	for _, k := range GetTopKeys() {
+		if k.Name == "test_topk" && len(k.Keys) != 0 {
+			t.Fatalf("Expected no keys in an empty window, got %v", k.Keys)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Samples kept per sub window. Older samples in the same sub window are
+// overwritten once it is full.
+const windowBuflen = 4096
+
+// Registers a histogram like AddHistogram whose reported count, total, min,
+// max, and percentiles cover the trailing windows*width of time instead of the
+// time since the last extraction. For example, 12 windows of 5 seconds always
+// report on the last minute, no matter how often or irregularly the metrics
+// are read. The bucketized histogram is not affected. Each sub window keeps at
+// most 4096 samples for percentiles.
+//
+// As with other settings, the window of the first registration wins.
+func AddWindowedHistogram(name string, windows int, width time.Duration, tgs Tags) uint32 {
+	if windows < 1 || width <= 0 {
+		panic("Histogram windows must have at least 1 sub window and a positive width")
+	}
+	return addHistogram(name, tgs, histOpts{rate: 1, windows: windows, width: width})
+}
+
+// A sliding window is a ring of sub windows, each covering one width of time.
+// Observations go into the sub window for the current time, reusing the
+// oldest sub window when time moves on. Reading the window merges every sub
+// window that is still within the trailing windows*width of time.
+//
+// Unlike the rest of the histogram, which is lock free for observers, the
+// window takes a mutex on every observation, so it is best kept off of the
+// very hottest paths.
+type window struct {
+	lock  sync.Mutex
+	width int64 // nanoseconds
+	subs  []*subWindow
+}
+
+type subWindow struct {
+	epoch int64 // the unix time in widths that this sub window covers
+	dat   *hdat
+}
+
+func newWindow(n int, width time.Duration) *window {
+	subs := make([]*subWindow, n)
+	for i := range subs {
+		subs[i] = &subWindow{
+			epoch: -1,
+			dat:   &hdat{min: math.MaxUint64, buf: make([]uint64, windowBuflen)},
+		}
+	}
+
+	return &window{
+		width: int64(width),
+		subs:  subs,
+	}
+}
+
+func (w *window) observe(value uint64) {
+	epoch := time.Now().UnixNano() / w.width
+
+	w.lock.Lock()
+
+	s := w.subs[epoch%int64(len(w.subs))]
+	if s.epoch != epoch {
+		s.epoch = epoch
+		s.dat.count = 0
+		s.dat.kept = 0
+		s.dat.total = 0
+		s.dat.min = math.MaxUint64
+		s.dat.max = 0
+	}
+
+	d := s.dat
+	d.count++
+	d.total += value
+	if value < d.min {
+		d.min = value
+	}
+	if value > d.max {
+		d.max = value
+	}
+	d.buf[d.kept%windowBuflen] = value
+	d.kept++
+
+	w.lock.Unlock()
+}
+
+// Empties every sub window. Each one is cleared by the next observation in it.
+func (w *window) reset() {
+	w.lock.Lock()
+	for _, s := range w.subs {
+		s.epoch = -1
+	}
+	w.lock.Unlock()
+}
+
+// Merges the sub windows within the trailing window into a new hdat
+func (w *window) snapshot() *hdat {
+	epoch := time.Now().UnixNano() / w.width
+	oldest := epoch - int64(len(w.subs)) + 1
+
+	ret := &hdat{min: math.MaxUint64}
+
+	w.lock.Lock()
+
+	for _, s := range w.subs {
+		if s.epoch < oldest || s.epoch > epoch {
+			continue
+		}
+
+		d := s.dat
+		ret.count += d.count
+		ret.total += d.total
+		if d.min < ret.min {
+			ret.min = d.min
+		}
+		if d.max > ret.max {
+			ret.max = d.max
+		}
+
+		kept := d.kept
+		if kept > windowBuflen {
+			kept = windowBuflen
+		}
+		ret.buf = append(ret.buf, d.buf[:kept]...)
+	}
+
+	w.lock.Unlock()
+
+	ret.kept = uint64(len(ret.buf))
+
+	return ret
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package misses publishes a record of every cache miss to a pluggable sink so
+// capacity planners can analyze miss patterns offline. Publishing is off until
+// Start is called.
+//
+// Only the hash of each key is published, never the key itself.
+package misses
+
+import (
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/orcas"
+)
+
+const (
+	queueSize     = 10000
+	batchSize     = 500
+	flushInterval = time.Second
+)
+
+var (
+	MetricMissesPublished     = metrics.AddCounter("misses_published", nil)
+	MetricMissesDropped       = metrics.AddCounter("misses_dropped", nil)
+	MetricMissesPublishErrors = metrics.AddCounter("misses_publish_errors", nil)
+)
+
+// Miss is the record published for one miss.
+type Miss struct {
+	// The 64 bit FNV-1a hash of the key
+	KeyHash uint64
+	// The length of the key in bytes. The size of the value isn't known on a
+	// miss.
+	Size int
+	Time time.Time
+}
+
+// Sink is the destination for miss records, e.g. a file, a UDP listener, or a
+// Kafka producer. Publish is called with batches of misses from a single
+// goroutine, and the batch is reused after it returns.
+type Sink interface {
+	Publish(batch []Miss) error
+}
+
+// Misses waiting to be published. Misses are dropped when it's full so a slow
+// sink never slows down requests.
+var queue = make(chan Miss, queueSize)
+
+// Starts publishing misses to the given sink in batches at least once a second.
+// Must be called before any requests are served.
+func Start(sink Sink) {
+	go publish(sink)
+}
+
+// Recording wraps an orca constructor so the misses of the get, gete, and gat
+// commands sent to the client are published.
+func Recording(oc orcas.OrcaConst) orcas.OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) orcas.Orca {
+		return oc(l1, l2, recordingResponder{res})
+	}
+}
+
+type recordingResponder struct {
+	common.Responder
+}
+
+func (r recordingResponder) Get(response common.GetResponse) error {
+	if response.Miss {
+		record(response.Key)
+	}
+	return r.Responder.Get(response)
+}
+
+func (r recordingResponder) GetE(response common.GetEResponse) error {
+	if response.Miss {
+		record(response.Key)
+	}
+	return r.Responder.GetE(response)
+}
+
+func (r recordingResponder) GAT(response common.GetResponse) error {
+	if response.Miss {
+		record(response.Key)
+	}
+	return r.Responder.GAT(response)
+}
+
+func record(key []byte) {
+	h := fnv.New64a()
+	h.Write(key)
+
+	m := Miss{
+		KeyHash: h.Sum64(),
+		Size:    len(key),
+		Time:    time.Now(),
+	}
+
+	select {
+	case queue <- m:
+	default:
+		metrics.IncCounter(MetricMissesDropped)
+	}
+}
+
+func publish(sink Sink) {
+	ticker := time.NewTicker(flushInterval)
+	batch := make([]Miss, 0, batchSize)
+
+	for {
+		select {
+		case m := <-queue:
+			batch = append(batch, m)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := sink.Publish(batch); err != nil {
+			log.Println("Error publishing misses:", err.Error())
+			metrics.IncCounter(MetricMissesPublishErrors)
+		} else {
+			metrics.IncCounterBy(MetricMissesPublished, uint64(len(batch)))
+		}
+
+		batch = batch[:0]
+	}
+}
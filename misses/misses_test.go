@@ -0,0 +1,105 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misses
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+type nopResponder struct {
+	common.Responder
+}
+
+func (nopResponder) Get(common.GetResponse) error   { return nil }
+func (nopResponder) GetE(common.GetEResponse) error { return nil }
+func (nopResponder) GAT(common.GetResponse) error   { return nil }
+
+func TestRecordingResponder(t *testing.T) {
+	r := recordingResponder{nopResponder{}}
+
+	r.Get(common.GetResponse{Key: []byte("hit"), Data: []byte("value")})
+	r.Get(common.GetResponse{Key: []byte("miss1"), Miss: true})
+	r.GetE(common.GetEResponse{Key: []byte("miss22"), Miss: true})
+	r.GAT(common.GetResponse{Key: []byte("miss333"), Miss: true})
+
+	if len(queue) != 3 {
+		t.Fatalf("Expected 3 misses to be queued, got %d", len(queue))
+	}
+
+	for _, size := range []int{5, 6, 7} {
+		m := <-queue
+		if m.Size != size {
+			t.Errorf("Expected size %d, got %d", size, m.Size)
+		}
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	m := Miss{
+		KeyHash: 0xcbf29ce484222325,
+		Size:    3,
+		Time:    time.Unix(1, 5),
+	}
+
+	line := string(appendLine(nil, m))
+	if line != "cbf29ce484222325 3 1000000005\n" {
+		t.Errorf("Unexpected line %q", line)
+	}
+}
+
+func TestUDPSinkPacking(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err.Error())
+	}
+	defer l.Close()
+
+	s, err := NewUDPSink(l.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error creating sink: %s", err.Error())
+	}
+
+	if err := s.Publish(make([]Miss, 100)); err != nil {
+		t.Fatalf("Error publishing: %s", err.Error())
+	}
+
+	// Each zero miss is "0 0 <time>" and doesn't fit in one packet 100 times
+	packets, lines := 0, 0
+	buf := make([]byte, 2*udpMaxPacket)
+	for lines < 100 {
+		l.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading packet: %s", err.Error())
+		}
+		if n > udpMaxPacket {
+			t.Fatalf("Packet of %d bytes is over the limit", n)
+		}
+		packets++
+		lines += bytes.Count(buf[:n], []byte("\n"))
+	}
+
+	if lines != 100 {
+		t.Errorf("Expected 100 lines, got %d", lines)
+	}
+	if packets < 2 {
+		t.Errorf("Expected the batch to be split into packets, got %d", packets)
+	}
+}
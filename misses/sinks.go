@@ -0,0 +1,106 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package misses
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Keeps each packet under the common 1500 byte MTU after IP and UDP headers
+const udpMaxPacket = 1432
+
+// Both built in sinks write one line per miss with the key hash in hex, the
+// size, and the time in nanoseconds since the Unix epoch, e.g.:
+//
+//	9f3a0c5e1b2d4f60 12 1476571234567890123
+func appendLine(buf []byte, m Miss) []byte {
+	buf = strconv.AppendUint(buf, m.KeyHash, 16)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, int64(m.Size), 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, m.Time.UnixNano(), 10)
+	return append(buf, '\n')
+}
+
+// FileSink appends misses to a file.
+type FileSink struct {
+	w    *bufio.Writer
+	line []byte
+}
+
+// Creates a sink that appends to the file at the given path, creating it if
+// needed.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{w: bufio.NewWriter(f)}, nil
+}
+
+func (s *FileSink) Publish(batch []Miss) error {
+	for _, m := range batch {
+		s.line = appendLine(s.line[:0], m)
+		s.w.Write(s.line)
+	}
+	return s.w.Flush()
+}
+
+// UDPSink sends misses over UDP, packing as many lines into each packet as fit.
+type UDPSink struct {
+	conn net.Conn
+	buf  bytes.Buffer
+	line []byte
+}
+
+// Creates a sink that sends to the given host:port.
+func NewUDPSink(addr string) (*UDPSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UDPSink{conn: conn}, nil
+}
+
+func (s *UDPSink) Publish(batch []Miss) error {
+	// Keep going after an error so one bad packet doesn't lose the whole
+	// batch, but report the first one.
+	var err error
+	send := func() {
+		if _, e := s.conn.Write(s.buf.Bytes()); e != nil && err == nil {
+			err = e
+		}
+		s.buf.Reset()
+	}
+
+	for _, m := range batch {
+		s.line = appendLine(s.line[:0], m)
+		if s.buf.Len()+len(s.line) > udpMaxPacket {
+			send()
+		}
+		s.buf.Write(s.line)
+	}
+	if s.buf.Len() > 0 {
+		send()
+	}
+
+	return err
+}
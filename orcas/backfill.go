@@ -0,0 +1,152 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"log"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricBackfillQueued  = metrics.AddCounter("l1_backfill_queued", nil)
+	MetricBackfillDropped = metrics.AddCounter("l1_backfill_dropped", nil)
+	MetricBackfillWritten = metrics.AddCounter("l1_backfill_written", nil)
+	MetricBackfillBytes   = metrics.AddCounter("l1_backfill_bytes", nil)
+	MetricBackfillSkipped = metrics.AddCounter("l1_backfill_skipped", nil)
+	MetricBackfillErrors  = metrics.AddCounter("l1_backfill_errors", nil)
+)
+
+func init() {
+	metrics.Describe("l1_backfill_queued", metrics.UnitCount, "Values found in L2 on an L1 miss that were queued to be written to L1")
+	metrics.Describe("l1_backfill_dropped", metrics.UnitCount, "Values found in L2 on an L1 miss that weren't written to L1 because the queue was full")
+	metrics.Describe("l1_backfill_written", metrics.UnitCount, "Values written to L1 from the backfill queue")
+	metrics.Describe("l1_backfill_bytes", metrics.UnitBytes, "Bytes of values written to L1 from the backfill queue")
+	metrics.Describe("l1_backfill_skipped", metrics.UnitCount, "Values from the backfill queue that weren't written because the key was already in L1")
+	metrics.Describe("l1_backfill_errors", metrics.UnitCount, "Values from the backfill queue that failed to be written to L1")
+}
+
+// How long the backfiller waits to reconnect after failing to reach L1
+var backfillReconnectInterval = time.Second
+
+// Backfiller writes values that missed L1 and were found in L2 back into L1 in
+// the background, so the get that found them doesn't wait on the write. It has
+// its own L1 connection, and writes at most a set number of values a second.
+// Values that come in faster than that wait in a queue, and are dropped if the
+// queue is full, since the next get for the key will just try again.
+//
+// Values are written with an add, like the GAT backfill, so a key that was set
+// by a client after the value was read from L2 is never overwritten with the
+// older value. This also keeps the write from racing a client's set of the same
+// key, which would otherwise need the orca's locks.
+type Backfiller struct {
+	hc    handlers.HandlerConst
+	queue chan common.SetRequest
+	rate  int
+}
+
+// NewBackfiller starts a backfiller that writes to L1 over a connection made by
+// the given constructor, at most rate values a second, with room for queueLen
+// values waiting to be written.
+func NewBackfiller(hc handlers.HandlerConst, rate, queueLen int) *Backfiller {
+	b := &Backfiller{
+		hc:    hc,
+		queue: make(chan common.SetRequest, queueLen),
+		rate:  rate,
+	}
+	go b.run()
+	return b
+}
+
+var backfiller *Backfiller
+
+// SetBackfiller sets the backfiller the L1/L2 orca hands values found in L2 to.
+// If it isn't set, the orca writes them to L1 itself before the get is done. It
+// must be called before any connections are accepted.
+func SetBackfiller(b *Backfiller) {
+	backfiller = b
+}
+
+// Queues the value to be written to L1. The key and value are copied, since the
+// buffers they're in may be reused once the get is done.
+func (b *Backfiller) add(req common.SetRequest) {
+	req.Key = append([]byte(nil), req.Key...)
+	req.Data = append([]byte(nil), req.Data...)
+	// It may be written long after the request ends
+	req.Span = nil
+	req.Deadline = time.Time{}
+
+	select {
+	case b.queue <- req:
+		metrics.IncCounter(MetricBackfillQueued)
+	default:
+		metrics.IncCounter(MetricBackfillDropped)
+	}
+}
+
+func (b *Backfiller) run() {
+	tick := time.NewTicker(time.Second / time.Duration(b.rate))
+	defer tick.Stop()
+
+	var l1 handlers.Handler
+	var lastTried time.Time
+
+	for req := range b.queue {
+		<-tick.C
+
+		if l1 == nil {
+			if time.Since(lastTried) < backfillReconnectInterval {
+				metrics.IncCounter(MetricBackfillErrors)
+				continue
+			}
+			lastTried = time.Now()
+
+			var err error
+			if l1, err = b.hc(); err != nil {
+				log.Println("Error opening backfill connection to L1:", err.Error())
+				if l1 != nil {
+					l1.Close()
+				}
+				l1 = nil
+				metrics.IncCounter(MetricBackfillErrors)
+				continue
+			}
+		}
+
+		if err := l1.Add(req); err != nil {
+			// The key was written some other way in the meantime
+			if err == common.ErrKeyExists || err == common.ErrItemNotStored {
+				metrics.IncCounter(MetricBackfillSkipped)
+				continue
+			}
+
+			metrics.IncCounter(MetricBackfillErrors)
+			// Anything but an error from memcached means the connection can't
+			// be trusted anymore
+			if !common.IsAppError(err) {
+				log.Println("Error backfilling L1, reconnecting:", err.Error())
+				l1.Close()
+				l1 = nil
+			}
+			continue
+		}
+
+		metrics.IncCounter(MetricBackfillWritten)
+		metrics.IncCounterBy(MetricBackfillBytes, uint64(len(req.Data)))
+	}
+}
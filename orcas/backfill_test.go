@@ -0,0 +1,215 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/metrics"
+)
+
+func counterValue(name string) uint64 {
+	for _, c := range metrics.GetCounters() {
+		if c.Name == name && len(c.Tags) == 0 {
+			return c.Value
+		}
+	}
+	return 0
+}
+
+// Waits for the counter to go up by n from start
+func waitForCounter(t *testing.T, name string, start, n uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for counterValue(name)-start < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s to reach %d, got %d", name, n, counterValue(name)-start)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func fakememConst(fm *fakemem.Server) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		client, server := net.Pipe()
+		go fm.ServeConn(server)
+		return std.NewHandler(client), nil
+	}
+}
+
+func getValue(t *testing.T, fm *fakemem.Server, key string) (string, bool) {
+	h, _ := fakememConst(fm)()
+	defer h.Close()
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	res := <-resChan
+	if err, ok := <-errChan; ok {
+		t.Fatalf("Error getting %q: %s", key, err.Error())
+	}
+	return string(res.Data), !res.Miss
+}
+
+func backfillReq(key, value string) common.SetRequest {
+	return common.SetRequest{Key: []byte(key), Data: []byte(value)}
+}
+
+func TestBackfillDoesNotOverwrite(t *testing.T) {
+	fm := fakemem.New(false)
+	hc := fakememConst(fm)
+
+	// A client set the key after the value was read from L2
+	h, _ := hc()
+	if err := h.Set(backfillReq("set", "new")); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	h.Close()
+
+	written, skipped := counterValue("l1_backfill_written"), counterValue("l1_backfill_skipped")
+
+	b := NewBackfiller(hc, 1000, 10)
+	b.add(backfillReq("set", "old"))
+	b.add(backfillReq("missing", "value"))
+
+	waitForCounter(t, "l1_backfill_skipped", skipped, 1)
+	waitForCounter(t, "l1_backfill_written", written, 1)
+
+	if v, _ := getValue(t, fm, "set"); v != "new" {
+		t.Fatalf("Expected the client's value to be kept, got %q", v)
+	}
+	if v, ok := getValue(t, fm, "missing"); !ok || v != "value" {
+		t.Fatalf("Expected the missing key to be backfilled, got %q, %v", v, ok)
+	}
+}
+
+func TestBackfillDropsWhenFull(t *testing.T) {
+	queued, dropped := counterValue("l1_backfill_queued"), counterValue("l1_backfill_dropped")
+
+	// Nothing takes from the queue
+	b := &Backfiller{queue: make(chan common.SetRequest, 1)}
+	b.add(backfillReq("a", "1"))
+	b.add(backfillReq("b", "2"))
+
+	if n := counterValue("l1_backfill_queued") - queued; n != 1 {
+		t.Fatalf("Expected 1 value queued, got %d", n)
+	}
+	if n := counterValue("l1_backfill_dropped") - dropped; n != 1 {
+		t.Fatalf("Expected 1 value dropped, got %d", n)
+	}
+
+	// The queued value is a copy of the request's buffers
+	key := []byte("c")
+	<-b.queue
+	b.add(common.SetRequest{Key: key, Data: []byte("3")})
+	key[0] = 'x'
+	if req := <-b.queue; string(req.Key) != "c" {
+		t.Fatalf("Expected the key to be copied, got %q", req.Key)
+	}
+}
+
+func TestBackfillRate(t *testing.T) {
+	written := counterValue("l1_backfill_written")
+
+	b := NewBackfiller(fakememConst(fakemem.New(false)), 20, 10)
+	start := time.Now()
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		b.add(backfillReq(k, "v"))
+	}
+	waitForCounter(t, "l1_backfill_written", written, 5)
+
+	// One write every 50ms
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("Expected 5 writes at 20 a second to take at least 200ms, took %s", d)
+	}
+}
+
+type brokenHandler struct {
+	handlers.Handler
+}
+
+func (brokenHandler) Add(common.SetRequest) error { return io.ErrUnexpectedEOF }
+func (brokenHandler) Close() error                { return nil }
+
+func TestBackfillReconnects(t *testing.T) {
+	defer func(d time.Duration) { backfillReconnectInterval = d }(backfillReconnectInterval)
+	backfillReconnectInterval = 0
+
+	fm := fakemem.New(false)
+	calls := make(chan int, 10)
+	n := 0
+	hc := func() (handlers.Handler, error) {
+		n++
+		calls <- n
+		switch n {
+		case 1:
+			return nil, errors.New("can't connect")
+		case 2:
+			return brokenHandler{}, nil
+		}
+		return fakememConst(fm)()
+	}
+
+	written, errs := counterValue("l1_backfill_written"), counterValue("l1_backfill_errors")
+
+	b := NewBackfiller(hc, 1000, 10)
+	// Fails to connect, then fails on a connection that has to be replaced,
+	// then is written on a new connection
+	b.add(backfillReq("a", "1"))
+	b.add(backfillReq("b", "2"))
+	b.add(backfillReq("c", "3"))
+
+	waitForCounter(t, "l1_backfill_written", written, 1)
+	if n := counterValue("l1_backfill_errors") - errs; n != 2 {
+		t.Fatalf("Expected 2 errors, got %d", n)
+	}
+	if len(calls) != 3 {
+		t.Fatalf("Expected 3 connections, got %d", len(calls))
+	}
+	if v, ok := getValue(t, fm, "c"); !ok || v != "3" {
+		t.Fatalf("Expected c to be backfilled after reconnecting, got %q, %v", v, ok)
+	}
+}
+
+func TestBackfillWaitsToReconnect(t *testing.T) {
+	defer func(d time.Duration) { backfillReconnectInterval = d }(backfillReconnectInterval)
+	backfillReconnectInterval = time.Hour
+
+	calls := make(chan struct{}, 10)
+	hc := func() (handlers.Handler, error) {
+		calls <- struct{}{}
+		return nil, errors.New("can't connect")
+	}
+
+	errs := counterValue("l1_backfill_errors")
+
+	b := NewBackfiller(hc, 1000, 10)
+	b.add(backfillReq("a", "1"))
+	b.add(backfillReq("b", "2"))
+
+	// The second value is given up on without trying to connect again
+	waitForCounter(t, "l1_backfill_errors", errs, 2)
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 connection attempt, got %d", len(calls))
+	}
+}
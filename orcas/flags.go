@@ -0,0 +1,94 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricCmdReservedFlags = metrics.AddCounter("cmd_reserved_flags", nil)
+
+type ReservedFlagsOrca struct {
+	Orca
+}
+
+// ReservedFlagsChecked wraps an orca to refuse stores of values whose flags
+// have a bit the proxy reserves, set with common.SetFlagBits, with an invalid
+// arguments error. They're counted by cmd_reserved_flags. Appends and prepends
+// aren't checked, since memcached ignores their flags and keeps the value's.
+func ReservedFlagsChecked(oc OrcaConst) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return &ReservedFlagsOrca{Orca: oc(l1, l2, res)}
+	}
+}
+
+func checkFlags(req common.SetRequest) error {
+	if common.ReservedFlags(req.Flags) {
+		metrics.IncCounter(MetricCmdReservedFlags)
+		return common.ErrInvalidArgs
+	}
+	return nil
+}
+
+func (r *ReservedFlagsOrca) Set(req common.SetRequest) error {
+	if err := checkFlags(req); err != nil {
+		return err
+	}
+	return r.Orca.Set(req)
+}
+
+func (r *ReservedFlagsOrca) Add(req common.SetRequest) error {
+	if err := checkFlags(req); err != nil {
+		return err
+	}
+	return r.Orca.Add(req)
+}
+
+func (r *ReservedFlagsOrca) Replace(req common.SetRequest) error {
+	if err := checkFlags(req); err != nil {
+		return err
+	}
+	return r.Orca.Replace(req)
+}
+
+// flagStats returns the bits of the flags the proxy reserves, numbered from 0,
+// and the mask of all of them, e.g.:
+//
+//	flags_compressed 31
+//	flags_encrypted 30
+//	flags_version 26-29
+//	flags_reserved_mask 0xfc000000
+//
+// Only the mask, 0x00000000, is shown if nothing is reserved.
+func flagStats() []common.Stat {
+	b := common.GetFlagBits()
+	mask := common.Stat{Name: "flags_reserved_mask", Value: fmt.Sprintf("0x%08x", b.Mask())}
+	if !b.Enabled {
+		return []common.Stat{mask}
+	}
+
+	version := strconv.Itoa(int(b.Version)) + "-" + strconv.Itoa(int(b.Version)+common.FlagVersionBits-1)
+	return []common.Stat{
+		{Name: "flags_compressed", Value: strconv.Itoa(int(b.Compressed))},
+		{Name: "flags_encrypted", Value: strconv.Itoa(int(b.Encrypted))},
+		{Name: "flags_version", Value: version},
+		mask,
+	}
+}
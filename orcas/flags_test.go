@@ -0,0 +1,57 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+type storeCounter struct {
+	Orca
+	stores int
+}
+
+func (s *storeCounter) Set(req common.SetRequest) error    { s.stores++; return nil }
+func (s *storeCounter) Append(req common.SetRequest) error { s.stores++; return nil }
+
+func TestReservedFlagsChecked(t *testing.T) {
+	sc := &storeCounter{}
+	oc := ReservedFlagsChecked(func(l1, l2 handlers.Handler, res common.Responder) Orca { return sc })
+	o := oc(nil, nil, nil)
+
+	high := common.SetRequest{Key: []byte("k"), Flags: 1 << 31, Data: []byte("v")}
+
+	// Nothing is reserved by default
+	if err := o.Set(high); err != nil {
+		t.Fatalf("Expected the set to go through with nothing reserved, got %v", err)
+	}
+
+	common.SetFlagBits(common.DefaultFlagBits)
+	defer common.SetFlagBits(common.FlagBits{})
+
+	if err := o.Set(high); err != common.ErrInvalidArgs {
+		t.Fatalf("Expected a set with a reserved bit to be refused, got %v", err)
+	}
+	// memcached ignores the flags of an append
+	if err := o.Append(high); err != nil {
+		t.Fatalf("Expected the append to go through, got %v", err)
+	}
+	if sc.stores != 2 {
+		t.Fatalf("Expected 2 stores to reach the orca, got %d", sc.stores)
+	}
+}
@@ -591,6 +591,8 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 		NoopOpaque: req.NoopOpaque,
 		Opaques:    l2opaques,
 		Quiet:      l2quiets,
+		Span:       req.Span,
+		Deadline:   req.Deadline,
 	}
 
 	metrics.IncCounter(MetricCmdGetEL2)
@@ -614,26 +616,32 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 
 					//set in l1
 					setreq := common.SetRequest{
-						Key:     res.Key,
-						Flags:   res.Flags,
-						Exptime: res.Exptime,
-						Data:    res.Data,
+						Key:      res.Key,
+						Flags:    res.Flags,
+						Exptime:  res.Exptime,
+						Data:     res.Data,
+						Span:     req.Span,
+						Deadline: req.Deadline,
 					}
 
-					metrics.IncCounter(MetricCmdGetSetL1)
-					start = time.Now().UnixNano()
+					if backfiller != nil {
+						backfiller.add(setreq)
+					} else {
+						metrics.IncCounter(MetricCmdGetSetL1)
+						start = time.Now().UnixNano()
 
-					err = l.l1.Set(setreq)
+						err = l.l1.Set(setreq)
 
-					dur = time.Now().UnixNano() - start
-					metrics.ObserveHist(HistSetL1, uint64(dur))
+						dur = time.Now().UnixNano() - start
+						metrics.ObserveHist(HistSetL1, uint64(dur))
 
-					if err != nil {
-						metrics.IncCounter(MetricCmdGetSetErrorsL1)
-						return err
-					}
+						if err != nil {
+							metrics.IncCounter(MetricCmdGetSetErrorsL1)
+							return err
+						}
 
-					metrics.IncCounter(MetricCmdGetSetSucessL1)
+						metrics.IncCounter(MetricCmdGetSetSucessL1)
+					}
 
 					// overall operation is considered a hit
 					metrics.IncCounter(MetricCmdGetHits)
@@ -749,10 +757,12 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 		// that is understood and accepted. The typical use cases at Netflix
 		// will not use deletes concurrently with GATs.
 		setreq := common.SetRequest{
-			Key:     req.Key,
-			Exptime: req.Exptime,
-			Flags:   res.Flags,
-			Data:    res.Data,
+			Key:      req.Key,
+			Exptime:  req.Exptime,
+			Flags:    res.Flags,
+			Data:     res.Data,
+			Span:     req.Span,
+			Deadline: req.Deadline,
 		}
 
 		metrics.IncCounter(MetricCmdGatAddL1)
@@ -813,8 +823,10 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 		// discounting the concurrent delete situation here and accepting that
 		// they might not be exactly correct.
 		touchreq := common.TouchRequest{
-			Key:     req.Key,
-			Exptime: req.Exptime,
+			Key:      req.Key,
+			Exptime:  req.Exptime,
+			Span:     req.Span,
+			Deadline: req.Deadline,
 		}
 
 		metrics.IncCounter(MetricCmdGatTouchL2)
@@ -862,6 +874,14 @@ func (l *L1L2Orca) Version(req common.VersionRequest) error {
 	return l.res.Version(req.Opaque)
 }
 
+func (l *L1L2Orca) Stats(req common.StatsRequest) error {
+	return respondStats(l.res, req)
+}
+
+func (l *L1L2Orca) LruCrawler(req common.LruCrawlerRequest) error {
+	return respondLruCrawler(l.res, req)
+}
+
 func (l *L1L2Orca) Unknown(req common.Request) error {
 	return common.ErrUnknownCmd
 }
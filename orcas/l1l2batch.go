@@ -544,6 +544,8 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 		NoopOpaque: req.NoopOpaque,
 		Opaques:    l2opaques,
 		Quiet:      l2quiets,
+		Span:       req.Span,
+		Deadline:   req.Deadline,
 	}
 
 	metrics.IncCounter(MetricCmdGetL2)
@@ -655,8 +657,10 @@ func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
 		// Success finding and touching the data in L2, but still need to touch
 		// in L1
 		touchreq := common.TouchRequest{
-			Key:    req.Key,
-			Opaque: req.Opaque,
+			Key:      req.Key,
+			Opaque:   req.Opaque,
+			Span:     req.Span,
+			Deadline: req.Deadline,
 		}
 
 		// Try touching in L1 to touch hot data. See touch impl for reasoning.
@@ -700,6 +704,14 @@ func (l *L1L2BatchOrca) Version(req common.VersionRequest) error {
 	return l.res.Version(req.Opaque)
 }
 
+func (l *L1L2BatchOrca) Stats(req common.StatsRequest) error {
+	return respondStats(l.res, req)
+}
+
+func (l *L1L2BatchOrca) LruCrawler(req common.LruCrawlerRequest) error {
+	return respondLruCrawler(l.res, req)
+}
+
 func (l *L1L2BatchOrca) Unknown(req common.Request) error {
 	return common.ErrUnknownCmd
 }
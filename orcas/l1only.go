@@ -401,6 +401,14 @@ func (l *L1OnlyOrca) Version(req common.VersionRequest) error {
 	return l.res.Version(req.Opaque)
 }
 
+func (l *L1OnlyOrca) Stats(req common.StatsRequest) error {
+	return respondStats(l.res, req)
+}
+
+func (l *L1OnlyOrca) LruCrawler(req common.LruCrawlerRequest) error {
+	return respondLruCrawler(l.res, req)
+}
+
 func (l *L1OnlyOrca) Unknown(req common.Request) error {
 	return common.ErrUnknownCmd
 }
@@ -0,0 +1,234 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricLeaseGrants       = metrics.AddCounter("lease_grants", nil)
+	MetricLeaseHotMisses    = metrics.AddCounter("lease_hot_misses", nil)
+	MetricLeaseSetsStored   = metrics.AddCounter("lease_sets_stored", nil)
+	MetricLeaseSetsRejected = metrics.AddCounter("lease_sets_rejected", nil)
+)
+
+// LeaseOrca is implemented by orcas that support lease gets and sets.
+type LeaseOrca interface {
+	Orca
+	LeaseGet(req common.GetRequest) error
+	LeaseSet(req common.SetRequest) error
+}
+
+type lease struct {
+	token   uint64
+	expires time.Time
+}
+
+// LeaseTable holds the outstanding leases, shared by every connection.
+type LeaseTable struct {
+	sync.Mutex
+	ttl    time.Duration
+	leases map[string]lease
+}
+
+// Gives out a new lease for the key unless there is one outstanding.
+func (t *LeaseTable) acquire(key []byte) (uint64, bool) {
+	now := time.Now()
+
+	t.Lock()
+	defer t.Unlock()
+
+	if l, ok := t.leases[string(key)]; ok && now.Before(l.expires) {
+		return 0, false
+	}
+
+	// Zero is never a valid token
+	var token uint64
+	for token == 0 {
+		token = uint64(rand.Int63())
+	}
+
+	t.leases[string(key)] = lease{
+		token:   token,
+		expires: now.Add(t.ttl),
+	}
+	return token, true
+}
+
+// Uses up the lease for the key if the token is still valid.
+func (t *LeaseTable) release(key []byte, token uint64) bool {
+	now := time.Now()
+
+	t.Lock()
+	defer t.Unlock()
+
+	l, ok := t.leases[string(key)]
+	if !ok || l.token != token || !now.Before(l.expires) {
+		return false
+	}
+
+	delete(t.leases, string(key))
+	return true
+}
+
+// Cancels any lease for the key because its value changed, so the lease
+// holder doesn't overwrite it with something older.
+func (t *LeaseTable) invalidate(key []byte) {
+	t.Lock()
+	delete(t.leases, string(key))
+	t.Unlock()
+}
+
+// Removes the expired leases of keys that were never filled
+func (t *LeaseTable) sweep() {
+	for range time.Tick(t.ttl) {
+		now := time.Now()
+
+		t.Lock()
+		for k, l := range t.leases {
+			if !now.Before(l.expires) {
+				delete(t.leases, k)
+			}
+		}
+		t.Unlock()
+	}
+}
+
+// leaseResponder turns misses into lease grants or hot misses while a lease
+// get is in progress, and passes everything else through.
+type leaseResponder struct {
+	common.Responder
+	leases *LeaseTable
+	active bool
+}
+
+func (r *leaseResponder) Get(response common.GetResponse) error {
+	if !r.active || !response.Miss {
+		return r.Responder.Get(response)
+	}
+
+	lr, ok := r.Responder.(common.LeaseResponder)
+	if !ok {
+		return common.ErrUnknownCmd
+	}
+
+	if token, ok := r.leases.acquire(response.Key); ok {
+		metrics.IncCounter(MetricLeaseGrants)
+		return lr.Lease(response.Key, token)
+	}
+
+	metrics.IncCounter(MetricLeaseHotMisses)
+	return lr.HotMiss(response.Key)
+}
+
+type LeasedOrca struct {
+	Orca
+	res    *leaseResponder
+	leases *LeaseTable
+}
+
+// Leased wraps an orca to support lease gets and sets, which prevent a
+// thundering herd of clients all recomputing an expensive value on a miss.
+// Only the first client to miss on a key gets a lease token. The others get a
+// hot miss until the lease holder sets the value with its token or the lease
+// expires after the given TTL. Any other change to the key cancels its lease.
+//
+// Leases are kept in this process, so they only coordinate the clients of one
+// proxy. Leased must be the outermost orca wrapper, apart from Ordered, so the
+// server can find the lease methods. The returned LeaseTable can be shared
+// with another listener using LeasedWithExisting.
+func Leased(oc OrcaConst, ttl time.Duration) (OrcaConst, *LeaseTable) {
+	lt := NewLeaseTable(ttl)
+	return LeasedWithExisting(oc, lt), lt
+}
+
+// NewLeaseTable makes an empty table for LeasedWithExisting whose leases last
+// for the given TTL.
+func NewLeaseTable(ttl time.Duration) *LeaseTable {
+	lt := &LeaseTable{
+		ttl:    ttl,
+		leases: make(map[string]lease),
+	}
+	go lt.sweep()
+
+	return lt
+}
+
+func LeasedWithExisting(oc OrcaConst, lt *LeaseTable) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		lr := &leaseResponder{
+			Responder: res,
+			leases:    lt,
+		}
+		return &LeasedOrca{
+			Orca:   oc(l1, l2, lr),
+			res:    lr,
+			leases: lt,
+		}
+	}
+}
+
+func (l *LeasedOrca) LeaseGet(req common.GetRequest) error {
+	l.res.active = true
+	defer func() { l.res.active = false }()
+	return l.Orca.Get(req)
+}
+
+func (l *LeasedOrca) LeaseSet(req common.SetRequest) error {
+	if !l.leases.release(req.Key, req.LeaseToken) {
+		metrics.IncCounter(MetricLeaseSetsRejected)
+		return common.ErrItemNotStored
+	}
+
+	metrics.IncCounter(MetricLeaseSetsStored)
+	return l.Orca.Set(req)
+}
+
+func (l *LeasedOrca) Set(req common.SetRequest) error {
+	l.leases.invalidate(req.Key)
+	return l.Orca.Set(req)
+}
+
+func (l *LeasedOrca) Add(req common.SetRequest) error {
+	l.leases.invalidate(req.Key)
+	return l.Orca.Add(req)
+}
+
+func (l *LeasedOrca) Replace(req common.SetRequest) error {
+	l.leases.invalidate(req.Key)
+	return l.Orca.Replace(req)
+}
+
+func (l *LeasedOrca) Append(req common.SetRequest) error {
+	l.leases.invalidate(req.Key)
+	return l.Orca.Append(req)
+}
+
+func (l *LeasedOrca) Prepend(req common.SetRequest) error {
+	l.leases.invalidate(req.Key)
+	return l.Orca.Prepend(req)
+}
+
+func (l *LeasedOrca) Delete(req common.DeleteRequest) error {
+	l.leases.invalidate(req.Key)
+	return l.Orca.Delete(req)
+}
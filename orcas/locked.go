@@ -74,29 +74,18 @@ type LockedOrca struct {
 // parallel. E.g. concurrency of 1 would allow 2 parallel operations, while a
 // concurrency of 4 allows 2^4 = 16 parallel operations.
 func Locked(oc OrcaConst, multipleReaders bool, concurrency uint8) (OrcaConst, uint32) {
+	slot := NewLockset(multipleReaders, concurrency)
+	return LockedWithExisting(oc, slot), slot
+}
+
+// NewLockset makes a set of locks for LockedWithExisting, with the same
+// parameters as Locked.
+func NewLockset(multipleReaders bool, concurrency uint8) uint32 {
 	if concurrency < 0 {
 		panic("Concurrency level must be at least 0")
 	}
 
-	slot := getNewLocks(multipleReaders, concurrency)
-
-	//counts := make([]uint32, 1<<concurrency)
-
-	hashpool := &sync.Pool{
-		New: func() interface{} {
-			return fnv.New32a()
-		},
-	}
-
-	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
-		return &LockedOrca{
-			wrapped: oc(l1, l2, res),
-			locks:   locks[slot],
-			rlocks:  rlocks[slot],
-			hpool:   hashpool,
-			//counts:  counts,
-		}
-	}, slot
+	return getNewLocks(multipleReaders, concurrency)
 }
 
 func LockedWithExisting(oc OrcaConst, locksetID uint32) OrcaConst {
@@ -225,6 +214,8 @@ func (l *LockedOrca) Get(req common.GetRequest) error {
 			Quiet:      []bool{req.Quiet[idx]},
 			NoopOpaque: noopOpaque,
 			NoopEnd:    noopEnd,
+			Span:       req.Span,
+			Deadline:   req.Deadline,
 		}
 
 		// Make the actual request
@@ -267,6 +258,8 @@ func (l *LockedOrca) GetE(req common.GetRequest) error {
 			Quiet:      []bool{req.Quiet[idx]},
 			NoopOpaque: noopOpaque,
 			NoopEnd:    noopEnd,
+			Span:       req.Span,
+			Deadline:   req.Deadline,
 		}
 
 		// Make the actual request
@@ -306,6 +299,14 @@ func (l *LockedOrca) Version(req common.VersionRequest) error {
 	return l.wrapped.Version(req)
 }
 
+func (l *LockedOrca) Stats(req common.StatsRequest) error {
+	return l.wrapped.Stats(req)
+}
+
+func (l *LockedOrca) LruCrawler(req common.LruCrawlerRequest) error {
+	return l.wrapped.LruCrawler(req)
+}
+
 func (l *LockedOrca) Unknown(req common.Request) error {
 	return l.wrapped.Unknown(req)
 }
@@ -0,0 +1,37 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import "github.com/netflix/rend/common"
+
+// LruCrawlerFunc runs an lru_crawler command with the given arguments on L1 and
+// calls line with each line of the response, with last set for the final one.
+type LruCrawlerFunc func(args []string, line func(line []byte, last bool) error) error
+
+var lruCrawler LruCrawlerFunc
+
+// SetLruCrawler sets how lru_crawler commands are run on L1. They get an
+// unknown command error if it isn't set, like when L1 is in memory. It must be
+// called before any connections are accepted.
+func SetLruCrawler(f LruCrawlerFunc) {
+	lruCrawler = f
+}
+
+func respondLruCrawler(res common.Responder, req common.LruCrawlerRequest) error {
+	if lruCrawler == nil {
+		return common.ErrUnknownCmd
+	}
+	return lruCrawler(req.Args, res.Line)
+}
@@ -0,0 +1,33 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+// Middleware adds something to every request on a listener, like locking,
+// leases, quotas, or recording misses, by wrapping the listener's orca. Each
+// of the wrappers in this package is middleware once the state it shares
+// between listeners exists, e.g.:
+//
+//	lt := NewLeaseTable(ttl)
+//	mw := func(oc OrcaConst) OrcaConst { return LeasedWithExisting(oc, lt) }
+type Middleware func(OrcaConst) OrcaConst
+
+// Chain wraps the orca in each middleware in order, so the first is the
+// outermost and sees each request first.
+func Chain(oc OrcaConst, mws ...Middleware) OrcaConst {
+	for i := len(mws) - 1; i >= 0; i-- {
+		oc = mws[i](oc)
+	}
+	return oc
+}
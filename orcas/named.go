@@ -0,0 +1,59 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	namedLock sync.RWMutex
+	named     = map[string]OrcaConst{
+		"l1only":     L1Only,
+		"l1l2":       L1L2,
+		"l1l2batch":  L1L2Batch,
+		"l1shadowl2": L1ShadowL2,
+	}
+)
+
+// Register makes an orca available by name, e.g. for choosing the orca of
+// each listener in configuration. Registering a name again replaces it.
+func Register(name string, oc OrcaConst) {
+	namedLock.Lock()
+	defer namedLock.Unlock()
+	named[name] = oc
+}
+
+// Named returns the orca registered with the name.
+func Named(name string) (OrcaConst, bool) {
+	namedLock.RLock()
+	defer namedLock.RUnlock()
+	oc, ok := named[name]
+	return oc, ok
+}
+
+// Names returns the names of every registered orca in order.
+func Names() []string {
+	namedLock.RLock()
+	defer namedLock.RUnlock()
+
+	ret := make([]string, 0, len(named))
+	for name := range named {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
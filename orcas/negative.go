@@ -0,0 +1,333 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricNegativeCacheHits    = metrics.AddCounter("negative_cache_hits", nil)
+	MetricNegativeCacheAdds    = metrics.AddCounter("negative_cache_adds", nil)
+	MetricNegativeCacheFull    = metrics.AddCounter("negative_cache_full", nil)
+	MetricNegativeCacheRemoved = metrics.AddCounter("negative_cache_removed", nil)
+)
+
+// NegativeTable holds the keys recently found to be missing, shared by every
+// connection.
+type NegativeTable struct {
+	sync.Mutex
+	ttl     time.Duration
+	maxKeys int
+	keys    map[string]time.Time
+	// Counts removals. Each removed key is kept with the count for the TTL, so
+	// a miss that raced with a set of the same key isn't added after the set
+	// removed it, while misses of other keys still are.
+	gen     uint64
+	removed map[string]removal
+}
+
+type removal struct {
+	gen uint64
+	at  time.Time
+}
+
+func (t *NegativeTable) generation() uint64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.gen
+}
+
+// Remembers that the key is missing for the TTL, unless it was removed since
+// the lookup started at the given generation. Keys are not added once the
+// table is full so it can't grow without bound when clients ask for many
+// different missing keys.
+func (t *NegativeTable) add(key []byte, gen uint64) {
+	expires := time.Now().Add(t.ttl)
+
+	t.Lock()
+	defer t.Unlock()
+
+	if r, ok := t.removed[string(key)]; ok && r.gen > gen {
+		return
+	}
+
+	if _, ok := t.keys[string(key)]; !ok && len(t.keys) >= t.maxKeys {
+		metrics.IncCounter(MetricNegativeCacheFull)
+		return
+	}
+
+	t.keys[string(key)] = expires
+	metrics.IncCounter(MetricNegativeCacheAdds)
+}
+
+func (t *NegativeTable) missing(key []byte) bool {
+	now := time.Now()
+
+	t.Lock()
+	expires, ok := t.keys[string(key)]
+	t.Unlock()
+
+	return ok && now.Before(expires)
+}
+
+// Forgets the key because it may have been given a value
+func (t *NegativeTable) remove(key []byte) {
+	now := time.Now()
+
+	t.Lock()
+	t.gen++
+	t.removed[string(key)] = removal{gen: t.gen, at: now}
+	if _, ok := t.keys[string(key)]; ok {
+		delete(t.keys, string(key))
+		metrics.IncCounter(MetricNegativeCacheRemoved)
+	}
+	t.Unlock()
+}
+
+// Removes the expired keys, and the removed keys older than the TTL. A lookup
+// that takes longer than the TTL could add a key removed while it ran, which
+// is no staler than what a lookup that slow already returns.
+func (t *NegativeTable) sweep() {
+	for range time.Tick(t.ttl) {
+		now := time.Now()
+
+		t.Lock()
+		for k, expires := range t.keys {
+			if !now.Before(expires) {
+				delete(t.keys, k)
+			}
+		}
+		for k, r := range t.removed {
+			if now.Sub(r.at) >= t.ttl {
+				delete(t.removed, k)
+			}
+		}
+		t.Unlock()
+	}
+}
+
+// negativeResponder adds every key that misses in the backends to the table
+// on its way to the client.
+type negativeResponder struct {
+	common.Responder
+	table *NegativeTable
+	gen   uint64
+}
+
+func (r *negativeResponder) Get(response common.GetResponse) error {
+	if response.Miss {
+		r.table.add(response.Key, r.gen)
+	}
+	return r.Responder.Get(response)
+}
+
+func (r *negativeResponder) GetE(response common.GetEResponse) error {
+	if response.Miss {
+		r.table.add(response.Key, r.gen)
+	}
+	return r.Responder.GetE(response)
+}
+
+func (r *negativeResponder) GAT(response common.GetResponse) error {
+	if response.Miss {
+		r.table.add(response.Key, r.gen)
+	}
+	return r.Responder.GAT(response)
+}
+
+type NegativeCachedOrca struct {
+	Orca
+	// The responder without the wrapper, so answering from the table doesn't
+	// extend how long a key is remembered as missing.
+	res   common.Responder
+	nr    *negativeResponder
+	table *NegativeTable
+}
+
+// NegativeCached wraps an orca to remember the keys that missed for the given
+// TTL, and answers gets for them with a miss without asking the backends.
+// Setting, adding, replacing, appending, or prepending a key through this
+// proxy forgets it right away, but a key filled some other way, such as by
+// another proxy, keeps missing here until the TTL runs out. At most maxKeys
+// keys are remembered at once.
+//
+// The returned NegativeTable can be shared with another listener using
+// NegativeCachedWithExisting.
+func NegativeCached(oc OrcaConst, ttl time.Duration, maxKeys int) (OrcaConst, *NegativeTable) {
+	nt := NewNegativeTable(ttl, maxKeys)
+	return NegativeCachedWithExisting(oc, nt), nt
+}
+
+// NewNegativeTable makes an empty table for NegativeCachedWithExisting, with
+// the same parameters as NegativeCached.
+func NewNegativeTable(ttl time.Duration, maxKeys int) *NegativeTable {
+	nt := &NegativeTable{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		keys:    make(map[string]time.Time),
+		removed: make(map[string]removal),
+	}
+	go nt.sweep()
+
+	return nt
+}
+
+func NegativeCachedWithExisting(oc OrcaConst, nt *NegativeTable) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		nr := &negativeResponder{
+			Responder: res,
+			table:     nt,
+		}
+		return &NegativeCachedOrca{
+			Orca:  oc(l1, l2, nr),
+			res:   res,
+			nr:    nr,
+			table: nt,
+		}
+	}
+}
+
+// Answers the keys known to be missing and returns a request for the rest.
+// The request is returned as is if none of its keys are known to be missing.
+func (n *NegativeCachedOrca) filter(req common.GetRequest, miss func(key []byte, opaque uint32, quiet bool) error) (common.GetRequest, error) {
+	var rest *common.GetRequest
+
+	for i, key := range req.Keys {
+		if !n.table.missing(key) {
+			if rest != nil {
+				rest.Keys = append(rest.Keys, key)
+				rest.Opaques = append(rest.Opaques, req.Opaques[i])
+				rest.Quiet = append(rest.Quiet, req.Quiet[i])
+			}
+			continue
+		}
+
+		if rest == nil {
+			rest = &common.GetRequest{
+				Keys:       append([][]byte(nil), req.Keys[:i]...),
+				Opaques:    append([]uint32(nil), req.Opaques[:i]...),
+				Quiet:      append([]bool(nil), req.Quiet[:i]...),
+				NoopOpaque: req.NoopOpaque,
+				NoopEnd:    req.NoopEnd,
+				Span:       req.Span,
+				Deadline:   req.Deadline,
+			}
+		}
+
+		metrics.IncCounter(MetricNegativeCacheHits)
+		if err := miss(key, req.Opaques[i], req.Quiet[i]); err != nil {
+			return req, err
+		}
+	}
+
+	if rest == nil {
+		return req, nil
+	}
+	return *rest, nil
+}
+
+func (n *NegativeCachedOrca) Get(req common.GetRequest) error {
+	req, err := n.filter(req, func(key []byte, opaque uint32, quiet bool) error {
+		return n.res.Get(common.GetResponse{
+			Key:    key,
+			Opaque: opaque,
+			Quiet:  quiet,
+			Miss:   true,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(req.Keys) == 0 {
+		return n.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+	n.nr.gen = n.table.generation()
+	return n.Orca.Get(req)
+}
+
+func (n *NegativeCachedOrca) GetE(req common.GetRequest) error {
+	req, err := n.filter(req, func(key []byte, opaque uint32, quiet bool) error {
+		return n.res.GetE(common.GetEResponse{
+			Key:    key,
+			Opaque: opaque,
+			Quiet:  quiet,
+			Miss:   true,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(req.Keys) == 0 {
+		return n.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+	n.nr.gen = n.table.generation()
+	return n.Orca.GetE(req)
+}
+
+func (n *NegativeCachedOrca) Gat(req common.GATRequest) error {
+	if !n.table.missing(req.Key) {
+		n.nr.gen = n.table.generation()
+		return n.Orca.Gat(req)
+	}
+
+	metrics.IncCounter(MetricNegativeCacheHits)
+	return n.res.GAT(common.GetResponse{
+		Key:    req.Key,
+		Opaque: req.Opaque,
+		Quiet:  req.Quiet,
+		Miss:   true,
+	})
+}
+
+// The key is forgotten both before and after a write. A get that misses while
+// the write is in flight would otherwise remember the key as missing, and the
+// writer's next get would miss until the TTL runs out.
+func (n *NegativeCachedOrca) Set(req common.SetRequest) error {
+	n.table.remove(req.Key)
+	defer n.table.remove(req.Key)
+	return n.Orca.Set(req)
+}
+
+func (n *NegativeCachedOrca) Add(req common.SetRequest) error {
+	n.table.remove(req.Key)
+	defer n.table.remove(req.Key)
+	return n.Orca.Add(req)
+}
+
+func (n *NegativeCachedOrca) Replace(req common.SetRequest) error {
+	n.table.remove(req.Key)
+	defer n.table.remove(req.Key)
+	return n.Orca.Replace(req)
+}
+
+func (n *NegativeCachedOrca) Append(req common.SetRequest) error {
+	n.table.remove(req.Key)
+	defer n.table.remove(req.Key)
+	return n.Orca.Append(req)
+}
+
+func (n *NegativeCachedOrca) Prepend(req common.SetRequest) error {
+	n.table.remove(req.Key)
+	defer n.table.remove(req.Key)
+	return n.Orca.Prepend(req)
+}
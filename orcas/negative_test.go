@@ -0,0 +1,206 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// A backend shared by the fake orcas of every connection. Sets block until
+// released when setStarted is set.
+type fakeBackend struct {
+	sync.Mutex
+	values map[string][]byte
+	gets   int
+
+	setStarted chan struct{}
+	releaseSet chan struct{}
+}
+
+func (b *fakeBackend) backendGets() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.gets
+}
+
+type fakeOrca struct {
+	Orca
+	b   *fakeBackend
+	res common.Responder
+}
+
+func (b *fakeBackend) orcaConst() OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return &fakeOrca{b: b, res: res}
+	}
+}
+
+func (o *fakeOrca) Get(req common.GetRequest) error {
+	for i, key := range req.Keys {
+		o.b.Lock()
+		o.b.gets++
+		data, ok := o.b.values[string(key)]
+		o.b.Unlock()
+
+		err := o.res.Get(common.GetResponse{Key: key, Opaque: req.Opaques[i], Data: data, Miss: !ok})
+		if err != nil {
+			return err
+		}
+	}
+	return o.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (o *fakeOrca) Set(req common.SetRequest) error {
+	if o.b.setStarted != nil {
+		o.b.setStarted <- struct{}{}
+		<-o.b.releaseSet
+	}
+	o.b.Lock()
+	o.b.values[string(req.Key)] = req.Data
+	o.b.Unlock()
+	return nil
+}
+
+type getRecorder struct {
+	common.Responder
+	hits, misses int
+}
+
+func (r *getRecorder) Get(response common.GetResponse) error {
+	if response.Miss {
+		r.misses++
+	} else {
+		r.hits++
+	}
+	return nil
+}
+
+func (r *getRecorder) GetEnd(opaque uint32, noopEnd bool) error { return nil }
+
+func negativeGet(o Orca, key string) error {
+	return o.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+}
+
+func TestNegativeCacheSetDuringMiss(t *testing.T) {
+	b := &fakeBackend{
+		values:     make(map[string][]byte),
+		setStarted: make(chan struct{}),
+		releaseSet: make(chan struct{}),
+	}
+	nt := NewNegativeTable(time.Minute, 100)
+	oc := NegativeCachedWithExisting(b.orcaConst(), nt)
+
+	writerRes, readerRes := &getRecorder{}, &getRecorder{}
+	writer, reader := oc(nil, nil, writerRes), oc(nil, nil, readerRes)
+
+	done := make(chan error)
+	go func() {
+		done <- writer.Set(common.SetRequest{Key: []byte("key"), Data: []byte("value")})
+	}()
+	<-b.setStarted
+
+	// Another connection misses while the set is in flight
+	if err := negativeGet(reader, "key"); err != nil {
+		t.Fatalf("Error getting: %s", err.Error())
+	}
+	if readerRes.misses != 1 {
+		t.Fatalf("Expected a miss before the set is done")
+	}
+
+	close(b.releaseSet)
+	if err := <-done; err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// The writer reads its own write
+	if err := negativeGet(writer, "key"); err != nil {
+		t.Fatalf("Error getting: %s", err.Error())
+	}
+	if writerRes.hits != 1 || writerRes.misses != 0 {
+		t.Fatalf("Expected a hit after the set, got %d hits and %d misses", writerRes.hits, writerRes.misses)
+	}
+}
+
+func TestNegativeCacheExpires(t *testing.T) {
+	b := &fakeBackend{values: make(map[string][]byte)}
+	nt := NewNegativeTable(50*time.Millisecond, 100)
+	res := &getRecorder{}
+	o := NegativeCachedWithExisting(b.orcaConst(), nt)(nil, nil, res)
+
+	for i := 0; i < 3; i++ {
+		if err := negativeGet(o, "missing"); err != nil {
+			t.Fatalf("Error getting: %s", err.Error())
+		}
+	}
+	if res.misses != 3 || b.backendGets() != 1 {
+		t.Fatalf("Expected 3 misses with 1 from the backend, got %d misses and %d backend gets", res.misses, b.backendGets())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := negativeGet(o, "missing"); err != nil {
+		t.Fatalf("Error getting: %s", err.Error())
+	}
+	if b.backendGets() != 2 {
+		t.Fatalf("Expected the backend to be asked again after the TTL, got %d backend gets", b.backendGets())
+	}
+}
+
+func TestNegativeCacheFull(t *testing.T) {
+	b := &fakeBackend{values: make(map[string][]byte)}
+	nt := NewNegativeTable(time.Minute, 1)
+	o := NegativeCachedWithExisting(b.orcaConst(), nt)(nil, nil, &getRecorder{})
+
+	for _, key := range []string{"a", "b", "a", "b"} {
+		if err := negativeGet(o, key); err != nil {
+			t.Fatalf("Error getting: %s", err.Error())
+		}
+	}
+	// Only a is remembered
+	if b.backendGets() != 3 {
+		t.Fatalf("Expected 3 backend gets, got %d", b.backendGets())
+	}
+}
+
+func TestNegativeCacheSetOtherKey(t *testing.T) {
+	nt := NewNegativeTable(time.Minute, 100)
+
+	// Misses of a and b come back after a set of b started and finished
+	gen := nt.generation()
+	nt.remove([]byte("b"))
+	nt.add([]byte("a"), gen)
+	nt.add([]byte("b"), gen)
+
+	if !nt.missing([]byte("a")) {
+		t.Fatalf("Expected a write to b not to stop a from being remembered")
+	}
+	if nt.missing([]byte("b")) {
+		t.Fatalf("Expected b not to be remembered after it was written")
+	}
+
+	// Lookups that start after the write remember b again
+	nt.add([]byte("b"), nt.generation())
+	if !nt.missing([]byte("b")) {
+		t.Fatalf("Expected b to be remembered by a later miss")
+	}
+}
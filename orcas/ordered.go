@@ -0,0 +1,212 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var MetricGetResponsesHeld = metrics.AddCounter("get_responses_held", nil)
+
+func init() {
+	metrics.Describe("get_responses_held", metrics.UnitCount, "Multiget responses held back until the responses for the keys before them were sent")
+}
+
+// orderedResponder holds back the responses of a multiget that arrive before
+// those for the keys ahead of them, and passes everything else through.
+type orderedResponder struct {
+	common.Responder
+	keys    [][]byte
+	opaques []uint32
+	// The response for each key once it arrives, until it's sent
+	held []func() error
+	done []bool
+	// The first key whose response hasn't been sent
+	next int
+}
+
+// Starts a multiget. Gets of one key are passed through as they are.
+func (r *orderedResponder) expect(req common.GetRequest) {
+	if len(req.Keys) < 2 {
+		return
+	}
+	r.keys = req.Keys
+	r.opaques = req.Opaques
+	r.held = make([]func() error, len(req.Keys))
+	r.done = make([]bool, len(req.Keys))
+	r.next = 0
+}
+
+// Sends the responses still held, in key order, and ends the multiget.
+// Keys that never got a response are skipped.
+func (r *orderedResponder) flush() error {
+	var err error
+	for i := r.next; i < len(r.held); i++ {
+		if r.held[i] != nil && err == nil {
+			err = r.held[i]()
+		}
+	}
+	r.keys = nil
+	r.opaques = nil
+	r.held = nil
+	r.done = nil
+	r.next = 0
+	return err
+}
+
+// Sends the response for the first key matching it without one if all the
+// keys before are done, otherwise holds it. Responses for keys that aren't
+// expected are sent right away.
+func (r *orderedResponder) respond(key []byte, opaque uint32, matchOpaque bool, send func() error) error {
+	for i := r.next; i < len(r.keys); i++ {
+		if r.done[i] || !bytes.Equal(r.keys[i], key) {
+			continue
+		}
+		if matchOpaque && i < len(r.opaques) && r.opaques[i] != opaque {
+			continue
+		}
+
+		r.done[i] = true
+		if i != r.next {
+			metrics.IncCounter(MetricGetResponsesHeld)
+			r.held[i] = send
+			return nil
+		}
+
+		if err := send(); err != nil {
+			return err
+		}
+		for r.next++; r.next < len(r.keys) && r.done[r.next]; r.next++ {
+			if r.held[r.next] != nil {
+				if err := r.held[r.next](); err != nil {
+					return err
+				}
+				r.held[r.next] = nil
+			}
+		}
+		return nil
+	}
+
+	return send()
+}
+
+func (r *orderedResponder) Get(response common.GetResponse) error {
+	return r.respond(response.Key, response.Opaque, true, func() error {
+		return r.Responder.Get(response)
+	})
+}
+
+func (r *orderedResponder) GetE(response common.GetEResponse) error {
+	return r.respond(response.Key, response.Opaque, true, func() error {
+		return r.Responder.GetE(response)
+	})
+}
+
+func (r *orderedResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	if err := r.flush(); err != nil {
+		return err
+	}
+	return r.Responder.GetEnd(opaque, noopEnd)
+}
+
+func (r *orderedResponder) Lease(key []byte, token uint64) error {
+	lr, ok := r.Responder.(common.LeaseResponder)
+	if !ok {
+		return common.ErrUnknownCmd
+	}
+	return r.respond(key, 0, false, func() error {
+		return lr.Lease(key, token)
+	})
+}
+
+func (r *orderedResponder) HotMiss(key []byte) error {
+	lr, ok := r.Responder.(common.LeaseResponder)
+	if !ok {
+		return common.ErrUnknownCmd
+	}
+	return r.respond(key, 0, false, func() error {
+		return lr.HotMiss(key)
+	})
+}
+
+type OrderedOrca struct {
+	Orca
+	res *orderedResponder
+}
+
+// Ordered wraps an orca so the responses of a multiget are sent in the order
+// of its keys. Orcas that fetch from more than one place, like an L1 and an
+// L2, otherwise send each response as soon as they have it, which the
+// memcached protocols allow but some clients don't expect. Responses that
+// come early are held until the ones before them are sent. The responses for
+// any keys left when the get ends, like after an error, are sent in order
+// before it's answered.
+//
+// Ordered wraps all of the middleware on a listener, including Leased, so it
+// passes the lease methods through to the orca it wraps.
+func Ordered(oc OrcaConst) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		or := &orderedResponder{Responder: res}
+		return &OrderedOrca{
+			Orca: oc(l1, l2, or),
+			res:  or,
+		}
+	}
+}
+
+func (o *OrderedOrca) Get(req common.GetRequest) error {
+	o.res.expect(req)
+	err := o.Orca.Get(req)
+	if ferr := o.res.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (o *OrderedOrca) GetE(req common.GetRequest) error {
+	o.res.expect(req)
+	err := o.Orca.GetE(req)
+	if ferr := o.res.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// LeaseGet returns ErrUnknownCmd if the wrapped orca doesn't support leases,
+// like the server does for orcas without them.
+func (o *OrderedOrca) LeaseGet(req common.GetRequest) error {
+	lo, ok := o.Orca.(LeaseOrca)
+	if !ok {
+		return common.ErrUnknownCmd
+	}
+	o.res.expect(req)
+	err := lo.LeaseGet(req)
+	if ferr := o.res.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+func (o *OrderedOrca) LeaseSet(req common.SetRequest) error {
+	lo, ok := o.Orca.(LeaseOrca)
+	if !ok {
+		return common.ErrUnknownCmd
+	}
+	return lo.LeaseSet(req)
+}
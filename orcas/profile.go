@@ -0,0 +1,154 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// The longest CPU profile that can be asked for
+const maxProfileDuration = 10 * time.Minute
+
+var (
+	profileDir = os.TempDir()
+	profiling  int32
+)
+
+// SetProfileDir sets the directory that "stats profile" writes its profiles
+// to. It must be called before any connections are accepted.
+func SetProfileDir(dir string) {
+	profileDir = dir
+}
+
+// profileStats captures a profile named by the arguments to the file named by
+// the last argument in the profile directory and returns where it was written:
+//
+//	stats profile cpu <seconds> <file>
+//	stats profile heap <file>
+//
+// A CPU profile blocks the connection for its duration and only one may run at
+// a time.
+func profileStats(args []string) ([]common.Stat, error) {
+	if len(args) < 2 {
+		return nil, common.ErrInvalidArgs
+	}
+
+	path, err := profilePath(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	switch args[0] {
+	case "cpu":
+		if len(args) != 3 {
+			return nil, common.ErrInvalidArgs
+		}
+		secs, err := strconv.Atoi(args[1])
+		if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxProfileDuration {
+			return nil, common.ErrInvalidArgs
+		}
+		err = writeProfile(path, func(w io.Writer) error {
+			return cpuProfile(w, time.Duration(secs)*time.Second)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	case "heap":
+		if len(args) != 2 {
+			return nil, common.ErrInvalidArgs
+		}
+		if err := writeProfile(path, pprof.WriteHeapProfile); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, common.ErrInvalidArgs
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Println("Error reading profile", path, err.Error())
+		return nil, common.ErrInternal
+	}
+
+	return []common.Stat{
+		{Name: "profile_path", Value: path},
+		{Name: "profile_bytes", Value: strconv.FormatInt(fi.Size(), 10)},
+		{Name: "profile_time_ms", Value: strconv.FormatInt(int64(time.Since(start)/time.Millisecond), 10)},
+	}, nil
+}
+
+// profilePath returns the path in the profile directory for the given file
+// name. Names may not leave the directory.
+func profilePath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", common.ErrInvalidArgs
+	}
+	return filepath.Join(profileDir, name), nil
+}
+
+func writeProfile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Println("Error creating profile", path, err.Error())
+		return common.ErrInternal
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		if err == common.ErrBusy {
+			return err
+		}
+		log.Println("Error writing profile", path, err.Error())
+		return common.ErrInternal
+	}
+
+	if err := f.Close(); err != nil {
+		log.Println("Error writing profile", path, err.Error())
+		return common.ErrInternal
+	}
+
+	return nil
+}
+
+func cpuProfile(w io.Writer, d time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&profiling, 0, 1) {
+		return common.ErrBusy
+	}
+	defer atomic.StoreInt32(&profiling, 0)
+
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Someone else in the process is already profiling
+		return common.ErrBusy
+	}
+	time.Sleep(d)
+	pprof.StopCPUProfile()
+
+	return nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Tenant is a set of keys named by their prefix that share a quota.
+type Tenant struct {
+	Name   string
+	Prefix string
+	// The most keys requested in each window. No limit if 0.
+	Requests uint64
+	// The most value bytes stored in each window. No limit if 0.
+	Bytes uint64
+}
+
+// The usage of one tenant in the current window
+type tenantQuota struct {
+	Tenant
+	// The prefix as bytes, so matching a key doesn't convert it to a string
+	prefix []byte
+
+	sync.Mutex
+	start    time.Time
+	requests uint64
+	bytes    uint64
+
+	metricRequests uint32
+	metricBytes    uint32
+	metricRejected uint32
+}
+
+// QuotaTable holds the usage of every tenant, shared by every connection.
+type QuotaTable struct {
+	window time.Duration
+	// Longest prefix first, so a key belongs to the most specific tenant
+	tenants []*tenantQuota
+}
+
+// Finds the tenant the key belongs to, or nil if it belongs to none.
+func (t *QuotaTable) tenant(key []byte) *tenantQuota {
+	for _, tq := range t.tenants {
+		if bytes.HasPrefix(key, tq.prefix) {
+			return tq
+		}
+	}
+	return nil
+}
+
+// Counts a request for the key that stores the given number of bytes against
+// its tenant's quota. Returns false without counting it if it would go over.
+func (t *QuotaTable) charge(key []byte, bytes uint64) bool {
+	tq := t.tenant(key)
+	if tq == nil {
+		return true
+	}
+
+	now := time.Now()
+
+	tq.Lock()
+	if now.Sub(tq.start) >= t.window {
+		tq.start = now
+		tq.requests = 0
+		tq.bytes = 0
+	}
+	if (tq.Requests > 0 && tq.requests+1 > tq.Requests) || (tq.Bytes > 0 && tq.bytes+bytes > tq.Bytes) {
+		tq.Unlock()
+		metrics.IncCounter(tq.metricRejected)
+		return false
+	}
+	tq.requests++
+	tq.bytes += bytes
+	tq.Unlock()
+
+	metrics.IncCounter(tq.metricRequests)
+	metrics.IncCounterBy(tq.metricBytes, bytes)
+	return true
+}
+
+type QuotaOrca struct {
+	Orca
+	table *QuotaTable
+}
+
+// Quotas wraps an orca to limit the keys requested and the bytes stored by
+// each tenant in every window. A key belongs to the tenant with the longest
+// matching prefix, and keys that match no tenant are not limited. Requests
+// that would go over a quota get a busy error. Each key of a multi-key get is
+// counted on its own, so a get that goes over may have used up some of the
+// quota of the tenants of its earlier keys.
+//
+// The counters tenant_requests, tenant_bytes, and tenant_rejected are tagged
+// with the tenant's name.
+//
+// The returned QuotaTable can be shared with another listener using
+// QuotasWithExisting.
+func Quotas(oc OrcaConst, tenants []Tenant, window time.Duration) (OrcaConst, *QuotaTable) {
+	qt := NewQuotaTable(tenants, window)
+	return QuotasWithExisting(oc, qt), qt
+}
+
+// NewQuotaTable makes a table for QuotasWithExisting with no usage, with the
+// same parameters as Quotas.
+func NewQuotaTable(tenants []Tenant, window time.Duration) *QuotaTable {
+	qt := &QuotaTable{window: window}
+
+	for _, t := range tenants {
+		tgs := metrics.Tags{"tenant": t.Name}
+		qt.tenants = append(qt.tenants, &tenantQuota{
+			Tenant:         t,
+			prefix:         []byte(t.Prefix),
+			metricRequests: metrics.AddCounter("tenant_requests", tgs),
+			metricBytes:    metrics.AddCounter("tenant_bytes", tgs),
+			metricRejected: metrics.AddCounter("tenant_rejected", tgs),
+		})
+	}
+
+	sort.SliceStable(qt.tenants, func(i, j int) bool {
+		return len(qt.tenants[i].Prefix) > len(qt.tenants[j].Prefix)
+	})
+
+	return qt
+}
+
+func QuotasWithExisting(oc OrcaConst, qt *QuotaTable) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return &QuotaOrca{
+			Orca:  oc(l1, l2, res),
+			table: qt,
+		}
+	}
+}
+
+func (q *QuotaOrca) chargeKeys(keys [][]byte) error {
+	for _, key := range keys {
+		if !q.table.charge(key, 0) {
+			return common.ErrBusy
+		}
+	}
+	return nil
+}
+
+func (q *QuotaOrca) Set(req common.SetRequest) error {
+	if !q.table.charge(req.Key, uint64(len(req.Data))) {
+		return common.ErrBusy
+	}
+	return q.Orca.Set(req)
+}
+
+func (q *QuotaOrca) Add(req common.SetRequest) error {
+	if !q.table.charge(req.Key, uint64(len(req.Data))) {
+		return common.ErrBusy
+	}
+	return q.Orca.Add(req)
+}
+
+func (q *QuotaOrca) Replace(req common.SetRequest) error {
+	if !q.table.charge(req.Key, uint64(len(req.Data))) {
+		return common.ErrBusy
+	}
+	return q.Orca.Replace(req)
+}
+
+func (q *QuotaOrca) Append(req common.SetRequest) error {
+	if !q.table.charge(req.Key, uint64(len(req.Data))) {
+		return common.ErrBusy
+	}
+	return q.Orca.Append(req)
+}
+
+func (q *QuotaOrca) Prepend(req common.SetRequest) error {
+	if !q.table.charge(req.Key, uint64(len(req.Data))) {
+		return common.ErrBusy
+	}
+	return q.Orca.Prepend(req)
+}
+
+func (q *QuotaOrca) Delete(req common.DeleteRequest) error {
+	if !q.table.charge(req.Key, 0) {
+		return common.ErrBusy
+	}
+	return q.Orca.Delete(req)
+}
+
+func (q *QuotaOrca) Touch(req common.TouchRequest) error {
+	if !q.table.charge(req.Key, 0) {
+		return common.ErrBusy
+	}
+	return q.Orca.Touch(req)
+}
+
+func (q *QuotaOrca) Get(req common.GetRequest) error {
+	if err := q.chargeKeys(req.Keys); err != nil {
+		return err
+	}
+	return q.Orca.Get(req)
+}
+
+func (q *QuotaOrca) GetE(req common.GetRequest) error {
+	if err := q.chargeKeys(req.Keys); err != nil {
+		return err
+	}
+	return q.Orca.GetE(req)
+}
+
+func (q *QuotaOrca) Gat(req common.GATRequest) error {
+	if !q.table.charge(req.Key, 0) {
+		return common.ErrBusy
+	}
+	return q.Orca.Gat(req)
+}
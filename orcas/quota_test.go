@@ -0,0 +1,173 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestQuotaTenantLongestPrefix(t *testing.T) {
+	// The broader prefix comes first to check that order doesn't matter
+	qt := NewQuotaTable([]Tenant{
+		{Name: "test_quota_foo", Prefix: "foo"},
+		{Name: "test_quota_foobar", Prefix: "foo:bar"},
+		{Name: "test_quota_baz", Prefix: "baz"},
+	}, time.Minute)
+
+	tests := []struct {
+		key    string
+		tenant string
+	}{
+		{"foo:bar:1", "test_quota_foobar"},
+		{"foo:bar", "test_quota_foobar"},
+		{"foo:baz", "test_quota_foo"},
+		{"foo", "test_quota_foo"},
+		{"fo", ""},
+		{"baz1", "test_quota_baz"},
+		{"other", ""},
+	}
+
+	for _, test := range tests {
+		var name string
+		if tq := qt.tenant([]byte(test.key)); tq != nil {
+			name = tq.Name
+		}
+		if name != test.tenant {
+			t.Errorf("Expected %q to belong to %q, got %q", test.key, test.tenant, name)
+		}
+	}
+}
+
+func TestQuotaCharge(t *testing.T) {
+	type charge struct {
+		key   string
+		bytes uint64
+		ok    bool
+	}
+
+	tests := []struct {
+		name    string
+		tenant  Tenant
+		charges []charge
+	}{
+		{
+			name:   "requests",
+			tenant: Tenant{Prefix: "r:", Requests: 2},
+			charges: []charge{
+				{"r:1", 100, true},
+				{"r:2", 100, true},
+				{"r:3", 0, false},
+				// Keys of no tenant are never limited
+				{"x", 100, true},
+			},
+		},
+		{
+			name:   "bytes",
+			tenant: Tenant{Prefix: "b:", Bytes: 10},
+			charges: []charge{
+				{"b:1", 6, true},
+				{"b:2", 5, false},
+				// A request that's refused isn't counted
+				{"b:3", 4, true},
+				{"b:4", 1, false},
+				{"b:5", 0, true},
+			},
+		},
+		{
+			name:   "both",
+			tenant: Tenant{Prefix: "c:", Requests: 2, Bytes: 10},
+			charges: []charge{
+				{"c:1", 10, true},
+				{"c:2", 1, false},
+				{"c:3", 0, true},
+				{"c:4", 0, false},
+			},
+		},
+		{
+			name:   "unlimited",
+			tenant: Tenant{Prefix: "u:"},
+			charges: []charge{
+				{"u:1", 1 << 30, true},
+				{"u:2", 1 << 30, true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test.tenant.Name = "test_quota_" + test.name
+		qt := NewQuotaTable([]Tenant{test.tenant}, time.Minute)
+
+		for i, c := range test.charges {
+			if ok := qt.charge([]byte(c.key), c.bytes); ok != c.ok {
+				t.Errorf("%s: expected charge %d of %q for %d bytes to be %v", test.name, i, c.key, c.bytes, c.ok)
+			}
+		}
+	}
+}
+
+func TestQuotaWindowReset(t *testing.T) {
+	qt := NewQuotaTable([]Tenant{{Name: "test_quota_window", Prefix: "w:", Requests: 1, Bytes: 5}}, time.Minute)
+
+	if !qt.charge([]byte("w:1"), 5) {
+		t.Fatalf("Expected the first charge to fit")
+	}
+	if qt.charge([]byte("w:2"), 0) {
+		t.Fatalf("Expected the second charge to go over")
+	}
+
+	// The window ends
+	tq := qt.tenant([]byte("w:"))
+	tq.Lock()
+	tq.start = tq.start.Add(-time.Minute)
+	tq.Unlock()
+
+	if !qt.charge([]byte("w:3"), 5) {
+		t.Fatalf("Expected the quota to be back after the window")
+	}
+}
+
+func TestQuotaMultigetPartialCharge(t *testing.T) {
+	qt := NewQuotaTable([]Tenant{
+		{Name: "test_quota_first", Prefix: "a:", Requests: 10},
+		{Name: "test_quota_full", Prefix: "b:", Requests: 1},
+	}, time.Minute)
+	q := &QuotaOrca{table: qt}
+
+	if !qt.charge([]byte("b:0"), 0) {
+		t.Fatalf("Expected the first charge to fit")
+	}
+
+	err := q.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("a:1"), []byte("b:1"), []byte("a:2")},
+		Opaques: []uint32{0, 0, 0},
+		Quiet:   []bool{false, false, false},
+	})
+	if err != common.ErrBusy {
+		t.Fatalf("Expected the get to go over the quota, got %v", err)
+	}
+
+	// The key before the one that went over was counted, and the one after
+	// wasn't
+	tq := qt.tenant([]byte("a:"))
+	tq.Lock()
+	requests := tq.requests
+	tq.Unlock()
+	if requests != 1 {
+		t.Fatalf("Expected 1 request counted for the earlier key's tenant, got %d", requests)
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricShadowQueued  = metrics.AddCounter("shadow_queued", nil)
+	MetricShadowDropped = metrics.AddCounter("shadow_dropped", nil)
+	MetricShadowErrors  = metrics.AddCounter("shadow_errors", nil)
+)
+
+func init() {
+	metrics.Describe("shadow_queued", metrics.UnitCount, "Requests queued to be copied to the shadow L2")
+	metrics.Describe("shadow_dropped", metrics.UnitCount, "Requests that weren't copied to the shadow L2 because the queue was full")
+	metrics.Describe("shadow_errors", metrics.UnitCount, "Requests copied to the shadow L2 that failed there")
+}
+
+// A request waiting to be copied to the shadow L2
+type shadowReq func(l2 handlers.Handler) error
+
+// Shadower copies requests to L2 in the background for the L1ShadowL2 orca, so
+// the shadow never adds to the latency of the requests it copies or holds
+// their place in a listener's in-flight limit. It has its own L2 connections,
+// which treat L2 being down like the miss backend down policy whatever the
+// listener's policy is, so a shadow pool that can't be reached never affects
+// clients. Requests that come in faster than the connections can send them
+// wait in a queue, and are dropped if the queue is full.
+type Shadower struct {
+	hc    handlers.HandlerConst
+	queue chan shadowReq
+}
+
+// NewShadower starts a shadower that sends to L2 over conns connections made
+// by the given constructor, with room for queueLen requests waiting to be sent.
+func NewShadower(hc handlers.HandlerConst, conns, queueLen int) *Shadower {
+	s := &Shadower{
+		hc:    handlers.MissWhenDown(hc, "l2"),
+		queue: make(chan shadowReq, queueLen),
+	}
+	for i := 0; i < conns; i++ {
+		go s.run()
+	}
+	return s
+}
+
+var shadower *Shadower
+
+// SetShadower sets the shadower the L1ShadowL2 orca copies requests to. Nothing
+// is copied if it isn't set. It must be called before any connections are
+// accepted.
+func SetShadower(s *Shadower) {
+	shadower = s
+}
+
+func (s *Shadower) add(req shadowReq) {
+	select {
+	case s.queue <- req:
+		metrics.IncCounter(MetricShadowQueued)
+	default:
+		metrics.IncCounter(MetricShadowDropped)
+	}
+}
+
+func (s *Shadower) run() {
+	// MissWhenDown never fails to make a handler
+	l2, _ := s.hc()
+	defer l2.Close()
+
+	for req := range s.queue {
+		mirror(req(l2))
+	}
+}
+
+func mirror(err error) {
+	if err != nil && err != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricShadowErrors)
+	}
+}
+
+// The keys and values of requests are copied before they're queued, since the
+// buffers they're in may be reused once the request is done. The copy may be
+// sent long after the request ends, so it isn't traced and has no deadline.
+
+func copyKey(key []byte) []byte {
+	return append([]byte(nil), key...)
+}
+
+func shadowSet(req common.SetRequest) common.SetRequest {
+	req.Key = copyKey(req.Key)
+	req.Data = append([]byte(nil), req.Data...)
+	req.Span = nil
+	req.Deadline = time.Time{}
+	return req
+}
+
+func shadowGet(req common.GetRequest) common.GetRequest {
+	keys := make([][]byte, len(req.Keys))
+	for i, key := range req.Keys {
+		keys[i] = copyKey(key)
+	}
+	req.Keys = keys
+	req.Opaques = append([]uint32(nil), req.Opaques...)
+	req.Quiet = append([]bool(nil), req.Quiet...)
+	req.Span = nil
+	req.Deadline = time.Time{}
+	return req
+}
+
+// Reads every response, like the other orcas, so the handler is left ready for
+// the next request.
+func drain(resChan <-chan common.GetResponse, errChan <-chan error) error {
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case _, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+func drainE(resChan <-chan common.GetEResponse, errChan <-chan error) error {
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case _, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+type L1ShadowL2Orca struct {
+	Orca
+	shadow *Shadower
+}
+
+// L1ShadowL2 serves every request from L1 like L1Only, and then queues the same
+// request to be sent to L2 by the shadower set with SetShadower, which throws
+// away the result. It is for trying out a new pool, or new memcached settings,
+// with real traffic before relying on it. The L2 handler of the connection
+// isn't used, so listeners with this orca don't need one. Errors from L2 never
+// reach the client and are counted in shadow_errors. L2's hits, misses, and
+// latency are in the l2 backend metrics.
+func L1ShadowL2(l1, l2 handlers.Handler, res common.Responder) Orca {
+	return &L1ShadowL2Orca{
+		Orca:   L1Only(l1, nil, res),
+		shadow: shadower,
+	}
+}
+
+func (s *L1ShadowL2Orca) copy(req shadowReq) {
+	if s.shadow != nil {
+		s.shadow.add(req)
+	}
+}
+
+func (s *L1ShadowL2Orca) Set(req common.SetRequest) error {
+	err := s.Orca.Set(req)
+	req = shadowSet(req)
+	s.copy(func(l2 handlers.Handler) error { return l2.Set(req) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Add(req common.SetRequest) error {
+	err := s.Orca.Add(req)
+	req = shadowSet(req)
+	s.copy(func(l2 handlers.Handler) error { return l2.Add(req) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Replace(req common.SetRequest) error {
+	err := s.Orca.Replace(req)
+	req = shadowSet(req)
+	s.copy(func(l2 handlers.Handler) error { return l2.Replace(req) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Append(req common.SetRequest) error {
+	err := s.Orca.Append(req)
+	req = shadowSet(req)
+	s.copy(func(l2 handlers.Handler) error { return l2.Append(req) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Prepend(req common.SetRequest) error {
+	err := s.Orca.Prepend(req)
+	req = shadowSet(req)
+	s.copy(func(l2 handlers.Handler) error { return l2.Prepend(req) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Delete(req common.DeleteRequest) error {
+	err := s.Orca.Delete(req)
+	req.Key = copyKey(req.Key)
+	req.Span = nil
+	req.Deadline = time.Time{}
+	s.copy(func(l2 handlers.Handler) error { return l2.Delete(req) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Touch(req common.TouchRequest) error {
+	err := s.Orca.Touch(req)
+	req.Key = copyKey(req.Key)
+	req.Span = nil
+	req.Deadline = time.Time{}
+	s.copy(func(l2 handlers.Handler) error { return l2.Touch(req) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Get(req common.GetRequest) error {
+	err := s.Orca.Get(req)
+	req = shadowGet(req)
+	s.copy(func(l2 handlers.Handler) error { return drain(l2.Get(req)) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) GetE(req common.GetRequest) error {
+	err := s.Orca.GetE(req)
+	req = shadowGet(req)
+	s.copy(func(l2 handlers.Handler) error { return drainE(l2.GetE(req)) })
+	return err
+}
+
+func (s *L1ShadowL2Orca) Gat(req common.GATRequest) error {
+	err := s.Orca.Gat(req)
+	req.Key = copyKey(req.Key)
+	req.Span = nil
+	req.Deadline = time.Time{}
+	s.copy(func(l2 handlers.Handler) error {
+		_, err := l2.GAT(req)
+		return err
+	})
+	return err
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+)
+
+type setResponder struct {
+	common.Responder
+}
+
+func (setResponder) Set(opaque uint32, quiet bool) error { return nil }
+
+// Returns a shadow orca serving from its own fakemem L1 and copying to the
+// shadower
+func shadowOrca(t *testing.T, s *Shadower) Orca {
+	l1, _ := fakememConst(fakemem.New(false))()
+	t.Cleanup(func() { l1.Close() })
+
+	prev := shadower
+	SetShadower(s)
+	defer SetShadower(prev)
+	return L1ShadowL2(l1, nil, setResponder{})
+}
+
+func TestShadowCopies(t *testing.T) {
+	l2 := fakemem.New(false)
+	o := shadowOrca(t, NewShadower(fakememConst(l2), 1, 10))
+
+	key := []byte("k")
+	if err := o.Set(common.SetRequest{Key: key, Data: []byte("value")}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+	// The copy doesn't use the request's buffers
+	key[0] = 'x'
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if v, ok := getValue(t, l2, "k"); ok && v == "value" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the set to be copied to L2")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShadowUnreachable(t *testing.T) {
+	errs := counterValue("shadow_errors")
+
+	o := shadowOrca(t, NewShadower(func() (handlers.Handler, error) {
+		return nil, errors.New("can't connect")
+	}, 1, 10))
+
+	if err := o.Set(backfillReq("k", "value")); err != nil {
+		t.Fatalf("Expected L2 being down not to reach the client, got %s", err.Error())
+	}
+	waitForCounter(t, "shadow_errors", errs, 1)
+}
+
+func TestShadowDropsWhenFull(t *testing.T) {
+	queued, dropped := counterValue("shadow_queued"), counterValue("shadow_dropped")
+
+	// Nothing takes from the queue, like an L2 that's too slow to keep up
+	o := shadowOrca(t, &Shadower{queue: make(chan shadowReq, 1)})
+
+	start := time.Now()
+	for _, k := range []string{"a", "b"} {
+		if err := o.Set(backfillReq(k, "v")); err != nil {
+			t.Fatalf("Error setting: %s", err.Error())
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected sets not to wait on L2, took %s", d)
+	}
+
+	if n := counterValue("shadow_queued") - queued; n != 1 {
+		t.Fatalf("Expected 1 request queued, got %d", n)
+	}
+	if n := counterValue("shadow_dropped") - dropped; n != 1 {
+		t.Fatalf("Expected 1 request dropped, got %d", n)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+var procStart = time.Now()
+
+// StatsResetFunc runs "stats reset" on the backends.
+type StatsResetFunc func() error
+
+var statsReset StatsResetFunc
+
+// SetStatsReset sets how "stats reset" is passed on to the backends. Without
+// it, like when L1 is in memory, only the proxy's own metrics are reset. It
+// must be called before any connections are accepted.
+func SetStatsReset(f StatsResetFunc) {
+	statsReset = f
+}
+
+// proxyStats returns the stats that describe the proxy itself, following the
+// names memcached uses where there is an equivalent.
+func proxyStats() []common.Stat {
+	now := time.Now()
+	return []common.Stat{
+		{Name: "pid", Value: strconv.Itoa(os.Getpid())},
+		{Name: "uptime", Value: strconv.FormatInt(int64(now.Sub(procStart)/time.Second), 10)},
+		{Name: "time", Value: strconv.FormatInt(now.Unix(), 10)},
+		{Name: "version", Value: common.Version},
+		{Name: "git_sha", Value: common.GitSHA},
+		{Name: "build_date", Value: common.BuildDate},
+	}
+}
+
+// respondStats sends the group of stats named in the request, or the proxy
+// stats if no group is named. "stats reset" resets the proxy's counters and
+// histograms and then the backends' stats.
+func respondStats(res common.Responder, req common.StatsRequest) error {
+	if req.Group != "profile" && len(req.Args) > 0 {
+		return common.ErrInvalidArgs
+	}
+
+	switch req.Group {
+	case "":
+		return res.Stats(req.Opaque, proxyStats())
+	case "hotkeys":
+		return res.Stats(req.Opaque, hotKeyStats())
+	case "proxy":
+		return res.Stats(req.Opaque, proxyInternalStats())
+	case "flags":
+		return res.Stats(req.Opaque, flagStats())
+	case "profile":
+		stats, err := profileStats(req.Args)
+		if err != nil {
+			return err
+		}
+		return res.Stats(req.Opaque, stats)
+	case "reset":
+		metrics.Reset()
+		if statsReset != nil {
+			if err := statsReset(); err != nil {
+				return err
+			}
+		}
+		return res.StatsReset(req.Opaque)
+	}
+
+	return common.ErrUnknownCmd
+}
+
+// hotKeyStats returns the hottest keys of each top-K tracker for its last
+// complete window, numbered from the hottest, e.g.:
+//
+//	hot_keys:window_start 1480000000
+//	hot_keys:1:key foo
+//	hot_keys:1:count 1234
+//
+// Keys that can't be sent as-is in a stat value are quoted.
+func hotKeyStats() []common.Stat {
+	var ret []common.Stat
+
+	for _, tk := range metrics.GetTopKeys() {
+		ret = append(ret,
+			common.Stat{Name: tk.Name + ":window_start", Value: strconv.FormatInt(tk.Start.Unix(), 10)},
+			common.Stat{Name: tk.Name + ":window_end", Value: strconv.FormatInt(tk.End.Unix(), 10)},
+		)
+
+		for i, kc := range tk.Keys {
+			prefix := tk.Name + ":" + strconv.Itoa(i+1)
+			ret = append(ret,
+				common.Stat{Name: prefix + ":key", Value: statKey(kc.Key)},
+				common.Stat{Name: prefix + ":count", Value: strconv.FormatUint(kc.Count, 10)},
+			)
+		}
+	}
+
+	return ret
+}
+
+func statKey(key string) string {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] >= 0x7f {
+			return strconv.Quote(key)
+		}
+	}
+	return key
+}
+
+// The metrics shown by "stats proxy", by name prefix
+var proxyStatPrefixes = []string{"conn_", "backend_", "chunk", "buf_pool_", "err_", "tracing_"}
+
+// proxyInternalStats returns the metrics that describe the proxy's own
+// connections, backend requests, chunking, and errors so memcached monitoring
+// agents can collect them without scraping the HTTP endpoint. Each client
+// connection has its own backend connections, so conn_open_l1 and conn_open_l2
+// are the backend pool sizes. Tagged metrics have the tag values appended in
+// order of the tag names, e.g.:
+//
+//	backend_hits:l1:get 1234
+func proxyInternalStats() []common.Stat {
+	var ret []common.Stat
+
+	ctrs := metrics.GetCounters()
+	for _, c := range ctrs {
+		if isProxyStat(c.Name) {
+			ret = append(ret, common.Stat{Name: statName(c.Name, c.Tags), Value: strconv.FormatUint(c.Value, 10)})
+		}
+	}
+
+	ints, floats := metrics.GetGauges()
+	for _, g := range ints {
+		if isProxyStat(g.Name) {
+			ret = append(ret, common.Stat{Name: statName(g.Name, g.Tags), Value: strconv.FormatUint(g.Value, 10)})
+		}
+	}
+	for _, g := range floats {
+		if isProxyStat(g.Name) {
+			ret = append(ret, common.Stat{Name: statName(g.Name, g.Tags), Value: strconv.FormatFloat(g.Value, 'f', -1, 64)})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+
+	return ret
+}
+
+func isProxyStat(name string) bool {
+	for _, p := range proxyStatPrefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func statName(name string, tgs metrics.Tags) string {
+	if len(tgs) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(tgs))
+	for k := range tgs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name += ":" + tgs[k]
+	}
+	return name
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// Exptimes over this many seconds are unix times instead of seconds from now,
+// like in memcached.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+var MetricTTLJittered = metrics.AddCounter("ttl_jittered", nil)
+
+// TTLRule limits the exptimes clients give keys with a prefix.
+type TTLRule struct {
+	Prefix string
+	TTL    time.Duration
+	// If true, every exptime is replaced with the TTL, and a TTL of 0 means
+	// keys never expire. Otherwise, exptimes further out than the TTL,
+	// including none at all, are cut to it.
+	Override bool
+}
+
+type ttlRule struct {
+	TTLRule
+	metric uint32
+}
+
+// TTLPolicy holds the TTL rules and jitter, shared by every connection.
+type TTLPolicy struct {
+	// Longest prefix first, so a key follows the most specific rule
+	rules []ttlRule
+	// The most a TTL is shortened by at random, as a fraction of it
+	jitter float64
+	now    func() time.Time
+}
+
+// NewTTLPolicy makes a policy for TTLLimited from the rules and jitter. A key
+// follows the rule with the longest matching prefix. The counter ttl_limited,
+// tagged with the prefix, counts the exptimes each rule changed.
+//
+// The jitter, from 0 to 1, randomly shortens the TTL of each value stored by
+// up to that fraction, after the rules are applied, so values stored together
+// with the same TTL don't all expire in the same second. Values that never
+// expire are left alone. The values jittered are counted by ttl_jittered.
+func NewTTLPolicy(rules []TTLRule, jitter float64) *TTLPolicy {
+	p := &TTLPolicy{jitter: jitter, now: time.Now}
+
+	for _, r := range rules {
+		p.rules = append(p.rules, ttlRule{
+			TTLRule: r,
+			metric:  metrics.AddCounter("ttl_limited", metrics.Tags{"prefix": r.Prefix}),
+		})
+	}
+
+	sort.SliceStable(p.rules, func(i, j int) bool {
+		return len(p.rules[i].Prefix) > len(p.rules[j].Prefix)
+	})
+
+	return p
+}
+
+// SetExptime returns the exptime to store the key with in place of the one the
+// client gave.
+func (p *TTLPolicy) SetExptime(key []byte, exptime uint32) uint32 {
+	return p.jittered(p.Exptime(key, exptime))
+}
+
+// Exptime returns the exptime for the key with only the rules applied, for
+// touches and GATs, which change the exptime of a value already stored.
+func (p *TTLPolicy) Exptime(key []byte, exptime uint32) uint32 {
+	for _, r := range p.rules {
+		if !strings.HasPrefix(string(key), r.Prefix) {
+			continue
+		}
+
+		limited := p.limit(r.TTLRule, exptime)
+		if limited != exptime {
+			metrics.IncCounter(r.metric)
+		}
+		return limited
+	}
+	return exptime
+}
+
+func (p *TTLPolicy) limit(r TTLRule, exptime uint32) uint32 {
+	ttl := uint32(r.TTL / time.Second)
+	if r.Override {
+		return p.exptimeFor(ttl)
+	}
+
+	// An exptime already in the past can't be any further out than the TTL
+	remaining := exptime
+	if exptime > maxRelativeExptime {
+		now := uint32(p.now().Unix())
+		if exptime <= now {
+			return exptime
+		}
+		remaining = exptime - now
+	}
+
+	if exptime == 0 || remaining > ttl {
+		return p.exptimeFor(ttl)
+	}
+	return exptime
+}
+
+// Returns the exptime for a TTL in seconds, which is a unix time if it's too
+// long to be relative.
+func (p *TTLPolicy) exptimeFor(ttl uint32) uint32 {
+	if ttl > maxRelativeExptime {
+		return uint32(p.now().Unix()) + ttl
+	}
+	return ttl
+}
+
+// Shortens the exptime by a random part of the jitter. Exptimes that are unix
+// times are shortened by the same number of seconds.
+func (p *TTLPolicy) jittered(exptime uint32) uint32 {
+	if p.jitter == 0 || exptime == 0 {
+		return exptime
+	}
+
+	remaining := exptime
+	if exptime > maxRelativeExptime {
+		now := uint32(p.now().Unix())
+		if exptime <= now {
+			return exptime
+		}
+		remaining = exptime - now
+	}
+
+	// Less than the remaining TTL, so the value doesn't expire right away
+	cut := uint32(float64(remaining) * p.jitter * rand.Float64())
+	if cut == 0 {
+		return exptime
+	}
+	metrics.IncCounter(MetricTTLJittered)
+	return exptime - cut
+}
+
+type TTLOrca struct {
+	Orca
+	policy *TTLPolicy
+}
+
+// TTLLimited wraps an orca to apply the TTL policy to every exptime clients
+// give, in sets, touches, and GATs. Jitter is only added to sets. The policy is
+// applied before the backends see the request, so a chunked value's metadata
+// and chunks all get the same exptime.
+func TTLLimited(oc OrcaConst, p *TTLPolicy) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return &TTLOrca{
+			Orca:   oc(l1, l2, res),
+			policy: p,
+		}
+	}
+}
+
+func (t *TTLOrca) Set(req common.SetRequest) error {
+	req.Exptime = t.policy.SetExptime(req.Key, req.Exptime)
+	return t.Orca.Set(req)
+}
+
+func (t *TTLOrca) Add(req common.SetRequest) error {
+	req.Exptime = t.policy.SetExptime(req.Key, req.Exptime)
+	return t.Orca.Add(req)
+}
+
+func (t *TTLOrca) Replace(req common.SetRequest) error {
+	req.Exptime = t.policy.SetExptime(req.Key, req.Exptime)
+	return t.Orca.Replace(req)
+}
+
+func (t *TTLOrca) Touch(req common.TouchRequest) error {
+	req.Exptime = t.policy.Exptime(req.Key, req.Exptime)
+	return t.Orca.Touch(req)
+}
+
+func (t *TTLOrca) Gat(req common.GATRequest) error {
+	req.Exptime = t.policy.Exptime(req.Key, req.Exptime)
+	return t.Orca.Gat(req)
+}
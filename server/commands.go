@@ -0,0 +1,92 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/netflix/rend/common"
+)
+
+// The command names a CommandFilter accepts, as returned by cmdName
+var filterableCommands = map[string]bool{
+	"set": true, "add": true, "replace": true, "append": true, "prepend": true,
+	"delete": true, "touch": true, "get": true, "gete": true, "gat": true,
+	"noop": true, "quit": true, "version": true, "stats": true,
+	"lget": true, "lset": true, "lru_crawler": true,
+}
+
+// CommandFilter decides which commands a listener serves. Commands are named
+// as in the text protocol, e.g. "set" or "gat", and each stats group can be
+// named on its own as "stats <group>", e.g. "stats profile". Plain "stats"
+// covers every group. Denied commands get an unknown command error.
+type CommandFilter struct {
+	allow bool
+	cmds  map[string]bool
+}
+
+// AllowCommands returns a filter that serves only the named commands.
+func AllowCommands(cmds []string) (*CommandFilter, error) {
+	return newCommandFilter(true, cmds)
+}
+
+// DenyCommands returns a filter that serves every command except the named
+// ones.
+func DenyCommands(cmds []string) (*CommandFilter, error) {
+	return newCommandFilter(false, cmds)
+}
+
+func newCommandFilter(allow bool, cmds []string) (*CommandFilter, error) {
+	f := &CommandFilter{
+		allow: allow,
+		cmds:  make(map[string]bool),
+	}
+
+	for _, cmd := range cmds {
+		cmd = strings.Join(strings.Fields(cmd), " ")
+		name := cmd
+		if strings.HasPrefix(cmd, "stats ") {
+			name = "stats"
+		}
+		if !filterableCommands[name] {
+			return nil, fmt.Errorf("unknown command %q", cmd)
+		}
+		f.cmds[cmd] = true
+	}
+
+	return f, nil
+}
+
+// Allowed returns whether the request should be served. Unknown commands are
+// always passed on so they get the usual response.
+func (f *CommandFilter) Allowed(request common.Request, reqType common.RequestType) bool {
+	if f == nil || reqType == common.RequestUnknown {
+		return true
+	}
+
+	named := f.cmds[cmdName(reqType)]
+	if req, ok := request.(common.StatsRequest); ok && req.Group != "" {
+		named = named || f.cmds["stats "+req.Group]
+	}
+
+	return named == f.allow
+}
+
+// Servers that filter commands implement commandFilterSetter to use the
+// listener's filter.
+type commandFilterSetter interface {
+	SetCommandFilter(f *CommandFilter)
+}
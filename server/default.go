@@ -16,18 +16,28 @@ package server
 
 import (
 	"io"
-	"log"
+	"strconv"
 	"time"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/tracing"
 )
 
 type DefaultServer struct {
 	rp    common.RequestParser
 	orca  orcas.Orca
 	conns []io.Closer
+	rl    *common.RequestLog
+	cmds  *CommandFilter
+	// No deadlines if 0
+	budget time.Duration
+	// Shared with the other connections of the listener
+	inFlight inFlightLimit
+	// Runs requests at the same time for clients sharing the connection. Nil
+	// if requests are run one at a time.
+	mux *multiplexer
 }
 
 func Default(conns []io.Closer, rp common.RequestParser, o orcas.Orca) Server {
@@ -38,115 +48,365 @@ func Default(conns []io.Closer, rp common.RequestParser, o orcas.Orca) Server {
 	}
 }
 
+// SetRequestLog sets the log used for lines about the connection's requests.
+func (s *DefaultServer) SetRequestLog(rl *common.RequestLog) {
+	s.rl = rl
+}
+
+// SetCommandFilter sets the commands the connection serves.
+func (s *DefaultServer) SetCommandFilter(f *CommandFilter) {
+	s.cmds = f
+}
+
+// SetBudget sets how long each request may take before it's given up on.
+func (s *DefaultServer) SetBudget(budget time.Duration) {
+	s.budget = budget
+}
+
+func (s *DefaultServer) setInFlightLimit(l inFlightLimit) {
+	s.inFlight = l
+}
+
+func (s *DefaultServer) setMultiplexer(m *multiplexer) {
+	s.mux = m
+}
+
 func (s *DefaultServer) Loop() {
-	defer func() {
-		if r := recover(); r != nil {
-			if r != io.EOF {
-				log.Println("Recovered from runtime panic:", r)
-				log.Println("Panic location: ", identifyPanic())
-			}
-		}
-	}()
+	defer s.recoverPanic()
 
 	for {
-		start := time.Now()
-
 		request, reqType, err := s.rp.Parse()
+
+		if s.mux != nil {
+			if err == nil && multiplexed(reqType) {
+				if err := s.mux.run(s, request, reqType); err != nil {
+					abort(s.conns, err, s.rl)
+					return
+				}
+				continue
+			}
+			// Everything else is answered in order, after the requests
+			// before it
+			s.mux.wait()
+		}
+
 		if err != nil {
 			if err == common.ErrBadRequest ||
 				err == common.ErrBadLength ||
 				err == common.ErrBadFlags ||
-				err == common.ErrBadExptime {
-				s.orca.Error(nil, common.RequestUnknown, err)
+				err == common.ErrBadExptime ||
+				err == common.ErrBadDataChunk {
+				metrics.IncCounter(MetricErrClient)
+				// Parsers return the request as far as they got, so binary
+				// clients get the error with its opcode and opaque
+				s.orca.Error(request, reqType, err)
 				continue
 			} else {
 				// Otherwise IO error. Abort!
-				abort(s.conns, err)
+				abort(s.conns, err, s.rl)
 				return
 			}
 		}
 
-		metrics.IncCounter(MetricCmdTotal)
-
-		// TODO: handle nil
-		switch reqType {
-		case common.RequestSet:
-			metrics.IncCounter(MetricCmdSet)
-			err = s.orca.Set(request.(common.SetRequest))
-		case common.RequestAdd:
-			metrics.IncCounter(MetricCmdAdd)
-			err = s.orca.Add(request.(common.SetRequest))
-		case common.RequestReplace:
-			metrics.IncCounter(MetricCmdReplace)
-			err = s.orca.Replace(request.(common.SetRequest))
-		case common.RequestAppend:
-			metrics.IncCounter(MetricCmdAppend)
-			err = s.orca.Append(request.(common.SetRequest))
-		case common.RequestPrepend:
-			metrics.IncCounter(MetricCmdPrepend)
-			err = s.orca.Prepend(request.(common.SetRequest))
-		case common.RequestDelete:
-			metrics.IncCounter(MetricCmdDelete)
-			err = s.orca.Delete(request.(common.DeleteRequest))
-		case common.RequestTouch:
-			metrics.IncCounter(MetricCmdTouch)
-			err = s.orca.Touch(request.(common.TouchRequest))
-		case common.RequestGet:
-			metrics.IncCounter(MetricCmdGet)
-			err = s.orca.Get(request.(common.GetRequest))
-		case common.RequestGetE:
-			metrics.IncCounter(MetricCmdGetE)
-			err = s.orca.GetE(request.(common.GetRequest))
-		case common.RequestGat:
-			metrics.IncCounter(MetricCmdGat)
-			err = s.orca.Gat(request.(common.GATRequest))
-		case common.RequestNoop:
-			metrics.IncCounter(MetricCmdNoop)
-			err = s.orca.Noop(request.(common.NoopRequest))
-		case common.RequestQuit:
-			metrics.IncCounter(MetricCmdQuit)
-			s.orca.Quit(request.(common.QuitRequest))
-			abort(s.conns, err)
+		if !s.run(s.orca, request, reqType) {
 			return
-		case common.RequestVersion:
-			metrics.IncCounter(MetricCmdVersion)
-			err = s.orca.Version(request.(common.VersionRequest))
-		case common.RequestUnknown:
-			metrics.IncCounter(MetricCmdUnknown)
-			err = s.orca.Unknown(request)
 		}
+	}
+}
 
-		if err != nil {
-			if common.IsAppError(err) {
-				if err != common.ErrKeyNotFound {
-					metrics.IncCounter(MetricErrAppError)
-				}
-				s.orca.Error(request, reqType, err)
-			} else {
-				metrics.IncCounter(MetricErrUnrecoverable)
-				abort(s.conns, err)
-				return
+// Closes the connection if a request panics, instead of taking down the whole
+// process.
+func (s *DefaultServer) recoverPanic() {
+	if r := recover(); r != nil {
+		if r != io.EOF {
+			s.rl.Println("Recovered from runtime panic:", r)
+			s.rl.Println("Panic location: ", identifyPanic())
+		}
+		// Close the connections so they don't leak or stay open in the
+		// connection gauges
+		abort(s.conns, nil, s.rl)
+	}
+}
+
+// Runs a parsed request with the orca. Returns false once the connection has
+// been closed, either because the client quit or because of an error the
+// connection can't recover from.
+func (s *DefaultServer) run(o orcas.Orca, request common.Request, reqType common.RequestType) bool {
+	if !s.cmds.Allowed(request, reqType) {
+		metrics.IncCounter(MetricCmdDenied)
+		o.Error(request, reqType, common.ErrUnknownCmd)
+		if req, ok := request.(common.SetRequest); ok {
+			common.PutBuf(req.Data)
+		}
+		return true
+	}
+	if req, ok := request.(common.GetRequest); ok && tooManyKeys(len(req.Keys)) {
+		metrics.IncCounter(MetricCmdTooManyKeys)
+		o.Error(request, reqType, common.ErrTooManyKeys)
+		return true
+	}
+
+	// Timing starts once the request is parsed so the time spent waiting
+	// for the client to send the next request isn't counted.
+	start := time.Now()
+
+	metrics.IncCounter(MetricCmdTotal)
+	observeKeys(request)
+
+	span := tracing.StartSpan(cmdName(reqType), tracing.KindServer)
+	if span != nil {
+		request = withSpan(request, span)
+	}
+	if s.budget > 0 {
+		request = withDeadline(request, start.Add(s.budget))
+	}
+
+	// Waiting for a slot counts toward the request's latency and budget.
+	// The slot is freed even if the request panics.
+	s.inFlight.acquire()
+	err := s.dispatch(o, request, reqType)
+	s.inFlight.release()
+
+	if reqType == common.RequestQuit {
+		abort(s.conns, nil, s.rl)
+		return false
+	}
+
+	if err != nil {
+		if common.IsAppError(err) {
+			if err != common.ErrKeyNotFound {
+				metrics.IncCounter(MetricErrAppError)
 			}
+			o.Error(request, reqType, err)
+		} else {
+			metrics.IncCounter(MetricErrUnrecoverable)
+			abort(s.conns, err, s.rl)
+			return false
 		}
+	}
 
-		dur := uint64(time.Since(start))
-		switch reqType {
-		case common.RequestSet:
-			metrics.ObserveHist(HistSet, dur)
-		case common.RequestAdd:
-			metrics.ObserveHist(HistAdd, dur)
-		case common.RequestReplace:
-			metrics.ObserveHist(HistReplace, dur)
-		case common.RequestDelete:
-			metrics.ObserveHist(HistDelete, dur)
-		case common.RequestTouch:
-			metrics.ObserveHist(HistTouch, dur)
-		case common.RequestGet:
-			metrics.ObserveHist(HistGet, dur)
-		case common.RequestGetE:
-			metrics.ObserveHist(HistGetE, dur)
-		case common.RequestGat:
-			metrics.ObserveHist(HistGat, dur)
+	if err != nil && err != common.ErrKeyNotFound {
+		span.SetTag("error", err.Error())
+	}
+	span.Finish()
+
+	// The backends have written out or copied the value by the time the
+	// command is done, so its buffer can be reused.
+	if req, ok := request.(common.SetRequest); ok {
+		common.PutBuf(req.Data)
+	}
+
+	dur := uint64(time.Since(start))
+	if s.budget > 0 && time.Duration(dur) > s.budget {
+		metrics.IncCounter(MetricCmdBudgetExceeded)
+	}
+	switch reqType {
+	case common.RequestSet:
+		metrics.ObserveHist(HistSet, dur)
+	case common.RequestAdd:
+		metrics.ObserveHist(HistAdd, dur)
+	case common.RequestReplace:
+		metrics.ObserveHist(HistReplace, dur)
+	case common.RequestAppend:
+		metrics.ObserveHist(HistAppend, dur)
+	case common.RequestPrepend:
+		metrics.ObserveHist(HistPrepend, dur)
+	case common.RequestDelete:
+		metrics.ObserveHist(HistDelete, dur)
+	case common.RequestTouch:
+		metrics.ObserveHist(HistTouch, dur)
+	case common.RequestGet:
+		metrics.ObserveHist(HistGet, dur)
+	case common.RequestGetE:
+		metrics.ObserveHist(HistGetE, dur)
+	case common.RequestGat:
+		metrics.ObserveHist(HistGat, dur)
+	}
+
+	return true
+}
+
+// Sends the request to the orca method for its command. The in-flight slot is
+// given back if the orca panics.
+func (s *DefaultServer) dispatch(o orcas.Orca, request common.Request, reqType common.RequestType) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.inFlight.release()
+			panic(r)
+		}
+	}()
+
+	// TODO: handle nil
+	switch reqType {
+	case common.RequestSet:
+		metrics.IncCounter(MetricCmdSet)
+		err = o.Set(request.(common.SetRequest))
+	case common.RequestAdd:
+		metrics.IncCounter(MetricCmdAdd)
+		err = o.Add(request.(common.SetRequest))
+	case common.RequestReplace:
+		metrics.IncCounter(MetricCmdReplace)
+		err = o.Replace(request.(common.SetRequest))
+	case common.RequestAppend:
+		metrics.IncCounter(MetricCmdAppend)
+		err = o.Append(request.(common.SetRequest))
+	case common.RequestPrepend:
+		metrics.IncCounter(MetricCmdPrepend)
+		err = o.Prepend(request.(common.SetRequest))
+	case common.RequestDelete:
+		metrics.IncCounter(MetricCmdDelete)
+		err = o.Delete(request.(common.DeleteRequest))
+	case common.RequestTouch:
+		metrics.IncCounter(MetricCmdTouch)
+		err = o.Touch(request.(common.TouchRequest))
+	case common.RequestGet:
+		metrics.IncCounter(MetricCmdGet)
+		err = o.Get(request.(common.GetRequest))
+	case common.RequestGetE:
+		metrics.IncCounter(MetricCmdGetE)
+		err = o.GetE(request.(common.GetRequest))
+	case common.RequestGat:
+		metrics.IncCounter(MetricCmdGat)
+		err = o.Gat(request.(common.GATRequest))
+	case common.RequestNoop:
+		metrics.IncCounter(MetricCmdNoop)
+		err = o.Noop(request.(common.NoopRequest))
+	case common.RequestQuit:
+		metrics.IncCounter(MetricCmdQuit)
+		o.Quit(request.(common.QuitRequest))
+	case common.RequestVersion:
+		metrics.IncCounter(MetricCmdVersion)
+		err = o.Version(request.(common.VersionRequest))
+	case common.RequestStats:
+		metrics.IncCounter(MetricCmdStats)
+		err = o.Stats(request.(common.StatsRequest))
+	case common.RequestLruCrawler:
+		metrics.IncCounter(MetricCmdLruCrawler)
+		err = o.LruCrawler(request.(common.LruCrawlerRequest))
+	case common.RequestLeaseGet:
+		metrics.IncCounter(MetricCmdLeaseGet)
+		if lo, ok := o.(orcas.LeaseOrca); ok {
+			err = lo.LeaseGet(request.(common.GetRequest))
+		} else {
+			err = common.ErrUnknownCmd
+		}
+	case common.RequestLeaseSet:
+		metrics.IncCounter(MetricCmdLeaseSet)
+		if lo, ok := o.(orcas.LeaseOrca); ok {
+			err = lo.LeaseSet(request.(common.SetRequest))
+		} else {
+			err = common.ErrUnknownCmd
+		}
+	case common.RequestUnknown:
+		metrics.IncCounter(MetricCmdUnknown)
+		err = o.Unknown(request)
+	}
+	return err
+}
+
+// Records the keys of a request in the hot key tracker. Keys are redacted
+// first so the tracker never holds keys that can't be shown.
+func observeKeys(request common.Request) {
+	switch req := request.(type) {
+	case common.SetRequest:
+		metrics.ObserveTopK(TopKeys, common.RedactKey(req.Key))
+	case common.GetRequest:
+		for _, key := range req.Keys {
+			metrics.ObserveTopK(TopKeys, common.RedactKey(key))
 		}
+	case common.DeleteRequest:
+		metrics.ObserveTopK(TopKeys, common.RedactKey(req.Key))
+	case common.TouchRequest:
+		metrics.ObserveTopK(TopKeys, common.RedactKey(req.Key))
+	case common.GATRequest:
+		metrics.ObserveTopK(TopKeys, common.RedactKey(req.Key))
+	}
+}
+
+// Returns the name of the command used for its span.
+func cmdName(reqType common.RequestType) string {
+	switch reqType {
+	case common.RequestSet:
+		return "set"
+	case common.RequestAdd:
+		return "add"
+	case common.RequestReplace:
+		return "replace"
+	case common.RequestAppend:
+		return "append"
+	case common.RequestPrepend:
+		return "prepend"
+	case common.RequestDelete:
+		return "delete"
+	case common.RequestTouch:
+		return "touch"
+	case common.RequestGet:
+		return "get"
+	case common.RequestGetE:
+		return "gete"
+	case common.RequestGat:
+		return "gat"
+	case common.RequestNoop:
+		return "noop"
+	case common.RequestQuit:
+		return "quit"
+	case common.RequestVersion:
+		return "version"
+	case common.RequestStats:
+		return "stats"
+	case common.RequestLruCrawler:
+		return "lru_crawler"
+	case common.RequestLeaseGet:
+		return "lget"
+	case common.RequestLeaseSet:
+		return "lset"
+	}
+	return "unknown"
+}
+
+// Returns a copy of the request that carries the span to the backends.
+// Requests that never reach a backend are returned as-is.
+func withSpan(request common.Request, span *tracing.Span) common.Request {
+	switch req := request.(type) {
+	case common.SetRequest:
+		req.Span = span
+		return req
+	case common.GetRequest:
+		span.SetTag("keys", strconv.Itoa(len(req.Keys)))
+		req.Span = span
+		return req
+	case common.DeleteRequest:
+		req.Span = span
+		return req
+	case common.TouchRequest:
+		req.Span = span
+		return req
+	case common.GATRequest:
+		req.Span = span
+		return req
+	}
+	return request
+}
+
+// Returns a copy of the request with the deadline for the backends to give up
+// at. Requests that never reach a backend are returned as-is.
+func withDeadline(request common.Request, deadline time.Time) common.Request {
+	switch req := request.(type) {
+	case common.SetRequest:
+		req.Deadline = deadline
+		return req
+	case common.GetRequest:
+		req.Deadline = deadline
+		return req
+	case common.DeleteRequest:
+		req.Deadline = deadline
+		return req
+	case common.TouchRequest:
+		req.Deadline = deadline
+		return req
+	case common.GATRequest:
+		req.Deadline = deadline
+		return req
 	}
+	return request
 }
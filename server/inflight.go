@@ -0,0 +1,57 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "github.com/netflix/rend/metrics"
+
+// inFlightLimit caps the requests the connections of a listener work on at
+// once, so a listener with a lot of traffic can't take up all of the backends'
+// time and starve another listener in the same process. Each request holds a
+// slot while it's dispatched. A nil inFlightLimit has no cap.
+type inFlightLimit chan struct{}
+
+func newInFlightLimit(max int) inFlightLimit {
+	if max <= 0 {
+		return nil
+	}
+	return make(inFlightLimit, max)
+}
+
+func (l inFlightLimit) acquire() {
+	if l == nil {
+		return
+	}
+
+	select {
+	case l <- struct{}{}:
+		return
+	default:
+	}
+
+	metrics.IncCounter(MetricCmdInFlightLimited)
+	l <- struct{}{}
+}
+
+func (l inFlightLimit) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// Servers that limit the requests in flight implement inFlightLimitSetter to
+// share the listener's limit.
+type inFlightLimitSetter interface {
+	setInFlightLimit(l inFlightLimit)
+}
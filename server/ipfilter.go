@@ -0,0 +1,102 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IPFilter decides which client addresses a TCP listener accepts connections
+// from. If there are allow rules, an address has to match one of them, and an
+// address that matches a deny rule is refused even if it is also allowed, so a
+// range can be allowed with holes in it.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter returns a filter from lists of CIDR ranges, e.g. "10.0.0.0/8".
+// Plain IP addresses match only themselves.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	var f IPFilter
+	var err error
+
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", c)
+		}
+		ret = append(ret, ipnet)
+	}
+
+	return ret, nil
+}
+
+// Allowed returns whether a connection from the address should be accepted.
+// Addresses without an IP, like those of unix sockets, are always accepted.
+func (f *IPFilter) Allowed(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	if len(f.allow) > 0 && !contains(f.allow, tcpAddr.IP) {
+		return false
+	}
+	return !contains(f.deny, tcpAddr.IP)
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "sync/atomic"
+
+// The most keys a get may have, or 0 for no limit
+var maxGetKeys int64
+
+// SetMaxGetKeys sets the most keys a get on any listener may have. Gets with
+// more are refused with a client error before anything is fetched, so one
+// request can't make the proxy build an unbounded response. There is no limit
+// if n is 0. It can be changed while connections are being served.
+func SetMaxGetKeys(n int) {
+	atomic.StoreInt64(&maxGetKeys, int64(n))
+}
+
+// MaxGetKeys returns the most keys a get may have, or 0 if there is no limit.
+func MaxGetKeys() int {
+	return int(atomic.LoadInt64(&maxGetKeys))
+}
+
+func tooManyKeys(n int) bool {
+	max := atomic.LoadInt64(&maxGetKeys)
+	return max > 0 && int64(n) > max
+}
@@ -21,108 +21,353 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
 	"time"
 
-	"github.com/netflix/rend/binprot"
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
-	"github.com/netflix/rend/textprot"
 )
 
+// Config is everything needed to run a listener: where to listen, and how to
+// build the server, orca, and backend handlers for each connection.
+type Config struct {
+	ListenArgs
+	// Builds the server loop for each connection. Default if nil.
+	Server ServerConst
+	Orca   orcas.OrcaConst
+	// Wrapped around the orca in order, so the first is the outermost
+	Middleware []orcas.Middleware
+	L1         handlers.HandlerConst
+	// NilHandler if nil, for orcas that only use L1
+	L2 handlers.HandlerConst
+}
+
+// ListenAndServe serves connections on the listener described by the
+// arguments forever. Errors binding the listener are logged. Use Serve to
+// handle them instead.
 func ListenAndServe(l ListenArgs, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) {
-	var listener net.Listener
-	var err error
+	err := Serve(Config{
+		ListenArgs: l,
+		Server:     s,
+		Orca:       o,
+		L1:         h1,
+		L2:         h2,
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
 
+// Serve binds the listener in the config and serves connections on it forever.
+// It only returns if the listener can't be bound.
+func Serve(c Config) error {
+	listener, err := listen(c.ListenArgs)
+	if err != nil {
+		return err
+	}
+
+	s := c.Server
+	if s == nil {
+		s = Default
+	}
+	h1 := c.L1
+	h2 := c.L2
+	if h2 == nil {
+		h2 = handlers.NilHandler
+	}
+	// Inside the backend down policy, so a connection closed at a deadline
+	// isn't taken for the backend going down
+	if c.Budget > 0 {
+		h1 = handlers.Budgeted(h1, c.BudgetPolicy == BudgetMiss)
+		h2 = handlers.Budgeted(h2, c.BudgetPolicy == BudgetMiss)
+	}
+	if c.Unavailable == UnavailableMiss {
+		h1 = handlers.MissWhenDown(h1, "l1")
+		h2 = handlers.MissWhenDown(h2, "l2")
+	}
+	// Outside of the backend down policy, so each extra connection recovers
+	// on its own
+	if c.GetFanOut > 1 {
+		h1 = handlers.FanOut(h1, c.GetFanOut, !c.GetAnyOrder)
+		h2 = handlers.FanOut(h2, c.GetFanOut, !c.GetAnyOrder)
+	}
+
+	// Outside of all the middleware, so responses sent by any of it are
+	// ordered too
+	o := orcas.Chain(c.Orca, c.Middleware...)
+	if !c.GetAnyOrder {
+		o = orcas.Ordered(o)
+	}
+
+	serve(listener, c.ListenArgs, s, o, h1, h2)
+	return nil
+}
+
+func listen(l ListenArgs) (net.Listener, error) {
 	switch l.Type {
 	case ListenTCP:
-		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", l.Port))
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", l.Port))
 		if err != nil {
-			log.Printf("Error binding to port %d\n", l.Port)
-			return
+			return nil, fmt.Errorf("Error binding to port %d: %s", l.Port, err.Error())
 		}
+		return listener, nil
 
 	case ListenUnix:
-		err = os.Remove(l.Path)
+		err := os.Remove(l.Path)
 		if err != nil && !os.IsNotExist(err) {
 			log.Printf("Error removing previous unix socket file at %s\n", l.Path)
 		}
-		listener, err = net.Listen("unix", l.Path)
+		listener, err := net.Listen("unix", l.Path)
 		if err != nil {
-			log.Printf("Error binding to unix socket at %s\n", l.Path)
-			return
+			return nil, fmt.Errorf("Error binding to unix socket at %s: %s", l.Path, err.Error())
 		}
-
-	default:
-		log.Panicf("Unsupported server listen type: %v", l.Type)
+		return listener, nil
 	}
 
+	return nil, fmt.Errorf("Unsupported server listen type: %v", l.Type)
+}
+
+func serve(listener net.Listener, l ListenArgs, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) {
+	limit := newConnLimit(l.MaxConns)
+	inFlight := newInFlightLimit(l.MaxInFlight)
+
 	for {
-		remote, err := listener.Accept()
+		// Wait for a free slot before accepting, so new connections queue up in
+		// the listen backlog instead of each starting more goroutines.
+		limit.acquire()
+
+		conn, err := listener.Accept()
 		if err != nil {
 			log.Println("Error accepting connection from remote:", err.Error())
-			remote.Close()
+			metrics.IncCounter(MetricConnectionErrorsAccept)
+			limit.release()
+			continue
+		}
+		if !l.IPs.Allowed(conn.RemoteAddr()) {
+			metrics.IncCounter(MetricConnectionsRejected)
+			conn.Close()
+			limit.release()
 			continue
 		}
 		metrics.IncCounter(MetricConnectionsEstablishedExt)
+		client := conn
+		if l.Capture != nil {
+			client = l.Capture.Conn(conn)
+		}
+		remote := gaugedConn{client, limit.closer(gauged(client, GaugeConnectionsOpenExt))}
+		rl := common.NewRequestLog()
 
 		if l.Type == ListenTCP {
-			tcpRemote := remote.(*net.TCPConn)
+			tcpRemote := conn.(*net.TCPConn)
 			tcpRemote.SetKeepAlive(true)
 			tcpRemote.SetKeepAlivePeriod(30 * time.Second)
 		}
 
-		// construct L1 handler using given constructor
-		l1, err := h1()
-		if err != nil {
-			log.Println("Error opening connection to L1:", err.Error())
-			remote.Close()
-			continue
-		}
-		metrics.IncCounter(MetricConnectionsEstablishedL1)
-
-		// construct l2
-		l2, err := h2()
+		backends, err := openBackends(h1, h2, rl)
 		if err != nil {
-			log.Println("Error opening connection to L2:", err.Error())
-			l1.Close()
 			remote.Close()
 			continue
 		}
-		metrics.IncCounter(MetricConnectionsEstablishedL2)
 
 		// spin off a goroutine here to handle determining the protocol used for the connection.
 		// The server loop can't be started until the protocol is known. Another goroutine is
 		// necessary here because we don't want to block accepting new connections if the current
 		// new connection doesn't send data immediately.
 		go func(remoteConn net.Conn) {
-			remoteReader := bufio.NewReader(remoteConn)
-			remoteWriter := bufio.NewWriter(remoteConn)
+			// Responses are written to the client by their own goroutine. The
+			// writer has to be closed before the connection so the responses
+			// queued before the connection ends still get to the client.
+			rw := newResponseWriter(remoteConn, l.WriteTimeout, l.MaxPendingWrite)
+			closers := append([]io.Closer{rw, remoteConn}, backends.closers...)
 
-			var reqParser common.RequestParser
-			var responder common.Responder
+			remoteReader := common.ClientBufio.GetReader(remoteConn)
+			remoteWriter := common.ClientBufio.GetWriter(rw)
 
-			// A connection is either binary protocol or text. It cannot switch between the two.
-			// This is the way memcached handles protocols, so it can be as strict here.
-			binary, err := isBinaryRequest(remoteReader)
+			protocol, err := listenerProtocol(l, remoteReader)
 			if err != nil {
 				// must be an IO error. Abort!
-				abort([]io.Closer{remoteConn, l1, l2}, err)
+				abort(closers, err, rl)
+				common.ClientBufio.PutReader(remoteReader)
+				common.ClientBufio.PutWriter(remoteWriter)
 				return
 			}
 
-			if binary {
-				reqParser = binprot.NewBinaryParser(remoteReader)
-				responder = binprot.NewBinaryResponder(remoteWriter)
-			} else {
-				reqParser = textprot.NewTextParser(remoteReader)
-				responder = textprot.NewTextResponder(remoteWriter)
+			// The parser moves the log on to the next request ID as it reads each request
+			reqParser, responder := protocol.newConn(remoteReader, remoteWriter, rl)
+
+			// Binary clients can match responses to requests by opaque, so
+			// their requests can be answered out of order
+			var mux *multiplexer
+			if l.Multiplex > 1 && protocol.Name == BinaryProtocol.Name {
+				mux = newMultiplexer(l.Multiplex, rw, func(w *bufio.Writer) (orcas.Orca, []io.Closer, error) {
+					b, err := openBackends(h1, h2, rl)
+					if err != nil {
+						return nil, nil, err
+					}
+					return o(b.l1, b.l2, protocol.NewResponder(w, rl)), b.closers, nil
+				})
+				closers = append(closers, mux)
 			}
 
-			server := s([]io.Closer{remoteConn, l1, l2}, reqParser, o(l1, l2, responder))
+			server := s(closers, reqParser, o(backends.l1, backends.l2, responder))
+			if rls, ok := server.(requestLogSetter); ok {
+				rls.SetRequestLog(rl)
+			}
+			if cfs, ok := server.(commandFilterSetter); ok {
+				cfs.SetCommandFilter(l.Commands)
+			}
+			if bs, ok := server.(budgetSetter); ok {
+				bs.SetBudget(l.Budget)
+			}
+			if ifs, ok := server.(inFlightLimitSetter); ok {
+				ifs.setInFlightLimit(inFlight)
+			}
+			if ms, ok := server.(multiplexerSetter); ok && mux != nil {
+				ms.setMultiplexer(mux)
+			}
 
-			go server.Loop()
+			// The buffers go back to the pool once the connection is closed
+			server.Loop()
+			common.ClientBufio.PutReader(remoteReader)
+			common.ClientBufio.PutWriter(remoteWriter)
 		}(remote)
 	}
 }
+
+// The backend connections of a client connection
+type backendConns struct {
+	l1, l2 handlers.Handler
+	// Keep the open connection gauges
+	closers []io.Closer
+}
+
+// Opens a connection to each backend. Errors are logged and counted.
+func openBackends(h1, h2 handlers.HandlerConst, rl *common.RequestLog) (backendConns, error) {
+	// construct L1 handler using given constructor
+	l1, err := h1()
+	if err != nil {
+		rl.Println("Error opening connection to L1:", err.Error())
+		metrics.IncCounter(MetricConnectionErrorsL1)
+		return backendConns{}, err
+	}
+	metrics.IncCounter(MetricConnectionsEstablishedL1)
+	l1Closer := gauged(l1, GaugeConnectionsOpenL1)
+
+	// construct l2
+	l2, err := h2()
+	if err != nil {
+		rl.Println("Error opening connection to L2:", err.Error())
+		metrics.IncCounter(MetricConnectionErrorsL2)
+		l1Closer.Close()
+		return backendConns{}, err
+	}
+	metrics.IncCounter(MetricConnectionsEstablishedL2)
+	l2Closer := gauged(l2, GaugeConnectionsOpenL2)
+
+	return backendConns{l1: l1, l2: l2, closers: []io.Closer{l1Closer, l2Closer}}, nil
+}
+
+// Servers that log about requests implement requestLogSetter to use the same
+// request IDs as the parser.
+type requestLogSetter interface {
+	SetRequestLog(rl *common.RequestLog)
+}
+
+// Servers that give requests deadlines implement budgetSetter to use the
+// listener's latency budget.
+type budgetSetter interface {
+	SetBudget(budget time.Duration)
+}
+
+// gaugedCloser keeps a gauge of open connections. The gauge is incremented
+// when the closer is made and decremented on the first Close.
+type gaugedCloser struct {
+	io.Closer
+	gauge uint32
+	once  sync.Once
+}
+
+// Returns nil for a nil closer, e.g. when there is no L2.
+func gauged(c io.Closer, gauge uint32) io.Closer {
+	if c == nil {
+		return nil
+	}
+	metrics.IncIntGauge(gauge)
+	return &gaugedCloser{Closer: c, gauge: gauge}
+}
+
+func (g *gaugedCloser) Close() error {
+	var err error
+	g.once.Do(func() {
+		metrics.DecIntGauge(g.gauge)
+		err = g.Closer.Close()
+	})
+	return err
+}
+
+// gaugedConn is a net.Conn whose Close goes through a gaugedCloser.
+type gaugedConn struct {
+	net.Conn
+	closer io.Closer
+}
+
+func (g gaugedConn) Close() error {
+	return g.closer.Close()
+}
+
+// connLimit caps the number of open client connections on a listener. Each
+// connection holds a slot until it's closed. A nil connLimit has no cap.
+type connLimit chan struct{}
+
+func newConnLimit(max int) connLimit {
+	if max <= 0 {
+		return nil
+	}
+	return make(connLimit, max)
+}
+
+func (l connLimit) acquire() {
+	if l == nil {
+		return
+	}
+
+	select {
+	case l <- struct{}{}:
+		return
+	default:
+	}
+
+	metrics.IncCounter(MetricConnectionsLimited)
+	l <- struct{}{}
+}
+
+func (l connLimit) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// Returns a closer that also frees the connection's slot on the first Close.
+func (l connLimit) closer(c io.Closer) io.Closer {
+	if l == nil {
+		return c
+	}
+	return &limitedCloser{Closer: c, limit: l}
+}
+
+type limitedCloser struct {
+	io.Closer
+	limit connLimit
+	once  sync.Once
+}
+
+func (c *limitedCloser) Close() error {
+	var err error
+	c.once.Do(func() {
+		err = c.Closer.Close()
+		c.limit.release()
+	})
+	return err
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/orcas"
+)
+
+// multiplexer runs the requests of a binary protocol connection at the same
+// time, for clients that share one connection between many threads. Binary
+// clients match responses to requests by their opaques, so each response is
+// written as soon as its request is done instead of waiting for the ones
+// before it. Each request is run by a worker with its own orca and backend
+// connections, which are made the first time they're needed and kept for
+// later requests. A worker's response is buffered and written to the client
+// all at once, so responses never interleave.
+//
+// Only the key commands are run this way. A request for a key that an earlier
+// request still being run has, like a get right after a set, waits for the
+// requests before it to be done, so a client sees its own writes. Anything
+// else, like a noop ending a batch of quiet sets, waits as well.
+type multiplexer struct {
+	out       io.Writer
+	newWorker func(w *bufio.Writer) (orcas.Orca, []io.Closer, error)
+
+	// One per request being run, to cap the workers
+	slots chan struct{}
+	idle  chan *muxWorker
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	// The keys of the requests being run
+	keys map[string]int
+}
+
+type muxWorker struct {
+	orca    orcas.Orca
+	buf     *bytes.Buffer
+	w       *bufio.Writer
+	closers []io.Closer
+}
+
+// Returns a multiplexer that runs up to max requests at once and writes their
+// responses to out. newWorker makes an orca whose responses go to the given
+// writer, along with the closers for its backend connections.
+func newMultiplexer(max int, out io.Writer, newWorker func(w *bufio.Writer) (orcas.Orca, []io.Closer, error)) *multiplexer {
+	return &multiplexer{
+		out:       out,
+		newWorker: newWorker,
+		slots:     make(chan struct{}, max),
+		idle:      make(chan *muxWorker, max),
+		keys:      make(map[string]int),
+	}
+}
+
+// Returns whether requests of the type are run at the same time as others.
+func multiplexed(reqType common.RequestType) bool {
+	switch reqType {
+	case common.RequestSet,
+		common.RequestAdd,
+		common.RequestReplace,
+		common.RequestAppend,
+		common.RequestPrepend,
+		common.RequestDelete,
+		common.RequestTouch,
+		common.RequestGet,
+		common.RequestGetE,
+		common.RequestGat:
+		return true
+	}
+	return false
+}
+
+// Starts running the request on a free worker, waiting for one if they're all
+// busy. Returns an error if a new worker's backend connections can't be made.
+func (m *multiplexer) run(s *DefaultServer, request common.Request, reqType common.RequestType) error {
+	keys := requestKeys(request)
+	if m.running(keys) {
+		m.wait()
+	}
+	m.track(keys, 1)
+
+	m.slots <- struct{}{}
+
+	var w *muxWorker
+	select {
+	case w = <-m.idle:
+	default:
+		var err error
+		if w, err = m.makeWorker(); err != nil {
+			<-m.slots
+			m.track(keys, -1)
+			return err
+		}
+	}
+
+	metrics.IncCounter(MetricCmdMultiplexed)
+	m.wg.Add(1)
+	go func() {
+		ok := false
+		defer func() {
+			if ok {
+				m.put(w)
+			} else {
+				w.close()
+			}
+			m.track(keys, -1)
+			<-m.slots
+			m.wg.Done()
+		}()
+		defer s.recoverPanic()
+
+		ok = s.run(w.orca, request, reqType)
+
+		// The responder flushes to the worker's buffer as it goes
+		w.w.Flush()
+		if w.buf.Len() > 0 {
+			m.out.Write(w.buf.Bytes())
+			w.buf.Reset()
+		}
+	}()
+
+	return nil
+}
+
+// Returns the keys a request reads or writes.
+func requestKeys(request common.Request) [][]byte {
+	switch req := request.(type) {
+	case common.SetRequest:
+		return [][]byte{req.Key}
+	case common.GetRequest:
+		return req.Keys
+	case common.DeleteRequest:
+		return [][]byte{req.Key}
+	case common.TouchRequest:
+		return [][]byte{req.Key}
+	case common.GATRequest:
+		return [][]byte{req.Key}
+	}
+	return nil
+}
+
+// Returns whether any of the keys belong to a request being run.
+func (m *multiplexer) running(keys [][]byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		if m.keys[string(key)] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds delta to the count of requests being run for each key.
+func (m *multiplexer) track(keys [][]byte, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		k := string(key)
+		if m.keys[k] += delta; m.keys[k] <= 0 {
+			delete(m.keys, k)
+		}
+	}
+}
+
+func (m *multiplexer) makeWorker() (*muxWorker, error) {
+	w := &muxWorker{buf: new(bytes.Buffer)}
+	w.w = common.ClientBufio.GetWriter(w.buf)
+
+	o, closers, err := m.newWorker(w.w)
+	if err != nil {
+		common.ClientBufio.PutWriter(w.w)
+		return nil, err
+	}
+	w.orca = o
+	w.closers = closers
+	return w, nil
+}
+
+// Keeps the worker for a later request, unless the connection has been closed.
+func (m *multiplexer) put(w *muxWorker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		w.close()
+		return
+	}
+	m.idle <- w
+}
+
+// Waits for the requests being run to be done.
+func (m *multiplexer) wait() {
+	m.wg.Wait()
+}
+
+// Close closes the backend connections of the idle workers. Workers still
+// running a request close theirs once it's done.
+func (m *multiplexer) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	for {
+		select {
+		case w := <-m.idle:
+			w.close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (w *muxWorker) close() {
+	for _, c := range w.closers {
+		if c != nil {
+			c.Close()
+		}
+	}
+	common.ClientBufio.PutWriter(w.w)
+}
+
+// Servers that can run requests at the same time implement multiplexerSetter
+// to use the listener's multiplexing.
+type multiplexerSetter interface {
+	setMultiplexer(m *multiplexer)
+}
@@ -0,0 +1,155 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"sync"
+
+	"github.com/netflix/rend/binprot"
+	"github.com/netflix/rend/bulkprot"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/textprot"
+)
+
+// Protocol is a wire protocol clients can use. The parser and responder are
+// all the server loop and orcas see of a protocol, so adding one doesn't touch
+// the orcas or handlers.
+type Protocol struct {
+	Name string
+	// Detect returns whether a connection that starts with the given byte is
+	// using the protocol.
+	Detect func(first byte) bool
+	// NewParser and NewResponder are called for each connection using the
+	// protocol. The request log is shared with the server loop so log lines
+	// about a request have the same ID.
+	NewParser    func(r *bufio.Reader, rl *common.RequestLog) common.RequestParser
+	NewResponder func(w *bufio.Writer, rl *common.RequestLog) common.Responder
+	// New is used instead of NewParser and NewResponder if it's set, for
+	// protocols whose parser and responder share state.
+	New func(r *bufio.Reader, w *bufio.Writer, rl *common.RequestLog) (common.RequestParser, common.Responder)
+}
+
+func (p Protocol) newConn(r *bufio.Reader, w *bufio.Writer, rl *common.RequestLog) (common.RequestParser, common.Responder) {
+	if p.New != nil {
+		return p.New(r, w, rl)
+	}
+	return p.NewParser(r, rl), p.NewResponder(w, rl)
+}
+
+var BinaryProtocol = Protocol{
+	Name: "binary",
+	Detect: func(first byte) bool {
+		return first == binprot.MagicRequest
+	},
+	NewParser: func(r *bufio.Reader, rl *common.RequestLog) common.RequestParser {
+		p := binprot.NewBinaryParser(r)
+		p.Log = rl
+		return p
+	},
+	NewResponder: func(w *bufio.Writer, rl *common.RequestLog) common.Responder {
+		return binprot.NewBinaryResponder(w)
+	},
+}
+
+// TextProtocol is used for any connection no other protocol claims, like
+// memcached does.
+var TextProtocol = Protocol{
+	Name: "text",
+	Detect: func(first byte) bool {
+		return true
+	},
+	NewParser: func(r *bufio.Reader, rl *common.RequestLog) common.RequestParser {
+		p := textprot.NewTextParser(r)
+		p.Log = rl
+		return p
+	},
+	NewResponder: func(w *bufio.Writer, rl *common.RequestLog) common.Responder {
+		r := textprot.NewTextResponder(w)
+		r.Log = rl
+		return r
+	},
+	// The parser and responder share state for the meta commands
+	New: func(r *bufio.Reader, w *bufio.Writer, rl *common.RequestLog) (common.RequestParser, common.Responder) {
+		p, res := textprot.NewTextConn(r, w)
+		p.Log = rl
+		res.Log = rl
+		return p, res
+	},
+}
+
+// BulkProtocol is for bulk producers sending many operations at once. It isn't
+// detected on the memcached listeners, only served on listeners set to use it.
+var BulkProtocol = Protocol{
+	Name: "bulk",
+	Detect: func(first byte) bool {
+		return first == bulkprot.MagicRequest
+	},
+	New: func(r *bufio.Reader, w *bufio.Writer, rl *common.RequestLog) (common.RequestParser, common.Responder) {
+		c := bulkprot.NewConn(r, w)
+		c.Log = rl
+		return c, c
+	},
+}
+
+var (
+	protocolsLock sync.RWMutex
+	// In the order they're tried
+	protocols = []Protocol{BinaryProtocol, TextProtocol}
+)
+
+// RegisterProtocol adds a protocol to be tried for new connections before the
+// ones already registered. A protocol with the same name replaces the
+// existing one.
+func RegisterProtocol(p Protocol) {
+	protocolsLock.Lock()
+	defer protocolsLock.Unlock()
+
+	ps := []Protocol{p}
+	for _, existing := range protocols {
+		if existing.Name != p.Name {
+			ps = append(ps, existing)
+		}
+	}
+	protocols = ps
+}
+
+// Picks the protocol of a connection from the first byte it sends. A
+// connection can't switch protocols afterward, which is how memcached works
+// as well. Returns an error if the first byte can't be read.
+func detectProtocol(reader *bufio.Reader) (Protocol, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return Protocol{}, err
+	}
+
+	protocolsLock.RLock()
+	defer protocolsLock.RUnlock()
+
+	for _, p := range protocols {
+		if p.Detect(first[0]) {
+			return p, nil
+		}
+	}
+	return TextProtocol, nil
+}
+
+// Returns the protocol the listener is set to use, or detects it.
+func listenerProtocol(l ListenArgs, reader *bufio.Reader) (Protocol, error) {
+	if l.Protocol != nil {
+		return *l.Protocol, nil
+	}
+	return detectProtocol(reader)
+}
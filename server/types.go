@@ -15,8 +15,11 @@
 package server
 
 import (
+	"fmt"
 	"io"
+	"time"
 
+	"github.com/netflix/rend/capture"
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
@@ -35,6 +38,51 @@ const (
 	ListenUnix
 )
 
+// UnavailablePolicy is what clients of a listener see when a backend can't be
+// reached.
+type UnavailablePolicy int
+
+const (
+	// The client connection is closed, like memcached going away.
+	UnavailableClose UnavailablePolicy = iota
+	// Gets miss, everything else gets a server error, and the client
+	// connection stays open. Backends are reconnected to once they're back.
+	UnavailableMiss
+)
+
+// ParseUnavailablePolicy returns the policy named "close" or "miss".
+func ParseUnavailablePolicy(s string) (UnavailablePolicy, error) {
+	switch s {
+	case "close":
+		return UnavailableClose, nil
+	case "miss":
+		return UnavailableMiss, nil
+	}
+	return UnavailableClose, fmt.Errorf("unknown backend down policy %q, expected close or miss", s)
+}
+
+// BudgetPolicy is what clients of a listener see when a request runs past the
+// listener's latency budget.
+type BudgetPolicy int
+
+const (
+	// Gets and GATs miss, and everything else gets a server error.
+	BudgetMiss BudgetPolicy = iota
+	// Everything gets a server error.
+	BudgetError
+)
+
+// ParseBudgetPolicy returns the policy named "miss" or "error".
+func ParseBudgetPolicy(s string) (BudgetPolicy, error) {
+	switch s {
+	case "miss":
+		return BudgetMiss, nil
+	case "error":
+		return BudgetError, nil
+	}
+	return BudgetMiss, fmt.Errorf("unknown latency budget policy %q, expected miss or error", s)
+}
+
 type ListenArgs struct {
 	// The type of the connection. "tcp" or "unix" only.
 	Type ListenType
@@ -42,41 +90,124 @@ type ListenArgs struct {
 	Port int
 	// Unix domain socket path to listen on, if applicable
 	Path string
+	// The most client connections open at once. New connections wait to be
+	// accepted until one closes. No limit if 0.
+	MaxConns int
+	// The most requests from the listener's connections worked on at once.
+	// Further requests wait for one to finish. No limit if 0.
+	MaxInFlight int
+	// The commands the listener serves. All commands are served if nil.
+	Commands *CommandFilter
+	// The client addresses the listener accepts connections from. All
+	// addresses are accepted if nil.
+	IPs *IPFilter
+	// Records what clients send on the listener so it can be replayed later.
+	// Nothing is recorded if nil.
+	Capture *capture.Recorder
+	// The protocol all connections on the listener use. It's detected from the
+	// first byte each client sends if nil.
+	Protocol *Protocol
+	// What clients see when a backend can't be reached
+	Unavailable UnavailablePolicy
+	// The most backend connections the keys of one get are fetched over at
+	// once. Gets use one connection if 1 or less.
+	GetFanOut int
+	// Whether the responses of a multiget are sent as they arrive, from
+	// either backend or any of the connections it's fetched over, instead of
+	// in the order of the keys
+	GetAnyOrder bool
+	// How long each request may take, from when it's parsed, before the work
+	// left for it at the backends is abandoned. No limit if 0.
+	Budget time.Duration
+	// What clients see when a request runs past the budget
+	BudgetPolicy BudgetPolicy
+	// The most requests of a binary protocol connection run at once, each
+	// answered as soon as it's done, for clients sharing a connection between
+	// threads. Each request run at once has its own backend connections.
+	// Requests are run one at a time, in order, if 1 or less.
+	Multiplex int
+	// How long each write of a response to a client may block before the
+	// client is taken to have stopped reading and its connection is closed.
+	// No limit if 0.
+	WriteTimeout time.Duration
+	// The most response bytes waiting to be written to a client before its
+	// connection is closed. No limit if 0.
+	MaxPendingWrite int
 }
 
 var (
-	MetricConnectionsEstablishedExt = metrics.AddCounter("conn_established_ext")
-	MetricConnectionsEstablishedL1  = metrics.AddCounter("conn_established_l1")
-	MetricConnectionsEstablishedL2  = metrics.AddCounter("conn_established_l2")
-	MetricCmdTotal                  = metrics.AddCounter("cmd_total")
-	MetricErrAppError               = metrics.AddCounter("err_app_err")
-	MetricErrUnrecoverable          = metrics.AddCounter("err_unrecoverable")
-
-	MetricCmdGet     = metrics.AddCounter("cmd_get")
-	MetricCmdGetE    = metrics.AddCounter("cmd_gete")
-	MetricCmdSet     = metrics.AddCounter("cmd_set")
-	MetricCmdAdd     = metrics.AddCounter("cmd_add")
-	MetricCmdReplace = metrics.AddCounter("cmd_replace")
-	MetricCmdAppend  = metrics.AddCounter("cmd_append")
-	MetricCmdPrepend = metrics.AddCounter("cmd_prepend")
-	MetricCmdDelete  = metrics.AddCounter("cmd_delete")
-	MetricCmdTouch   = metrics.AddCounter("cmd_touch")
-	MetricCmdGat     = metrics.AddCounter("cmd_gat")
-	MetricCmdUnknown = metrics.AddCounter("cmd_unknown")
-	MetricCmdNoop    = metrics.AddCounter("cmd_noop")
-	MetricCmdQuit    = metrics.AddCounter("cmd_quit")
-	MetricCmdVersion = metrics.AddCounter("cmd_version")
-
-	HistSet     = metrics.AddHistogram("set", false)
-	HistAdd     = metrics.AddHistogram("add", false)
-	HistReplace = metrics.AddHistogram("replace", false)
-	HistAppend  = metrics.AddHistogram("append", false)
-	HistPrepend = metrics.AddHistogram("prepend", false)
-	HistDelete  = metrics.AddHistogram("delete", false)
-	HistTouch   = metrics.AddHistogram("touch", false)
-	HistGet     = metrics.AddHistogram("get", false)  // not sampled until configurable
-	HistGetE    = metrics.AddHistogram("gete", false) // not sampled until configurable
-	HistGat     = metrics.AddHistogram("gat", false)  // not sampled until configurable
+	MetricConnectionsEstablishedExt = metrics.AddCounter("conn_established_ext", nil)
+	MetricConnectionsEstablishedL1  = metrics.AddCounter("conn_established_l1", nil)
+	MetricConnectionsEstablishedL2  = metrics.AddCounter("conn_established_l2", nil)
+	MetricConnectionErrorsAccept    = metrics.AddCounter("conn_errors_accept", nil)
+	MetricConnectionsLimited        = metrics.AddCounter("conn_limited", nil)
+	MetricConnectionsRejected       = metrics.AddCounter("conn_rejected", nil)
+	MetricConnectionErrorsL1        = metrics.AddCounter("conn_errors_l1", nil)
+	MetricConnectionErrorsL2        = metrics.AddCounter("conn_errors_l2", nil)
+	// Client connections closed for not reading their responses fast enough
+	MetricConnectionsSlowClosed = metrics.AddCounter("conn_slow_closed", nil)
+
+	// Each client connection has its own L1 and L2 connections, so the open
+	// backend connections are the equivalent of pool utilization.
+	GaugeConnectionsOpenExt = metrics.AddIntGauge("conn_open_ext", nil)
+	GaugeConnectionsOpenL1  = metrics.AddIntGauge("conn_open_l1", nil)
+	GaugeConnectionsOpenL2  = metrics.AddIntGauge("conn_open_l2", nil)
+
+	MetricCmdTotal         = metrics.AddCounter("cmd_total", nil)
+	MetricErrAppError      = metrics.AddCounter("err_app_err", nil)
+	MetricErrUnrecoverable = metrics.AddCounter("err_unrecoverable", nil)
+	MetricErrClient        = metrics.AddCounter("err_client", nil)
+	MetricCmdDenied        = metrics.AddCounter("cmd_denied", nil)
+	// Gets refused for having more keys than the limit
+	MetricCmdTooManyKeys = metrics.AddCounter("cmd_too_many_keys", nil)
+	// Requests that ran past the listener's latency budget
+	MetricCmdBudgetExceeded = metrics.AddCounter("cmd_budget_exceeded", nil)
+	// Requests that waited for a slot under their listener's in-flight limit
+	MetricCmdInFlightLimited = metrics.AddCounter("cmd_in_flight_limited", nil)
+	// Requests of binary connections run at the same time as others
+	MetricCmdMultiplexed = metrics.AddCounter("cmd_multiplexed", nil)
+
+	MetricCmdGet     = metrics.AddCounter("cmd_get", nil)
+	MetricCmdGetE    = metrics.AddCounter("cmd_gete", nil)
+	MetricCmdSet     = metrics.AddCounter("cmd_set", nil)
+	MetricCmdAdd     = metrics.AddCounter("cmd_add", nil)
+	MetricCmdReplace = metrics.AddCounter("cmd_replace", nil)
+	MetricCmdAppend  = metrics.AddCounter("cmd_append", nil)
+	MetricCmdPrepend = metrics.AddCounter("cmd_prepend", nil)
+	MetricCmdDelete  = metrics.AddCounter("cmd_delete", nil)
+	MetricCmdTouch   = metrics.AddCounter("cmd_touch", nil)
+	MetricCmdGat     = metrics.AddCounter("cmd_gat", nil)
+	MetricCmdUnknown = metrics.AddCounter("cmd_unknown", nil)
+	MetricCmdNoop    = metrics.AddCounter("cmd_noop", nil)
+	MetricCmdQuit    = metrics.AddCounter("cmd_quit", nil)
+	MetricCmdVersion = metrics.AddCounter("cmd_version", nil)
+	MetricCmdStats   = metrics.AddCounter("cmd_stats", nil)
+
+	MetricCmdLruCrawler = metrics.AddCounter("cmd_lru_crawler", nil)
+
+	MetricCmdLeaseGet = metrics.AddCounter("cmd_lease_get", nil)
+	MetricCmdLeaseSet = metrics.AddCounter("cmd_lease_set", nil)
+
+	HistSet     = metrics.AddHistogram("set", false, nil)
+	HistAdd     = metrics.AddHistogram("add", false, nil)
+	HistReplace = metrics.AddHistogram("replace", false, nil)
+	HistAppend  = metrics.AddHistogram("append", false, nil)
+	HistPrepend = metrics.AddHistogram("prepend", false, nil)
+	HistDelete  = metrics.AddHistogram("delete", false, nil)
+	HistTouch   = metrics.AddHistogram("touch", false, nil)
+	HistGet     = metrics.AddHistogram("get", false, nil)  // not sampled until configurable
+	HistGetE    = metrics.AddHistogram("gete", false, nil) // not sampled until configurable
+	HistGat     = metrics.AddHistogram("gat", false, nil)  // not sampled until configurable
+
+	// The hottest keys across all commands each minute, shown by "stats hotkeys"
+	// and on the /metrics/hotkeys endpoint.
+	TopKeys = metrics.AddTopK("hot_keys", 20, time.Minute, nil)
 
 	// TODO: inconsistency metrics for when L1 is not a subset of L2
 )
+
+func init() {
+	for _, cmd := range []string{"set", "add", "replace", "append", "prepend", "delete", "touch", "get", "gete", "gat"} {
+		metrics.Describe(cmd, metrics.UnitNanoseconds, "Time to handle "+cmd+" requests end to end in the server")
+	}
+}
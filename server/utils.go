@@ -15,27 +15,17 @@
 package server
 
 import (
-	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"runtime"
 	"strings"
 
-	"github.com/netflix/rend/binprot"
+	"github.com/netflix/rend/common"
 )
 
-func isBinaryRequest(reader *bufio.Reader) (bool, error) {
-	headerByte, err := reader.Peek(1)
-	if err != nil {
-		return false, err
-	}
-	return headerByte[0] == binprot.MagicRequest, nil
-}
-
-func abort(toClose []io.Closer, err error) {
+func abort(toClose []io.Closer, err error, rl *common.RequestLog) {
 	if err != nil && err != io.EOF {
-		log.Println("Error while processing request. Closing connection. Error:", err.Error())
+		rl.Println("Error while processing request. Closing connection. Error:", err.Error())
 	}
 	for _, c := range toClose {
 		if c != nil {
@@ -0,0 +1,170 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// The most responses that can be waiting to be written to a client before the
+// connection stops running requests.
+const writeQueueSize = 64
+
+var errSlowClient = errors.New("client is too slow reading its responses")
+
+// responseWriter queues the responses written to a client connection and
+// writes them from a separate goroutine in the order they were queued. The
+// connection can parse the next request and send it to the backends while the
+// last response is still going out to the client, which keeps pipelined
+// clients busy.
+//
+// A client that stops reading would otherwise hold up its connection, and the
+// buffers of everything queued for it, for as long as it stays open. Each
+// write to the client can be given a timeout, and the bytes queued for it a
+// cap. A connection that goes over either is closed.
+//
+// Writes fail once a write to the client has failed or the writer is closed.
+type responseWriter struct {
+	conn       net.Conn
+	timeout    time.Duration
+	maxPending int
+	queue      chan []byte
+	done       chan struct{}
+
+	// Held to read while queueing, so the queue isn't closed under a write
+	closeLock sync.RWMutex
+	closed    bool
+
+	mu  sync.Mutex
+	err error
+	// The bytes queued and not yet written to the client
+	pending int
+}
+
+// Returns a writer for the connection. Writes have no timeout if timeout is 0,
+// and the bytes queued no cap if maxPending is 0.
+func newResponseWriter(conn net.Conn, timeout time.Duration, maxPending int) *responseWriter {
+	rw := &responseWriter{
+		conn:       conn,
+		timeout:    timeout,
+		maxPending: maxPending,
+		queue:      make(chan []byte, writeQueueSize),
+		done:       make(chan struct{}),
+	}
+	go rw.loop()
+	return rw
+}
+
+// Write queues a copy of p, because the caller is free to reuse it. A response
+// bigger than the cap is still written if nothing else is queued.
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if err := rw.reserve(len(p)); err != nil {
+		return 0, err
+	}
+
+	rw.closeLock.RLock()
+	defer rw.closeLock.RUnlock()
+	if rw.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	b := common.GetBuf(len(p))
+	copy(b, p)
+	rw.queue <- b
+
+	return len(p), nil
+}
+
+// Counts n more bytes as queued, unless that puts the client over the cap.
+func (rw *responseWriter) reserve(n int) error {
+	rw.mu.Lock()
+	if rw.err != nil {
+		defer rw.mu.Unlock()
+		return rw.err
+	}
+	if rw.maxPending > 0 && rw.pending > 0 && rw.pending+n > rw.maxPending {
+		rw.mu.Unlock()
+		rw.fail(errSlowClient, true)
+		return errSlowClient
+	}
+	rw.pending += n
+	rw.mu.Unlock()
+	return nil
+}
+
+func (rw *responseWriter) failed() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.err
+}
+
+// Keeps the first error. A slow client's connection is closed so its requests
+// stop being read as well.
+func (rw *responseWriter) fail(err error, slow bool) {
+	rw.mu.Lock()
+	first := rw.err == nil
+	if first {
+		rw.err = err
+	}
+	rw.mu.Unlock()
+
+	if first && slow {
+		metrics.IncCounter(MetricConnectionsSlowClosed)
+		rw.conn.Close()
+	}
+}
+
+func (rw *responseWriter) loop() {
+	defer close(rw.done)
+
+	for b := range rw.queue {
+		// Keep draining after a failure so Close doesn't block
+		if rw.failed() == nil {
+			if rw.timeout > 0 {
+				rw.conn.SetWriteDeadline(time.Now().Add(rw.timeout))
+			}
+			if _, err := rw.conn.Write(b); err != nil {
+				nerr, ok := err.(net.Error)
+				rw.fail(err, ok && nerr.Timeout())
+			}
+		}
+
+		rw.mu.Lock()
+		rw.pending -= len(b)
+		rw.mu.Unlock()
+		common.PutBuf(b)
+	}
+}
+
+// Close waits for the queued responses to be written. It doesn't close the
+// underlying connection, so it goes before the connection in the list of
+// things to close when a connection is done.
+func (rw *responseWriter) Close() error {
+	rw.closeLock.Lock()
+	if !rw.closed {
+		rw.closed = true
+		close(rw.queue)
+	}
+	rw.closeLock.Unlock()
+	<-rw.done
+	return rw.failed()
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+func slowClosed() uint64 {
+	for _, c := range metrics.GetCounters() {
+		if c.Name == "conn_slow_closed" {
+			return c.Value
+		}
+	}
+	return 0
+}
+
+// Waits for writes to start failing once the writer gives up on the client
+func waitForFailure(t *testing.T, rw *responseWriter) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := rw.failed(); err != nil {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for the writer to fail")
+	return nil
+}
+
+func TestResponseWriterOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	rw := newResponseWriter(server, 0, 0)
+
+	read := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		read <- b
+	}()
+
+	var expected []byte
+	buf := make([]byte, 1)
+	for i := 0; i < 3*writeQueueSize; i++ {
+		buf[0] = byte(i)
+		expected = append(expected, buf[0])
+		// The caller can reuse its buffer right away
+		if _, err := rw.Write(buf); err != nil {
+			t.Fatalf("Error writing: %s", err.Error())
+		}
+	}
+
+	// Close waits for everything queued to be written
+	if err := rw.Close(); err != nil {
+		t.Fatalf("Error closing: %s", err.Error())
+	}
+	server.Close()
+
+	if b := <-read; !bytes.Equal(b, expected) {
+		t.Fatalf("Expected the responses in the order they were written, got %v", b)
+	}
+	if _, err := rw.Write(buf); err == nil {
+		t.Fatalf("Expected writes to fail once the writer is closed")
+	}
+}
+
+func TestResponseWriterPendingCap(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	rw := newResponseWriter(server, 0, 10)
+	start := slowClosed()
+
+	// The client never reads, so this stays pending
+	if _, err := rw.Write(make([]byte, 8)); err != nil {
+		t.Fatalf("Error writing: %s", err.Error())
+	}
+	if _, err := rw.Write(make([]byte, 5)); err != errSlowClient {
+		t.Fatalf("Expected the write over the cap to fail, got %v", err)
+	}
+
+	// The connection is closed, which lets the blocked write fail too
+	if err := rw.Close(); err != errSlowClient {
+		t.Fatalf("Expected the slow client error, got %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+	if n := slowClosed() - start; n != 1 {
+		t.Fatalf("Expected 1 slow connection closed, got %d", n)
+	}
+}
+
+func TestResponseWriterLargeResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	rw := newResponseWriter(server, 0, 10)
+	start := slowClosed()
+
+	read := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		read <- b
+	}()
+
+	// Bigger than the cap, but nothing else is waiting
+	big := bytes.Repeat([]byte("a"), 100)
+	if _, err := rw.Write(big); err != nil {
+		t.Fatalf("Expected a large response with nothing queued to be written, got %v", err)
+	}
+	if err := rw.Close(); err != nil {
+		t.Fatalf("Error closing: %s", err.Error())
+	}
+	server.Close()
+
+	if b := <-read; !bytes.Equal(b, big) {
+		t.Fatalf("Expected the whole response, got %d bytes", len(b))
+	}
+	if n := slowClosed() - start; n != 0 {
+		t.Fatalf("Expected no slow connections closed, got %d", n)
+	}
+}
+
+func TestResponseWriterTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	rw := newResponseWriter(server, 20*time.Millisecond, 0)
+	start := slowClosed()
+
+	// The client never reads, so the write times out
+	if _, err := rw.Write([]byte("value")); err != nil {
+		t.Fatalf("Error writing: %s", err.Error())
+	}
+
+	err := waitForFailure(t, rw)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if _, err := rw.Write([]byte("more")); err == nil {
+		t.Fatalf("Expected writes to fail after the timeout")
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+	if n := slowClosed() - start; n != 1 {
+		t.Fatalf("Expected 1 slow connection closed, got %d", n)
+	}
+	rw.Close()
+}
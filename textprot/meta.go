@@ -0,0 +1,339 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"bufio"
+	"strconv"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// The meta commands are the newer part of the text protocol that pipelining
+// clients use. Each takes a key and a list of single letter flags, some with a
+// value right after the letter:
+//
+//	mg <key> <flags>*              get, or GAT with T
+//	ms <key> <datalen> <flags>*    set, with M to add, replace, append, or prepend
+//	md <key> <flags>*              delete
+//	mn                             no-op, answered with MN
+//
+// Responses start with a two letter code: VA with the value, HD for success,
+// EN for a get miss, NF for a delete miss, and NS for a store that didn't
+// happen. Clients pipeline meta commands with the q flag, which leaves out
+// the responses they don't need (EN for gets, HD for sets and deletes, and NF
+// for deletes), and end each batch with mn, which is always answered, to know
+// every response before it has arrived. They match responses to requests with
+// the O flag, whose value is sent back in the response, and the k flag, which
+// sends back the key.
+//
+// Requests are answered one at a time, in order, so the parser leaves what the
+// responder needs to know about the request in a metaState they share.
+type metaState struct {
+	// Whether the request being answered is a meta command
+	active bool
+	quiet  bool
+	// Whether a get hit sends the value
+	value bool
+	// The flags to send back, in the order they were asked for
+	ret    []byte
+	key    []byte
+	opaque []byte
+}
+
+// NewTextConn returns a parser and a responder for a connection that share
+// state, so they support the meta commands as well as the classic ones.
+func NewTextConn(reader *bufio.Reader, writer *bufio.Writer) (TextParser, TextResponder) {
+	m := &metaState{}
+	p := NewTextParser(reader)
+	p.meta = m
+	r := NewTextResponder(writer)
+	r.meta = m
+	return p, r
+}
+
+func (m *metaState) reset() {
+	if m == nil {
+		return
+	}
+	m.active = false
+	m.quiet = false
+	m.value = false
+	m.ret = m.ret[:0]
+	m.key = nil
+	m.opaque = nil
+}
+
+func (m *metaState) on() bool {
+	return m != nil && m.active
+}
+
+// Returns the response line for the code with the flags the request asked
+// for. The flags describing the value are only sent with a hit.
+func (m *metaState) line(code string, hit *common.GetResponse) string {
+	b := []byte(code)
+	if code == "VA" {
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(len(hit.Data)), 10)
+	}
+
+	for _, f := range m.ret {
+		switch f {
+		case 'O':
+			b = append(b, " O"...)
+			b = append(b, m.opaque...)
+		case 'k':
+			b = append(b, " k"...)
+			b = append(b, m.key...)
+		case 'f':
+			if hit != nil {
+				b = append(b, " f"...)
+				b = strconv.AppendUint(b, uint64(hit.Flags), 10)
+			}
+		case 's':
+			if hit != nil {
+				b = append(b, " s"...)
+				b = strconv.AppendInt(b, int64(len(hit.Data)), 10)
+			}
+		}
+	}
+
+	return string(b)
+}
+
+func (t TextParser) metaRequest(clParts [][]byte) (common.Request, common.RequestType, error) {
+	m := t.meta
+
+	switch string(clParts[0]) {
+	case "mn":
+		if len(clParts) != 1 {
+			return nil, common.RequestNoop, common.ErrBadRequest
+		}
+		m.active = true
+		return common.NoopRequest{}, common.RequestNoop, nil
+
+	case "mg":
+		if len(clParts) < 2 {
+			return nil, common.RequestGet, common.ErrBadRequest
+		}
+		key := clParts[1]
+
+		var exptime uint32
+		var touch bool
+		for _, f := range clParts[2:] {
+			switch f[0] {
+			case 'v':
+				m.value = true
+			case 'q':
+				m.quiet = true
+			case 'k', 'f', 's':
+				m.ret = append(m.ret, f[0])
+			case 'O':
+				m.ret = append(m.ret, 'O')
+				m.opaque = f[1:]
+			case 'T':
+				var ok bool
+				if exptime, ok = parseExptime(f[1:]); !ok {
+					t.Log.Printf("Error parsing ttl for mg command: %q\n", f)
+					return nil, common.RequestGet, common.ErrBadRequest
+				}
+				touch = true
+			default:
+				t.Log.Printf("Unsupported flag for mg command: %q\n", f)
+				return nil, common.RequestGet, common.ErrBadRequest
+			}
+		}
+		m.key = key
+		m.active = true
+
+		if touch {
+			return common.GATRequest{
+				Key:     key,
+				Exptime: exptime,
+			}, common.RequestGat, nil
+		}
+
+		if cap(t.s.opaques) < 1 {
+			t.s.opaques = make([]uint32, 1)
+			t.s.quiet = make([]bool, 1)
+		}
+		return common.GetRequest{
+			Keys:    clParts[1:2],
+			Opaques: t.s.opaques[:1],
+			Quiet:   t.s.quiet[:1],
+		}, common.RequestGet, nil
+
+	case "ms":
+		if len(clParts) < 3 {
+			return nil, common.RequestSet, common.ErrBadRequest
+		}
+		key := clParts[1]
+
+		length, ok := parseUint32(clParts[2])
+		if !ok {
+			t.Log.Printf("Error parsing length for ms command: %q\n", clParts[2])
+			return nil, common.RequestSet, common.ErrBadLength
+		}
+
+		// The data is read before the flags are checked so a bad flag
+		// doesn't leave it to be parsed as the next command
+		data, err := t.readData(length)
+		if err != nil {
+			return nil, common.RequestSet, err
+		}
+
+		req := common.SetRequest{Key: key, Data: data}
+		reqType := common.RequestSet
+		for _, f := range clParts[3:] {
+			switch f[0] {
+			case 'q':
+				m.quiet = true
+			case 'k':
+				m.ret = append(m.ret, 'k')
+			case 'O':
+				m.ret = append(m.ret, 'O')
+				m.opaque = f[1:]
+			case 'T':
+				req.Exptime, ok = parseExptime(f[1:])
+			case 'F':
+				req.Flags, ok = parseUint32(f[1:])
+			case 'M':
+				reqType, ok = metaSetMode(f[1:])
+			default:
+				ok = false
+			}
+			if !ok {
+				t.Log.Printf("Bad flag for ms command: %q\n", f)
+				common.PutBuf(data)
+				return nil, common.RequestSet, common.ErrBadRequest
+			}
+		}
+		m.key = key
+		m.active = true
+
+		return req, reqType, nil
+
+	case "md":
+		if len(clParts) < 2 {
+			return nil, common.RequestDelete, common.ErrBadRequest
+		}
+		key := clParts[1]
+
+		for _, f := range clParts[2:] {
+			switch f[0] {
+			case 'q':
+				m.quiet = true
+			case 'k':
+				m.ret = append(m.ret, 'k')
+			case 'O':
+				m.ret = append(m.ret, 'O')
+				m.opaque = f[1:]
+			default:
+				t.Log.Printf("Unsupported flag for md command: %q\n", f)
+				return nil, common.RequestDelete, common.ErrBadRequest
+			}
+		}
+		m.key = key
+		m.active = true
+
+		return common.DeleteRequest{Key: key}, common.RequestDelete, nil
+	}
+
+	return nil, common.RequestUnknown, nil
+}
+
+// Returns the request type for the mode of an ms command.
+func metaSetMode(mode []byte) (common.RequestType, bool) {
+	if len(mode) != 1 {
+		return common.RequestSet, false
+	}
+
+	switch mode[0] {
+	case 'S', 's':
+		return common.RequestSet, true
+	case 'E', 'e':
+		return common.RequestAdd, true
+	case 'R', 'r':
+		return common.RequestReplace, true
+	case 'A', 'a':
+		return common.RequestAppend, true
+	case 'P', 'p':
+		return common.RequestPrepend, true
+	}
+	return common.RequestSet, false
+}
+
+// Answers a meta get or GAT without sending it yet.
+func (t TextResponder) metaGet(response common.GetResponse) error {
+	m := t.meta
+	if response.Miss {
+		if m.quiet {
+			return nil
+		}
+		return t.line(m.line("EN", nil))
+	}
+	if !m.value {
+		return t.line(m.line("HD", &response))
+	}
+
+	if err := t.line(m.line("VA", &response)); err != nil {
+		return err
+	}
+	n, err := t.writer.Write(response.Data)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+	n, err = t.writer.WriteString("\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return err
+}
+
+// Answers a successful meta set or delete.
+func (t TextResponder) metaStored() error {
+	if t.meta.quiet {
+		return nil
+	}
+	return t.resp(t.meta.line("HD", nil))
+}
+
+// Answers a meta command that failed. Returns false for errors that get the
+// same response as for classic commands.
+func (t TextResponder) metaError(reqType common.RequestType, err error) (bool, error) {
+	m := t.meta
+
+	switch reqType {
+	case common.RequestSet,
+		common.RequestAdd,
+		common.RequestReplace,
+		common.RequestAppend,
+		common.RequestPrepend:
+		switch err {
+		case common.ErrKeyExists, common.ErrItemNotStored, common.ErrKeyNotFound:
+			return true, t.resp(m.line("NS", nil))
+		}
+
+	case common.RequestDelete:
+		if err == common.ErrKeyNotFound {
+			if m.quiet {
+				return true, nil
+			}
+			return true, t.resp(m.line("NF", nil))
+		}
+	}
+
+	return false, nil
+}
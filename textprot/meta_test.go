@@ -0,0 +1,103 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/textprot"
+)
+
+func TestMetaCommands(t *testing.T) {
+	in := strings.Join([]string{
+		"mg foo v f k Oa1",
+		"mg bar q Oa2",
+		"ms foo 3 T10 F5 MR q Oa3\r\nbaz",
+		"ms foo 3 X\r\nbaz",
+		"md foo q",
+		"md foo Oa4",
+		"get foo",
+		"mn",
+	}, "\r\n") + "\r\n"
+
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	p, res := textprot.NewTextConn(bufio.NewReader(strings.NewReader(in)), w)
+
+	parse := func(expected common.RequestType, expectedErr error) common.Request {
+		req, reqType, err := p.Parse()
+		if reqType != expected || err != expectedErr {
+			t.Fatalf("Expected %v and error %v, got %v and %v", expected, expectedErr, reqType, err)
+		}
+		return req
+	}
+
+	// A hit sends back the flags asked for, in order
+	get := parse(common.RequestGet, nil).(common.GetRequest)
+	if len(get.Keys) != 1 || string(get.Keys[0]) != "foo" {
+		t.Fatalf("Expected a get of foo, got %q", get.Keys)
+	}
+	res.Get(common.GetResponse{Key: get.Keys[0], Flags: 5, Data: []byte("bar")})
+	res.GetEnd(0, false)
+
+	// A quiet miss sends nothing
+	get = parse(common.RequestGet, nil).(common.GetRequest)
+	res.Get(common.GetResponse{Key: get.Keys[0], Miss: true})
+	res.GetEnd(0, false)
+
+	set := parse(common.RequestReplace, nil).(common.SetRequest)
+	if string(set.Key) != "foo" || string(set.Data) != "baz" || set.Exptime != 10 || set.Flags != 5 {
+		t.Fatalf("Unexpected request %+v", set)
+	}
+	// Quiet only leaves out success
+	res.Error(0, common.RequestReplace, common.ErrKeyNotFound, false)
+
+	// The data of a set with a bad flag is skipped
+	req := parse(common.RequestSet, common.ErrBadRequest)
+	res.Error(0, common.RequestSet, common.ErrBadRequest, false)
+
+	req = parse(common.RequestDelete, nil)
+	res.Error(0, common.RequestDelete, common.ErrKeyNotFound, false)
+	req = parse(common.RequestDelete, nil)
+	res.Error(0, common.RequestDelete, common.ErrKeyNotFound, false)
+
+	// Classic commands still get classic responses
+	req = parse(common.RequestGet, nil)
+	res.GetEnd(req.GetOpaque(), false)
+
+	parse(common.RequestNoop, nil)
+	res.Noop(0)
+
+	expected := "VA 3 f5 kfoo Oa1\r\nbar\r\n" +
+		"NS Oa3\r\n" +
+		"CLIENT_ERROR bad request\r\n" +
+		"NF Oa4\r\n" +
+		"END\r\n" +
+		"MN\r\n"
+	if out.String() != expected {
+		t.Fatalf("Expected responses %q, got %q", expected, out.String())
+	}
+}
+
+func TestMetaCommandsNeedSharedState(t *testing.T) {
+	_, reqType, err := parser("mn\r\n").Parse()
+	if reqType != common.RequestUnknown || err != nil {
+		t.Fatalf("Expected mn to be unknown to a parser without a responder, got %v, %v", reqType, err)
+	}
+}
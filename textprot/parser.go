@@ -16,73 +16,254 @@ package textprot
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
-	"log"
-	"strconv"
-	"strings"
+	"math"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
 )
 
+// TextParser parses text protocol requests. Command lines are parsed in place
+// in a buffer that is reused for every request, so the keys in a request refer
+// to that buffer and are only valid until the next call to Parse.
 type TextParser struct {
 	reader *bufio.Reader
+	s      *parseState
+	// Shared with the connection's responder. Meta commands are unknown if
+	// it's nil.
+	meta *metaState
+
+	// Log is used for all log lines about the requests being parsed. It may be
+	// nil.
+	Log *common.RequestLog
 }
 
+// Because Parse is a value method, the reused buffers are kept in another
+// struct with a pointer to it in the parser.
+type parseState struct {
+	line    []byte
+	fields  [][]byte
+	opaques []uint32
+	quiet   []bool
+}
+
+var MetricBadDataChunks = metrics.AddCounter("text_bad_data_chunks", nil)
+
+// DataChunkPolicy is what happens when the data block of a storage command
+// doesn't end in \r\n right after the number of bytes the command line says,
+// meaning the client sent more or less data than it declared.
+type DataChunkPolicy int
+
+const (
+	// The client gets CLIENT_ERROR bad data chunk, everything up to the next
+	// \n is skipped, and the connection is kept open. This lines the stream
+	// back up if the client sent too much data. If it sent too little, the
+	// declared length ran into the next command, which is lost as well.
+	DataChunkResync DataChunkPolicy = iota
+	// The connection is closed, since nothing the client sends afterward can
+	// be trusted to be where it should be.
+	DataChunkClose
+)
+
+// ParseDataChunkPolicy returns the policy named "resync" or "close".
+func ParseDataChunkPolicy(s string) (DataChunkPolicy, error) {
+	switch s {
+	case "resync":
+		return DataChunkResync, nil
+	case "close":
+		return DataChunkClose, nil
+	}
+	return DataChunkResync, fmt.Errorf("unknown bad data chunk policy %q, expected resync or close", s)
+}
+
+var dataChunkPolicy = DataChunkResync
+
+// SetDataChunkPolicy sets what happens to connections that send a bad data
+// chunk. It must be called before any connections are accepted.
+func SetDataChunkPolicy(p DataChunkPolicy) {
+	dataChunkPolicy = p
+}
+
+// Returned instead of common.ErrBadDataChunk to close the connection
+var errBadDataChunkClose = errors.New("Bad data chunk, closing connection")
+
 func NewTextParser(reader *bufio.Reader) TextParser {
 	return TextParser{
 		reader: reader,
+		s:      &parseState{},
 	}
 }
 
+// Reads the next command line into the line buffer. Lines longer than the
+// bufio buffer are read in pieces.
+func (t TextParser) readLine() ([]byte, error) {
+	t.s.line = t.s.line[:0]
+	for {
+		part, err := t.reader.ReadSlice('\n')
+		t.s.line = append(t.s.line, part...)
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(len(part)))
+
+		if err != bufio.ErrBufferFull {
+			return t.s.line, err
+		}
+	}
+}
+
+// Splits the line into the space separated fields, reusing the fields slice.
+func (t TextParser) split(line []byte) [][]byte {
+	fields := t.s.fields[:0]
+	for {
+		for len(line) > 0 && line[0] == ' ' {
+			line = line[1:]
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		i := bytes.IndexByte(line, ' ')
+		if i < 0 {
+			i = len(line)
+		}
+		// Handlers may append to keys, like the chunked handler does to make
+		// its chunk keys, which must not write over the next field
+		fields = append(fields, line[:i:i])
+		line = line[i:]
+	}
+
+	t.s.fields = fields
+	return fields
+}
+
+// Parses an unsigned 32 bit decimal number without converting it to a string.
+func parseUint32(b []byte) (uint32, bool) {
+	n, ok := parseUint64(b)
+	if !ok || n > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// Parses an exptime. Negative exptimes mean the value expires right away, like
+// in memcached.
+func parseExptime(b []byte) (uint32, bool) {
+	if len(b) > 1 && b[0] == '-' {
+		if _, ok := parseUint64(b[1:]); !ok {
+			return 0, false
+		}
+		return common.ExptimeExpired, true
+	}
+	return parseUint32(b)
+}
+
+func parseUint64(b []byte) (uint64, bool) {
+	if len(b) == 0 || len(b) > 20 {
+		return 0, false
+	}
+
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		d := uint64(c - '0')
+		if n > (math.MaxUint64-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+
+	return n, true
+}
+
 func (t TextParser) Parse() (common.Request, common.RequestType, error) {
-	data, err := t.reader.ReadString('\n')
-	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(len(data)))
+	t.Log.Next()
+	t.meta.reset()
 
+	line, err := t.readLine()
 	if err != nil {
 		if err == io.EOF {
-			log.Println("Connection closed")
+			t.Log.Println("Connection closed")
 		} else {
-			log.Printf("Error while reading text command line: %s\n", err.Error())
+			t.Log.Printf("Error while reading text command line: %s\n", err.Error())
 		}
 		return nil, common.RequestUnknown, err
 	}
 
-	clParts := strings.Split(strings.TrimSpace(data), " ")
+	clParts := t.split(bytes.TrimSpace(line))
+	if len(clParts) == 0 {
+		return nil, common.RequestUnknown, nil
+	}
 
-	switch clParts[0] {
+	// The conversion doesn't allocate when it's only used for the comparisons
+	switch string(clParts[0]) {
 	case "set":
-		return setRequest(t.reader, clParts, common.RequestSet)
+		return t.setRequest(clParts, common.RequestSet)
 
 	case "add":
-		return setRequest(t.reader, clParts, common.RequestAdd)
+		return t.setRequest(clParts, common.RequestAdd)
 
 	case "replace":
-		return setRequest(t.reader, clParts, common.RequestReplace)
+		return t.setRequest(clParts, common.RequestReplace)
 
 	case "append":
-		return setRequest(t.reader, clParts, common.RequestAppend)
+		return t.setRequest(clParts, common.RequestAppend)
 
 	case "prepend":
-		return setRequest(t.reader, clParts, common.RequestPrepend)
+		return t.setRequest(clParts, common.RequestPrepend)
+
+	case "lget":
+		if len(clParts) != 2 {
+			return nil, common.RequestLeaseGet, common.ErrBadRequest
+		}
+
+		if cap(t.s.opaques) < 1 {
+			t.s.opaques = make([]uint32, 1)
+			t.s.quiet = make([]bool, 1)
+		}
+
+		return common.GetRequest{
+			Keys:    clParts[1:],
+			Opaques: t.s.opaques[:1],
+			Quiet:   t.s.quiet[:1],
+			NoopEnd: false,
+		}, common.RequestLeaseGet, nil
+
+	case "lset":
+		// A set with the lease token on the end
+		if len(clParts) != 6 {
+			return nil, common.RequestLeaseSet, common.ErrBadRequest
+		}
+
+		token, ok := parseUint64(clParts[5])
+		if !ok {
+			t.Log.Printf("Error parsing lease token for lset command: %q\n", clParts[5])
+			return nil, common.RequestLeaseSet, common.ErrBadRequest
+		}
+
+		req, reqType, err := t.setRequest(clParts[:5], common.RequestLeaseSet)
+		req.LeaseToken = token
+		return req, reqType, err
 
 	case "get":
 		if len(clParts) < 2 {
 			return nil, common.RequestGet, common.ErrBadRequest
 		}
 
-		var keys [][]byte
-		for _, key := range clParts[1:] {
-			keys = append(keys, []byte(key))
-		}
+		keys := clParts[1:]
 
-		opaques := make([]uint32, len(keys))
-		quiet := make([]bool, len(keys))
+		// The opaques and quiet flags are all zero for text requests
+		if cap(t.s.opaques) < len(keys) {
+			t.s.opaques = make([]uint32, len(keys))
+			t.s.quiet = make([]bool, len(keys))
+		}
 
 		return common.GetRequest{
 			Keys:    keys,
-			Opaques: opaques,
-			Quiet:   quiet,
+			Opaques: t.s.opaques[:len(keys)],
+			Quiet:   t.s.quiet[:len(keys)],
 			NoopEnd: false,
 		}, common.RequestGet, nil
 
@@ -92,7 +273,7 @@ func (t TextParser) Parse() (common.Request, common.RequestType, error) {
 		}
 
 		return common.DeleteRequest{
-			Key:    []byte(clParts[1]),
+			Key:    clParts[1],
 			Opaque: uint32(0),
 		}, common.RequestDelete, nil
 
@@ -102,17 +283,17 @@ func (t TextParser) Parse() (common.Request, common.RequestType, error) {
 			return nil, common.RequestTouch, common.ErrBadRequest
 		}
 
-		key := []byte(clParts[1])
+		key := clParts[1]
 
-		exptime, err := strconv.ParseUint(strings.TrimSpace(clParts[2]), 10, 32)
-		if err != nil {
-			log.Printf("Error parsing ttl for touch command: %s\n", err.Error())
+		exptime, ok := parseExptime(clParts[2])
+		if !ok {
+			t.Log.Printf("Error parsing ttl for touch command: %q\n", clParts[2])
 			return nil, common.RequestSet, common.ErrBadRequest
 		}
 
 		return common.TouchRequest{
 			Key:     key,
-			Exptime: uint32(exptime),
+			Exptime: exptime,
 			Opaque:  uint32(0),
 		}, common.RequestTouch, nil
 
@@ -141,54 +322,125 @@ func (t TextParser) Parse() (common.Request, common.RequestType, error) {
 			Opaque: 0,
 		}, common.RequestVersion, nil
 
+	case "stats":
+		var group string
+		var args []string
+		if len(clParts) > 1 {
+			group = string(clParts[1])
+			for _, arg := range clParts[2:] {
+				args = append(args, string(arg))
+			}
+		}
+		return common.StatsRequest{
+			Group:  group,
+			Args:   args,
+			Opaque: 0,
+		}, common.RequestStats, nil
+
+	case "lru_crawler":
+		if len(clParts) < 2 {
+			return nil, common.RequestLruCrawler, common.ErrBadRequest
+		}
+		args := make([]string, 0, len(clParts)-1)
+		for _, arg := range clParts[1:] {
+			args = append(args, string(arg))
+		}
+		return common.LruCrawlerRequest{
+			Args:   args,
+			Opaque: 0,
+		}, common.RequestLruCrawler, nil
+
+	case "mg", "ms", "md", "mn":
+		if t.meta == nil {
+			return nil, common.RequestUnknown, nil
+		}
+		return t.metaRequest(clParts)
+
 	default:
 		return nil, common.RequestUnknown, nil
 	}
 }
 
-func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType) (common.SetRequest, common.RequestType, error) {
+func (t TextParser) setRequest(clParts [][]byte, reqType common.RequestType) (common.SetRequest, common.RequestType, error) {
 	// sanity check
 	if len(clParts) != 5 {
 		return common.SetRequest{}, reqType, common.ErrBadRequest
 	}
 
-	key := []byte(clParts[1])
+	key := clParts[1]
 
-	flags, err := strconv.ParseUint(strings.TrimSpace(clParts[2]), 10, 32)
-	if err != nil {
-		log.Printf("Error parsing flags for set/add/replace command: %s\n", err.Error())
+	flags, ok := parseUint32(clParts[2])
+	if !ok {
+		t.Log.Printf("Error parsing flags for set/add/replace command: %q\n", clParts[2])
 		return common.SetRequest{}, reqType, common.ErrBadFlags
 	}
 
-	exptime, err := strconv.ParseUint(strings.TrimSpace(clParts[3]), 10, 32)
-	if err != nil {
-		log.Printf("Error parsing ttl for set/add/replace command: %s\n", err.Error())
+	exptime, ok := parseExptime(clParts[3])
+	if !ok {
+		t.Log.Printf("Error parsing ttl for set/add/replace command: %q\n", clParts[3])
 		return common.SetRequest{}, reqType, common.ErrBadExptime
 	}
 
-	length, err := strconv.ParseUint(strings.TrimSpace(clParts[4]), 10, 32)
-	if err != nil {
-		log.Printf("Error parsing length for set/add/replace command: %s\n", err.Error())
+	length, ok := parseUint32(clParts[4])
+	if !ok {
+		t.Log.Printf("Error parsing length for set/add/replace command: %q\n", clParts[4])
 		return common.SetRequest{}, reqType, common.ErrBadLength
 	}
 
-	// Read in data
-	dataBuf := make([]byte, length)
-	n, err := io.ReadAtLeast(r, dataBuf, int(length))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	dataBuf, err := t.readData(length)
 	if err != nil {
-		return common.SetRequest{}, reqType, common.ErrInternal
+		return common.SetRequest{}, reqType, err
 	}
 
-	// Consume the last two bytes "\r\n"
-	r.ReadString(byte('\n'))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, 2)
-
 	return common.SetRequest{
 		Key:     key,
-		Flags:   uint32(flags),
-		Exptime: uint32(exptime),
+		Flags:   flags,
+		Exptime: exptime,
 		Opaque:  uint32(0),
 		Data:    dataBuf,
 	}, reqType, nil
 }
+
+// Reads a data block of the given length and the \r\n after it.
+func (t TextParser) readData(length uint32) ([]byte, error) {
+	dataBuf := common.GetBuf(int(length))
+	n, err := io.ReadAtLeast(t.reader, dataBuf, int(length))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return nil, common.ErrInternal
+	}
+
+	// Consume the last two bytes "\r\n"
+	if err := t.readDataEnd(); err != nil {
+		common.PutBuf(dataBuf)
+		return nil, err
+	}
+
+	return dataBuf, nil
+}
+
+// Reads the \r\n after a data block. If it isn't there, the stream is skipped
+// ahead to the end of the next line or the connection is closed, depending on
+// the data chunk policy.
+func (t TextParser) readDataEnd() error {
+	end, err := t.reader.Peek(2)
+	if err != nil {
+		return err
+	}
+	if end[0] == '\r' && end[1] == '\n' {
+		t.reader.Discard(2)
+		metrics.IncCounterBy(common.MetricBytesReadRemote, 2)
+		return nil
+	}
+
+	metrics.IncCounter(MetricBadDataChunks)
+	if dataChunkPolicy == DataChunkClose {
+		return errBadDataChunkClose
+	}
+
+	t.Log.Printf("Data block doesn't end where its length says, skipping to the next line\n")
+	if _, err := t.readLine(); err != nil {
+		return err
+	}
+	return common.ErrBadDataChunk
+}
@@ -0,0 +1,199 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/textprot"
+)
+
+func parser(s string) textprot.TextParser {
+	return textprot.NewTextParser(bufio.NewReader(strings.NewReader(s)))
+}
+
+func TestParseSet(t *testing.T) {
+	req, reqType, err := parser("set foo 5 10 3\r\nbar\r\n").Parse()
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err.Error())
+	}
+	if reqType != common.RequestSet {
+		t.Fatalf("Expected a set request, got %v", reqType)
+	}
+
+	set := req.(common.SetRequest)
+	if string(set.Key) != "foo" || set.Flags != 5 || set.Exptime != 10 || string(set.Data) != "bar" {
+		t.Fatalf("Unexpected request %+v", set)
+	}
+}
+
+func TestParseNegativeExptime(t *testing.T) {
+	req, _, err := parser("set foo 0 -1 3\r\nbar\r\n").Parse()
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err.Error())
+	}
+	if exptime := req.(common.SetRequest).Exptime; exptime != common.ExptimeExpired {
+		t.Fatalf("Expected a negative exptime to be already expired, got %d", exptime)
+	}
+}
+
+func TestParseBadNumbers(t *testing.T) {
+	tests := []struct {
+		line string
+		err  error
+	}{
+		{"set foo x 0 3\r\n", common.ErrBadFlags},
+		{"set foo 0 -x 3\r\n", common.ErrBadExptime},
+		{"set foo 0 0 4294967296\r\n", common.ErrBadLength},
+		{"touch foo 1x\r\n", common.ErrBadRequest},
+	}
+
+	for _, test := range tests {
+		if _, _, err := parser(test.line).Parse(); err != test.err {
+			t.Errorf("Expected %v for %q, got %v", test.err, test.line, err)
+		}
+	}
+}
+
+func TestParseBadDataChunk(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		next string
+	}{
+		{"too much", "set foo 0 0 3\r\nbarbaz\r\nget a\r\n", "a"},
+		{"one short", "set foo 0 0 4\r\nbar\r\nget a\r\n", "a"},
+		// The declared length runs into the next command, which is lost
+		{"too little", "set foo 0 0 5\r\nbar\r\nget a\r\nget b\r\n", "b"},
+	}
+
+	for _, test := range tests {
+		p := parser(test.in)
+		if _, _, err := p.Parse(); err != common.ErrBadDataChunk {
+			t.Fatalf("%s: Expected a bad data chunk error, got %v", test.name, err)
+		}
+
+		req, reqType, err := p.Parse()
+		if err != nil || reqType != common.RequestGet {
+			t.Fatalf("%s: Expected the stream to line up again at a get, got %v, %v", test.name, reqType, err)
+		}
+		if key := string(req.(common.GetRequest).Keys[0]); key != test.next {
+			t.Fatalf("%s: Expected the get of %s, got %s", test.name, test.next, key)
+		}
+	}
+}
+
+func TestParseBadDataChunkClose(t *testing.T) {
+	textprot.SetDataChunkPolicy(textprot.DataChunkClose)
+	defer textprot.SetDataChunkPolicy(textprot.DataChunkResync)
+
+	_, _, err := parser("set foo 0 0 3\r\nbarbaz\r\nget a\r\n").Parse()
+	if err == nil || common.IsAppError(err) || err == common.ErrBadDataChunk {
+		t.Fatalf("Expected an error that closes the connection, got %v", err)
+	}
+}
+
+func TestParseGetLongLine(t *testing.T) {
+	// Longer than the default bufio buffer, with extra spaces between keys
+	var line bytes.Buffer
+	line.WriteString("get")
+	for i := 0; i < 1000; i++ {
+		line.WriteString("  key")
+	}
+	line.WriteString("\r\n")
+
+	req, reqType, err := parser(line.String()).Parse()
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err.Error())
+	}
+	if reqType != common.RequestGet {
+		t.Fatalf("Expected a get request, got %v", reqType)
+	}
+
+	get := req.(common.GetRequest)
+	if len(get.Keys) != 1000 || len(get.Opaques) != 1000 || len(get.Quiet) != 1000 {
+		t.Fatalf("Expected 1000 keys, got %d", len(get.Keys))
+	}
+	for _, k := range get.Keys {
+		if string(k) != "key" {
+			t.Fatalf("Unexpected key %q", k)
+		}
+	}
+}
+
+func TestParseGetKeysDontOverlap(t *testing.T) {
+	req, _, err := parser("get a b\r\n").Parse()
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err.Error())
+	}
+
+	keys := req.(common.GetRequest).Keys
+	_ = append(keys[0], "-meta"...)
+	if string(keys[1]) != "b" {
+		t.Fatalf("Expected appending to a key to leave the next one alone, got %q", keys[1])
+	}
+}
+
+func TestParseGetAllocs(t *testing.T) {
+	p := parser(strings.Repeat("get foo bar baz\r\n", 1000))
+
+	// The only allocation left is putting the request in the interface
+	allocs := testing.AllocsPerRun(500, func() {
+		if _, _, err := p.Parse(); err != nil {
+			t.Fatalf("Error parsing: %s", err.Error())
+		}
+	})
+	if allocs > 1 {
+		t.Errorf("Expected at most 1 allocation per get, got %v", allocs)
+	}
+}
+
+func TestParseLeaseSet(t *testing.T) {
+	req, reqType, err := parser("lset foo 1 0 3 18446744073709551615\r\nbar\r\n").Parse()
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err.Error())
+	}
+	if reqType != common.RequestLeaseSet {
+		t.Fatalf("Expected a lease set request, got %v", reqType)
+	}
+
+	set := req.(common.SetRequest)
+	if string(set.Key) != "foo" || set.LeaseToken != 18446744073709551615 || string(set.Data) != "bar" {
+		t.Fatalf("Unexpected request %+v", set)
+	}
+
+	if _, _, err := parser("lset foo 1 0 3 18446744073709551616\r\nbar\r\n").Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected a bad request for an overflowing token, got %v", err)
+	}
+}
+
+func TestParseStatsArgs(t *testing.T) {
+	req, reqType, err := parser("stats profile cpu 30 cpu.pprof\r\n").Parse()
+	if err != nil {
+		t.Fatalf("Error parsing: %s", err.Error())
+	}
+	if reqType != common.RequestStats {
+		t.Fatalf("Expected a stats request, got %v", reqType)
+	}
+
+	stats := req.(common.StatsRequest)
+	if stats.Group != "profile" || strings.Join(stats.Args, " ") != "cpu 30 cpu.pprof" {
+		t.Fatalf("Unexpected request %+v", stats)
+	}
+}
@@ -17,6 +17,7 @@ package textprot
 import (
 	"bufio"
 	"fmt"
+	"strconv"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/metrics"
@@ -24,6 +25,13 @@ import (
 
 type TextResponder struct {
 	writer *bufio.Writer
+	// Shared with the connection's parser, so meta commands get meta
+	// responses. Only classic responses are sent if it's nil.
+	meta *metaState
+
+	// Log identifies the request in error responses that have free form text.
+	// It may be nil.
+	Log *common.RequestLog
 }
 
 func NewTextResponder(writer *bufio.Writer) TextResponder {
@@ -33,31 +41,50 @@ func NewTextResponder(writer *bufio.Writer) TextResponder {
 }
 
 func (t TextResponder) Set(opaque uint32, quiet bool) error {
+	if t.meta.on() {
+		return t.metaStored()
+	}
 	return t.resp("STORED")
 }
 
 func (t TextResponder) Add(opaque uint32, quiet bool) error {
+	if t.meta.on() {
+		return t.metaStored()
+	}
 	return t.resp("STORED")
 }
 
 func (t TextResponder) Replace(opaque uint32, quiet bool) error {
+	if t.meta.on() {
+		return t.metaStored()
+	}
 	return t.resp("STORED")
 }
 
 func (t TextResponder) Append(opaque uint32, quiet bool) error {
+	if t.meta.on() {
+		return t.metaStored()
+	}
 	return t.resp("STORED")
 }
 
 func (t TextResponder) Prepend(opaque uint32, quiet bool) error {
+	if t.meta.on() {
+		return t.metaStored()
+	}
 	return t.resp("STORED")
 }
 
 func (t TextResponder) Get(response common.GetResponse) error {
+	if t.meta.on() {
+		return t.metaGet(response)
+	}
 	if response.Miss {
 		// A miss is a no-op in the text world
 		return nil
 	}
 
+	// Values are buffered and sent all at once with the END by GetEnd
 	// Write data out to client
 	// [VALUE <key> <flags> <bytes>\r\n
 	// <data block>\r\n]*
@@ -76,15 +103,38 @@ func (t TextResponder) Get(response common.GetResponse) error {
 
 	n, err = t.writer.WriteString("\r\n")
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return err
+}
+
+// Lease and HotMiss respond to a lease get miss. They are followed by END like
+// any other get.
+func (t TextResponder) Lease(key []byte, token uint64) error {
+	return t.line("LEASE " + string(key) + " " + strconv.FormatUint(token, 10))
+}
+
+func (t TextResponder) HotMiss(key []byte) error {
+	return t.line("HOTMISS " + string(key))
+}
+
+func (t TextResponder) Line(line []byte, last bool) error {
+	n, err := t.writer.Write(line)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
 		return err
 	}
-
-	t.writer.Flush()
-	return nil
+	n, err = t.writer.WriteString("\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil || !last {
+		return err
+	}
+	return t.writer.Flush()
 }
 
 func (t TextResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	// Meta gets have no end line
+	if t.meta.on() {
+		return t.writer.Flush()
+	}
 	return t.resp("END")
 }
 
@@ -93,17 +143,28 @@ func (t TextResponder) GetE(response common.GetEResponse) error {
 }
 
 func (t TextResponder) GAT(response common.GetResponse) error {
+	// Meta gets with a new TTL are GATs
+	if t.meta.on() {
+		if err := t.metaGet(response); err != nil {
+			return err
+		}
+		return t.writer.Flush()
+	}
+
 	// There's two options here.
 	// 1) panic() because this is never supposed to be called
 	// 2) Respond as a normal get
 	//
 	// I chose to panic, since this means we are in a bad state.
-	// The text parser will never return a GAT command because
-	// it does not exist in the text protocol.
+	// The text parser will never return a GAT command for a classic
+	// command because it does not exist in the text protocol.
 	panic("GAT command in text protocol")
 }
 
 func (t TextResponder) Delete(opaque uint32) error {
+	if t.meta.on() {
+		return t.metaStored()
+	}
 	return t.resp("DELETED")
 }
 
@@ -112,6 +173,9 @@ func (t TextResponder) Touch(opaque uint32) error {
 }
 
 func (t TextResponder) Noop(opaque uint32) error {
+	if t.meta.on() {
+		return t.resp("MN")
+	}
 	return t.resp("Yep, it works.")
 }
 
@@ -126,7 +190,32 @@ func (t TextResponder) Version(opaque uint32) error {
 	return t.resp("VERSION " + common.VersionString)
 }
 
+func (t TextResponder) Stats(opaque uint32, stats []common.Stat) error {
+	// STAT <name> <value>\r\n
+	// ...
+	// END\r\n
+	for _, stat := range stats {
+		n, err := fmt.Fprintf(t.writer, "STAT %s %s\r\n", stat.Name, stat.Value)
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.resp("END")
+}
+
+func (t TextResponder) StatsReset(opaque uint32) error {
+	return t.resp("RESET")
+}
+
 func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	if t.meta.on() {
+		if ok, merr := t.metaError(reqType, err); ok {
+			return merr
+		}
+	}
+
 	switch err {
 	case common.ErrKeyNotFound:
 		return t.resp("NOT_FOUND")
@@ -147,16 +236,25 @@ func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err erro
 	case common.ErrNoMem:
 		fallthrough
 	default:
+		if t.Log != nil {
+			return t.resp(err.Error() + " (request " + t.Log.ID() + ")")
+		}
 		return t.resp(err.Error())
 	}
 }
 
+// Writes a whole response line and sends it
 func (t TextResponder) resp(s string) error {
-	n, err := fmt.Fprintf(t.writer, s+"\r\n")
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
-	if err != nil {
+	if err := t.line(s); err != nil {
 		return err
 	}
 
 	return t.writer.Flush()
 }
+
+// Writes a line that's part of a longer response without sending it yet
+func (t TextResponder) line(s string) error {
+	n, err := fmt.Fprintf(t.writer, "%s\r\n", s)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return err
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot_test
+
+import (
+	"bufio"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/textprot"
+)
+
+// Records each write that reaches the connection
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestMultigetFlushesOnce(t *testing.T) {
+	w := &writeRecorder{}
+	res := textprot.NewTextResponder(bufio.NewWriter(w))
+
+	res.Get(common.GetResponse{Key: []byte("a"), Data: []byte("1")})
+	res.Get(common.GetResponse{Key: []byte("b"), Miss: true})
+	res.Get(common.GetResponse{Key: []byte("c"), Flags: 3, Data: []byte("22")})
+	if len(w.writes) != 0 {
+		t.Fatalf("Expected no writes before the end of the get, got %q", w.writes)
+	}
+
+	res.GetEnd(0, false)
+
+	expected := "VALUE a 0 1\r\n1\r\nVALUE c 3 2\r\n22\r\nEND\r\n"
+	if len(w.writes) != 1 || w.writes[0] != expected {
+		t.Fatalf("Expected one write of %q, got %q", expected, w.writes)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records spans for sampled requests and sends them to a
+// Zipkin compatible collector, including the OpenTelemetry collector's Zipkin
+// receiver. Tracing is off until Start is called.
+//
+// A nil *Span is a valid span that records nothing, so callers never need to
+// check whether a request is being traced.
+package tracing
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Span kinds, following Zipkin
+const (
+	KindServer = "SERVER"
+	KindClient = "CLIENT"
+)
+
+// Span is a single timed operation in a trace.
+type Span struct {
+	traceID  uint64
+	id       uint64
+	parentID uint64
+	name     string
+	kind     string
+	start    time.Time
+	tags     map[string]string
+}
+
+// The sample rate scaled to the range of a uint64, so 0 traces nothing.
+var sampleThreshold uint64
+
+// Starts a root span for a new trace if tracing is on and the trace is
+// sampled. Otherwise it returns nil.
+func StartSpan(name, kind string) *Span {
+	t := atomic.LoadUint64(&sampleThreshold)
+	if t == 0 || rand.Uint64() > t {
+		return nil
+	}
+
+	id := newID()
+	return &Span{
+		traceID: id,
+		id:      id,
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+	}
+}
+
+// Starts a span for an operation done on behalf of this one. Returns nil if
+// this span is nil. Children can be started concurrently from many goroutines.
+func (s *Span) Child(name, kind string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return &Span{
+		traceID:  s.traceID,
+		id:       newID(),
+		parentID: s.id,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+}
+
+// Adds a tag to the span. Tags must be set by the goroutine that owns the span.
+func (s *Span) SetTag(key, value string) {
+	if s == nil {
+		return
+	}
+
+	if s.tags == nil {
+		s.tags = make(map[string]string)
+	}
+	s.tags[key] = value
+}
+
+// Records the span as done. If the span is unfinished it is never sent.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	record(s, time.Since(s.start))
+}
+
+func newID() uint64 {
+	// Zero means no parent in the Zipkin format
+	for {
+		if id := rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+func setSampleRate(rate float64) {
+	var t uint64
+	switch {
+	case rate <= 0:
+		t = 0
+	case rate >= 1:
+		t = math.MaxUint64
+	default:
+		t = uint64(rate * math.MaxUint64)
+	}
+	atomic.StoreUint64(&sampleThreshold, t)
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import "testing"
+
+func TestSpans(t *testing.T) {
+	// Off by default, and nil spans are safe to use
+	setSampleRate(0)
+	s := StartSpan("get", KindServer)
+	if s != nil {
+		t.Fatalf("Expected no span with tracing off")
+	}
+	c := s.Child("l1.get", KindClient)
+	c.SetTag("keys", "1")
+	c.Finish()
+
+	setSampleRate(1)
+	defer setSampleRate(0)
+
+	s = StartSpan("get", KindServer)
+	c = s.Child("l1.get", KindClient)
+	c.SetTag("keys", "1")
+	c.Finish()
+	s.Finish()
+
+	child := <-queue
+	root := <-queue
+
+	if root.TraceID != child.TraceID || child.ParentID != root.ID || root.ParentID != "" {
+		t.Fatalf("Expected a root span and its child in one trace, got %+v and %+v", root, child)
+	}
+	if child.Name != "l1.get" || child.Kind != KindClient || child.Tags["keys"] != "1" {
+		t.Fatalf("Unexpected child span %+v", child)
+	}
+	if len(root.ID) != 16 || root.Duration < 1 {
+		t.Fatalf("Unexpected root span %+v", root)
+	}
+}
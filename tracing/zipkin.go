@@ -0,0 +1,145 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+const (
+	queueSize     = 10000
+	batchSize     = 500
+	flushInterval = time.Second
+)
+
+var (
+	MetricSpansSent    = metrics.AddCounter("tracing_spans_sent", nil)
+	MetricSpansDropped = metrics.AddCounter("tracing_spans_dropped", nil)
+	MetricSendErrors   = metrics.AddCounter("tracing_send_errors", nil)
+)
+
+// Finished spans waiting to be sent. Spans are dropped when it's full so a
+// slow collector never slows down requests.
+var queue = make(chan zipkinSpan, queueSize)
+
+// The Zipkin v2 JSON span format
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+var serviceName = "rend"
+
+// Starts tracing the given fraction of requests, from 0 to 1, and sending the
+// spans to a Zipkin v2 collector URL, e.g. http://localhost:9411/api/v2/spans.
+// Spans are sent in batches at least once a second.
+func Start(url, service string, rate float64) {
+	serviceName = service
+	setSampleRate(rate)
+	go send(url)
+}
+
+func record(s *Span, dur time.Duration) {
+	zs := zipkinSpan{
+		TraceID:       fmt.Sprintf("%016x", s.traceID),
+		ID:            fmt.Sprintf("%016x", s.id),
+		Name:          s.name,
+		Kind:          s.kind,
+		Timestamp:     s.start.UnixNano() / int64(time.Microsecond),
+		Duration:      int64(dur / time.Microsecond),
+		LocalEndpoint: zipkinEndpoint{ServiceName: serviceName},
+		Tags:          s.tags,
+	}
+	if s.parentID != 0 {
+		zs.ParentID = fmt.Sprintf("%016x", s.parentID)
+	}
+
+	// Zipkin drops spans with a zero duration
+	if zs.Duration == 0 {
+		zs.Duration = 1
+	}
+
+	select {
+	case queue <- zs:
+	default:
+		metrics.IncCounter(MetricSpansDropped)
+	}
+}
+
+func send(url string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(flushInterval)
+	batch := make([]zipkinSpan, 0, batchSize)
+
+	for {
+		select {
+		case s := <-queue:
+			batch = append(batch, s)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := post(client, url, batch); err != nil {
+			log.Println("Error sending spans to Zipkin:", err.Error())
+			metrics.IncCounter(MetricSendErrors)
+		} else {
+			metrics.IncCounterBy(MetricSpansSent, uint64(len(batch)))
+		}
+
+		batch = batch[:0]
+	}
+}
+
+func post(client *http.Client, url string, batch []zipkinSpan) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Zipkin export to %s failed with status %s", url, res.Status)
+	}
+
+	return nil
+}
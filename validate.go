@@ -0,0 +1,288 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/server"
+	"github.com/netflix/rend/textprot"
+)
+
+// validateConfig prints out the effective configuration and checks that the
+// proxy would be able to start with it. The backends are dialed and the
+// listeners are bound and then immediately closed. Every problem found is
+// printed so they can all be fixed in one pass. Returns true if there were no
+// problems.
+func validateConfig(w io.Writer) bool {
+	fmt.Fprintln(w, "Effective configuration:")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(w, "  %s=%s (%s)\n", f.Name, f.Value.String(), envName(f.Name))
+	})
+
+	var problems []string
+
+	if concurrency < 0 {
+		problems = append(problems, fmt.Sprintf("concurrency must be at least 0, got %d", concurrency))
+	}
+	if traceSampleRate < 0 || traceSampleRate > 1 {
+		problems = append(problems, fmt.Sprintf("trace-sample-rate must be from 0 to 1, got %g", traceSampleRate))
+	}
+	if leases && leaseTTL <= 0 {
+		problems = append(problems, fmt.Sprintf("lease-ttl must be positive, got %s", leaseTTL))
+	}
+	if negativeTTL < 0 {
+		problems = append(problems, fmt.Sprintf("negative-ttl must be at least 0, got %s", negativeTTL))
+	}
+	if negativeTTL > 0 && negativeMaxKeys <= 0 {
+		problems = append(problems, fmt.Sprintf("negative-max-keys must be positive, got %d", negativeMaxKeys))
+	}
+	if _, err := commandFilter("", allowCommands, denyCommands); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := commandFilter("batch-", batchAllowCommands, batchDenyCommands); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if tenantQuotas != "" {
+		if _, err := parseTenants(tenantQuotas); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid tenant-quotas: %s", err.Error()))
+		}
+		if tenantWindow <= 0 {
+			problems = append(problems, fmt.Sprintf("tenant-window must be positive, got %s", tenantWindow))
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"backend-down", backendDown},
+		{"batch-backend-down", batchBackendDown},
+	} {
+		if _, err := server.ParseUnavailablePolicy(f.value); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid %s: %s", f.name, err.Error()))
+		}
+	}
+	if latencyBudget < 0 {
+		problems = append(problems, fmt.Sprintf("latency-budget must be at least 0, got %s", latencyBudget))
+	}
+	if _, err := server.ParseBudgetPolicy(budgetPolicy); err != nil {
+		problems = append(problems, "latency-budget-policy: "+err.Error())
+	}
+	if throttleLatency < 0 || throttleInFlight < 0 || throttleDelay < 0 {
+		problems = append(problems, fmt.Sprintf("write-throttle-latency, write-throttle-in-flight, and write-throttle-delay must be at least 0, got %s, %d, and %s", throttleLatency, throttleInFlight, throttleDelay))
+	}
+	if maxConns < 0 || maxInFlight < 0 || batchMaxConns < 0 || batchInFlight < 0 {
+		problems = append(problems, "max-conns, max-in-flight, batch-max-conns, and batch-max-in-flight must be at least 0")
+	}
+	if writeTimeout < 0 || maxPendingWrite < 0 {
+		problems = append(problems, fmt.Sprintf("write-timeout and max-pending-write-bytes must be at least 0, got %s and %d", writeTimeout, maxPendingWrite))
+	}
+	if backfillRate < 0 || backfillRate > int(time.Second) {
+		problems = append(problems, fmt.Sprintf("l1-backfill-rate must be from 0 to %d, got %d", int(time.Second), backfillRate))
+	}
+	if backfillRate > 0 && backfillQueue < 1 {
+		problems = append(problems, fmt.Sprintf("l1-backfill-queue must be at least 1, got %d", backfillQueue))
+	}
+	if (shadowConns < 1 || shadowQueue < 1) && shadowing() {
+		problems = append(problems, fmt.Sprintf("shadow-conns and shadow-queue must be at least 1, got %d and %d", shadowConns, shadowQueue))
+	}
+	if ttlRules != "" {
+		if _, err := parseTTLRules(ttlRules); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid ttl-rules: %s", err.Error()))
+		}
+	}
+	if ttlJitter < 0 || ttlJitter > 100 {
+		problems = append(problems, fmt.Sprintf("ttl-jitter must be from 0 to 100, got %g", ttlJitter))
+	}
+	if _, err := ipFilter(allowCIDRs, denyCIDRs); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := common.ParseKeyRedaction(redactKeys); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := common.ParseFlagBits(flagBits); err != nil {
+		problems = append(problems, "flag-bits: "+err.Error())
+	}
+	if _, err := textprot.ParseDataChunkPolicy(badDataChunk); err != nil {
+		problems = append(problems, "bad-data-chunk: "+err.Error())
+	}
+	if err := checkOrca("orca", mainOrcaName()); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if l2enabled {
+		if err := checkOrca("batch-orca", batchOrcaName); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if maxConns < 0 {
+		problems = append(problems, fmt.Sprintf("max-conns must be at least 0, got %d", maxConns))
+	}
+	if getFanOut < 1 {
+		problems = append(problems, fmt.Sprintf("get-fanout must be at least 1, got %d", getFanOut))
+	}
+	if multiplex < 1 {
+		problems = append(problems, fmt.Sprintf("multiplex must be at least 1, got %d", multiplex))
+	}
+	if metaCacheSize < 0 {
+		problems = append(problems, fmt.Sprintf("metadata-cache-size must be at least 0, got %d", metaCacheSize))
+	}
+	if metaCacheSize > 0 && metaCacheTTL <= 0 {
+		problems = append(problems, fmt.Sprintf("metadata-cache-ttl must be more than 0 with a metadata cache, got %s", metaCacheTTL))
+	}
+	if maxGetKeys < 0 {
+		problems = append(problems, fmt.Sprintf("max-get-keys must be at least 0, got %d", maxGetKeys))
+	}
+	if clientBufSize < 16 {
+		problems = append(problems, fmt.Sprintf("client-buf-size must be at least 16, got %d", clientBufSize))
+	}
+	if backendBufSize < 16 {
+		problems = append(problems, fmt.Sprintf("backend-buf-size must be at least 16, got %d", backendBufSize))
+	}
+	if fi, err := os.Stat(profileDir); err != nil || !fi.IsDir() {
+		problems = append(problems, fmt.Sprintf("profile-dir %s is not a directory", profileDir))
+	}
+	if gcPercent < -1 {
+		problems = append(problems, fmt.Sprintf("gc-percent must be at least -1, got %d", gcPercent))
+	}
+	if memoryLimit < 0 {
+		problems = append(problems, fmt.Sprintf("memory-limit must be at least 0, got %d", memoryLimit))
+	}
+	if ballastSize < 0 {
+		problems = append(problems, fmt.Sprintf("ballast-size must be at least 0, got %d", ballastSize))
+	}
+	if memoryLimit > 0 && int64(ballastSize) >= memoryLimit {
+		problems = append(problems, fmt.Sprintf("ballast-size %d must be less than memory-limit %d", ballastSize, memoryLimit))
+	}
+	if gcPercent == -1 && memoryLimit == 0 {
+		problems = append(problems, "gc-percent -1 turns GC off, so memory-limit must be set")
+	}
+	if missFile != "" && missUDPAddr != "" {
+		problems = append(problems, "only one of miss-file and miss-udp-addr can be set")
+	}
+	if captureLimit < 0 {
+		problems = append(problems, fmt.Sprintf("capture-limit must be at least 0, got %d", captureLimit))
+	}
+	if captureFile != "" && redactKeys != "none" {
+		problems = append(problems, "capture-file records keys as clients sent them, so it can't be used with redact-keys")
+	}
+	for _, f := range []struct {
+		name string
+		prob float64
+	}{
+		{"fault-latency-prob", faults.LatencyProb},
+		{"fault-drop-prob", faults.DropProb},
+		{"fault-truncate-prob", faults.TruncateProb},
+		{"fault-reset-prob", faults.ResetProb},
+	} {
+		if f.prob < 0 || f.prob > 1 {
+			problems = append(problems, fmt.Sprintf("%s must be from 0 to 1, got %g", f.name, f.prob))
+		}
+	}
+	if faults.Latency < 0 {
+		problems = append(problems, fmt.Sprintf("fault-latency must be at least 0, got %s", faults.Latency))
+	}
+
+	// Backends
+	if !l1inmem {
+		if err := checkBackend(l1sock); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot connect to L1 at %s: %s", l1sock, err.Error()))
+		}
+	}
+	if canaryPercent < 0 || canaryPercent > 100 {
+		problems = append(problems, fmt.Sprintf("canary-percent must be from 0 to 100, got %g", canaryPercent))
+	}
+	if canaryHandler != "" && canaryHandler != "regular" && canaryHandler != "chunked" {
+		problems = append(problems, fmt.Sprintf("unknown canary-handler %q, expected regular or chunked", canaryHandler))
+	}
+	if canaryPercent > 0 && canarySock != "" {
+		if err := checkBackend(canarySock); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot connect to the canary L1 at %s: %s", canarySock, err.Error()))
+		}
+	}
+	if l2enabled {
+		if err := checkBackend(l2sock); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot connect to L2 at %s: %s", l2sock, err.Error()))
+		}
+	}
+
+	// Listeners
+	if useDomainSocket {
+		if err := checkUnixListener(sockPath); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot listen on unix socket %s: %s", sockPath, err.Error()))
+		}
+	} else {
+		if err := checkTCPListener(port); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot listen on port %d: %s", port, err.Error()))
+		}
+	}
+	if l2enabled {
+		if err := checkTCPListener(batchPort); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot listen on batch port %d: %s", batchPort, err.Error()))
+		}
+	}
+
+	if bulkPort != 0 {
+		if err := checkTCPListener(bulkPort); err != nil {
+			problems = append(problems, fmt.Sprintf("cannot listen on bulk port %d: %s", bulkPort, err.Error()))
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "Configuration OK")
+		return true
+	}
+
+	fmt.Fprintln(w, "Configuration problems:")
+	for _, p := range problems {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	return false
+}
+
+func checkBackend(sock string) error {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func checkTCPListener(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+func checkUnixListener(path string) error {
+	// The server removes any previous socket file before binding, so binding
+	// here would fail on a file that the server would happily replace.
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
@@ -0,0 +1,263 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package warmer copies a list of keys from one memcached pool to another,
+// to fill a new pool before traffic is cut over to it. Keys are read from the
+// source with ordinary gets and written to the destination with sets, so a
+// chunked destination handler stores them in chunks like Rend would. With
+// Move, the source and destination can be plain and chunked handlers for the
+// same memcached to convert its values from one layout to the other in place.
+package warmer
+
+import (
+	"bufio"
+	"io"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// The longest key memcached accepts
+const maxKeyLength = 250
+
+// Config controls how keys are copied.
+type Config struct {
+	// Rate is the most keys fetched per second. No limit if 0.
+	Rate int
+	// Batch is the number of keys fetched from the source in each get.
+	// Defaults to 1.
+	Batch int
+	// Exptime is the expiration time given to every item written. It is
+	// ignored if PreserveTTL is set.
+	Exptime uint32
+	// PreserveTTL fetches keys with the GetE extension so each item is
+	// written with the expiration time the source reports for it.
+	PreserveTTL bool
+	// Move deletes each key from the source once it's written to the
+	// destination. Keys that fail to be written are left in the source.
+	Move bool
+}
+
+// Result counts what happened to the keys that were read.
+type Result struct {
+	Keys    uint64
+	Hits    uint64
+	Misses  uint64
+	Skipped uint64
+	Written uint64
+	Deleted uint64
+	Errors  uint64
+}
+
+// Warm reads keys one per line from r, fetches them from src, and writes the
+// hits to dst until r is exhausted. Blank lines are ignored and keys memcached
+// would reject are skipped. Errors on a single key are counted and the rest
+// carry on, but an error from the source or destination connection itself
+// stops the copy since neither can be used afterward.
+func Warm(r io.Reader, src, dst handlers.Handler, conf Config) (Result, error) {
+	var res Result
+
+	batch := conf.Batch
+	if batch < 1 {
+		batch = 1
+	}
+
+	var interval time.Duration
+	if conf.Rate > 0 {
+		interval = time.Second / time.Duration(conf.Rate)
+	}
+	next := time.Now()
+
+	scanner := bufio.NewScanner(r)
+	keys := make([][]byte, 0, batch)
+
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if interval > 0 {
+			if d := time.Until(next); d > 0 {
+				time.Sleep(d)
+			}
+			next = next.Add(interval * time.Duration(len(keys)))
+		}
+		err := warmBatch(keys, src, dst, conf, &res)
+		keys = keys[:0]
+		return err
+	}
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		res.Keys++
+		if !validKey(line) {
+			res.Skipped++
+			continue
+		}
+
+		keys = append(keys, append([]byte(nil), line...))
+		if len(keys) == batch {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return res, err
+	}
+
+	return res, scanner.Err()
+}
+
+func validKey(key []byte) bool {
+	if len(key) > maxKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// An item read from the source
+type item struct {
+	key     []byte
+	data    []byte
+	flags   uint32
+	exptime uint32
+}
+
+func warmBatch(keys [][]byte, src, dst handlers.Handler, conf Config, res *Result) error {
+	req := common.GetRequest{
+		Keys:    keys,
+		Opaques: make([]uint32, len(keys)),
+		Quiet:   make([]bool, len(keys)),
+	}
+
+	var items []item
+	var err error
+
+	if conf.PreserveTTL {
+		items, err = getE(req, src)
+	} else {
+		items, err = get(req, src, conf.Exptime)
+	}
+
+	res.Hits += uint64(len(items))
+	res.Misses += uint64(len(keys) - len(items))
+
+	if err != nil {
+		if !common.IsAppError(err) {
+			return err
+		}
+		res.Errors++
+	}
+
+	for _, it := range items {
+		err := dst.Set(common.SetRequest{
+			Key:     it.key,
+			Data:    it.data,
+			Flags:   it.flags,
+			Exptime: it.exptime,
+		})
+		if err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			res.Errors++
+			continue
+		}
+		res.Written++
+
+		if !conf.Move {
+			continue
+		}
+		if err := src.Delete(common.DeleteRequest{Key: it.key}); err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			// Already gone is as good as deleted
+			if err != common.ErrKeyNotFound {
+				res.Errors++
+			}
+			continue
+		}
+		res.Deleted++
+	}
+
+	return nil
+}
+
+// get returns the hits for the request. Like the orcas, it reads until both
+// channels are closed so the handler is left ready for the next request.
+func get(req common.GetRequest, src handlers.Handler, exptime uint32) ([]item, error) {
+	resChan, errChan := src.Get(req)
+
+	var items []item
+	var err error
+
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if !r.Miss {
+				items = append(items, item{key: r.Key, data: r.Data, flags: r.Flags, exptime: exptime})
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = getErr
+			}
+		}
+	}
+
+	return items, err
+}
+
+func getE(req common.GetRequest, src handlers.Handler) ([]item, error) {
+	resChan, errChan := src.GetE(req)
+
+	var items []item
+	var err error
+
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else if !r.Miss {
+				items = append(items, item{key: r.Key, data: r.Data, flags: r.Flags, exptime: r.Exptime})
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = getErr
+			}
+		}
+	}
+
+	return items, err
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package warmer_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/fakemem"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/memcached/chunked"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/warmer"
+)
+
+func pipe(t *testing.T) net.Conn {
+	client, server := net.Pipe()
+	go fakemem.New(false).ServeConn(server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestWarm(t *testing.T) {
+	src := std.NewHandler(pipe(t))
+	dst := chunked.NewHandler(pipe(t))
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := src.Set(common.SetRequest{Key: []byte(key), Data: []byte("value " + key), Flags: 7}); err != nil {
+			t.Fatalf("Error setting %s: %s", key, err.Error())
+		}
+	}
+
+	keys := "a\nb\n\nmissing\nbad key\nc\n"
+	res, err := warmer.Warm(strings.NewReader(keys), src, dst, warmer.Config{Batch: 2})
+	if err != nil {
+		t.Fatalf("Error warming: %s", err.Error())
+	}
+
+	want := warmer.Result{Keys: 5, Hits: 3, Misses: 1, Skipped: 1, Written: 3}
+	if res != want {
+		t.Fatalf("Expected %+v, got %+v", want, res)
+	}
+
+	resChan, errChan := dst.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("a"), []byte("c")},
+		Opaques: []uint32{0, 0},
+		Quiet:   []bool{false, false},
+	})
+
+	var hits int
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			if r.Miss || string(r.Data) != "value "+string(r.Key) || r.Flags != 7 {
+				t.Errorf("Unexpected response %+v", r)
+			}
+			hits++
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			t.Fatalf("Error getting from destination: %s", err.Error())
+		}
+	}
+	if hits != 2 {
+		t.Fatalf("Expected 2 hits in the destination, got %d", hits)
+	}
+}
+
+func TestWarmMoveInPlace(t *testing.T) {
+	fm := fakemem.New(false)
+	conn := func() net.Conn {
+		client, server := net.Pipe()
+		go fm.ServeConn(server)
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+	plain := std.NewHandler(conn())
+	chunks := chunked.NewHandler(conn())
+
+	if err := plain.Set(common.SetRequest{Key: []byte("a"), Data: []byte("value a"), Flags: 7}); err != nil {
+		t.Fatalf("Error setting: %s", err.Error())
+	}
+
+	// Into the chunked layout and back out
+	for _, step := range []struct {
+		name     string
+		src, dst handlers.Handler
+	}{
+		{"to chunked", plain, chunks},
+		{"to plain", chunks, plain},
+	} {
+		res, err := warmer.Warm(strings.NewReader("a\nmissing\n"), step.src, step.dst, warmer.Config{Move: true})
+		if err != nil {
+			t.Fatalf("%s: Error moving: %s", step.name, err.Error())
+		}
+		want := warmer.Result{Keys: 2, Hits: 1, Misses: 1, Written: 1, Deleted: 1}
+		if res != want {
+			t.Fatalf("%s: Expected %+v, got %+v", step.name, want, res)
+		}
+
+		if err := step.src.Delete(common.DeleteRequest{Key: []byte("a")}); err != common.ErrKeyNotFound {
+			t.Fatalf("%s: Expected the key to be gone from the old layout, got %v", step.name, err)
+		}
+		r, err := step.dst.GAT(common.GATRequest{Key: []byte("a")})
+		if err != nil || r.Miss || string(r.Data) != "value a" || r.Flags != 7 {
+			t.Fatalf("%s: Expected the value in the new layout, got %+v, %v", step.name, r, err)
+		}
+	}
+}